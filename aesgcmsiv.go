@@ -0,0 +1,185 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// CipherAESGCMSIV is the AES-256-GCM-SIV nonce-misuse-resistant AEAD cipher of
+// RFC 8452, with the counter encoded as for CipherAESGCM. Reusing a nonce only
+// reveals whether the same plaintext was encrypted twice, which makes it
+// suitable for callers that manage nonces themselves through
+// CipherState.Cipher on lossy transports.
+var CipherAESGCMSIV CipherFunc = cipherFn{cipherAESGCMSIV, "AESGCMSIV"}
+
+func cipherAESGCMSIV(k [32]byte) Cipher {
+	c, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err)
+	}
+	return NewAEADCipher(newGCMSIV(c, len(k)), binary.BigEndian)
+}
+
+// gcmSIV implements AES-GCM-SIV. Noise only uses a key-generating key of 256
+// bits, but 128-bit ones are supported for the test vectors of RFC 8452.
+type gcmSIV struct {
+	kgk    cipher.Block
+	keyLen int // length of the key-generating key, and so of derived encryption keys
+}
+
+func newGCMSIV(kgk cipher.Block, keyLen int) gcmSIV {
+	return gcmSIV{kgk: kgk, keyLen: keyLen}
+}
+
+func (gcmSIV) NonceSize() int { return 12 }
+func (gcmSIV) Overhead() int  { return 16 }
+
+// keys derives the message authentication and encryption keys for a nonce.
+func (c gcmSIV) keys(nonce []byte) (authKey [16]byte, encKey cipher.Block) {
+	var in, out [16]byte
+	var encKeyBytes [32]byte
+	copy(in[4:], nonce)
+	for i := uint32(0); i < 2+uint32(c.keyLen)/8; i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		c.kgk.Encrypt(out[:], in[:])
+		if i < 2 {
+			copy(authKey[8*i:], out[:8])
+		} else {
+			copy(encKeyBytes[8*(i-2):], out[:8])
+		}
+	}
+	encKey, _ = aes.NewCipher(encKeyBytes[:c.keyLen])
+	return authKey, encKey
+}
+
+// tag computes the authentication tag over ad and plaintext.
+func (c gcmSIV) tag(authKey [16]byte, encKey cipher.Block, nonce, ad, plaintext []byte) [16]byte {
+	var p polyval
+	p.init(authKey)
+	p.update(ad)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(ad))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	encKey.Encrypt(s[:], s[:])
+	return s
+}
+
+// ctr XORs in with the AES-CTR keystream that starts at the tag, and writes
+// the result to out.
+func ctr(encKey cipher.Block, tag [16]byte, out, in []byte) {
+	block := tag
+	block[15] |= 0x80
+	var ks [16]byte
+	for len(in) > 0 {
+		encKey.Encrypt(ks[:], block[:])
+		n := subtle.XORBytes(out, in, ks[:])
+		out, in = out[n:], in[n:]
+		binary.LittleEndian.PutUint32(block[:4], binary.LittleEndian.Uint32(block[:4])+1)
+	}
+}
+
+func (c gcmSIV) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	authKey, encKey := c.keys(nonce)
+	tag := c.tag(authKey, encKey, nonce, ad, plaintext)
+	ret, out := sliceForAppend(dst, len(plaintext)+16)
+	ctr(encKey, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+var errOpen = errors.New("noise: message authentication failed")
+
+func (c gcmSIV) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errOpen
+	}
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ciphertext)-16:])
+	ciphertext = ciphertext[:len(ciphertext)-16]
+	authKey, encKey := c.keys(nonce)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(encKey, tag, out, ciphertext)
+	expected := c.tag(authKey, encKey, nonce, ad, out)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	return head, head[len(in):]
+}
+
+// polyval computes the POLYVAL universal hash of RFC 8452, zero-padding each
+// input to a multiple of 16 bytes.
+type polyval struct {
+	hLo, hHi     uint64
+	accLo, accHi uint64
+}
+
+func (p *polyval) init(key [16]byte) {
+	p.hLo = binary.LittleEndian.Uint64(key[:8])
+	p.hHi = binary.LittleEndian.Uint64(key[8:])
+	p.accLo, p.accHi = 0, 0
+}
+
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		p.accLo ^= binary.LittleEndian.Uint64(block[:8])
+		p.accHi ^= binary.LittleEndian.Uint64(block[8:])
+		p.accLo, p.accHi = polyvalDot(p.accLo, p.accHi, p.hLo, p.hHi)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.LittleEndian.PutUint64(s[:8], p.accLo)
+	binary.LittleEndian.PutUint64(s[8:], p.accHi)
+	return s
+}
+
+// polyvalDot returns a*b*x^-128 in POLYVAL's field, in constant time. For
+// each bit of b, from the lowest, it adds a if the bit is set and then
+// multiplies by x^-1.
+func polyvalDot(aLo, aHi, bLo, bHi uint64) (uint64, uint64) {
+	var lo, hi uint64
+	for i := 0; i < 128; i++ {
+		bit := bLo
+		if i >= 64 {
+			bit = bHi
+		}
+		mask := -((bit >> (uint(i) % 64)) & 1)
+		lo ^= aLo & mask
+		hi ^= aHi & mask
+		// Multiplying by x^-1 shifts right. If the constant term was set,
+		// the polynomial x^128 + x^127 + x^126 + x^121 + 1 is added first.
+		reduce := -(lo & 1)
+		lo = lo>>1 | hi<<63
+		hi = hi>>1 ^ 0xe100000000000000&reduce
+	}
+	return lo, hi
+}
@@ -0,0 +1,96 @@
+package noise
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+
+	. "gopkg.in/check.v1"
+)
+
+// gcmSIVVectors are from RFC 8452, appendices C.1 and C.2, all with the
+// nonce 030000000000000000000000.
+var gcmSIVVectors = []struct {
+	key, ad, plaintext, result string
+}{
+	{"01000000000000000000000000000000", "", "", "dc20e2d83f25705bb49e439eca56de25"},
+	{"01000000000000000000000000000000", "", "0100000000000000", "b5d839330ac7b786578782fff6013b815b287c22493a364c"},
+	{"01000000000000000000000000000000", "", "010000000000000000000000", "7323ea61d05932260047d942a4978db357391a0bc4fdec8b0d106639"},
+	{"01000000000000000000000000000000", "", "01000000000000000000000000000000", "743f7c8077ab25f8624e2e948579cf77303aaf90f6fe21199c6068577437a0c4"},
+	{"01000000000000000000000000000000", "", "0100000000000000000000000000000002000000000000000000000000000000", "84e07e62ba83a6585417245d7ec413a9fe427d6315c09b57ce45f2e3936a94451a8e45dcd4578c667cd86847bf6155ff"},
+	{"01000000000000000000000000000000", "", "010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000", "3fd24ce1f5a67b75bf2351f181a475c7b800a5b4d3dcf70106b1eea82fa1d64df42bf7226122fa92e17a40eeaac1201b5e6e311dbf395d35b0fe39c2714388f8"},
+	{"01000000000000000000000000000000", "", "01000000000000000000000000000000020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000", "2433668f1058190f6d43e360f4f35cd8e475127cfca7028ea8ab5c20f7ab2af02516a2bdcbc08d521be37ff28c152bba36697f25b4cd169c6590d1dd39566d3f8a263dd317aa88d56bdf3936dba75bb8"},
+	{"01000000000000000000000000000000", "01", "0200000000000000", "1e6daba35669f4273b0a1a2560969cdf790d99759abd1508"},
+	{"01000000000000000000000000000000", "01", "020000000000000000000000", "296c7889fd99f41917f4462008299c5102745aaa3a0c469fad9e075a"},
+	{"01000000000000000000000000000000", "01", "02000000000000000000000000000000", "e2b0c5da79a901c1745f700525cb335b8f8936ec039e4e4bb97ebd8c4457441f"},
+	{"01000000000000000000000000000000", "01", "0200000000000000000000000000000003000000000000000000000000000000", "620048ef3c1e73e57e02bb8562c416a319e73e4caac8e96a1ecb2933145a1d71e6af6a7f87287da059a71684ed3498e1"},
+	{"01000000000000000000000000000000", "01", "020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000", "50c8303ea93925d64090d07bd109dfd9515a5a33431019c17d93465999a8b0053201d723120a8562b838cdff25bf9d1e6a8cc3865f76897c2e4b245cf31c51f2"},
+	{"01000000000000000000000000000000", "01", "02000000000000000000000000000000030000000000000000000000000000000400000000000000000000000000000005000000000000000000000000000000", "2f5c64059db55ee0fb847ed513003746aca4e61c711b5de2e7a77ffd02da42feec601910d3467bb8b36ebbaebce5fba30d36c95f48a3e7980f0e7ac299332a80cdc46ae475563de037001ef84ae21744"},
+	{"01000000000000000000000000000000", "010000000000000000000000", "02000000", "a8fe3e8707eb1f84fb28f8cb73de8e99e2f48a14"},
+	{"01000000000000000000000000000000", "010000000000000000000000000000000200", "0300000000000000000000000000000004000000", "6bb0fecf5ded9b77f902c7d5da236a4391dd029724afc9805e976f451e6d87f6fe106514"},
+	{"01000000000000000000000000000000", "0100000000000000000000000000000002000000", "030000000000000000000000000000000400", "44d0aaf6fb2f1f34add5e8064e83e12a2adabff9b2ef00fb47920cc72a0c0f13b9fd"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "", "0100000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "", "010000000000000000000000", "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "", "01000000000000000000000000000000", "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "01", "0200000000000000", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "010000000000000000000000", "02000000", "22b3f4cd1835e517741dfddccfa07fa4661b74cf"},
+}
+
+func (NoiseSuite) TestAESGCMSIVVectors(c *C) {
+	nonce, _ := hex.DecodeString("030000000000000000000000")
+	for _, v := range gcmSIVVectors {
+		key, _ := hex.DecodeString(v.key)
+		ad, _ := hex.DecodeString(v.ad)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		block, _ := aes.NewCipher(key)
+		aead := newGCMSIV(block, len(key))
+		ct := aead.Seal(nil, nonce, plaintext, ad)
+		c.Assert(hex.EncodeToString(ct), Equals, v.result)
+		pt, err := aead.Open(nil, nonce, ct, ad)
+		c.Assert(err, IsNil)
+		c.Assert(hex.EncodeToString(pt), Equals, v.plaintext)
+
+		// Any change to the tag is rejected.
+		for i := len(ct) - 16; i < len(ct); i++ {
+			ct[i] ^= 0x80
+			_, err = aead.Open(nil, nonce, ct, ad)
+			c.Assert(err, Equals, errOpen)
+			ct[i] ^= 0x80
+		}
+	}
+}
+
+func (NoiseSuite) TestAESGCMSIV(c *C) {
+	key, _ := hex.DecodeString("0100000000000000000000000000000000000000000000000000000000000000")
+	nonce, _ := hex.DecodeString("030000000000000000000000")
+	block, _ := aes.NewCipher(key)
+	aead := newGCMSIV(block, len(key))
+	ct := aead.Seal([]byte("prefix"), nonce, []byte("hello, world"), []byte("ad"))
+	c.Assert(string(ct[:6]), Equals, "prefix")
+	pt, err := aead.Open(nil, nonce, ct[6:], []byte("ad"))
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "hello, world")
+	_, err = aead.Open(nil, nonce, ct[6:], []byte("AD"))
+	c.Assert(err, NotNil)
+	ct[6] ^= 1
+	_, err = aead.Open(nil, nonce, ct[6:], []byte("ad"))
+	c.Assert(err, NotNil)
+
+	// A repeated nonce leaks only the equality of whole messages.
+	var k [32]byte
+	ciph := CipherAESGCMSIV.Cipher(k)
+	a := ciph.Encrypt(nil, 1, nil, []byte("attack at dawn"))
+	b := ciph.Encrypt(nil, 1, nil, []byte("attack at dusk"))
+	c.Assert(a, DeepEquals, ciph.Encrypt(nil, 1, nil, []byte("attack at dawn")))
+	c.Assert(a[:10], Not(DeepEquals), b[:10])
+
+	cs := NewCipherSuite(DH25519, CipherAESGCMSIV, HashSHA256)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("hi"))
+	res, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hi")
+}
@@ -0,0 +1,45 @@
+package noise
+
+import (
+	"errors"
+
+	"github.com/flynn/noise/subtle"
+)
+
+// An Allocator provides memory for the secret state of a handshake, so that it
+// can be kept in locked or guarded pages or an external secure heap. Without
+// one, ordinary Go memory is used. Keys held by CipherStates and private keys
+// returned by DHFunc.GenerateKeypair are not covered.
+type Allocator interface {
+	// Alloc returns a zeroed buffer of at least n bytes.
+	Alloc(n int) []byte
+
+	// Free releases a buffer returned by Alloc. The buffer has already been
+	// wiped.
+	Free(b []byte)
+}
+
+var errDestroyed = errors.New("noise: HandshakeState has been destroyed")
+
+// Destroy wipes the secret state of the handshake, including the local
+// ephemeral private keys, and returns its memory to the Allocator. The
+// HandshakeState cannot be used afterwards; CipherStates returned by the
+// handshake are not affected.
+func (s *HandshakeState) Destroy() {
+	// The ephemeral private keys may live in the arena, so they are wiped
+	// before it is freed.
+	subtle.Zero(s.e.Private)
+	subtle.Zero(s.e1.Private)
+	subtle.Zero(s.injectedE.Private)
+	subtle.Zero(s.arena)
+	if s.allocator != nil && s.arena != nil {
+		s.allocator.Free(s.arena)
+	}
+	s.arena = nil
+	s.ss.h, s.ss.ck, s.ss.prevH, s.ss.prevCK, s.re, s.rs = nil, nil, nil, nil, nil, nil
+	s.e.Private, s.e1.Private, s.injectedE.Private = nil, nil, nil
+	subtle.Zero(s.ss.k[:])
+	subtle.Zero(s.ss.prevK[:])
+	s.ss.c = nil
+	s.err = errDestroyed
+}
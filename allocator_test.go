@@ -0,0 +1,105 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+type countingAllocator struct {
+	allocs [][]byte
+	freed  [][]byte
+}
+
+func (a *countingAllocator) Alloc(n int) []byte {
+	b := make([]byte, n)
+	a.allocs = append(a.allocs, b)
+	return b
+}
+
+func (a *countingAllocator) Free(b []byte) { a.freed = append(a.freed, b) }
+
+func (NoiseSuite) TestAllocator(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	alloc := &countingAllocator{}
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, Allocator: alloc})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(alloc.allocs, HasLen, 1)
+	c.Assert(alloc.allocs[0], HasLen, 4*32+32+32)
+
+	clone := hsI.Clone()
+	c.Assert(alloc.allocs, HasLen, 2)
+	clone.Destroy()
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(csI, NotNil)
+
+	hsI.Destroy()
+	c.Assert(alloc.freed, HasLen, 2)
+	for _, b := range alloc.freed {
+		for _, x := range b {
+			c.Assert(x, Equals, byte(0))
+		}
+	}
+	_, _, _, err = hsI.WriteMessage(nil, nil)
+	c.Assert(err, ErrorMatches, ".*destroyed")
+}
+
+func (NoiseSuite) TestDestroyCallerKeys(c *C) {
+	// Destroy wipes the state's copies of the ephemeral keys, not the
+	// caller's, nor those of the state it was cloned from.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	e, _ := cs.GenerateKeypair(nil)
+	injected, _ := cs.GenerateKeypair(nil)
+	want := append([]byte(nil), e.Private...)
+	wantInjected := append([]byte(nil), injected.Private...)
+	hs, err := NewHandshakeState(Config{
+		CipherSuite:                  cs,
+		Pattern:                      HandshakeNN,
+		Initiator:                    true,
+		EphemeralKeypair:             e,
+		InjectedEphemeral:            injected,
+		UnsafeAllowInjectedEphemeral: true,
+	})
+	c.Assert(err, IsNil)
+	hs.Clone().Destroy()
+	hs.Destroy()
+	c.Assert(e.Private, DeepEquals, want)
+	c.Assert(injected.Private, DeepEquals, wantInjected)
+
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsI.Clone().Destroy()
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(csI, NotNil)
+}
+
+func (NoiseSuite) TestDestroyCompleted(c *C) {
+	// Nothing is derived from the wiped state of a destroyed handshake.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(hsI.SessionID(), NotNil)
+	c.Assert(hsI.ChannelBinding(), NotNil)
+	_, _, err = hsI.DeriveCipherStates([]byte("control"))
+	c.Assert(err, IsNil)
+
+	hsI.Destroy()
+	cs1, cs2, err := hsI.DeriveCipherStates([]byte("control"))
+	c.Assert(err, Equals, errDestroyed)
+	c.Assert(cs1, IsNil)
+	c.Assert(cs2, IsNil)
+	c.Assert(hsI.SessionID(), IsNil)
+	c.Assert(hsI.ChannelBinding(), IsNil)
+}
@@ -0,0 +1,133 @@
+// Package bench measures the performance of Noise cipher suites on the current
+// host, so that a deployment can choose a suite at startup according to the
+// hardware it runs on, for example preferring AESGCM where AES is accelerated.
+package bench
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Options controls a benchmark run.
+type Options struct {
+	// Duration is how long each measurement runs. If zero, 100ms is used.
+	Duration time.Duration
+
+	// MessageSize is the size of the transport messages encrypted to measure
+	// throughput. If zero, 1024 bytes is used.
+	MessageSize int
+}
+
+// A Result holds the measurements for a single cipher suite.
+type Result struct {
+	Suite string `json:"suite"`
+
+	// HandshakesPerSecond is the number of complete NN handshakes, both
+	// sides included, performed per second.
+	HandshakesPerSecond float64 `json:"handshakes_per_second"`
+
+	// EncryptBytesPerSecond is the number of plaintext bytes encrypted per
+	// second by a transport CipherState.
+	EncryptBytesPerSecond float64 `json:"encrypt_bytes_per_second"`
+}
+
+// Suites returns every cipher suite built from the primitives registered with
+// package noise, which include those it defines. Suites with a KEM are not
+// included.
+func Suites() []noise.CipherSuite {
+	return noise.CipherSuites()
+}
+
+// Run measures each of suites in turn.
+func Run(suites []noise.CipherSuite, opts Options) ([]Result, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = 100 * time.Millisecond
+	}
+	if opts.MessageSize <= 0 {
+		opts.MessageSize = 1024
+	}
+	results := make([]Result, 0, len(suites))
+	for _, cs := range suites {
+		res := Result{Suite: string(cs.Name())}
+
+		var cs1 *noise.CipherState
+		n, elapsed, err := measure(opts.Duration, func() error {
+			var err error
+			cs1, err = handshake(cs)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.HandshakesPerSecond = float64(n) / elapsed.Seconds()
+
+		plaintext := make([]byte, opts.MessageSize)
+		out := make([]byte, 0, opts.MessageSize+noise.MACLen)
+		n, elapsed, _ = measure(opts.Duration, func() error {
+			out = cs1.Encrypt(out[:0], nil, plaintext)
+			return nil
+		})
+		res.EncryptBytesPerSecond = float64(n) * float64(opts.MessageSize) / elapsed.Seconds()
+
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Fastest returns the result with the highest encryption throughput, which
+// usually dominates the cost of long-lived sessions.
+func Fastest(results []Result) (Result, error) {
+	if len(results) == 0 {
+		return Result{}, errors.New("bench: no results")
+	}
+	best := results[0]
+	for _, r := range results[1:] {
+		if r.EncryptBytesPerSecond > best.EncryptBytesPerSecond {
+			best = r
+		}
+	}
+	return best, nil
+}
+
+// measure calls f repeatedly for at least d and returns the number of calls
+// and the time they took.
+func measure(d time.Duration, f func() error) (int, time.Duration, error) {
+	start := time.Now()
+	n := 0
+	for {
+		if err := f(); err != nil {
+			return 0, 0, err
+		}
+		n++
+		if elapsed := time.Since(start); elapsed >= d {
+			return n, elapsed, nil
+		}
+	}
+}
+
+// handshake runs an NN handshake and returns the initiator's sending
+// CipherState.
+func handshake(cs noise.CipherSuite) (*noise.CipherState, error) {
+	hsI, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN, Initiator: true})
+	if err != nil {
+		return nil, err
+	}
+	hsR, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN})
+	if err != nil {
+		return nil, err
+	}
+	msg, _, _, err := hsI.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err = hsR.ReadMessage(nil, msg); err != nil {
+		return nil, err
+	}
+	if msg, _, _, err = hsR.WriteMessage(nil, nil); err != nil {
+		return nil, err
+	}
+	_, cs1, _, err := hsI.ReadMessage(nil, msg)
+	return cs1, err
+}
@@ -0,0 +1,36 @@
+package bench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/flynn/noise/bench"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type BenchSuite struct{}
+
+var _ = Suite(&BenchSuite{})
+
+func (BenchSuite) TestRun(c *C) {
+	suites := bench.Suites()
+	c.Assert(suites, HasLen, len(noise.CipherSuites()))
+
+	results, err := bench.Run(suites[:2], bench.Options{Duration: time.Millisecond, MessageSize: 64})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	c.Assert(results[0].Suite, Equals, "25519_AESGCM_BLAKE2b")
+	for _, r := range results {
+		c.Assert(r.HandshakesPerSecond > 0, Equals, true)
+		c.Assert(r.EncryptBytesPerSecond > 0, Equals, true)
+	}
+
+	best, err := bench.Fastest(results)
+	c.Assert(err, IsNil)
+	c.Assert(best.EncryptBytesPerSecond >= results[0].EncryptBytesPerSecond, Equals, true)
+	_, err = bench.Fastest(nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,99 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Capability types used in the encoding of Capabilities.
+const (
+	CapabilityMaxMessageSize uint8 = 1
+	CapabilityRekey          uint8 = 2
+	CapabilityMultiplexing   uint8 = 3
+)
+
+// Capabilities describes features of a peer that can be advertised in a
+// handshake payload, so that both peers agree on them once the handshake
+// completes.
+//
+// Capabilities are encoded as a sequence of type-length-value records: a
+// one-byte type, a big-endian uint16 value length and the value. Records are
+// sorted by strictly increasing type, so each set of capabilities has exactly
+// one encoding. Records of unknown types are skipped when parsing, so new
+// capabilities can be added without breaking older peers.
+type Capabilities struct {
+	// MaxMessageSize is the largest transport message the peer will accept,
+	// from 1 to 65535, or zero if not advertised.
+	MaxMessageSize int
+
+	// Rekey indicates that the peer supports rekeying transport messages.
+	Rekey bool
+
+	// Multiplexing indicates that the peer supports multiplexing several
+	// streams over the session.
+	Multiplexing bool
+}
+
+// Marshal returns the canonical encoding of c. It fails if MaxMessageSize is
+// out of range.
+func (c Capabilities) Marshal() ([]byte, error) {
+	if c.MaxMessageSize < 0 || c.MaxMessageSize > 65535 {
+		return nil, errors.New("noise: max message size capability out of range")
+	}
+	var out []byte
+	if c.MaxMessageSize > 0 {
+		out = appendCapability(out, CapabilityMaxMessageSize, []byte{byte(c.MaxMessageSize >> 8), byte(c.MaxMessageSize)})
+	}
+	if c.Rekey {
+		out = appendCapability(out, CapabilityRekey, nil)
+	}
+	if c.Multiplexing {
+		out = appendCapability(out, CapabilityMultiplexing, nil)
+	}
+	return out, nil
+}
+
+func appendCapability(out []byte, typ uint8, value []byte) []byte {
+	out = append(out, typ, byte(len(value)>>8), byte(len(value)))
+	return append(out, value...)
+}
+
+// ParseCapabilities parses the encoding of a set of capabilities produced by
+// Capabilities.Marshal.
+func ParseCapabilities(b []byte) (Capabilities, error) {
+	var c Capabilities
+	var last uint8
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return Capabilities{}, errors.New("noise: truncated capability")
+		}
+		typ, n := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b)-3 < n {
+			return Capabilities{}, errors.New("noise: truncated capability")
+		}
+		if typ <= last {
+			return Capabilities{}, errors.New("noise: capabilities are not in canonical order")
+		}
+		last = typ
+		value := b[3 : 3+n]
+		b = b[3+n:]
+
+		switch typ {
+		case CapabilityMaxMessageSize:
+			if n != 2 || binary.BigEndian.Uint16(value) == 0 {
+				return Capabilities{}, errors.New("noise: invalid max message size capability")
+			}
+			c.MaxMessageSize = int(binary.BigEndian.Uint16(value))
+		case CapabilityRekey, CapabilityMultiplexing:
+			if n != 0 {
+				return Capabilities{}, errors.New("noise: invalid capability flag")
+			}
+			if typ == CapabilityRekey {
+				c.Rekey = true
+			} else {
+				c.Multiplexing = true
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,44 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestCapabilities(c *C) {
+	caps := Capabilities{MaxMessageSize: 16384, Multiplexing: true}
+	b, err := caps.Marshal()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{1, 0, 2, 0x40, 0, 3, 0, 0})
+	parsed, err := ParseCapabilities(b)
+	c.Assert(err, IsNil)
+	c.Assert(parsed, Equals, caps)
+
+	b0, err := Capabilities{}.Marshal()
+	c.Assert(err, IsNil)
+	c.Assert(b0, HasLen, 0)
+
+	// MaxMessageSize must fit in the two bytes of its record.
+	b1, err := Capabilities{MaxMessageSize: 65535}.Marshal()
+	c.Assert(err, IsNil)
+	c.Assert(b1, DeepEquals, []byte{1, 0, 2, 0xff, 0xff})
+	for _, size := range []int{-1, 65536} {
+		_, err := Capabilities{MaxMessageSize: size}.Marshal()
+		c.Assert(err, NotNil, Commentf("%d", size))
+	}
+
+	// Unknown capabilities are skipped.
+	parsed, err = ParseCapabilities(append(b, 200, 0, 1, 0xff))
+	c.Assert(err, IsNil)
+	c.Assert(parsed, Equals, caps)
+
+	for _, bad := range [][]byte{
+		{1, 0},
+		{1, 0, 2, 0x40},
+		{3, 0, 0, 1, 0, 2, 0x40, 0},
+		{2, 0, 0, 2, 0, 0},
+		{2, 0, 1, 0},
+		{1, 0, 1, 0x40},
+		{1, 0, 2, 0, 0},
+	} {
+		_, err := ParseCapabilities(bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
+}
@@ -7,21 +7,39 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
+	"errors"
 	"hash"
 	"io"
 
+	"github.com/flynn/noise/subtle"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+	"lukechampine.com/blake3"
 )
 
 // A DHKey is a keypair used for Diffie-Hellman key agreement.
 type DHKey struct {
 	Private []byte
 	Public  []byte
+
+	// PrivateDH, if set, holds the private key in place of Private, which is
+	// then unused. It is only supported for static keys.
+	PrivateDH PrivateDH
 }
 
+var (
+	// ErrInvalidPublicKey is returned by DH functions for a public key that
+	// has the wrong length, is not on the curve, or is the identity.
+	ErrInvalidPublicKey = errors.New("noise: invalid DH public key")
+
+	// ErrInvalidPrivateKey is returned by DH functions for a malformed
+	// private key.
+	ErrInvalidPrivateKey = errors.New("noise: invalid DH private key")
+)
+
 // A DHFunc implements Diffie-Hellman key agreement.
 type DHFunc interface {
 	// GenerateKeypair generates a new keypair using random as a source of
@@ -29,8 +47,10 @@ type DHFunc interface {
 	GenerateKeypair(random io.Reader) (DHKey, error)
 
 	// DH performs a Diffie-Hellman calculation between the provided private and
-	// public keys and returns the result.
-	DH(privkey, pubkey []byte) []byte
+	// public keys and returns the result. It returns an error, typically
+	// ErrInvalidPublicKey, instead of a result if a key is invalid, which fails
+	// the handshake with FailureDH.
+	DH(privkey, pubkey []byte) ([]byte, error)
 
 	// DHLen is the number of bytes returned by DH.
 	DHLen() int
@@ -57,6 +77,24 @@ type CipherFunc interface {
 	CipherName() string
 }
 
+// A RekeyFunc is implemented by a CipherFunc that overrides the default REKEY
+// function of the specification.
+type RekeyFunc interface {
+	// Rekey returns the key that replaces k.
+	Rekey(k [32]byte) [32]byte
+}
+
+// rekeyFunc returns the RekeyFunc of the CipherFunc of cs, or nil if it uses
+// the default.
+func rekeyFunc(cs CipherSuite) RekeyFunc {
+	if s, ok := cs.(ciphersuite); ok {
+		r, _ := s.CipherFunc.(RekeyFunc)
+		return r
+	}
+	r, _ := cs.(RekeyFunc)
+	return r
+}
+
 // A Cipher is a AEAD cipher that has been initialized with a key.
 type Cipher interface {
 	// Encrypt encrypts the provided plaintext with a nonce and then appends the
@@ -71,7 +109,9 @@ type Cipher interface {
 }
 
 // A CipherSuite is a set of cryptographic primitives used in a Noise protocol.
-// It should be constructed with NewCipherSuite.
+// It should be constructed with NewCipherSuite, or with NewCipherSuiteKEM for
+// the hfs modifier. A CipherSuite implemented elsewhere supports the hfs
+// modifier by also implementing KEM.
 type CipherSuite interface {
 	DHFunc
 	CipherFunc
@@ -92,8 +132,11 @@ func NewCipherSuite(dh DHFunc, c CipherFunc, h HashFunc) CipherSuite {
 	}
 }
 
-// NewCipherSuite HFS returns a CipherSuite constructed from the specified
-// primitives, with the Hybrid Forward Secrecy extension.
+// NewCipherSuiteHFS returns a CipherSuite constructed from the specified
+// primitives, with the "f" token of the draft Hybrid Forward Secrecy extension.
+// That draft has been replaced by the KEM-based hfs modifier of
+// NewCipherSuiteKEM, which new protocols should use; NewCipherSuiteHFS is
+// kept for compatibility with existing peers.
 func NewCipherSuiteHFS(dh DHFunc, c CipherFunc, h HashFunc, hfs HFSFunc) CipherSuite {
 	return ciphersuite{
 		DHFunc:     dh,
@@ -104,16 +147,41 @@ func NewCipherSuiteHFS(dh DHFunc, c CipherFunc, h HashFunc, hfs HFSFunc) CipherS
 	}
 }
 
+// NewCipherSuiteKEM returns a CipherSuite constructed from the specified
+// primitives, with a KEM for the KEM-based hfs modifier. This is the form of
+// hybrid forward secrecy described by the current specification, and the one
+// ParseProtocolName produces.
+func NewCipherSuiteKEM(dh DHFunc, kem KEM, c CipherFunc, h HashFunc) CipherSuite {
+	return ciphersuite{
+		DHFunc:     dh,
+		CipherFunc: c,
+		HashFunc:   h,
+		HFSFunc:    hfsNull,
+		KEM:        kem,
+		name:       []byte(dh.DHName() + "+" + kem.KEMName() + "_" + c.CipherName() + "_" + h.HashName()),
+	}
+}
+
 type ciphersuite struct {
 	DHFunc
 	CipherFunc
 	HashFunc
 	HFSFunc
+	KEM
 	name []byte
 }
 
 func (s ciphersuite) Name() []byte { return s.name }
 
+// kemOf returns the KEM of cs, or nil if it has none.
+func kemOf(cs CipherSuite) KEM {
+	if s, ok := cs.(ciphersuite); ok {
+		return s.KEM
+	}
+	k, _ := cs.(KEM)
+	return k
+}
+
 // DH25519 is the Curve25519 ECDH function.
 var DH25519 DHFunc = dh25519{}
 
@@ -131,15 +199,24 @@ func (dh25519) GenerateKeypair(rng io.Reader) (DHKey, error) {
 	return DHKey{Private: privkey[:], Public: pubkey[:]}, nil
 }
 
-func (dh25519) DH(privkey, pubkey []byte) []byte {
+func (dh25519) DH(privkey, pubkey []byte) ([]byte, error) {
+	if len(privkey) != 32 {
+		return nil, ErrInvalidPrivateKey
+	}
+	if len(pubkey) != 32 {
+		return nil, ErrInvalidPublicKey
+	}
+	// Low-order points are accepted, as the specification allows, and give
+	// an all-zero result; see Config.RejectZeroDH.
 	var dst, in, base [32]byte
 	copy(in[:], privkey)
 	copy(base[:], pubkey)
 	curve25519.ScalarMult(&dst, &in, &base)
-	return dst[:]
+	subtle.Zero(in[:])
+	return dst[:], nil
 }
 
-func (dh25519) DHLen() int     { return 32 }
+func (dh25519) DHLen() int     { return DH25519Len }
 func (dh25519) DHName() string { return "25519" }
 
 type cipherFn struct {
@@ -150,6 +227,24 @@ type cipherFn struct {
 func (c cipherFn) Cipher(k [32]byte) Cipher { return c.fn(k) }
 func (c cipherFn) CipherName() string       { return c.name }
 
+// NewCipherFunc returns a CipherFunc with the given name that uses fn to
+// initialize a Cipher with a key. It is typically combined with
+// NewAEADCipher to add ciphers that are not built in.
+func NewCipherFunc(name string, fn func(k [32]byte) Cipher) CipherFunc {
+	return cipherFn{fn, name}
+}
+
+// NewAEADCipher returns a Cipher that encrypts with aead. The 64-bit Noise
+// nonce is encoded with order into the last eight bytes of the AEAD's nonce,
+// and the remaining bytes are zero, which is the convention of the ciphers in
+// the specification. Hardware acceleration in aead is used as is.
+func NewAEADCipher(aead cipher.AEAD, order binary.ByteOrder) Cipher {
+	if aead.NonceSize() < 8 {
+		panic("noise: AEAD nonce is shorter than 64 bits")
+	}
+	return aeadCipher{aead, order}
+}
+
 // CipherAESGCM is the AES256-GCM AEAD cipher.
 var CipherAESGCM CipherFunc = cipherFn{cipherAESGCM, "AESGCM"}
 
@@ -162,14 +257,7 @@ func cipherAESGCM(k [32]byte) Cipher {
 	if err != nil {
 		panic(err)
 	}
-	return aeadCipher{
-		gcm,
-		func(n uint64) []byte {
-			var nonce [12]byte
-			binary.BigEndian.PutUint64(nonce[4:], n)
-			return nonce[:]
-		},
-	}
+	return NewAEADCipher(gcm, binary.BigEndian)
 }
 
 // CipherChaChaPoly is the ChaCha20-Poly1305 AEAD cipher construction.
@@ -180,19 +268,18 @@ func cipherChaChaPoly(k [32]byte) Cipher {
 	if err != nil {
 		panic(err)
 	}
-	return aeadCipher{
-		c,
-		func(n uint64) []byte {
-			var nonce [12]byte
-			binary.LittleEndian.PutUint64(nonce[4:], n)
-			return nonce[:]
-		},
-	}
+	return NewAEADCipher(c, binary.LittleEndian)
 }
 
 type aeadCipher struct {
 	cipher.AEAD
-	nonce func(uint64) []byte
+	order binary.ByteOrder
+}
+
+func (c aeadCipher) nonce(n uint64) []byte {
+	nonce := make([]byte, c.NonceSize())
+	c.order.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
 }
 
 func (c aeadCipher) Encrypt(out []byte, n uint64, ad, plaintext []byte) []byte {
@@ -238,3 +325,14 @@ func blake2sNew() hash.Hash {
 
 // HashBLAKE2s is the BLAKE2s hash function.
 var HashBLAKE2s HashFunc = hashFn{blake2sNew, "BLAKE2s"}
+
+func blake3New() hash.Hash { return blake3.New(32, nil) }
+
+// HashBLAKE3 is the unkeyed BLAKE3 hash function with a 32-byte output. It is
+// not defined by the Noise specification, so it only interoperates with peers
+// that make the same choice.
+var HashBLAKE3 HashFunc = hashFn{blake3New, "BLAKE3"}
+
+// HashSHA3_256 is the SHA3-256 hash function. It is not one of the hash
+// functions defined by the Noise specification.
+var HashSHA3_256 HashFunc = hashFn{sha3.New256, "SHA3-256"}
@@ -0,0 +1,120 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestAEADCipher(c *C) {
+	var k [32]byte
+	k[0] = 1
+	custom := NewCipherFunc("ChaChaPoly", func(k [32]byte) Cipher {
+		aead, _ := chacha20poly1305.New(k[:])
+		return NewAEADCipher(aead, binary.LittleEndian)
+	})
+	c.Assert(custom.CipherName(), Equals, "ChaChaPoly")
+	c.Assert(custom.Cipher(k).Encrypt(nil, 42, []byte("ad"), []byte("foo")), DeepEquals,
+		CipherChaChaPoly.Cipher(k).Encrypt(nil, 42, []byte("ad"), []byte("foo")))
+
+	// Longer nonces are zero-padded in front of the counter.
+	aead, _ := chacha20poly1305.NewX(k[:])
+	x := NewAEADCipher(aead, binary.BigEndian)
+	ct := x.Encrypt(nil, 7, nil, []byte("bar"))
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	nonce[23] = 7
+	c.Assert(ct, DeepEquals, aead.Seal(nil, nonce, []byte("bar"), nil))
+	pt, err := x.Decrypt(nil, 7, nil, ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "bar")
+}
+
+func (NoiseSuite) TestAESGCMNonce(c *C) {
+	var k [32]byte
+	k[0] = 1
+	block, _ := aes.NewCipher(k[:])
+	gcm, _ := cipher.NewGCM(block)
+
+	// The counter is big-endian in the last eight bytes of the 96-bit nonce.
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], 0x0102030405)
+	ct := CipherAESGCM.Cipher(k).Encrypt(nil, 0x0102030405, []byte("ad"), []byte("foo"))
+	c.Assert(ct, DeepEquals, gcm.Seal(nil, nonce, []byte("foo"), []byte("ad")))
+	pt, err := CipherAESGCM.Cipher(k).Decrypt(nil, 0x0102030405, []byte("ad"), ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "foo")
+}
+
+func (NoiseSuite) TestHashSHA3_256(c *C) {
+	h := HashSHA3_256.Hash()
+	c.Assert(h.Size(), Equals, 32)
+	c.Assert(hex.EncodeToString(h.Sum(nil)), Equals,
+		"a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a")
+	testHashHandshake(c, "Noise_NN_25519_ChaChaPoly_SHA3-256")
+}
+
+func (NoiseSuite) TestHashBLAKE3(c *C) {
+	h := HashBLAKE3.Hash()
+	c.Assert(h.Size(), Equals, 32)
+	c.Assert(h.BlockSize(), Equals, 64)
+	c.Assert(hex.EncodeToString(h.Sum(nil)), Equals,
+		"af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262")
+	testHashHandshake(c, "Noise_NN_25519_ChaChaPoly_BLAKE3")
+}
+
+func testHashHandshake(c *C, name string) {
+	cfgI, err := ParseProtocolName(name)
+	c.Assert(err, IsNil)
+	cfgR, _ := ParseProtocolName(name)
+	cfgI.Initiator = true
+	hsI, _ := NewHandshakeState(cfgI)
+	hsR, _ := NewHandshakeState(cfgR)
+	c.Assert(hsI.ProtocolName(), Equals, name)
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("hello"))
+	payload, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(payload), Equals, "hello")
+	msg, csR0, _, _ := hsR.WriteMessage(nil, nil)
+	_, csI0, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	ct := csI0.Encrypt(nil, nil, []byte("ping"))
+	pt, err := csR0.Decrypt(nil, nil, ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "ping")
+}
+
+// xorRekey is CipherChaChaPoly with a REKEY function that flips the key.
+type xorRekey struct{ CipherFunc }
+
+func (xorRekey) Rekey(k [32]byte) [32]byte {
+	for i := range k {
+		k[i] ^= 0xff
+	}
+	return k
+}
+
+func (NoiseSuite) TestRekeyFunc(c *C) {
+	var k [32]byte
+	k[0] = 1
+
+	// The default encrypts zeros under the maximum nonce.
+	cs := &CipherState{cs: NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256), c: CipherChaChaPoly.Cipher(k), k: k}
+	cs.Rekey()
+	want := CipherChaChaPoly.Cipher(k).Encrypt(nil, math.MaxUint64, nil, make([]byte, 32))
+	c.Assert(cs.k[:], DeepEquals, want[:32])
+
+	cs = &CipherState{cs: NewCipherSuite(DH25519, xorRekey{CipherChaChaPoly}, HashSHA256), c: CipherChaChaPoly.Cipher(k), k: k}
+	cs.Rekey()
+	c.Assert(cs.k, Equals, xorRekey{}.Rekey(k))
+	msg := cs.Encrypt(nil, nil, []byte("hi"))
+	_, err := CipherChaChaPoly.Cipher(xorRekey{}.Rekey(k)).Decrypt(nil, 0, nil, msg)
+	c.Assert(err, IsNil)
+
+	cs.Cipher()
+	c.Assert(cs.Rekey, PanicMatches, ".*state is invalid")
+}
@@ -0,0 +1,50 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestClone(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rs, _ := cs.GenerateKeypair(nil)
+	psk := make([]byte, 32)
+	psk[0] = 1
+	wrong := make([]byte, 32)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:           cs,
+		Pattern:               HandshakeNK,
+		Initiator:             true,
+		PeerStatic:            rs.Public,
+		PresharedKey:          psk,
+		PresharedKeyPlacement: 0,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:           cs,
+		Pattern:               HandshakeNK,
+		StaticKeypair:         rs,
+		PresharedKey:          wrong,
+		PresharedKeyPlacement: 0,
+	})
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("hello"))
+
+	// Try each candidate on a clone, leaving hsR untouched.
+	var accepted *HandshakeState
+	for _, k := range [][]byte{wrong, psk} {
+		clone := hsR.Clone()
+		c.Assert(clone.SetPresharedKey(0, k), IsNil)
+		if res, _, _, err := clone.ReadMessage(nil, msg); err == nil {
+			c.Assert(string(res), Equals, "hello")
+			accepted = clone
+		}
+	}
+	c.Assert(accepted, NotNil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, NotNil)
+
+	c.Assert(accepted.SetPresharedKey(0, psk), ErrorMatches, ".*already been used")
+	msg, csR, _, _ := accepted.WriteMessage(nil, nil)
+	_, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("done")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "done")
+}
@@ -0,0 +1,235 @@
+// Package conformance runs matrices of Noise handshakes between in-process
+// peers and reports the outcome of each in a machine-readable form. It is
+// intended for the continuous integration of products that embed package
+// noise, to check that every profile they rely on works end to end.
+package conformance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flynn/noise"
+)
+
+// A Matrix describes the handshakes to run. Every combination of its fields
+// is run once.
+type Matrix struct {
+	Patterns     []noise.HandshakePattern
+	CipherSuites []noise.CipherSuite
+
+	// PresharedKeyPlacements lists the PSK placements to run. A negative
+	// placement runs the handshake without a PSK. If empty, handshakes are
+	// only run without a PSK.
+	PresharedKeyPlacements []int
+
+	// PayloadSizes lists the sizes of the payloads sent in every handshake
+	// and transport message. If empty, only empty payloads are sent.
+	PayloadSizes []int
+
+	// Random is the source of randomness for keys and payloads. If nil,
+	// crypto/rand is used.
+	Random io.Reader
+}
+
+// A Result is the outcome of a single handshake in a Matrix.
+type Result struct {
+	Protocol     string `json:"protocol"`
+	PayloadSize  int    `json:"payload_size"`
+	Passed       bool   `json:"passed"`
+	Error        string `json:"error,omitempty"`
+	MessageSizes []int  `json:"message_sizes,omitempty"`
+}
+
+// A Report is the outcome of running a Matrix. It is intended to be encoded
+// with encoding/json.
+type Report struct {
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Results []Result `json:"results"`
+}
+
+// Run runs every handshake described by m and returns a report.
+func Run(m Matrix) *Report {
+	placements := m.PresharedKeyPlacements
+	if len(placements) == 0 {
+		placements = []int{-1}
+	}
+	sizes := m.PayloadSizes
+	if len(sizes) == 0 {
+		sizes = []int{0}
+	}
+	rng := m.Random
+	if rng == nil {
+		rng = rand.Reader
+	}
+
+	r := &Report{Results: []Result{}}
+	for _, p := range m.Patterns {
+		for _, cs := range m.CipherSuites {
+			for _, psk := range placements {
+				for _, size := range sizes {
+					res := Result{PayloadSize: size}
+					var err error
+					res.Protocol, res.MessageSizes, err = run(p, cs, psk, size, rng)
+					if err != nil {
+						res.Error = err.Error()
+						r.Failed++
+					} else {
+						res.Passed = true
+						r.Passed++
+					}
+					r.Results = append(r.Results, res)
+				}
+			}
+		}
+	}
+	return r
+}
+
+// protocolName returns the name of a handshake that could not be set up, as
+// the HandshakeState would have reported it.
+func protocolName(p noise.HandshakePattern, cs noise.CipherSuite, psk int) string {
+	name := "Noise_" + p.Name
+	if psk >= 0 {
+		// Modifiers after the first are separated by "+".
+		if strings.ToUpper(p.Name) != p.Name {
+			name += "+"
+		}
+		name += fmt.Sprintf("psk%d", psk)
+	}
+	return name + "_" + string(cs.Name())
+}
+
+// wrongPhase reports whether err is the error of a HandshakeState that is not
+// due to write.
+func wrongPhase(err error) bool {
+	var herr *noise.HandshakeError
+	return errors.As(err, &herr) && herr.Reason == noise.FailureWrongPhase
+}
+
+func hasToken(tokens []noise.MessagePattern, t noise.MessagePattern) bool {
+	for _, m := range tokens {
+		if m == t {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs one handshake and its transport messages, and returns the protocol
+// name and the sizes of the handshake messages.
+func run(p noise.HandshakePattern, cs noise.CipherSuite, psk, size int, rng io.Reader) (string, []int, error) {
+	name := protocolName(p, cs, psk)
+	ci := noise.Config{CipherSuite: cs, Random: rng, Pattern: p, Initiator: true}
+	cr := noise.Config{CipherSuite: cs, Random: rng, Pattern: p}
+
+	var err error
+	if ci.StaticKeypair, err = cs.GenerateKeypair(rng); err != nil {
+		return name, nil, err
+	}
+	if cr.StaticKeypair, err = cs.GenerateKeypair(rng); err != nil {
+		return name, nil, err
+	}
+	if hasToken(p.InitiatorPreMessages, noise.MessagePatternS) {
+		cr.PeerStatic = ci.StaticKeypair.Public
+	}
+	if hasToken(p.ResponderPreMessages, noise.MessagePatternS) {
+		ci.PeerStatic = cr.StaticKeypair.Public
+	}
+	if hasToken(p.InitiatorPreMessages, noise.MessagePatternE) {
+		if ci.EphemeralKeypair, err = cs.GenerateKeypair(rng); err != nil {
+			return name, nil, err
+		}
+		cr.PeerEphemeral = ci.EphemeralKeypair.Public
+	}
+	if hasToken(p.ResponderPreMessages, noise.MessagePatternE) {
+		if cr.EphemeralKeypair, err = cs.GenerateKeypair(rng); err != nil {
+			return name, nil, err
+		}
+		ci.PeerEphemeral = cr.EphemeralKeypair.Public
+	}
+	if psk >= 0 {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rng, key); err != nil {
+			return name, nil, err
+		}
+		ci.PresharedKey, ci.PresharedKeyPlacement = key, psk
+		cr.PresharedKey, cr.PresharedKeyPlacement = key, psk
+	}
+
+	hsI, err := noise.NewHandshakeState(ci)
+	if err != nil {
+		return name, nil, fmt.Errorf("initiator: %v", err)
+	}
+	hsR, err := noise.NewHandshakeState(cr)
+	if err != nil {
+		return name, nil, fmt.Errorf("responder: %v", err)
+	}
+
+	name = hsI.ProtocolName()
+
+	payload := make([]byte, size)
+	var sizes []int
+	var csI, csR [2]*noise.CipherState
+	writer, reader := hsI, hsR
+	for i := range p.Messages {
+		if _, err := io.ReadFull(rng, payload); err != nil {
+			return name, sizes, err
+		}
+		msg, cs0, cs1, err := writer.WriteMessage(nil, payload)
+		if i == 0 && wrongPhase(err) {
+			// The responder writes first in fallback patterns.
+			writer, reader = reader, writer
+			msg, cs0, cs1, err = writer.WriteMessage(nil, payload)
+		}
+		if err != nil {
+			return name, sizes, fmt.Errorf("message %d: write: %v", i, err)
+		}
+		sizes = append(sizes, len(msg))
+		res, cr0, cr1, err := reader.ReadMessage(nil, msg)
+		if err != nil {
+			return name, sizes, fmt.Errorf("message %d: read: %v", i, err)
+		}
+		if !bytes.Equal(res, payload) {
+			return name, sizes, fmt.Errorf("message %d: payload mismatch", i)
+		}
+		if writer == hsI {
+			csI, csR = [2]*noise.CipherState{cs0, cs1}, [2]*noise.CipherState{cr0, cr1}
+		} else {
+			csI, csR = [2]*noise.CipherState{cr0, cr1}, [2]*noise.CipherState{cs0, cs1}
+		}
+		writer, reader = reader, writer
+	}
+	if csI[0] == nil || csR[0] == nil {
+		return name, sizes, errors.New("handshake did not complete")
+	}
+	if !bytes.Equal(hsI.ChannelBinding(), hsR.ChannelBinding()) {
+		return name, sizes, errors.New("handshake hash mismatch")
+	}
+
+	for dir := 0; dir < 2; dir++ {
+		enc, dec := csI[dir], csR[dir]
+		if dir == 1 {
+			enc, dec = csR[dir], csI[dir]
+		}
+		if enc == nil && dec == nil {
+			continue
+		}
+		if enc == nil || dec == nil {
+			return name, sizes, errors.New("mismatched transport CipherStates")
+		}
+		msg := enc.Encrypt(nil, nil, payload)
+		res, err := dec.Decrypt(nil, nil, msg)
+		if err != nil {
+			return name, sizes, fmt.Errorf("transport %d: %v", dir, err)
+		}
+		if !bytes.Equal(res, payload) {
+			return name, sizes, fmt.Errorf("transport %d: payload mismatch", dir)
+		}
+	}
+	return name, sizes, nil
+}
@@ -0,0 +1,62 @@
+package conformance_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/flynn/noise/conformance"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ConformanceSuite struct{}
+
+var _ = Suite(&ConformanceSuite{})
+
+func (ConformanceSuite) TestRun(c *C) {
+	r := conformance.Run(conformance.Matrix{
+		Patterns: []noise.HandshakePattern{noise.HandshakeNN, noise.HandshakeXK, noise.HandshakeIX, noise.HandshakeK},
+		CipherSuites: []noise.CipherSuite{
+			noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s),
+			noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA512),
+		},
+		PresharedKeyPlacements: []int{-1, 0, 1},
+		PayloadSizes:           []int{0, 100},
+	})
+	c.Assert(r.Failed, Equals, 0, Commentf("%+v", r.Results))
+	c.Assert(r.Passed, Equals, 4*2*3*2)
+	c.Assert(r.Results[0].Protocol, Equals, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(r.Results[0].MessageSizes, DeepEquals, []int{32, 48})
+
+	b, err := json.Marshal(r)
+	c.Assert(err, IsNil)
+	var decoded conformance.Report
+	c.Assert(json.Unmarshal(b, &decoded), IsNil)
+	c.Assert(decoded.Results, HasLen, len(r.Results))
+}
+
+func (ConformanceSuite) TestRunFailure(c *C) {
+	r := conformance.Run(conformance.Matrix{
+		Patterns:     []noise.HandshakePattern{noise.HandshakeNN},
+		CipherSuites: []noise.CipherSuite{noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)},
+		PayloadSizes: []int{noise.DefaultMaxMsgLen + 1},
+	})
+	c.Assert(r.Failed, Equals, 1)
+	c.Assert(r.Results[0].Passed, Equals, false)
+	c.Assert(r.Results[0].Error, Not(Equals), "")
+}
+
+func (ConformanceSuite) TestRunFallback(c *C) {
+	// The responder writes first, and the psk modifier follows the fallback
+	// modifier.
+	r := conformance.Run(conformance.Matrix{
+		Patterns:               []noise.HandshakePattern{noise.HandshakeXXfallback},
+		CipherSuites:           []noise.CipherSuite{noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)},
+		PresharedKeyPlacements: []int{-1, 0},
+	})
+	c.Assert(r.Failed, Equals, 0, Commentf("%+v", r.Results))
+	c.Assert(r.Results[0].Protocol, Equals, "Noise_XXfallback_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(r.Results[1].Protocol, Equals, "Noise_XXfallback+psk0_25519_ChaChaPoly_BLAKE2s")
+}
@@ -0,0 +1,279 @@
+package noise
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Conn is a net.Conn secured with Noise, in the manner of tls.Conn. The
+// handshake is run by the first Read or Write, or explicitly by Handshake, and
+// application data is then sent as transport messages. Handshake and
+// transport messages are framed as by FrameWriter. The handshake messages
+// carry no payload.
+//
+// Read and Write may be called concurrently with each other, but not with
+// themselves.
+type Conn struct {
+	conn   net.Conn
+	config Config
+
+	handshakeMu   sync.Mutex
+	handshakeDone uint32 // set atomically once the handshake has succeeded
+	handshakeErr  error
+	hs            *HandshakeState
+
+	fr *FrameReader
+	fw *FrameWriter
+
+	inMu sync.Mutex
+	in   *Reader // nil if the Conn cannot receive
+
+	outMu sync.Mutex
+	out   *Writer // nil if the Conn cannot send
+
+	rekeyMu sync.Mutex
+	rekey   RekeyPolicy
+}
+
+// Client returns a new Conn that runs a handshake as the initiator over conn.
+// The Initiator field of config is ignored.
+func Client(conn net.Conn, config Config) *Conn {
+	config.Initiator = true
+	return newConn(conn, config)
+}
+
+// Server returns a new Conn that runs a handshake as the responder over conn.
+// The Initiator field of config is ignored.
+func Server(conn net.Conn, config Config) *Conn {
+	config.Initiator = false
+	return newConn(conn, config)
+}
+
+func newConn(conn net.Conn, config Config) *Conn {
+	return &Conn{conn: conn, config: config, fr: NewFrameReader(conn), fw: NewFrameWriter(conn)}
+}
+
+// Handshake runs the handshake if it has not yet been run. Most uses of this
+// package need not call Handshake explicitly, as the first Read or Write
+// calls it.
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is like Handshake. If ctx is done before the handshake
+// completes, the handshake is interrupted with a deadline on the underlying
+// connection and fails with ctx.Err(); if the handshake completes anyway, the
+// deadline is cleared. The context is also passed to a static key that
+// implements ContextPrivateDH. A failed handshake cannot be retried, and the
+// Conn should be closed.
+func (c *Conn) HandshakeContext(ctx context.Context) (err error) {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	if atomic.LoadUint32(&c.handshakeDone) == 1 {
+		return nil
+	}
+	if ctx.Done() != nil {
+		// Unblock any I/O in progress once ctx is done.
+		fired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			c.conn.SetDeadline(time.Unix(1, 0))
+			close(fired)
+		})
+		defer func() {
+			if stop() {
+				return
+			}
+			<-fired
+			if err != nil {
+				err = ctx.Err()
+				c.handshakeErr = err
+				return
+			}
+			// The handshake completed as ctx was done, so the deadline
+			// set to interrupt it must not outlive it.
+			c.conn.SetDeadline(time.Time{})
+		}()
+	}
+	c.handshakeErr = c.handshake(ctx)
+	if c.handshakeErr == nil {
+		atomic.StoreUint32(&c.handshakeDone, 1)
+	}
+	return c.handshakeErr
+}
+
+func (c *Conn) handshake(ctx context.Context) error {
+	if c.config.HalfDuplex {
+		return errors.New("noise: Conn does not support HalfDuplex")
+	}
+	hs, err := NewHandshakeState(c.config)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for {
+		var cs1, cs2 *CipherState
+		if hs.shouldWrite {
+			buf, cs1, cs2, err = hs.WriteMessageContext(ctx, buf[:0], nil)
+			if err != nil {
+				return err
+			}
+			if err := c.fw.WriteFrame(buf); err != nil {
+				return err
+			}
+		} else {
+			msg, err := c.fr.ReadFrame()
+			if err != nil {
+				return err
+			}
+			if len(msg) > hs.maxMsgLen {
+				return errors.New("noise: message is too long")
+			}
+			_, cs1, cs2, err = hs.ReadMessageContext(ctx, nil, msg)
+			if err != nil {
+				return err
+			}
+		}
+		if cs1 != nil {
+			c.hs = hs
+			send, recv := cs1, cs2
+			if !c.config.Initiator {
+				send, recv = cs2, cs1
+			}
+			c.rekeyMu.Lock()
+			if send != nil {
+				c.out = newWriter(c.fw, send)
+				c.out.SetRekeyPolicy(c.rekey)
+			}
+			if recv != nil {
+				c.in = &Reader{fr: c.fr, cs: recv}
+				c.in.SetRekeyPolicy(c.rekey)
+			}
+			c.rekeyMu.Unlock()
+			return nil
+		}
+	}
+}
+
+// Read reads application data, running the handshake first if needed. A
+// read that times out part way through a transport message can be retried. A
+// transport message that fails to decrypt breaks the Conn, and Read returns
+// the error from then on.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if c.in == nil {
+		return 0, errors.New("noise: Conn cannot receive in a one-way pattern")
+	}
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	return c.in.Read(b)
+}
+
+// Write writes application data, running the handshake first if needed. Data
+// is split into transport messages of at most MaxFrameLen bytes. After an
+// error from the underlying connection, the Conn cannot be written to any
+// more.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if c.out == nil {
+		return 0, errors.New("noise: Conn cannot send in a one-way pattern")
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return c.out.Write(b)
+}
+
+// SetRekeyPolicy sets when the Conn rekeys the transport messages it sends,
+// and the hook for rekeys in either direction. It can be called before or
+// after the handshake. The peer follows the Conn's rekeys whatever its own
+// policy.
+func (c *Conn) SetRekeyPolicy(p RekeyPolicy) {
+	c.rekeyMu.Lock()
+	defer c.rekeyMu.Unlock()
+	c.rekey = p
+	if c.out != nil {
+		c.outMu.Lock()
+		c.out.SetRekeyPolicy(p)
+		c.outMu.Unlock()
+	}
+	if c.in != nil {
+		c.inMu.Lock()
+		c.in.SetRekeyPolicy(p)
+		c.inMu.Unlock()
+	}
+}
+
+// CloseWrite sends an authenticated message that ends the data the Conn
+// sends, after which Read on the peer's Conn returns io.EOF and Write fails.
+// It then closes the write half of the underlying connection if it has a
+// CloseWrite method, as *net.TCPConn does. A peer running Tunnel needs this
+// message, and treats the end of the connection without it as truncation.
+func (c *Conn) CloseWrite() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.out == nil {
+		return errors.New("noise: Conn cannot send in a one-way pattern")
+	}
+	c.outMu.Lock()
+	err := c.out.close()
+	c.outMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error { return c.conn.Close() }
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the write deadline of the underlying connection. A
+// Write that times out breaks the Conn, as part of a message may have been
+// sent.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn { return c.conn }
+
+// PeerStatic returns the peer's static public key, or nil before the
+// handshake has completed or if the peer has none.
+func (c *Conn) PeerStatic() []byte {
+	if atomic.LoadUint32(&c.handshakeDone) == 0 {
+		return nil
+	}
+	return c.hs.PeerStatic()
+}
+
+// ChannelBinding returns the handshake hash, or nil before the handshake has
+// completed.
+func (c *Conn) ChannelBinding() []byte {
+	if atomic.LoadUint32(&c.handshakeDone) == 0 {
+		return nil
+	}
+	return c.hs.ChannelBinding()
+}
@@ -0,0 +1,206 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func connPair(pattern HandshakePattern, prologueR []byte) (*Conn, *Conn) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	cfgI := Config{CipherSuite: cs, Pattern: pattern, StaticKeypair: staticI}
+	cfgR := Config{CipherSuite: cs, Pattern: pattern, StaticKeypair: staticR, Prologue: prologueR}
+	if len(pattern.ResponderPreMessages) > 0 {
+		cfgI.PeerStatic = staticR.Public
+	}
+	if len(pattern.InitiatorPreMessages) > 0 {
+		cfgR.PeerStatic = staticI.Public
+	}
+	a, b := net.Pipe()
+	return Client(a, cfgI), Server(b, cfgR)
+}
+
+func (NoiseSuite) TestConn(c *C) {
+	client, server := connPair(HandshakeXX, nil)
+	defer client.Close()
+	defer server.Close()
+	c.Assert(client.PeerStatic(), IsNil)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Write([]byte("hello"))
+		if err == nil {
+			_, err = server.Write(big)
+		}
+		done <- err
+	}()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(client, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "hello")
+	got := make([]byte, len(big))
+	_, err = io.ReadFull(client, got)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, big)
+	c.Assert(<-done, IsNil)
+
+	c.Assert(client.PeerStatic(), DeepEquals, server.config.StaticKeypair.Public)
+	c.Assert(server.PeerStatic(), DeepEquals, client.config.StaticKeypair.Public)
+	c.Assert(client.ChannelBinding(), DeepEquals, server.ChannelBinding())
+
+	// Data flows the other way too, and the peer sees EOF on close.
+	go func() {
+		client.Write([]byte("bye"))
+		client.Close()
+	}()
+	res, err := io.ReadAll(server)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "bye")
+}
+
+func (NoiseSuite) TestConnHandshakeFailure(c *C) {
+	client, server := connPair(HandshakeXX, []byte("other"))
+	defer client.Close()
+	go func() {
+		server.Handshake()
+		server.Close()
+	}()
+	err := client.Handshake()
+	c.Assert(err, NotNil)
+	_, err2 := client.Write([]byte("foo"))
+	c.Assert(err2, Equals, err)
+}
+
+func (NoiseSuite) TestConnOneWay(c *C) {
+	client, server := connPair(HandshakeK, nil)
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("one-way"))
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(server, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "one-way")
+	_, err = server.Write([]byte("reply"))
+	c.Assert(err, ErrorMatches, "noise: Conn cannot send in a one-way pattern")
+}
+
+func (NoiseSuite) TestConnHandshakeContext(c *C) {
+	client, server := connPair(HandshakeXX, nil)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// The server never answers, so the handshake is interrupted.
+	go io.Copy(io.Discard, server.NetConn())
+	c.Assert(client.HandshakeContext(ctx), Equals, context.DeadlineExceeded)
+}
+
+// cancelConn cancels a context after its first Write, and waits for the
+// deadline that the cancellation sets.
+type cancelConn struct {
+	net.Conn
+	cancel   context.CancelFunc
+	deadline chan struct{}
+	once     sync.Once
+}
+
+func (c *cancelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.once.Do(func() {
+		c.cancel()
+		<-c.deadline
+	})
+	return n, err
+}
+
+func (c *cancelConn) SetDeadline(t time.Time) error {
+	if !t.IsZero() {
+		close(c.deadline)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (NoiseSuite) TestConnHandshakeContextCompletes(c *C) {
+	// ctx is done after the responder's last handshake message has been
+	// written, so the handshake succeeds and the Conn must still work.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	a, b := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := Client(a, Config{CipherSuite: cs, Pattern: HandshakeNN})
+	server := Server(&cancelConn{Conn: b, cancel: cancel, deadline: make(chan struct{})}, Config{CipherSuite: cs, Pattern: HandshakeNN})
+	defer client.Close()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() { done <- client.Handshake() }()
+	c.Assert(server.HandshakeContext(ctx), IsNil)
+	c.Assert(<-done, IsNil)
+
+	go client.Write([]byte("after"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(server, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "after")
+}
+
+func (NoiseSuite) TestConnReadTimeout(c *C) {
+	client, server := connPair(HandshakeNN, nil)
+	defer client.Close()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	c.Assert(client.Handshake(), IsNil)
+	c.Assert(<-done, IsNil)
+
+	// A timeout in the middle of a message does not lose the bytes read.
+	msg := append([]byte(nil), server.out.cs.Encrypt([]byte{0, 0}, nil, []byte("slow"))...)
+	msg[1] = byte(len(msg) - 2)
+	go server.NetConn().Write(msg[:4])
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 4)
+	_, err := client.Read(buf)
+	ne, ok := err.(net.Error)
+	c.Assert(ok && ne.Timeout(), Equals, true, Commentf("%v", err))
+
+	client.SetReadDeadline(time.Time{})
+	go server.NetConn().Write(msg[4:])
+	_, err = io.ReadFull(client, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "slow")
+}
+
+func (NoiseSuite) TestListener(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l := NewListener(inner, Config{CipherSuite: cs, Pattern: HandshakeNN})
+	defer l.Close()
+	c.Assert(l.Addr(), Equals, inner.Addr())
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("hi"))
+			conn.Close()
+		}
+		done <- err
+	}()
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	c.Assert(err, IsNil)
+	client := Client(conn, Config{CipherSuite: cs, Pattern: HandshakeNN})
+	defer client.Close()
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(client, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "hi")
+	c.Assert(<-done, IsNil)
+}
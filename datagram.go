@@ -0,0 +1,139 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+)
+
+// DatagramOverhead is the number of bytes that a DatagramCipher adds to each
+// message: the explicit nonce and the authentication tag.
+const DatagramOverhead = 8 + MACLen
+
+// ReplayWindowSize is the number of nonces below the highest one received
+// that a DatagramCipher still accepts, once, out of order.
+const ReplayWindowSize = 2048 - 64
+
+// ErrReplay is returned by DatagramCipher.Decrypt for a message whose nonce
+// has already been received or is too old to tell.
+var ErrReplay = errors.New("noise: replayed or too old datagram")
+
+// A DatagramCipher encrypts and decrypts transport messages for unreliable
+// transports such as UDP, which may drop, duplicate or reorder them. Each
+// message carries its nonce explicitly, as a big-endian uint64 ahead of the
+// ciphertext, and the receiver rejects nonces it has already seen with a
+// sliding window. It is safe for concurrent use.
+//
+// A DatagramCipher is built on the Cipher of a single CipherState, so each
+// peer needs one for sending and one for receiving.
+type DatagramCipher struct {
+	mu       sync.Mutex
+	c        Cipher
+	sendOnly bool
+	recvOnly bool
+	n        uint64 // the next nonce to send
+	window   replayWindow
+}
+
+// NewDatagramCipher returns a DatagramCipher that uses the Cipher of cs, which
+// must not be used for anything else afterwards.
+func NewDatagramCipher(cs *CipherState) *DatagramCipher {
+	d := &DatagramCipher{sendOnly: cs.sendOnly, recvOnly: cs.recvOnly}
+	d.c = cs.Cipher()
+	return d
+}
+
+// Encrypt encrypts plaintext with the next nonce and appends the nonce,
+// ciphertext and tag to out. It fails once the nonces have run out, after
+// 2^64-1 messages, at which point a new handshake is needed.
+func (d *DatagramCipher) Encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	if d.recvOnly {
+		return nil, errors.New("noise: CipherState is receive-only")
+	}
+	d.mu.Lock()
+	n := d.n
+	if n == math.MaxUint64 {
+		d.mu.Unlock()
+		return nil, errors.New("noise: datagram nonces exhausted")
+	}
+	d.n++
+	d.mu.Unlock()
+	out = binary.BigEndian.AppendUint64(out, n)
+	return d.c.Encrypt(out, n, ad, plaintext), nil
+}
+
+// Decrypt authenticates and decrypts a message produced by Encrypt and
+// appends the plaintext to out. It returns ErrReplay if the nonce has already
+// been accepted or is more than ReplayWindowSize below the highest nonce
+// accepted. A message that fails authentication does not affect the window.
+func (d *DatagramCipher) Decrypt(out, ad, msg []byte) ([]byte, error) {
+	if d.sendOnly {
+		return nil, errors.New("noise: CipherState is send-only")
+	}
+	if len(msg) < DatagramOverhead {
+		return nil, errors.New("noise: datagram is too short")
+	}
+	n := binary.BigEndian.Uint64(msg)
+	if n == math.MaxUint64 {
+		return nil, ErrReplay
+	}
+	d.mu.Lock()
+	ok := d.window.check(n)
+	d.mu.Unlock()
+	if !ok {
+		return nil, ErrReplay
+	}
+	out, err := d.c.Decrypt(out, n, ad, msg[8:])
+	if err != nil {
+		return nil, err
+	}
+	// Another message with the same nonce may have been accepted since
+	// the check.
+	d.mu.Lock()
+	ok = d.window.update(n)
+	d.mu.Unlock()
+	if !ok {
+		return nil, ErrReplay
+	}
+	return out, nil
+}
+
+// A replayWindow is a bitmap of the nonces received, in a ring of words as
+// described in RFC 6479, so that advancing it rarely touches more than one
+// word.
+type replayWindow struct {
+	top    uint64 // one more than the highest nonce received
+	bitmap [2048 / 64]uint64
+}
+
+// check reports whether n is new and within the window.
+func (w *replayWindow) check(n uint64) bool {
+	if n >= w.top {
+		return true
+	}
+	if w.top-n > ReplayWindowSize {
+		return false
+	}
+	return w.bitmap[(n/64)%uint64(len(w.bitmap))]&(1<<(n%64)) == 0
+}
+
+// update records n, reporting whether it was new and within the window.
+func (w *replayWindow) update(n uint64) bool {
+	if !w.check(n) {
+		return false
+	}
+	if n >= w.top {
+		// Clear the words that the window moves over.
+		cur, next := uint64(0), n/64
+		if w.top > 0 {
+			cur = (w.top - 1) / 64
+		}
+		for i := cur + 1; i <= next && i-cur <= uint64(len(w.bitmap)); i++ {
+			w.bitmap[i%uint64(len(w.bitmap))] = 0
+		}
+		w.top = n + 1
+	}
+	w.bitmap[(n/64)%uint64(len(w.bitmap))] |= 1 << (n % 64)
+	return true
+}
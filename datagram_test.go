@@ -0,0 +1,92 @@
+package noise
+
+import (
+	"encoding/binary"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+func datagramPair(c *C) (*DatagramCipher, *DatagramCipher) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, _, csR, _ := hsR.WriteMessage(nil, nil)
+	_, _, csI, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	return NewDatagramCipher(csR), NewDatagramCipher(csI)
+}
+
+func (NoiseSuite) TestDatagramReorder(c *C) {
+	send, recv := datagramPair(c)
+	var msgs [][]byte
+	for _, m := range []string{"one", "two", "three"} {
+		msg, err := send.Encrypt(nil, nil, []byte(m))
+		c.Assert(err, IsNil)
+		c.Assert(msg, HasLen, len(m)+DatagramOverhead)
+		msgs = append(msgs, msg)
+	}
+	for _, i := range []int{2, 0, 1} {
+		res, err := recv.Decrypt(nil, nil, msgs[i])
+		c.Assert(err, IsNil)
+		c.Assert(string(res), Equals, []string{"one", "two", "three"}[i])
+	}
+	for _, msg := range msgs {
+		_, err := recv.Decrypt(nil, nil, msg)
+		c.Assert(err, Equals, ErrReplay)
+	}
+
+	// A forged message does not use up its nonce.
+	forged := append([]byte(nil), msgs[0]...)
+	binary.BigEndian.PutUint64(forged, 3)
+	_, err := recv.Decrypt(nil, nil, forged)
+	c.Assert(err, NotNil)
+	msg, _ := send.Encrypt(nil, nil, []byte("four"))
+	res, err := recv.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "four")
+
+	_, err = recv.Decrypt(nil, nil, msg[:DatagramOverhead-1])
+	c.Assert(err, NotNil)
+}
+
+func (NoiseSuite) TestDatagramNoncesExhausted(c *C) {
+	send, _ := datagramPair(c)
+	send.n = math.MaxUint64 - 1
+	_, err := send.Encrypt(nil, nil, nil)
+	c.Assert(err, IsNil)
+	_, err = send.Encrypt(nil, nil, nil)
+	c.Assert(err, NotNil)
+}
+
+func (NoiseSuite) TestReplayWindow(c *C) {
+	var w replayWindow
+	c.Assert(w.update(0), Equals, true)
+	c.Assert(w.update(0), Equals, false)
+	c.Assert(w.update(ReplayWindowSize-1), Equals, true)
+	c.Assert(w.update(1), Equals, true)
+	c.Assert(w.update(0), Equals, false)
+	c.Assert(w.update(ReplayWindowSize), Equals, true)
+	// 0 is now too old to tell.
+	c.Assert(w.check(0), Equals, false)
+	c.Assert(w.update(1), Equals, false)
+	c.Assert(w.update(2), Equals, true)
+
+	// Jumping far ahead clears the whole ring.
+	c.Assert(w.update(100000), Equals, true)
+	for n := uint64(100001 - ReplayWindowSize); n < 100000; n++ {
+		c.Assert(w.check(n), Equals, true)
+	}
+	c.Assert(w.check(100000-ReplayWindowSize), Equals, false)
+	c.Assert(w.update(99999), Equals, true)
+	c.Assert(w.update(99999), Equals, false)
+
+	// Every nonce in a long run is accepted once.
+	var w2 replayWindow
+	for n := uint64(0); n < 10000; n++ {
+		c.Assert(w2.update(n), Equals, true)
+		c.Assert(w2.update(n), Equals, false)
+	}
+}
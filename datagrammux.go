@@ -0,0 +1,749 @@
+package noise
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message types of a DatagramMux.
+const (
+	datagramHandshake        byte = 1
+	datagramTransport        byte = 2
+	datagramCookieReply      byte = 3
+	datagramCookieInitiation byte = 4
+)
+
+const (
+	datagramHandshakeHeaderLen        = 9
+	datagramTransportHeaderLen        = 5
+	datagramCookieLen                 = 16
+	datagramCookieReplyLen            = 5 + datagramCookieLen
+	datagramCookieInitiationHeaderLen = 5 + datagramCookieLen
+
+	// datagramHandshakeTimeout is the time after which a handshake that a
+	// peer started, or a session it has not yet confirmed, may be dropped to
+	// make room for new ones.
+	datagramHandshakeTimeout = 10 * time.Second
+
+	// datagramMaxHandshakes is the number of handshakes that may be in
+	// progress at once.
+	datagramMaxHandshakes = 1024
+
+	// datagramMaxHandshakesPerAddr is the number of handshakes that peers at
+	// one address may have in progress at once.
+	datagramMaxHandshakesPerAddr = 16
+
+	// datagramMaxSessions is the number of sessions that may be open at
+	// once; handshakes started by peers beyond it are dropped.
+	datagramMaxSessions = 1 << 16
+
+	// datagramCookieThreshold is the number of handshakes started by peers
+	// in progress above which initiations must carry a cookie.
+	datagramCookieThreshold = datagramMaxHandshakes / 8
+
+	// datagramCookieLifetime is how often the secret for cookies changes. A
+	// cookie is valid until the secret has changed twice.
+	datagramCookieLifetime = 2 * time.Minute
+
+	// datagramQueueLen is the number of received messages that a
+	// DatagramSession holds for Receive before dropping new ones.
+	datagramQueueLen = 64
+
+	// datagramAcceptBacklog is the number of sessions that may wait for
+	// Accept before new ones are dropped.
+	datagramAcceptBacklog = 64
+)
+
+// DatagramMuxOverhead is the number of bytes that a DatagramMux adds to each
+// transport message, on top of DatagramOverhead.
+const DatagramMuxOverhead = datagramTransportHeaderLen
+
+// ErrDatagramClosed is returned by operations on a closed DatagramMux or
+// DatagramSession.
+var ErrDatagramClosed = errors.New("noise: datagram session closed")
+
+// A DatagramMux runs many Noise sessions over one packet socket, such as a
+// UDP socket, telling them apart with session IDs in the manner of WireGuard's
+// receiver indices. Each peer picks a random 32-bit ID for its end of a
+// session and sends it in its handshake messages, and every message carries
+// the ID chosen by its receiver, so that sessions are found without regard to
+// the address they come from. An authenticated transport message from a new
+// address moves the session to that address.
+//
+// The first byte of each message is its type. A handshake message carries the
+// sender's ID and then the receiver's ID, which is zero in the first message
+// of a handshake. A transport message carries the receiver's ID, followed by
+// the message of a DatagramCipher whose additional data is the five bytes of
+// the header. IDs are big-endian. Handshake messages carry no payload, and
+// the pattern must have at least two messages, so that the initiator learns
+// the responder's ID; HalfDuplex is not supported.
+//
+// A responder limits the handshakes in progress from each address and in all,
+// and once many handshakes are in progress it answers the first message of a
+// handshake with a cookie reply instead, in the manner of WireGuard. When the
+// responder writes the last handshake message, as in two-message patterns
+// such as NK and IK, the handshake counts as in progress until the first
+// transport message from the initiator shows that it got that message, and
+// only then is the session returned by Accept; sessions that are not
+// confirmed within ten seconds may be dropped to make room for new ones. The cookie reply
+// carries the sender's ID and a 16-byte MAC of its address under a secret
+// that changes every two minutes, and the initiator sends its first message
+// again with the cookie, as a message that carries the sender's ID and the
+// cookie in place of the receiver's ID. The responder thus only spends a DH
+// and holds state for peers that can receive at their address, and a cookie
+// reply is smaller than the message it answers. Before it is loaded, though,
+// a responder answers a first message from an unverified address with a
+// somewhat larger handshake message, after a DH: an attacker that can spoof
+// addresses can reflect a little traffic off it, and push it into the loaded
+// state, where every new session takes one more round trip.
+//
+// Handshake messages are not retransmitted. If one is lost, Dial fails once
+// its context is done, or, if the last message of the handshake is lost, the
+// responder never sees the session. On lossy networks the caller should dial
+// with a deadline, and confirm a new session with an exchange of its own.
+type DatagramMux struct {
+	pc     net.PacketConn
+	accept *Config
+
+	mu         sync.Mutex
+	handshakes map[uint32]*DatagramSession // nil for IDs reserved by Dial
+	sessions   map[uint32]*DatagramSession
+	err        error
+	closed     chan struct{}
+
+	// Handshakes started by peers that are in progress or not yet
+	// confirmed, in all and by address, and the number of them above which
+	// cookies are required.
+	pending         map[uint32]*DatagramSession
+	addrPending     map[string]int
+	cookieThreshold int
+
+	cookies datagramCookies // used only by the read loop
+
+	acceptCh chan *DatagramSession
+}
+
+// A DatagramSession is a Noise session of a DatagramMux. Send and Receive may
+// be called concurrently.
+type DatagramSession struct {
+	m         *DatagramMux
+	localID   uint32
+	initiator bool
+
+	// Used only by the read loop of the DatagramMux once the session is
+	// registered.
+	hs         *HandshakeState
+	started    time.Time
+	addrKey    string // the address of a peer that started the handshake
+	initiation []byte // the first message, until the peer has answered it
+	confirmed  bool   // whether a peer that started the session has shown it completed
+
+	ready chan struct{} // closed when the handshake completes
+
+	mu         sync.Mutex
+	remoteID   uint32
+	addr       net.Addr
+	peerStatic []byte
+	in, out    *DatagramCipher
+	err        error
+	done       chan struct{} // closed with err set when the session closes
+
+	queue chan []byte
+}
+
+// NewDatagramMux returns a DatagramMux over pc, which it reads from until it
+// is closed. If accept is not nil, the DatagramMux responds to handshakes
+// started by peers with accept, and the resulting sessions are returned by
+// Accept; otherwise it only makes sessions with Dial.
+func NewDatagramMux(pc net.PacketConn, accept *Config) *DatagramMux {
+	m := &DatagramMux{
+		pc:              pc,
+		accept:          accept,
+		handshakes:      make(map[uint32]*DatagramSession),
+		sessions:        make(map[uint32]*DatagramSession),
+		closed:          make(chan struct{}),
+		pending:         make(map[uint32]*DatagramSession),
+		addrPending:     make(map[string]int),
+		cookieThreshold: datagramCookieThreshold,
+		cookies:         datagramCookies{now: time.Now},
+		acceptCh:        make(chan *DatagramSession, datagramAcceptBacklog),
+	}
+	go m.readLoop()
+	return m
+}
+
+// LocalAddr returns the local address of the packet socket.
+func (m *DatagramMux) LocalAddr() net.Addr {
+	return m.pc.LocalAddr()
+}
+
+// Close closes the packet socket and every session.
+func (m *DatagramMux) Close() error {
+	m.shutdown(ErrDatagramClosed)
+	return nil
+}
+
+// Accept waits for and returns the next session started by a peer.
+func (m *DatagramMux) Accept() (*DatagramSession, error) {
+	select {
+	case s := <-m.acceptCh:
+		return s, nil
+	case <-m.closed:
+		return nil, m.closeErr()
+	}
+}
+
+// Dial runs a handshake as the initiator with the peer at addr and returns
+// the session once it is complete, or fails when ctx is done.
+func (m *DatagramMux) Dial(ctx context.Context, addr net.Addr, config Config) (*DatagramSession, error) {
+	config.Initiator = true
+	hs, err := newDatagramHandshake(config)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.reserveID()
+	if err != nil {
+		return nil, err
+	}
+	s := newDatagramSession(m, id, true, addr)
+	s.hs = hs
+	msg, _, _, err := hs.WriteMessage(s.handshakeHeader(), nil)
+	if err != nil {
+		m.remove(s)
+		return nil, err
+	}
+	s.initiation = msg
+	if err := m.register(s); err != nil {
+		return nil, err
+	}
+	if _, err := m.pc.WriteTo(msg, addr); err != nil {
+		s.close(err)
+		return nil, err
+	}
+	select {
+	case <-s.ready:
+		return s, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		s.close(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func newDatagramHandshake(config Config) (*HandshakeState, error) {
+	if config.HalfDuplex {
+		return nil, errors.New("noise: DatagramMux does not support HalfDuplex")
+	}
+	hs, err := NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(hs.messagePatterns) < 2 {
+		return nil, errors.New("noise: DatagramMux needs a pattern with at least two messages")
+	}
+	return hs, nil
+}
+
+func newDatagramSession(m *DatagramMux, id uint32, initiator bool, addr net.Addr) *DatagramSession {
+	return &DatagramSession{
+		m:         m,
+		localID:   id,
+		initiator: initiator,
+		started:   time.Now(),
+		ready:     make(chan struct{}),
+		addr:      addr,
+		done:      make(chan struct{}),
+		queue:     make(chan []byte, datagramQueueLen),
+	}
+}
+
+// reserveID picks an unused random ID and reserves it for a handshake.
+func (m *DatagramMux) reserveID() (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	if len(m.handshakes) >= datagramMaxHandshakes {
+		return 0, errors.New("noise: too many datagram handshakes in progress")
+	}
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id := binary.BigEndian.Uint32(b[:])
+		if _, ok := m.handshakes[id]; ok || id == 0 {
+			continue
+		}
+		if _, ok := m.sessions[id]; ok {
+			continue
+		}
+		m.handshakes[id] = nil
+		return id, nil
+	}
+}
+
+// register makes the handshake of s visible to the read loop.
+func (m *DatagramMux) register(s *DatagramSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.handshakes[s.localID] = s
+	if !s.initiator {
+		m.pending[s.localID] = s
+		m.addrPending[s.addrKey]++
+	}
+	return nil
+}
+
+// unpend stops counting s, a session started by a peer, against the limits
+// on handshakes in progress. m.mu must be held.
+func (m *DatagramMux) unpend(s *DatagramSession) {
+	if m.pending[s.localID] != s {
+		return
+	}
+	delete(m.pending, s.localID)
+	if m.addrPending[s.addrKey]--; m.addrPending[s.addrKey] == 0 {
+		delete(m.addrPending, s.addrKey)
+	}
+}
+
+// expire closes the handshakes and unconfirmed sessions started by peers that
+// are older than datagramHandshakeTimeout.
+func (m *DatagramMux) expire() {
+	var stale []*DatagramSession
+	m.mu.Lock()
+	for _, s := range m.pending {
+		if time.Since(s.started) > datagramHandshakeTimeout {
+			stale = append(stale, s)
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range stale {
+		s.close(errors.New("noise: datagram handshake timed out"))
+	}
+}
+
+func (m *DatagramMux) remove(s *DatagramSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handshakes[s.localID] == s || m.handshakes[s.localID] == nil {
+		delete(m.handshakes, s.localID)
+	}
+	if m.sessions[s.localID] == s {
+		delete(m.sessions, s.localID)
+	}
+	m.unpend(s)
+}
+
+func (m *DatagramMux) closeErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// shutdown closes the DatagramMux with err, if it is not already closed.
+func (m *DatagramMux) shutdown(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	close(m.closed)
+	var all []*DatagramSession
+	for _, s := range m.handshakes {
+		if s != nil {
+			all = append(all, s)
+		}
+	}
+	for _, s := range m.sessions {
+		all = append(all, s)
+	}
+	m.handshakes, m.sessions, m.pending = nil, nil, nil
+	m.mu.Unlock()
+	m.pc.Close()
+	for _, s := range all {
+		s.fail(err)
+	}
+}
+
+func (m *DatagramMux) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := m.pc.ReadFrom(buf)
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+		msg := buf[:n]
+		switch {
+		case n >= datagramHandshakeHeaderLen && msg[0] == datagramHandshake:
+			m.handleHandshake(msg, addr)
+		case n >= datagramTransportHeaderLen && msg[0] == datagramTransport:
+			m.handleTransport(msg, addr)
+		case n == datagramCookieReplyLen && msg[0] == datagramCookieReply:
+			m.handleCookieReply(msg, addr)
+		case n >= datagramCookieInitiationHeaderLen && msg[0] == datagramCookieInitiation:
+			if sender := binary.BigEndian.Uint32(msg[1:]); sender != 0 {
+				m.handleInitiation(sender, msg[datagramCookieInitiationHeaderLen:], msg[5:datagramCookieInitiationHeaderLen], addr)
+			}
+		}
+	}
+}
+
+// handleHandshake processes a handshake message. Messages that cannot be
+// processed are dropped; a message that fails to be read leaves no trace in
+// the HandshakeState, so forged messages cannot break a handshake.
+func (m *DatagramMux) handleHandshake(msg []byte, addr net.Addr) {
+	sender := binary.BigEndian.Uint32(msg[1:])
+	receiver := binary.BigEndian.Uint32(msg[5:])
+	body := msg[datagramHandshakeHeaderLen:]
+	if sender == 0 {
+		return
+	}
+	if receiver == 0 {
+		m.handleInitiation(sender, body, nil, addr)
+		return
+	}
+	m.mu.Lock()
+	s := m.handshakes[receiver]
+	m.mu.Unlock()
+	if s == nil || s.hs.shouldWrite {
+		return
+	}
+	s.mu.Lock()
+	remoteID := s.remoteID
+	s.mu.Unlock()
+	if remoteID != 0 && sender != remoteID {
+		return
+	}
+	_, cs1, cs2, err := s.hs.ReadMessage(nil, body)
+	if err != nil {
+		return
+	}
+	s.initiation = nil
+	s.mu.Lock()
+	s.remoteID, s.addr = sender, addr
+	s.mu.Unlock()
+	m.step(s, cs1, cs2)
+}
+
+// handleInitiation processes the first message of a handshake, with the
+// cookie it carries, if any. Before spending a DH on it, it checks the limits
+// on handshakes in progress and sessions and, when loaded, answers without a
+// valid cookie with a cookie reply. Stale handshakes are dropped first when a
+// limit is reached.
+func (m *DatagramMux) handleInitiation(sender uint32, body, cookie []byte, addr net.Addr) {
+	if m.accept == nil {
+		return
+	}
+	key := addrKey(addr)
+	loaded, full := m.limits(key)
+	if loaded || full {
+		m.expire()
+		loaded, full = m.limits(key)
+	}
+	if loaded && !m.cookies.valid(cookie, key, sender) {
+		reply := []byte{datagramCookieReply}
+		reply = binary.BigEndian.AppendUint32(reply, sender)
+		reply = append(reply, m.cookies.make(key, sender)...)
+		m.pc.WriteTo(reply, addr)
+		return
+	}
+	if full {
+		return
+	}
+	config := *m.accept
+	config.Initiator = false
+	hs, err := newDatagramHandshake(config)
+	if err != nil {
+		return
+	}
+	if _, _, _, err := hs.ReadMessage(nil, body); err != nil {
+		return
+	}
+	id, err := m.reserveID()
+	if err != nil {
+		return
+	}
+	s := newDatagramSession(m, id, false, addr)
+	s.hs, s.remoteID, s.addrKey = hs, sender, key
+	if err := m.register(s); err != nil {
+		return
+	}
+	m.step(s, nil, nil)
+}
+
+// limits reports whether enough handshakes started by peers are in progress
+// that cookies are required, and whether no more may be started by peers at
+// the address with key.
+func (m *DatagramMux) limits(key string) (loaded, full bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	loaded = len(m.pending) >= m.cookieThreshold
+	full = m.addrPending[key] >= datagramMaxHandshakesPerAddr ||
+		len(m.pending) >= datagramMaxHandshakes ||
+		len(m.sessions) >= datagramMaxSessions
+	return loaded, full
+}
+
+// step writes the next handshake message of s if it is its turn, and
+// completes the session once the handshake is done. A session started by a
+// peer is confirmed at once if the peer wrote the last message, and otherwise
+// by its first transport message.
+func (m *DatagramMux) step(s *DatagramSession, cs1, cs2 *CipherState) {
+	s.confirmed = cs1 != nil
+	if cs1 == nil && s.hs.shouldWrite {
+		var msg []byte
+		var err error
+		msg, cs1, cs2, err = s.hs.WriteMessage(s.handshakeHeader(), nil)
+		if err != nil {
+			s.close(err)
+			return
+		}
+		s.mu.Lock()
+		addr := s.addr
+		s.mu.Unlock()
+		if _, err := m.pc.WriteTo(msg, addr); err != nil {
+			s.close(err)
+			return
+		}
+	}
+	if cs1 == nil {
+		return
+	}
+	if !s.initiator {
+		cs1, cs2 = cs2, cs1
+	}
+	s.mu.Lock()
+	s.out, s.in = NewDatagramCipher(cs1), NewDatagramCipher(cs2)
+	s.peerStatic = s.hs.PeerStatic()
+	s.mu.Unlock()
+	s.hs = nil
+
+	m.mu.Lock()
+	if m.handshakes[s.localID] != s {
+		// Closed in the meantime.
+		m.mu.Unlock()
+		return
+	}
+	delete(m.handshakes, s.localID)
+	m.sessions[s.localID] = s
+	m.mu.Unlock()
+	close(s.ready)
+	if !s.initiator && s.confirmed {
+		m.confirm(s)
+	}
+}
+
+// confirm stops counting s, a session started by a peer, as a handshake in
+// progress, and passes it to Accept.
+func (m *DatagramMux) confirm(s *DatagramSession) {
+	s.confirmed = true
+	m.mu.Lock()
+	m.unpend(s)
+	m.mu.Unlock()
+	select {
+	case m.acceptCh <- s:
+	default:
+		s.close(errors.New("noise: DatagramMux accept backlog is full"))
+	}
+}
+
+// handleCookieReply sends the first message of a handshake again with the
+// cookie from a responder.
+func (m *DatagramMux) handleCookieReply(msg []byte, addr net.Addr) {
+	m.mu.Lock()
+	s := m.handshakes[binary.BigEndian.Uint32(msg[1:])]
+	m.mu.Unlock()
+	if s == nil || s.initiation == nil {
+		return
+	}
+	s.mu.Lock()
+	same := s.addr.String() == addr.String()
+	s.mu.Unlock()
+	if !same {
+		return
+	}
+	b := append([]byte{datagramCookieInitiation}, s.initiation[1:5]...)
+	b = append(b, msg[5:]...)
+	b = append(b, s.initiation[datagramHandshakeHeaderLen:]...)
+	m.pc.WriteTo(b, addr)
+}
+
+func (m *DatagramMux) handleTransport(msg []byte, addr net.Addr) {
+	m.mu.Lock()
+	s := m.sessions[binary.BigEndian.Uint32(msg[1:])]
+	m.mu.Unlock()
+	if s == nil {
+		return
+	}
+	plaintext, err := s.in.Decrypt(nil, msg[:datagramTransportHeaderLen], msg[datagramTransportHeaderLen:])
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.addr = addr
+	s.mu.Unlock()
+	select {
+	case s.queue <- plaintext:
+	default:
+	}
+	if !s.initiator && !s.confirmed {
+		m.confirm(s)
+	}
+}
+
+// handshakeHeader returns the header of a handshake message from s.
+func (s *DatagramSession) handshakeHeader() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := []byte{datagramHandshake}
+	b = binary.BigEndian.AppendUint32(b, s.localID)
+	return binary.BigEndian.AppendUint32(b, s.remoteID)
+}
+
+// Send encrypts payload into a transport message and sends it to the peer.
+func (s *DatagramSession) Send(payload []byte) error {
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+	s.mu.Lock()
+	addr := s.addr
+	var hdr [datagramTransportHeaderLen]byte
+	hdr[0] = datagramTransport
+	binary.BigEndian.PutUint32(hdr[1:], s.remoteID)
+	s.mu.Unlock()
+	msg := make([]byte, 0, len(hdr)+DatagramOverhead+len(payload))
+	msg, err := s.out.Encrypt(append(msg, hdr[:]...), hdr[:], payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.m.pc.WriteTo(msg, addr)
+	return err
+}
+
+// Receive waits for a transport message from the peer and appends its payload
+// to out. Messages may arrive out of order, and are dropped if the caller
+// falls behind; replayed messages are dropped.
+func (s *DatagramSession) Receive(ctx context.Context, out []byte) ([]byte, error) {
+	select {
+	case p := <-s.queue:
+		return append(out, p...), nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RemoteAddr returns the address that the peer last sent from.
+func (s *DatagramSession) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// PeerStatic returns the peer's static public key, or nil if it has none.
+func (s *DatagramSession) PeerStatic() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerStatic
+}
+
+// Close closes the session. The peer is not told, and drops the session only
+// when its own side is closed.
+func (s *DatagramSession) Close() error {
+	s.close(ErrDatagramClosed)
+	return nil
+}
+
+// close removes s from its DatagramMux and closes it with err.
+func (s *DatagramSession) close(err error) {
+	s.m.remove(s)
+	s.fail(err)
+}
+
+// fail closes s with err, if it is not already closed.
+func (s *DatagramSession) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+}
+
+func (s *DatagramSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// addrKey returns the key under which handshakes from addr are limited and
+// cookies are made: the IP address of a UDP address, so that a peer cannot
+// get around the limit by changing ports.
+func addrKey(addr net.Addr) string {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	return addr.String()
+}
+
+// datagramCookies makes and checks the cookies of a DatagramMux.
+type datagramCookies struct {
+	now          func() time.Time
+	secret, prev [32]byte
+	hasPrev      bool
+	rotated      time.Time
+}
+
+// rotate changes the secret once it is older than datagramCookieLifetime.
+func (c *datagramCookies) rotate() {
+	now := c.now()
+	if !c.rotated.IsZero() && now.Sub(c.rotated) < datagramCookieLifetime {
+		return
+	}
+	c.prev, c.hasPrev = c.secret, !c.rotated.IsZero() && now.Sub(c.rotated) < 2*datagramCookieLifetime
+	rand.Read(c.secret[:])
+	c.rotated = now
+}
+
+func (c *datagramCookies) mac(secret *[32]byte, key string, sender uint32) []byte {
+	h := hmac.New(sha256.New, secret[:])
+	h.Write([]byte(key))
+	binary.Write(h, binary.BigEndian, sender)
+	return h.Sum(nil)[:datagramCookieLen]
+}
+
+// make returns a cookie for the peer with ID sender at the address with key.
+func (c *datagramCookies) make(key string, sender uint32) []byte {
+	c.rotate()
+	return c.mac(&c.secret, key, sender)
+}
+
+// valid reports whether cookie was made for the peer with ID sender at the
+// address with key, under the current or the previous secret.
+func (c *datagramCookies) valid(cookie []byte, key string, sender uint32) bool {
+	if cookie == nil {
+		return false
+	}
+	c.rotate()
+	return hmac.Equal(cookie, c.mac(&c.secret, key, sender)) ||
+		c.hasPrev && hmac.Equal(cookie, c.mac(&c.prev, key, sender))
+}
@@ -0,0 +1,356 @@
+package noise
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// recordingPacketConn records the messages written to a net.PacketConn.
+type recordingPacketConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (c *recordingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.written = append(c.written, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenUDP(c *C) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	return pc
+}
+
+func (NoiseSuite) TestDatagramMux(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	server := NewDatagramMux(listenUDP(c), &Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	defer server.Close()
+
+	// The server echoes on every session.
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					msg, err := s.Receive(context.Background(), nil)
+					if err != nil {
+						return
+					}
+					s.Send(msg)
+				}
+			}()
+		}
+	}()
+
+	// Many sessions from two sockets, one of which has several.
+	clientA := NewDatagramMux(listenUDP(c), nil)
+	defer clientA.Close()
+	clientB := NewDatagramMux(listenUDP(c), nil)
+	defer clientB.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		client := clientA
+		if i%4 == 0 {
+			client = clientB
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			staticI, _ := cs.GenerateKeypair(nil)
+			s, err := client.Dial(ctx, server.LocalAddr(), Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticI})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(s.PeerStatic()) != string(staticR.Public) {
+				errs <- fmt.Errorf("session %d: wrong peer static key", i)
+				return
+			}
+			for j := 0; j < 3; j++ {
+				want := fmt.Sprintf("session %d message %d", i, j)
+				if err := s.Send([]byte(want)); err != nil {
+					errs <- err
+					return
+				}
+				res, err := s.Receive(ctx, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(res) != want {
+					errs <- fmt.Errorf("got %q, want %q", res, want)
+					return
+				}
+			}
+			s.Close()
+			if err := s.Send(nil); err != ErrDatagramClosed {
+				errs <- fmt.Errorf("Send after Close: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+}
+
+func (NoiseSuite) TestDatagramMuxReplay(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	server := NewDatagramMux(listenUDP(c), &Config{CipherSuite: cs, Pattern: HandshakeNN})
+	defer server.Close()
+	pc := &recordingPacketConn{PacketConn: listenUDP(c)}
+	client := NewDatagramMux(pc, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := client.Dial(ctx, server.LocalAddr(), Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(err, IsNil)
+
+	// The server gets the session once the client's first message arrives.
+	c.Assert(s.Send([]byte("once")), IsNil)
+	ss, err := server.Accept()
+	c.Assert(err, IsNil)
+	c.Assert(ss.RemoteAddr().String(), Equals, client.LocalAddr().String())
+	res, err := ss.Receive(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "once")
+
+	// A replayed message, or a forged one, from another address is
+	// dropped, and does not move the session.
+	pc.mu.Lock()
+	replay := pc.written[len(pc.written)-1]
+	pc.mu.Unlock()
+	forged := append([]byte(nil), replay...)
+	forged[len(forged)-1] ^= 1
+	other := listenUDP(c)
+	defer other.Close()
+	for _, msg := range [][]byte{replay, forged, replay[:3]} {
+		_, err = other.WriteTo(msg, server.LocalAddr())
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.Send([]byte("twice")), IsNil)
+	res, err = ss.Receive(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "twice")
+	c.Assert(ss.RemoteAddr().String(), Equals, client.LocalAddr().String())
+
+	// Closing the DatagramMux closes its sessions.
+	server.Close()
+	_, err = ss.Receive(ctx, nil)
+	c.Assert(err, Equals, ErrDatagramClosed)
+	_, err = server.Accept()
+	c.Assert(err, Equals, ErrDatagramClosed)
+}
+
+func (NoiseSuite) TestDatagramMuxErrors(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	client := NewDatagramMux(listenUDP(c), nil)
+	defer client.Close()
+
+	// One-way patterns leave the initiator without the responder's ID.
+	_, err := client.Dial(context.Background(), client.LocalAddr(), Config{CipherSuite: cs, Pattern: HandshakeN, PeerStatic: staticR.Public})
+	c.Assert(err, ErrorMatches, ".*at least two messages")
+
+	// A peer that does not accept handshakes never answers.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	peer := NewDatagramMux(listenUDP(c), nil)
+	defer peer.Close()
+	_, err = client.Dial(ctx, peer.LocalAddr(), Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	client.mu.Lock()
+	c.Assert(client.handshakes, HasLen, 0)
+	client.mu.Unlock()
+}
+
+// datagramInitiation returns the first message of an NN handshake from the
+// peer with ID sender.
+func datagramInitiation(cs CipherSuite, sender uint32) []byte {
+	hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	msg := []byte{datagramHandshake}
+	msg = binary.BigEndian.AppendUint32(msg, sender)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg, _, _, _ = hs.WriteMessage(msg, nil)
+	return msg
+}
+
+func (NoiseSuite) TestDatagramMuxCookies(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	server := NewDatagramMux(listenUDP(c), &Config{CipherSuite: cs, Pattern: HandshakeNN})
+	defer server.Close()
+	server.mu.Lock()
+	server.cookieThreshold = 0
+	server.mu.Unlock()
+
+	// A first message without a cookie gets only a small cookie reply, and
+	// takes no handshake slot.
+	raw := listenUDP(c)
+	defer raw.Close()
+	msg := datagramInitiation(cs, 7)
+	_, err := raw.WriteTo(msg, server.LocalAddr())
+	c.Assert(err, IsNil)
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _, err := raw.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, datagramCookieReplyLen)
+	c.Assert(n < len(msg), Equals, true)
+	c.Assert(buf[0], Equals, datagramCookieReply)
+	c.Assert(binary.BigEndian.Uint32(buf[1:]), Equals, uint32(7))
+	server.mu.Lock()
+	c.Assert(server.handshakes, HasLen, 0)
+	server.mu.Unlock()
+
+	// A wrong cookie gets another cookie reply.
+	forged := append([]byte{datagramCookieInitiation}, msg[1:5]...)
+	forged = append(forged, make([]byte, datagramCookieLen)...)
+	forged = append(forged, msg[datagramHandshakeHeaderLen:]...)
+	raw.WriteTo(forged, server.LocalAddr())
+	n, _, err = raw.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf[0], Equals, datagramCookieReply)
+
+	// Dial goes through the cookie round trip.
+	client := NewDatagramMux(listenUDP(c), nil)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := client.Dial(ctx, server.LocalAddr(), Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(err, IsNil)
+	c.Assert(s.Send([]byte("cookie")), IsNil)
+	ss, err := server.Accept()
+	c.Assert(err, IsNil)
+	res, err := ss.Receive(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "cookie")
+}
+
+func (NoiseSuite) TestDatagramMuxAddrLimit(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	server := NewDatagramMux(listenUDP(c), &Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	defer server.Close()
+	raw := listenUDP(c)
+	defer raw.Close()
+	for i := 0; i < 2*datagramMaxHandshakesPerAddr; i++ {
+		hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true})
+		msg := []byte{datagramHandshake}
+		msg = binary.BigEndian.AppendUint32(msg, uint32(i+1))
+		msg = binary.BigEndian.AppendUint32(msg, 0)
+		msg, _, _, _ = hs.WriteMessage(msg, nil)
+		raw.WriteTo(msg, server.LocalAddr())
+	}
+	// The answers to the first messages show they have been processed.
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1000)
+	for i := 0; i < datagramMaxHandshakesPerAddr; i++ {
+		_, _, err := raw.ReadFrom(buf)
+		c.Assert(err, IsNil)
+	}
+	raw.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := raw.ReadFrom(buf)
+	c.Assert(err, NotNil)
+	server.mu.Lock()
+	c.Assert(server.handshakes, HasLen, datagramMaxHandshakesPerAddr)
+	server.mu.Unlock()
+}
+
+func (NoiseSuite) TestDatagramMuxFlood(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	staticI, _ := cs.GenerateKeypair(nil)
+	for _, pattern := range []HandshakePattern{HandshakeNK, HandshakeIK} {
+		server := NewDatagramMux(listenUDP(c), &Config{CipherSuite: cs, Pattern: pattern, StaticKeypair: staticR})
+		defer server.Close()
+		server.mu.Lock()
+		server.cookieThreshold = datagramMaxHandshakesPerAddr
+		server.mu.Unlock()
+
+		// Sessions that the responder completes by writing the last
+		// message stay counted against the limits until the initiator
+		// confirms them, so a flood from one address gets answers to the
+		// first few messages and cookie replies after that.
+		raw := listenUDP(c)
+		defer raw.Close()
+		for i := 0; i < 2*datagramMaxHandshakesPerAddr; i++ {
+			hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: pattern, Initiator: true, StaticKeypair: staticI, PeerStatic: staticR.Public})
+			msg := []byte{datagramHandshake}
+			msg = binary.BigEndian.AppendUint32(msg, uint32(i+1))
+			msg = binary.BigEndian.AppendUint32(msg, 0)
+			msg, _, _, _ = hs.WriteMessage(msg, nil)
+			raw.WriteTo(msg, server.LocalAddr())
+		}
+		raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1000)
+		var replies, cookies int
+		for replies+cookies < 2*datagramMaxHandshakesPerAddr {
+			_, _, err := raw.ReadFrom(buf)
+			c.Assert(err, IsNil)
+			if buf[0] == datagramCookieReply {
+				cookies++
+			} else {
+				replies++
+			}
+		}
+		c.Assert(replies, Equals, datagramMaxHandshakesPerAddr)
+		c.Assert(cookies, Equals, datagramMaxHandshakesPerAddr)
+		server.mu.Lock()
+		c.Assert(server.pending, HasLen, datagramMaxHandshakesPerAddr)
+		c.Assert(server.sessions, HasLen, datagramMaxHandshakesPerAddr)
+		server.mu.Unlock()
+		select {
+		case <-server.acceptCh:
+			c.Fatal("unconfirmed session accepted")
+		default:
+		}
+
+		// Stale unconfirmed sessions are dropped to make room.
+		server.mu.Lock()
+		for _, s := range server.pending {
+			s.started = s.started.Add(-2 * datagramHandshakeTimeout)
+		}
+		server.cookieThreshold = datagramCookieThreshold
+		server.mu.Unlock()
+		client := NewDatagramMux(listenUDP(c), nil)
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s, err := client.Dial(ctx, server.LocalAddr(), Config{CipherSuite: cs, Pattern: pattern, StaticKeypair: staticI, PeerStatic: staticR.Public})
+		c.Assert(err, IsNil)
+		server.mu.Lock()
+		c.Assert(server.pending, HasLen, 1)
+		c.Assert(server.sessions, HasLen, 1)
+		server.mu.Unlock()
+
+		// A transport message confirms the session.
+		c.Assert(s.Send([]byte("confirm")), IsNil)
+		ss, err := server.Accept()
+		c.Assert(err, IsNil)
+		res, err := ss.Receive(ctx, nil)
+		c.Assert(err, IsNil)
+		c.Assert(string(res), Equals, "confirm")
+		server.mu.Lock()
+		c.Assert(server.pending, HasLen, 0)
+		server.mu.Unlock()
+	}
+}
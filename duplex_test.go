@@ -0,0 +1,44 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestHalfDuplex(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, HalfDuplex: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, HalfDuplex: true})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, csR, csR2, _ := hsR.WriteMessage(nil, nil)
+	_, csI, csI2, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(csR2, IsNil)
+	c.Assert(csI2, IsNil)
+
+	// Each side takes its turn with the same CipherState.
+	ct := csI.Encrypt(nil, nil, []byte("ping"))
+	res, err := csR.Decrypt(nil, nil, ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "ping")
+	ct = csR.Encrypt(nil, nil, []byte("pong"))
+	res, err = csI.Decrypt(nil, nil, ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "pong")
+}
+
+func (NoiseSuite) TestOneWayDirection(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rs, _ := cs.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeN, Initiator: true, PeerStatic: rs.Public})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeN, StaticKeypair: rs})
+	msg, csI, _, _ := hsI.WriteMessage(nil, nil)
+	_, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	ct := csI.Encrypt(nil, nil, []byte("hello"))
+	_, err = csR.Decrypt(nil, nil, ct)
+	c.Assert(err, IsNil)
+	_, err = csI.Decrypt(nil, nil, ct)
+	c.Assert(err, ErrorMatches, ".*send-only")
+	c.Assert(func() { csR.Encrypt(nil, nil, nil) }, PanicMatches, ".*receive-only")
+}
@@ -0,0 +1,60 @@
+package noise
+
+import "errors"
+
+// payloadEncrypted reports whether the payload of the current message will be
+// encrypted.
+func (s *HandshakeState) payloadEncrypted() bool {
+	hasK := s.ss.hasK
+	for _, t := range s.messagePatterns[s.msgIdx] {
+		switch t {
+		case MessagePatternE:
+			hasK = hasK || len(s.psks) > 0
+		case MessagePatternS, MessagePatternF, MessagePatternE1, MessagePatternSig:
+		default:
+			hasK = true
+		}
+	}
+	return hasK
+}
+
+// WriteEarlyData writes the first handshake message with payload as early
+// (0-RTT) data, as WriteMessage does. It fails unless this peer is the
+// initiator and the pattern encrypts the first payload, as NK, IK and N do, so
+// that application data is never sent in the clear by mistake.
+//
+// Early data is encrypted to the responder's static key but is not protected
+// against replay; the responder must use ReadEarlyData with a ReplayGuard.
+func (s *HandshakeState) WriteEarlyData(out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	if !s.initiator || s.msgIdx != 0 {
+		return nil, nil, nil, errors.New("noise: early data can only be sent in the initiator's first message")
+	}
+	if !s.payloadEncrypted() {
+		return nil, nil, nil, errors.New("noise: pattern does not encrypt the first payload")
+	}
+	return s.WriteMessage(out, payload)
+}
+
+// ReadEarlyData reads the first handshake message, as ReadMessage does, and
+// accepts its payload as early data only if Config.ReplayGuard accepts the
+// message. If the guard rejects it, a HandshakeError with the reason
+// FailureReplay is returned and the HandshakeState must be discarded.
+func (s *HandshakeState) ReadEarlyData(out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	if s.initiator || s.msgIdx != 0 {
+		return nil, nil, nil, errors.New("noise: early data can only be read from the initiator's first message")
+	}
+	if s.replayGuard == nil {
+		return nil, nil, nil, errors.New("noise: early data requires a ReplayGuard")
+	}
+	if !s.payloadEncrypted() {
+		return nil, nil, nil, errors.New("noise: pattern does not encrypt the first payload")
+	}
+	payload, cs1, cs2, err := s.ReadMessage(out, message)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.replayGuard(append([]byte(nil), s.ss.h...)); err != nil {
+		return nil, nil, nil, &HandshakeError{FailureReplay, err}
+	}
+	return payload, cs1, cs2, nil
+}
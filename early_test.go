@@ -0,0 +1,48 @@
+package noise
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestEarlyData(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rs, _ := cs.GenerateKeypair(nil)
+	seen := make(map[string]bool)
+	guard := func(id []byte) error {
+		if seen[string(id)] {
+			return errors.New("seen")
+		}
+		seen[string(id)] = true
+		return nil
+	}
+
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: rs.Public})
+	msg, _, _, err := hsI.WriteEarlyData(nil, []byte("early"))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, StaticKeypair: rs, ReplayGuard: guard})
+		res, _, _, err := hsR.ReadEarlyData(nil, msg)
+		if i == 0 {
+			c.Assert(err, IsNil)
+			c.Assert(string(res), Equals, "early")
+			continue
+		}
+		c.Assert(res, IsNil)
+		var herr *HandshakeError
+		c.Assert(errors.As(err, &herr), Equals, true)
+		c.Assert(herr.Reason, Equals, FailureReplay)
+	}
+
+	// Without a guard, early data is refused.
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, StaticKeypair: rs})
+	_, _, _, err = hsR.ReadEarlyData(nil, msg)
+	c.Assert(err, NotNil)
+
+	// NN cannot encrypt its first payload.
+	hsI, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	_, _, _, err = hsI.WriteEarlyData(nil, []byte("early"))
+	c.Assert(err, ErrorMatches, ".*does not encrypt.*")
+}
@@ -0,0 +1,55 @@
+package noise
+
+import (
+	"container/list"
+	"sync"
+)
+
+// An EphemeralTracker remembers recently received remote ephemeral public keys
+// and reports any that are received again. Honest peers never reuse an
+// ephemeral, so a repeat indicates a peer with a broken random number
+// generator or a replayed handshake message. An EphemeralTracker may be shared
+// by many handshakes and is safe for concurrent use.
+type EphemeralTracker struct {
+	mu          sync.Mutex
+	size        int
+	lru         *list.List
+	seen        map[string]*list.Element
+	onDuplicate func(re []byte)
+}
+
+// NewEphemeralTracker returns an EphemeralTracker that remembers the last size
+// ephemerals and calls onDuplicate with any that is received again.
+// onDuplicate is only informed; the handshake continues.
+func NewEphemeralTracker(size int, onDuplicate func(re []byte)) *EphemeralTracker {
+	return &EphemeralTracker{
+		size:        size,
+		lru:         list.New(),
+		seen:        make(map[string]*list.Element),
+		onDuplicate: onDuplicate,
+	}
+}
+
+// Observe records re and reports whether it had already been recorded. It is
+// called by HandshakeState for every ephemeral it reads when the tracker is set
+// in Config.EphemeralTracker.
+func (t *EphemeralTracker) Observe(re []byte) bool {
+	t.mu.Lock()
+	key := string(re)
+	if elem, ok := t.seen[key]; ok {
+		t.lru.MoveToFront(elem)
+		t.mu.Unlock()
+		if t.onDuplicate != nil {
+			t.onDuplicate(append([]byte(nil), re...))
+		}
+		return true
+	}
+	t.seen[key] = t.lru.PushFront(key)
+	if t.lru.Len() > t.size {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.seen, oldest.Value.(string))
+	}
+	t.mu.Unlock()
+	return false
+}
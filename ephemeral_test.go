@@ -0,0 +1,37 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestEphemeralTracker(c *C) {
+	var dups [][]byte
+	t := NewEphemeralTracker(2, func(re []byte) { dups = append(dups, re) })
+	c.Assert(t.Observe([]byte("a")), Equals, false)
+	c.Assert(t.Observe([]byte("b")), Equals, false)
+	c.Assert(t.Observe([]byte("a")), Equals, true)
+	c.Assert(t.Observe([]byte("c")), Equals, false) // evicts b
+	c.Assert(t.Observe([]byte("b")), Equals, false)
+	c.Assert(dups, DeepEquals, [][]byte{[]byte("a")})
+
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	e, _ := cs.GenerateKeypair(nil)
+	dups = nil
+	t = NewEphemeralTracker(16, func(re []byte) { dups = append(dups, re) })
+	for i := 0; i < 2; i++ {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:                  cs,
+			Pattern:                      HandshakeNN,
+			Initiator:                    true,
+			InjectedEphemeral:            e,
+			UnsafeAllowInjectedEphemeral: true,
+		})
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite:      cs,
+			Pattern:          HandshakeNN,
+			EphemeralTracker: t,
+		})
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+		_, _, _, err := hsR.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(dups, DeepEquals, [][]byte{e.Public})
+}
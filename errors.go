@@ -0,0 +1,97 @@
+package noise
+
+// A FailureReason classifies why a handshake message could not be processed.
+type FailureReason int
+
+const (
+	// FailureShortMessage indicates that a handshake message was truncated.
+	FailureShortMessage FailureReason = iota + 1
+
+	// FailureStaticMAC indicates that an encrypted public key in a handshake
+	// message failed authentication. This is typically caused by the peers
+	// disagreeing on key material, for example a stale PeerStatic.
+	FailureStaticMAC
+
+	// FailurePayloadMAC indicates that the encrypted payload of a handshake
+	// message failed authentication.
+	FailurePayloadMAC
+
+	// FailureWrongPhase indicates that WriteMessage or ReadMessage was called
+	// out of sync with the handshake pattern.
+	FailureWrongPhase
+
+	// FailureDH indicates that a Diffie-Hellman calculation failed.
+	FailureDH
+
+	// FailureSignature indicates that a handshake payload signature was
+	// missing or rejected by the PayloadVerifier.
+	FailureSignature
+
+	// FailureKEM indicates that a KEM ciphertext could not be decapsulated.
+	FailureKEM
+
+	// FailureReplay indicates that early data was rejected by the
+	// ReplayGuard.
+	FailureReplay
+
+	// FailureIdentityChanged indicates that the peer sent a static key that
+	// differs from Config.PreviousPeerStatic.
+	FailureIdentityChanged
+
+	// FailureRateLimited indicates that the peer's static key was over its
+	// limit in Config.PeerLimiter.
+	FailureRateLimited
+
+	// FailureNonContributory indicates that a DH output was all zeros, because
+	// the peer sent a low-order or invalid public key, and
+	// Config.RejectZeroDH is set.
+	FailureNonContributory
+)
+
+func (r FailureReason) String() string {
+	switch r {
+	case FailureShortMessage:
+		return "message is too short"
+	case FailureStaticMAC:
+		return "public key authentication failed"
+	case FailurePayloadMAC:
+		return "payload authentication failed"
+	case FailureWrongPhase:
+		return "handshake message out of sequence"
+	case FailureDH:
+		return "Diffie-Hellman failed"
+	case FailureSignature:
+		return "payload signature verification failed"
+	case FailureKEM:
+		return "KEM decapsulation failed"
+	case FailureReplay:
+		return "early data was replayed"
+	case FailureIdentityChanged:
+		return "peer static key changed"
+	case FailureRateLimited:
+		return "peer is rate limited"
+	case FailureNonContributory:
+		return "DH output is all zeros"
+	}
+	return "unknown failure"
+}
+
+// A HandshakeError is returned by WriteMessage and ReadMessage when a handshake
+// message could not be processed. The Reason can be used to distinguish key
+// mismatches from corruption of messages in transit.
+type HandshakeError struct {
+	Reason FailureReason
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Err == nil {
+		return "noise: " + e.Reason.String()
+	}
+	return "noise: " + e.Reason.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error { return e.Err }
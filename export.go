@@ -0,0 +1,61 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/flynn/noise/subtle"
+)
+
+// An ExportedKey holds the transport key material of a CipherState so that
+// bulk encryption can be performed outside of this package, for example by
+// kernel crypto offload or a userspace packet datapath.
+type ExportedKey struct {
+	// Cipher is the name of the cipher, as returned by CipherName.
+	Cipher string
+
+	// Key is the cipher key.
+	Key [32]byte
+
+	// Nonce is the nonce that will be used for the next message.
+	Nonce uint64
+
+	// NonceOrder is the byte order used to encode a nonce into the final eight
+	// bytes of the cipher's 96-bit nonce, after four zero bytes. It is nil if
+	// the nonce layout of the cipher is not known to this package.
+	NonceOrder binary.ByteOrder
+}
+
+// NonceBytes returns the 96-bit nonce used for message n.
+func (k *ExportedKey) NonceBytes(n uint64) ([12]byte, error) {
+	var nonce [12]byte
+	if k.NonceOrder == nil {
+		return nonce, errors.New("noise: unknown nonce layout for cipher " + k.Cipher)
+	}
+	k.NonceOrder.PutUint64(nonce[4:], n)
+	return nonce, nil
+}
+
+// Export returns the key and nonce of the CipherState and destroys it. After
+// calling this method, it is an error to call any other method on the
+// CipherState; the exported key must not be used by more than one datapath.
+func (s *CipherState) Export() (*ExportedKey, error) {
+	if s.invalid {
+		return nil, errors.New("noise: CipherState is invalid")
+	}
+	k := &ExportedKey{
+		Cipher: s.cs.CipherName(),
+		Key:    s.k,
+		Nonce:  s.n,
+	}
+	switch k.Cipher {
+	case "ChaChaPoly":
+		k.NonceOrder = binary.LittleEndian
+	case "AESGCM", "AESGCMSIV":
+		k.NonceOrder = binary.BigEndian
+	}
+	subtle.Zero(s.k[:])
+	s.c = nil
+	s.invalid = true
+	return k, nil
+}
@@ -0,0 +1,89 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FragmentHeaderLen is the size in bytes of the length prefix carried by the
+// first fragment of a payload split with FragmentPayload.
+const FragmentHeaderLen = 4
+
+// FragmentPayload splits payload, such as a certificate chain too large for a
+// single handshake message, across the handshake messages that remain to be
+// written by this peer. Each returned fragment is the payload for one call to
+// WriteMessage, in order; the first is prefixed with the total length of
+// payload. Fragments fill each message up to MaxMsgLen, so fewer fragments
+// than remaining messages may be returned. Every fragment is mixed into the
+// handshake hash, so the reassembled payload is bound to the final handshake
+// hash like any other handshake payload. Room for payload signatures is not
+// reserved.
+func (s *HandshakeState) FragmentPayload(payload []byte) ([][]byte, error) {
+	if !s.shouldWrite {
+		return nil, errors.New("noise: FragmentPayload must be called before this peer's next WriteMessage")
+	}
+	if uint64(len(payload)) > 0xffffffff {
+		return nil, errors.New("noise: payload is too long to fragment")
+	}
+	header := make([]byte, FragmentHeaderLen)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	rest := append(header, payload...)
+
+	var fragments [][]byte
+	for i, overhead := range s.overheads() {
+		if i%2 != 0 {
+			continue
+		}
+		n := s.maxMsgLen - overhead
+		if n <= 0 {
+			continue
+		}
+		if n > len(rest) {
+			n = len(rest)
+		}
+		fragments = append(fragments, rest[:n])
+		if rest = rest[n:]; len(rest) == 0 {
+			return fragments, nil
+		}
+	}
+	return nil, errors.New("noise: payload does not fit in the remaining handshake messages")
+}
+
+// A PayloadReassembler reassembles a payload split with FragmentPayload from
+// the payloads of successive handshake messages. The zero value is ready for
+// use.
+type PayloadReassembler struct {
+	buf  []byte
+	size int
+}
+
+// Add appends the payload of the next handshake message read from the peer
+// and reports whether the payload is complete.
+func (r *PayloadReassembler) Add(fragment []byte) (bool, error) {
+	if r.buf != nil && len(r.buf) == r.size {
+		return false, errors.New("noise: payload is already complete")
+	}
+	if r.buf == nil {
+		if len(fragment) < FragmentHeaderLen {
+			return false, errors.New("noise: fragment is missing its length")
+		}
+		r.size = int(binary.BigEndian.Uint32(fragment))
+		fragment = fragment[FragmentHeaderLen:]
+		r.buf = make([]byte, 0, len(fragment))
+	}
+	if len(r.buf)+len(fragment) > r.size {
+		return false, errors.New("noise: fragment exceeds the payload length")
+	}
+	r.buf = append(r.buf, fragment...)
+	return len(r.buf) == r.size, nil
+}
+
+// Payload returns the reassembled payload, or nil if it is not yet complete.
+// Until the handshake is complete, the peer that sent it may not yet be
+// authenticated.
+func (r *PayloadReassembler) Payload() []byte {
+	if r.buf == nil || len(r.buf) != r.size {
+		return nil
+	}
+	return r.buf
+}
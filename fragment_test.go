@@ -0,0 +1,64 @@
+package noise
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestFragmentPayload(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeXX,
+		Initiator:     true,
+		StaticKeypair: staticI,
+		MaxMsgLen:     200,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeXX,
+		StaticKeypair: staticR,
+		MaxMsgLen:     200,
+	})
+
+	// The initiator writes the first and third messages, with room for
+	// 200-32 and 200-64 bytes including the length prefix.
+	_, err := hsI.FragmentPayload(make([]byte, 301))
+	c.Assert(err, ErrorMatches, "noise: payload does not fit in the remaining handshake messages")
+	chain := bytes.Repeat([]byte("certificate"), 25)
+	fragments, err := hsI.FragmentPayload(chain)
+	c.Assert(err, IsNil)
+	c.Assert(fragments, HasLen, 2)
+	c.Assert(fragments[0], HasLen, 168)
+
+	var r PayloadReassembler
+	msg, _, _, _ := hsI.WriteMessage(nil, fragments[0])
+	c.Assert(msg, HasLen, 200)
+	res, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	done, err := r.Add(res)
+	c.Assert(err, IsNil)
+	c.Assert(done, Equals, false)
+	c.Assert(r.Payload(), IsNil)
+
+	_, err = hsR.FragmentPayload(nil)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	msg, _, _, _ = hsI.WriteMessage(nil, fragments[1])
+	res, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	done, err = r.Add(res)
+	c.Assert(err, IsNil)
+	c.Assert(done, Equals, true)
+	c.Assert(r.Payload(), DeepEquals, chain)
+
+	_, err = r.Add([]byte("more"))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,87 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxFrameLen is the maximum length of a message framed by FrameWriter, the
+// most that its uint16 length prefix can describe.
+const MaxFrameLen = 65535
+
+// A FrameReader reads messages that are each preceded by their length as a
+// big-endian uint16, the framing used by NoiseSocket and by WriteMessageTo.
+type FrameReader struct {
+	r          io.Reader
+	buf        []byte
+	start, end int // buf[start:end] has been read but not returned
+}
+
+// NewFrameReader returns a FrameReader that reads from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// ReadFrame returns the next message, which is only valid until the next call
+// to ReadFrame. It returns io.EOF if r ends between messages and
+// io.ErrUnexpectedEOF if it ends within one. If r returns another error, such
+// as a timeout, part way through a message, the bytes read so far are kept and
+// the next call continues with the same message.
+func (f *FrameReader) ReadFrame() ([]byte, error) {
+	if f.buf == nil {
+		f.buf = make([]byte, 2+MaxFrameLen)
+	}
+	if f.start > 0 {
+		f.end = copy(f.buf, f.buf[f.start:f.end])
+		f.start = 0
+	}
+	if err := f.fill(2); err != nil {
+		return nil, err
+	}
+	n := 2 + int(binary.BigEndian.Uint16(f.buf))
+	if err := f.fill(n); err != nil {
+		return nil, err
+	}
+	f.start = n
+	return f.buf[2:n], nil
+}
+
+// fill reads until buf holds at least n bytes.
+func (f *FrameReader) fill(n int) error {
+	for f.end < n {
+		m, err := f.r.Read(f.buf[f.end:])
+		f.end += m
+		if err != nil && f.end < n {
+			if err == io.EOF && f.end > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// A FrameWriter writes messages that are each preceded by their length as a
+// big-endian uint16, to be read by a FrameReader.
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewFrameWriter returns a FrameWriter that writes to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes msg and its length prefix to w with a single call to
+// Write. It fails if msg is longer than MaxFrameLen.
+func (f *FrameWriter) WriteFrame(msg []byte) error {
+	if len(msg) > MaxFrameLen {
+		return errors.New("noise: message is too long")
+	}
+	f.buf = binary.BigEndian.AppendUint16(f.buf[:0], uint16(len(msg)))
+	f.buf = append(f.buf, msg...)
+	_, err := f.w.Write(f.buf)
+	return err
+}
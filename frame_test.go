@@ -0,0 +1,66 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	. "gopkg.in/check.v1"
+)
+
+// stutterReader returns one byte per Read and fails every other call.
+type stutterReader struct {
+	r    io.Reader
+	fail bool
+}
+
+var errStutter = errors.New("stutter")
+
+func (r *stutterReader) Read(b []byte) (int, error) {
+	r.fail = !r.fail
+	if r.fail {
+		return 0, errStutter
+	}
+	return r.r.Read(b[:1])
+}
+
+func (NoiseSuite) TestFrames(c *C) {
+	var buf bytes.Buffer
+	w := NewFrameWriter(&buf)
+	c.Assert(w.WriteFrame([]byte("hello")), IsNil)
+	c.Assert(w.WriteFrame(nil), IsNil)
+	c.Assert(w.WriteFrame(make([]byte, MaxFrameLen)), IsNil)
+	c.Assert(w.WriteFrame(make([]byte, MaxFrameLen+1)), ErrorMatches, "noise: message is too long")
+	c.Assert(buf.Bytes()[:7], DeepEquals, []byte("\x00\x05hello"))
+
+	r := NewFrameReader(bytes.NewReader(buf.Bytes()))
+	msg, err := r.ReadFrame()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg), Equals, "hello")
+	msg, err = r.ReadFrame()
+	c.Assert(err, IsNil)
+	c.Assert(msg, HasLen, 0)
+	msg, err = r.ReadFrame()
+	c.Assert(err, IsNil)
+	c.Assert(msg, HasLen, MaxFrameLen)
+	_, err = r.ReadFrame()
+	c.Assert(err, Equals, io.EOF)
+
+	r = NewFrameReader(bytes.NewReader([]byte("\x00\x05hel")))
+	_, err = r.ReadFrame()
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (NoiseSuite) TestFrameReaderResume(c *C) {
+	r := NewFrameReader(&stutterReader{r: bytes.NewReader([]byte("\x00\x03foo\x00\x03bar"))})
+	var got []string
+	for len(got) < 2 {
+		msg, err := r.ReadFrame()
+		if err == errStutter {
+			continue
+		}
+		c.Assert(err, IsNil)
+		got = append(got, string(msg))
+	}
+	c.Assert(got, DeepEquals, []string{"foo", "bar"})
+}
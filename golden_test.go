@@ -0,0 +1,28 @@
+package noise
+
+import (
+	"embed"
+	"io/fs"
+
+	. "gopkg.in/check.v1"
+)
+
+// golden holds transcripts recorded with earlier releases of this package, in
+// the format of vectors.txt. Unlike vectors.txt they are never regenerated, so
+// they catch changes that would break interoperability with deployed peers.
+//
+//go:embed testdata/golden/*.txt
+var golden embed.FS
+
+func (NoiseSuite) TestGoldenTranscripts(c *C) {
+	files, err := fs.Glob(golden, "testdata/golden/*.txt")
+	c.Assert(err, IsNil)
+	c.Assert(files, Not(HasLen), 0)
+	for _, name := range files {
+		c.Log(name)
+		f, err := golden.Open(name)
+		c.Assert(err, IsNil)
+		checkVectors(c, f)
+		f.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package noise
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestReadMessageRetry(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	// A truncated message fails after the ephemeral key has been read.
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg[:40])
+	c.Assert(err, Equals, ErrShortMessage)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	// A corrupted static key fails after its nonce has been used.
+	msg, _, _, _ = hsI.WriteMessage(nil, []byte("hi"))
+	bad := append([]byte(nil), msg...)
+	bad[0] ^= 1
+	_, _, _, err = hsR.ReadMessage(nil, bad)
+	c.Assert(err, NotNil)
+	res, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hi")
+	c.Assert(csR, NotNil)
+	c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func (NoiseSuite) TestWriteMessageFailureIsSticky(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, Random: failingReader{}})
+	_, _, _, err := hs.WriteMessage(nil, nil)
+	c.Assert(err, ErrorMatches, "no entropy")
+	_, _, _, err2 := hs.WriteMessage(nil, nil)
+	c.Assert(err2, Equals, err)
+	_, _, _, err2 = hs.ReadMessage(nil, nil)
+	c.Assert(err2, Equals, err)
+}
+
+// blockingReader blocks each read until it is released.
+type blockingReader struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r blockingReader) Read(p []byte) (int, error) {
+	r.reading <- struct{}{}
+	<-r.release
+	for i := range p {
+		p[i] = 1
+	}
+	return len(p), nil
+}
+
+func (NoiseSuite) TestConcurrentUse(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	r := blockingReader{make(chan struct{}), make(chan struct{})}
+	hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, Random: r})
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := hs.WriteMessage(nil, nil)
+		done <- err
+	}()
+	<-r.reading
+	_, _, _, err := hs.WriteMessage(nil, nil)
+	c.Assert(err, Equals, ErrConcurrentUse)
+	close(r.release)
+	c.Assert(<-done, Equals, ErrConcurrentUse)
+
+	_, _, _, err = hs.ReadMessage(nil, nil)
+	c.Assert(err, Equals, ErrConcurrentUse)
+}
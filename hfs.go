@@ -27,7 +27,9 @@ type HFSKey interface {
 }
 
 // HFSFunc implements a hybrid forward secrecy function, for the Noise HFS
-// extension (version 1draft-5).
+// extension (version 1draft-5) and its "f" token. The current specification
+// replaces it with the "e1" and "ekem1" tokens of the hfs modifier, which use
+// a KEM instead; HFSFunc remains for protocols that already use the draft.
 //
 // See: https://github.com/noiseprotocol/noise_spec/blob/master/extensions/ext_hybrid_forward_secrecy.md
 type HFSFunc interface {
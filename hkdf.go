@@ -3,8 +3,14 @@ package noise
 import (
 	"crypto/hmac"
 	"hash"
+
+	"github.com/flynn/noise/subtle"
 )
 
+// hkdf implements the HKDF function of the specification, which is RFC 5869
+// HKDF with chainingKey as the salt and an empty info, returning the first
+// outputs blocks of output. Outputs are appended to out1, out2 and out3, which
+// must be empty.
 func hkdf(h func() hash.Hash, outputs int, out1, out2, out3, chainingKey, inputKeyMaterial []byte) ([]byte, []byte, []byte) {
 	if len(out1) > 0 {
 		panic("len(out1) > 0")
@@ -19,9 +25,12 @@ func hkdf(h func() hash.Hash, outputs int, out1, out2, out3, chainingKey, inputK
 		panic("outputs > 3")
 	}
 
+	// tempKey must not share storage with any output, as it keys every
+	// output's HMAC after earlier outputs have been written.
 	tempMAC := hmac.New(h, chainingKey)
 	tempMAC.Write(inputKeyMaterial)
-	tempKey := tempMAC.Sum(out2)
+	tempKey := tempMAC.Sum(nil)
+	defer subtle.Zero(tempKey)
 
 	out1MAC := hmac.New(h, tempKey)
 	out1MAC.Write([]byte{0x01})
@@ -0,0 +1,68 @@
+package noise
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+
+	xhkdf "golang.org/x/crypto/hkdf"
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestHKDF(c *C) {
+	// RFC 5869, test case 3.
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	okm, _ := hex.DecodeString("8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8")
+	out1, out2, _ := hkdf(sha256.New, 2, nil, nil, nil, nil, ikm)
+	c.Assert(append(out1, out2...)[:len(okm)], DeepEquals, okm)
+
+	// Outputs with spare capacity must not disturb later outputs.
+	ck := []byte("chaining key")
+	want := make([]byte, 3*sha256.Size)
+	io.ReadFull(xhkdf.New(sha256.New, ikm, ck, nil), want)
+	out1, out2, out3 := hkdf(sha256.New, 3, make([]byte, 0, 64), make([]byte, 0, 64), make([]byte, 0, 64), ck, ikm)
+	c.Assert(out1, DeepEquals, want[:32])
+	c.Assert(out2, DeepEquals, want[32:64])
+	c.Assert(out3, DeepEquals, want[64:])
+}
+
+func (NoiseSuite) TestHKDFSHA512(c *C) {
+	ikm := []byte("input key material")
+	ck := make([]byte, sha512.Size)
+	want := make([]byte, 3*sha512.Size)
+	io.ReadFull(xhkdf.New(sha512.New, ikm, ck, nil), want)
+	out1, out2, out3 := hkdf(sha512.New, 3, nil, nil, nil, ck, ikm)
+	c.Assert(out1, DeepEquals, want[:64])
+	c.Assert(out2, DeepEquals, want[64:128])
+	c.Assert(out3, DeepEquals, want[128:])
+}
+
+func (NoiseSuite) TestInitializeSymmetricSHA512(c *C) {
+	// Names up to HASHLEN bytes are zero-padded, longer ones are hashed.
+	short := "Noise_XX_25519_AESGCM_SHA512"
+	long := "Noise_XXpsk0+psk1+psk2+psk3_25519+Ed25519_ChaChaPoly_SHA512_padding"
+	c.Assert(len(long) > sha512.Size, Equals, true)
+
+	var ss symmetricState
+	ss.cs = NewCipherSuite(DH25519, CipherAESGCM, HashSHA512)
+	ss.InitializeSymmetric([]byte(short))
+	want := make([]byte, sha512.Size)
+	copy(want, short)
+	c.Assert(ss.h, DeepEquals, want)
+	c.Assert(ss.ck, DeepEquals, want)
+
+	ss.InitializeSymmetric([]byte(long))
+	sum := sha512.Sum512([]byte(long))
+	c.Assert(ss.h, DeepEquals, sum[:])
+	c.Assert(ss.ck, DeepEquals, sum[:])
+
+	// MixKey and MixKeyAndHash keep 64-byte ck and h and a 32-byte key.
+	ss.MixKey([]byte("dh output"))
+	c.Assert(ss.ck, HasLen, sha512.Size)
+	want, _, _ = hkdf(sha512.New, 2, nil, nil, nil, sum[:], []byte("dh output"))
+	c.Assert(ss.ck, DeepEquals, want)
+	ss.MixKeyAndHash(make([]byte, 32))
+	c.Assert(ss.ck, HasLen, sha512.Size)
+	c.Assert(ss.h, HasLen, sha512.Size)
+}
@@ -0,0 +1,65 @@
+package noise
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestPreviousPeerStatic(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	other, _ := cs.GenerateKeypair(nil)
+
+	for _, prev := range [][]byte{staticR.Public, other.Public} {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:        cs,
+			Pattern:            HandshakeXX,
+			Initiator:          true,
+			StaticKeypair:      staticI,
+			PreviousPeerStatic: prev,
+		})
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+		_, _, _, err := hsR.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		msg, _, _, _ = hsR.WriteMessage(nil, nil)
+		_, _, _, err = hsI.ReadMessage(nil, msg)
+		if string(prev) == string(staticR.Public) {
+			c.Assert(err, IsNil)
+			continue
+		}
+		var herr *HandshakeError
+		c.Assert(errors.As(err, &herr), Equals, true)
+		c.Assert(herr.Reason, Equals, FailureIdentityChanged)
+		c.Assert(hsI.PeerStatic(), HasLen, 0)
+	}
+}
+
+func (NoiseSuite) TestPreviousPeerStaticForged(c *C) {
+	// A different static key that the message does not authenticate is a
+	// MAC failure, not a change of identity.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticR, _ := cs.GenerateKeypair(nil)
+	other, _ := cs.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:        cs,
+		Pattern:            HandshakeXX,
+		Initiator:          true,
+		PreviousPeerStatic: staticR.Public,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeXX,
+		StaticKeypair: DHKey{Private: staticR.Private, Public: other.Public},
+	})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	var herr *HandshakeError
+	c.Assert(errors.As(err, &herr), Equals, true)
+	c.Assert(herr.Reason, Equals, FailurePayloadMAC)
+}
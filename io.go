@@ -0,0 +1,76 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WriteMessageTo is like WriteMessage, but writes the message to w preceded
+// by its length as a big-endian uint16, the framing suggested by the
+// specification for stream transports. The message is built in scratch space
+// kept by the HandshakeState, so no buffer needs to be supplied.
+//
+// A message that would be longer than the length prefix or the maximum
+// message length allows is rejected before the handshake state changes. Any
+// other error, including one from w, leaves the HandshakeState unusable, as
+// the message has already been mixed into it, and later calls return the same
+// error.
+func (s *HandshakeState) WriteMessageTo(w io.Writer, payload []byte) (*CipherState, *CipherState, error) {
+	if s.err == nil && s.shouldWrite && s.msgIdx < len(s.messagePatterns) {
+		if n := s.overheads()[0] + len(payload); n > 0xffff || n > s.maxMsgLen {
+			return nil, nil, errors.New("noise: message is too long")
+		}
+	}
+	msg, cs1, cs2, err := s.WriteMessage(s.scratch()[:2], payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.buf = msg
+	if len(msg)-2 > 0xffff {
+		// Only a payload signature, which is not counted above, gets here.
+		s.err = errors.New("noise: message is too long")
+		return nil, nil, s.err
+	}
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+	if _, err := w.Write(msg); err != nil {
+		s.err = err
+		return nil, nil, err
+	}
+	return cs1, cs2, nil
+}
+
+// ReadMessageFrom is like ReadMessage, but reads a message framed as by
+// WriteMessageTo from r. The returned payload is held in scratch space kept by
+// the HandshakeState and is only valid until the next call to WriteMessageTo
+// or ReadMessageFrom.
+func (s *HandshakeState) ReadMessageFrom(r io.Reader) ([]byte, *CipherState, *CipherState, error) {
+	buf := s.scratch()
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, nil, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if n > s.maxMsgLen {
+		return nil, nil, nil, errors.New("noise: message is too long")
+	}
+	if cap(buf) < 2+2*n {
+		buf = make([]byte, 2, 2+2*n)
+		s.buf = buf
+	}
+	msg := buf[2 : 2+n]
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, nil, nil, err
+	}
+	// Decrypt into the space after the message, which is never smaller than
+	// the payload.
+	return s.ReadMessage(buf[2+n:2+n], msg)
+}
+
+// scratch returns the scratch buffer, with room for a length prefix and a
+// message of the maximum length.
+func (s *HandshakeState) scratch() []byte {
+	if cap(s.buf) < 2+s.maxMsgLen {
+		s.buf = make([]byte, 2, 2+s.maxMsgLen)
+	}
+	return s.buf[:2]
+}
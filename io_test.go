@@ -0,0 +1,72 @@
+package noise
+
+import (
+	"bytes"
+	"io"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestMessageToFrom(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+
+	var wire bytes.Buffer
+	_, _, err := hsI.WriteMessageTo(&wire, []byte("abc"))
+	c.Assert(err, IsNil)
+	c.Assert(wire.Bytes()[:2], DeepEquals, []byte{0, 35})
+	res, _, _, err := hsR.ReadMessageFrom(&wire)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "abc")
+
+	_, _, err = hsR.WriteMessageTo(&wire, []byte("defg"))
+	c.Assert(err, IsNil)
+	res, _, _, err = hsI.ReadMessageFrom(&wire)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "defg")
+
+	csI0, _, err := hsI.WriteMessageTo(&wire, bytes.Repeat([]byte("x"), 1000))
+	c.Assert(err, IsNil)
+	res, csR0, _, err := hsR.ReadMessageFrom(&wire)
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, bytes.Repeat([]byte("x"), 1000))
+	c.Assert(wire.Len(), Equals, 0)
+
+	res, err = csR0.Decrypt(nil, nil, csI0.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+
+	hsR, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	_, _, _, err = hsR.ReadMessageFrom(bytes.NewReader([]byte{0, 40, 1}))
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (NoiseSuite) TestMessageToErrors(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, MaxMsgLen: 100})
+
+	// A message over the maximum length is rejected without using up the
+	// handshake state.
+	var wire bytes.Buffer
+	_, _, err := hsI.WriteMessageTo(&wire, make([]byte, 100-32+1))
+	c.Assert(err, ErrorMatches, ".*too long")
+	c.Assert(wire.Len(), Equals, 0)
+	_, _, err = hsI.WriteMessageTo(&wire, make([]byte, 100-32))
+	c.Assert(err, IsNil)
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, MaxMsgLen: 100})
+	_, _, _, err = hsR.ReadMessageFrom(&wire)
+	c.Assert(err, IsNil)
+
+	// A failed write leaves the handshake state unusable.
+	_, _, err = hsR.WriteMessageTo(failingWriter{}, nil)
+	c.Assert(err, Equals, io.ErrClosedPipe)
+	_, _, err = hsR.WriteMessageTo(&wire, nil)
+	c.Assert(err, Equals, io.ErrClosedPipe)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
@@ -0,0 +1,70 @@
+package noise
+
+import "io"
+
+// A KEMKey is a key encapsulation mechanism keypair.
+type KEMKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// KEM implements a key encapsulation mechanism, for the KEM-based hfs modifier
+// of the Hybrid Forward Secrecy extension. With it, the "e1" token sends the
+// public key of a fresh KEM keypair and the "ekem1" token answers it with an
+// encapsulated shared secret, which is mixed into the chaining key alongside
+// the DH results.
+//
+// See: https://github.com/noiseprotocol/noise_hfs_spec
+type KEM interface {
+	// GenerateKEMKeypair generates a new KEM keypair using rng as a source of
+	// entropy.
+	GenerateKEMKeypair(rng io.Reader) (KEMKey, error)
+
+	// Encapsulate generates a shared secret for the holder of the private key
+	// for publicKey, and returns it along with the ciphertext that carries it.
+	Encapsulate(rng io.Reader, publicKey []byte) (ciphertext, sharedSecret []byte, err error)
+
+	// Decapsulate recovers the shared secret from a ciphertext produced by
+	// Encapsulate.
+	Decapsulate(privateKey, ciphertext []byte) ([]byte, error)
+
+	// KEMPublicKeyLen is a constant specifying the size in bytes of a public
+	// key.
+	KEMPublicKeyLen() int
+
+	// KEMCiphertextLen is a constant specifying the size in bytes of a
+	// ciphertext.
+	KEMCiphertextLen() int
+
+	// KEMName is the name of the KEM.
+	KEMName() string
+}
+
+// HFS returns p with the hfs modifier applied: an "e1" token directly after
+// the first "e" token and an "ekem1" token directly after the first "ee"
+// token. The resulting pattern must be used with a CipherSuite constructed
+// with NewCipherSuiteKEM.
+func HFS(p HandshakePattern) HandshakePattern {
+	hfs := HandshakePattern{
+		Name:                 appendModifier(p.Name, "hfs"),
+		InitiatorPreMessages: p.InitiatorPreMessages,
+		ResponderPreMessages: p.ResponderPreMessages,
+		Messages:             make([][]MessagePattern, len(p.Messages)),
+	}
+	var e1, ekem1 bool
+	for i, m := range p.Messages {
+		hfs.Messages[i] = make([]MessagePattern, 0, len(m)+2)
+		for _, t := range m {
+			hfs.Messages[i] = append(hfs.Messages[i], t)
+			switch {
+			case t == MessagePatternE && !e1:
+				hfs.Messages[i] = append(hfs.Messages[i], MessagePatternE1)
+				e1 = true
+			case t == MessagePatternEE && !ekem1:
+				hfs.Messages[i] = append(hfs.Messages[i], MessagePatternEKEM1)
+				ekem1 = true
+			}
+		}
+	}
+	return hfs
+}
@@ -0,0 +1,140 @@
+package noise
+
+import (
+	"io"
+
+	. "gopkg.in/check.v1"
+)
+
+// x25519KEM is a KEM built from X25519, used to exercise the hfs tokens.
+type x25519KEM struct{}
+
+func (x25519KEM) GenerateKEMKeypair(rng io.Reader) (KEMKey, error) {
+	k, err := DH25519.GenerateKeypair(rng)
+	return KEMKey{Private: k.Private, Public: k.Public}, err
+}
+
+func (x25519KEM) Encapsulate(rng io.Reader, publicKey []byte) ([]byte, []byte, error) {
+	k, err := DH25519.GenerateKeypair(rng)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := DH25519.DH(k.Private, publicKey)
+	return k.Public, shared, err
+}
+
+func (x25519KEM) Decapsulate(privateKey, ciphertext []byte) ([]byte, error) {
+	return DH25519.DH(privateKey, ciphertext)
+}
+
+func (x25519KEM) KEMPublicKeyLen() int  { return 32 }
+func (x25519KEM) KEMCiphertextLen() int { return 32 }
+func (x25519KEM) KEMName() string       { return "X25519KEM" }
+
+func (NoiseSuite) TestHFSPattern(c *C) {
+	p := HFS(HandshakeXX)
+	c.Assert(p.Name, Equals, "XXhfs")
+	c.Assert(p.Messages, DeepEquals, [][]MessagePattern{
+		{MessagePatternE, MessagePatternE1},
+		{MessagePatternE, MessagePatternEE, MessagePatternEKEM1, MessagePatternS, MessagePatternES},
+		{MessagePatternS, MessagePatternSE},
+	})
+	c.Assert(p.Validate(), IsNil)
+	c.Assert(HandshakeXX.Messages[0], HasLen, 1)
+	c.Assert(HFS(HandshakeXXfallback).Name, Equals, "XXfallback+hfs")
+	c.Assert(HFS(HandshakeXXfallback).fallback(), Equals, true)
+
+	parsed, err := ParseHandshakePattern("XXhfs", "-> e, e1\n<- e, ee, ekem1, s, es\n-> s, se")
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, p)
+}
+
+func (NoiseSuite) TestHFSKEMHandshake(c *C) {
+	cs := NewCipherSuiteKEM(DH25519, x25519KEM{}, CipherChaChaPoly, HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+
+	newStates := func() (*HandshakeState, *HandshakeState) {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:   cs,
+			Pattern:       HFS(HandshakeXX),
+			Initiator:     true,
+			StaticKeypair: staticI,
+		})
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite:   cs,
+			Pattern:       HFS(HandshakeXX),
+			StaticKeypair: staticR,
+		})
+		return hsI, hsR
+	}
+	hsI, hsR := newStates()
+	c.Assert(hsI.protocolName, Equals, "Noise_XXhfs_25519+X25519KEM_ChaChaPoly_BLAKE2s")
+	overheads := hsI.overheads()
+	c.Assert(overheads, DeepEquals, []int{64, 144, 64})
+
+	var csI, csR *CipherState
+	writer, reader := hsI, hsR
+	for i := 0; csI == nil; i++ {
+		msg, cs1, _, err := writer.WriteMessage(nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(msg, HasLen, overheads[i])
+		_, cs2, _, err := reader.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		csI, csR = cs1, cs2
+		writer, reader = reader, writer
+	}
+	res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+
+	// A corrupted KEM ciphertext is detected by its authentication tag.
+	hsI, hsR = newStates()
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	msg[70] ^= 1
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureStaticMAC)
+}
+
+// kemSuite is a CipherSuite implemented outside the package that supports the
+// hfs modifier.
+type kemSuite struct {
+	CipherSuite
+	x25519KEM
+}
+
+func (NoiseSuite) TestHFSKEMSupport(c *C) {
+	_, err := NewHandshakeState(Config{
+		CipherSuite: NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s),
+		Pattern:     HFS(HandshakeNN),
+		Initiator:   true,
+	})
+	c.Assert(err, ErrorMatches, ".*requires a CipherSuite with a KEM")
+
+	cs := kemSuite{CipherSuite: NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)}
+	hsI, err := NewHandshakeState(Config{CipherSuite: cs, Pattern: HFS(HandshakeNN), Initiator: true})
+	c.Assert(err, IsNil)
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HFS(HandshakeNN)})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	c.Assert(msg, HasLen, 32+32)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(csI, NotNil)
+}
+
+func (NoiseSuite) TestModifierNames(c *C) {
+	hs, err := NewHandshakeState(Config{
+		CipherSuite:   NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256),
+		Pattern:       HandshakeXXfallback,
+		PeerEphemeral: make([]byte, 32),
+		PresharedKey:  make([]byte, 32),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(hs.protocolName, Equals, "Noise_XXfallback+psk0_25519_ChaChaPoly_SHA256")
+}
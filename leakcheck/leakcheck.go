@@ -0,0 +1,80 @@
+// Package leakcheck finds secret key material that is still reachable in the
+// heap, for tests that check that keys are destroyed when they should be.
+//
+// A test records the secrets of a HandshakeState or CipherState with New, for
+// example from their Secrets methods, drops its own references to them and to
+// the state, and then calls Leaks. Secrets are kept masked with a random pad
+// so that the Checker does not itself keep them in the heap.
+package leakcheck
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// A Checker looks for a fixed set of secrets in heap dumps.
+type Checker struct {
+	masked [][]byte
+	pads   [][]byte
+}
+
+// New returns a Checker for copies of secrets. Secrets shorter than 16 bytes
+// are ignored, as they would match by chance.
+func New(secrets [][]byte) (*Checker, error) {
+	c := &Checker{}
+	for _, s := range secrets {
+		if len(s) < 16 {
+			continue
+		}
+		pad := make([]byte, len(s))
+		if _, err := rand.Read(pad); err != nil {
+			return nil, err
+		}
+		masked := make([]byte, len(s))
+		for i := range s {
+			masked[i] = s[i] ^ pad[i]
+		}
+		c.masked = append(c.masked, masked)
+		c.pads = append(c.pads, pad)
+	}
+	return c, nil
+}
+
+// Leaks runs the garbage collector, writes a heap dump and returns the
+// indexes, among the secrets that were not ignored by New, of those that
+// appear in it.
+func (c *Checker) Leaks() ([]int, error) {
+	f, err := os.CreateTemp("", "leakcheck")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	runtime.GC()
+	debug.WriteHeapDump(f.Fd())
+	dump, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var leaks []int
+	secret := make([]byte, 0, 64)
+	for i, masked := range c.masked {
+		secret = secret[:0]
+		for j := range masked {
+			secret = append(secret, masked[j]^c.pads[i][j])
+		}
+		if bytes.Contains(dump, secret) {
+			leaks = append(leaks, i)
+		}
+	}
+	secret = secret[:cap(secret)]
+	for i := range secret {
+		secret[i] = 0
+	}
+	return leaks, nil
+}
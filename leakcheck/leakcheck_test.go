@@ -0,0 +1,59 @@
+package leakcheck_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/flynn/noise/leakcheck"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type LeakSuite struct{}
+
+var _ = Suite(&LeakSuite{})
+
+// live keeps a HandshakeState reachable for the duration of a test.
+var live *noise.HandshakeState
+
+func (LeakSuite) TestLeaks(c *C) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	psk := make([]byte, 32)
+	rand.Read(psk)
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           cs,
+		Pattern:               noise.HandshakeNN,
+		Initiator:             true,
+		PresharedKey:          psk,
+		PresharedKeyPlacement: 0,
+	})
+	c.Assert(err, IsNil)
+	_, _, _, err = hs.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	live = hs
+	defer func() { live = nil }()
+
+	secrets := hs.Secrets()
+	c.Assert(len(secrets) > 0, Equals, true)
+	checker, err := leakcheck.New(secrets)
+	c.Assert(err, IsNil)
+
+	// The state is still live, so all of its secrets are found.
+	leaks, err := checker.Leaks()
+	c.Assert(err, IsNil)
+	c.Assert(leaks, HasLen, len(secrets))
+
+	// A secret that was wiped after it was recorded is not.
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	checker, err = leakcheck.New([][]byte{secret})
+	c.Assert(err, IsNil)
+	for i := range secret {
+		secret[i] = 0
+	}
+	leaks, err = checker.Leaks()
+	c.Assert(err, IsNil)
+	c.Assert(leaks, HasLen, 0)
+}
@@ -0,0 +1,76 @@
+package noise
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A PeerLimiter rate-limits handshakes per remote static key with a token
+// bucket for each key, so that a single credential cannot monopolize a
+// server's handshake capacity regardless of the addresses it connects from.
+// A PeerLimiter may be shared by many handshakes and is safe for concurrent
+// use.
+type PeerLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	size    int
+	lru     *list.List
+	buckets map[string]*list.Element
+	now     func() time.Time
+}
+
+type peerBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewPeerLimiter returns a PeerLimiter that allows each static key rate
+// handshakes per second on average and up to burst at once. It tracks the
+// last size keys; a key that has been forgotten starts with a full bucket.
+func NewPeerLimiter(rate float64, burst, size int) *PeerLimiter {
+	return &PeerLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		lru:     list.New(),
+		buckets: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of rs and reports whether there was one.
+// It is called by HandshakeState for every remote static key it reads when
+// the limiter is set in Config.PeerLimiter, and the handshake fails with
+// FailureRateLimited if it returns false.
+func (l *PeerLimiter) Allow(rs []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	key := string(rs)
+	var b *peerBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		b = elem.Value.(*peerBucket)
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	} else {
+		b = &peerBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		if l.lru.Len() > l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*peerBucket).key)
+		}
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,91 @@
+package noise
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestPeerLimiter(c *C) {
+	now := time.Unix(0, 0)
+	l := NewPeerLimiter(1, 2, 2)
+	l.now = func() time.Time { return now }
+	c.Assert(l.Allow([]byte("a")), Equals, true)
+	c.Assert(l.Allow([]byte("a")), Equals, true)
+	c.Assert(l.Allow([]byte("a")), Equals, false)
+	c.Assert(l.Allow([]byte("b")), Equals, true)
+	now = now.Add(time.Second)
+	c.Assert(l.Allow([]byte("a")), Equals, true)
+	c.Assert(l.Allow([]byte("a")), Equals, false)
+	c.Assert(l.Allow([]byte("c")), Equals, true) // evicts b
+	c.Assert(l.Allow([]byte("b")), Equals, true)
+	c.Assert(l.Allow([]byte("b")), Equals, true)
+
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	l = NewPeerLimiter(1, 1, 16)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:   cs,
+			Pattern:       HandshakeXX,
+			Initiator:     true,
+			StaticKeypair: staticI,
+		})
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite:   cs,
+			Pattern:       HandshakeXX,
+			StaticKeypair: staticR,
+			PeerLimiter:   l,
+		})
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+		_, _, _, err := hsR.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		msg, _, _, _ = hsR.WriteMessage(nil, nil)
+		_, _, _, err = hsI.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		msg, _, _, _ = hsI.WriteMessage(nil, nil)
+		_, _, _, err = hsR.ReadMessage(nil, msg)
+		if i == 0 {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, DeepEquals, &HandshakeError{Reason: FailureRateLimited})
+		}
+	}
+}
+
+func (NoiseSuite) TestPeerLimiterForgedStatic(c *C) {
+	// An initiator that puts the victim's public key in message 3 of XX
+	// without its private key fails at se, and must not use up the victim's
+	// tokens.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	victim, _ := cs.GenerateKeypair(nil)
+	attacker, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	l := NewPeerLimiter(0, 1, 16)
+	handshake := func(staticI DHKey) error {
+		hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI})
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR, PeerLimiter: l})
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+		if _, _, _, err := hsR.ReadMessage(nil, msg); err != nil {
+			return err
+		}
+		msg, _, _, _ = hsR.WriteMessage(nil, nil)
+		if _, _, _, err := hsI.ReadMessage(nil, msg); err != nil {
+			return err
+		}
+		msg, _, _, _ = hsI.WriteMessage(nil, nil)
+		_, _, _, err := hsR.ReadMessage(nil, msg)
+		return err
+	}
+	forged := DHKey{Private: attacker.Private, Public: victim.Public}
+	for i := 0; i < 3; i++ {
+		err := handshake(forged)
+		herr, ok := err.(*HandshakeError)
+		c.Assert(ok, Equals, true)
+		c.Assert(herr.Reason, Equals, FailurePayloadMAC)
+	}
+	c.Assert(handshake(victim), IsNil)
+	c.Assert(handshake(victim), DeepEquals, &HandshakeError{Reason: FailureRateLimited})
+}
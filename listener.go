@@ -0,0 +1,37 @@
+package noise
+
+import "net"
+
+// A listener wraps a net.Listener, securing each accepted connection as a
+// responder.
+type listener struct {
+	net.Listener
+	config Config
+}
+
+// Accept waits for and returns the next connection as a *Conn. The
+// handshake is run by the first Read or Write on it.
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(c, l.config), nil
+}
+
+// NewListener returns a net.Listener whose Accept returns the connections
+// accepted by inner as Conns that run a handshake as the responder with
+// config, in the manner of tls.NewListener.
+func NewListener(inner net.Listener, config Config) net.Listener {
+	return &listener{Listener: inner, config: config}
+}
+
+// Listen listens for connections on the given network address with
+// net.Listen and returns a listener as made by NewListener.
+func Listen(network, laddr string, config Config) (net.Listener, error) {
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, config), nil
+}
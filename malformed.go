@@ -0,0 +1,96 @@
+package noise
+
+// A MalformedMessage is a near-valid handshake message produced by
+// MalformedMessages, for fuzzing the peer that reads it.
+type MalformedMessage struct {
+	// Description names the change made to the valid message, for example
+	// "truncated s" or "flipped tag payload".
+	Description string
+
+	Message []byte
+
+	// Rejectable reports whether a peer that is ready to read the valid
+	// message must reject this one. A change to bytes that are neither
+	// encrypted nor followed by an encrypted span of the same message, such
+	// as a flipped ephemeral key in the first message of NN, is not detected
+	// until a later message, if at all.
+	Rejectable bool
+}
+
+// MalformedMessages writes the next handshake message with payload on a clone
+// of s and returns it together with malformed variants of it: truncated within
+// each token, extended by a byte, with each public key or authentication tag
+// flipped, and with adjacent tokens swapped. A peer that is ready to read the
+// valid message should reject each variant marked Rejectable. s itself is not
+// modified, so the handshake can continue with WriteMessage.
+func (s *HandshakeState) MalformedMessages(payload []byte) ([]byte, []MalformedMessage, error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	if !s.shouldWrite {
+		return nil, nil, &HandshakeError{Reason: FailureWrongPhase}
+	}
+	if s.msgIdx >= len(s.messagePatterns) {
+		return nil, nil, errNoMessagesLeft
+	}
+	spans := s.layout()[0]
+	c := s.Clone()
+	c.trace = nil
+	valid, _, _, err := c.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The payload span is whatever follows the tokens, which includes a
+	// payload signature, if any.
+	last := &spans[len(spans)-1]
+	last.len = len(valid)
+	for _, sp := range spans[:len(spans)-1] {
+		last.len -= sp.len
+	}
+
+	// A change from span i onwards is detected if span i or a later one is
+	// encrypted, as the earlier spans are mixed into the handshake hash that
+	// authenticates it.
+	authenticated := make([]bool, len(spans)+1)
+	for i := len(spans) - 1; i >= 0; i-- {
+		authenticated[i] = spans[i].encrypted || authenticated[i+1]
+	}
+
+	var out []MalformedMessage
+	variant := func(desc string, rejectable bool, f func(m []byte) []byte) {
+		m := f(append([]byte(nil), valid...))
+		out = append(out, MalformedMessage{desc, m, rejectable})
+	}
+	name := func(sp span) string {
+		if sp.payload {
+			return "payload"
+		}
+		return sp.token.String()
+	}
+	off := 0
+	for i, sp := range spans {
+		start, end := off, off+sp.len
+		off = end
+		if sp.len == 0 {
+			continue
+		}
+		// A truncated token leaves the message too short to read; a truncated
+		// payload is only noticed if it is encrypted.
+		variant("truncated "+name(sp), !sp.payload || sp.encrypted, func(m []byte) []byte { return m[:end-1] })
+		if sp.encrypted {
+			variant("flipped tag "+name(sp), true, func(m []byte) []byte { m[end-1] ^= 1; return m })
+		} else {
+			variant("flipped "+name(sp), authenticated[i], func(m []byte) []byte { m[start] ^= 1; return m })
+		}
+		if i+1 < len(spans) && spans[i+1].len > 0 {
+			next := spans[i+1]
+			variant("swapped "+name(sp)+" "+name(next), authenticated[i], func(m []byte) []byte {
+				swapped := append(append([]byte(nil), valid[end:end+next.len]...), valid[start:end]...)
+				copy(m[start:], swapped)
+				return m
+			})
+		}
+	}
+	variant("extended", last.encrypted, func(m []byte) []byte { return append(m, 0) })
+	return valid, out, nil
+}
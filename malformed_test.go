@@ -0,0 +1,88 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestMalformedMessages(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	newPair := func() (*HandshakeState, *HandshakeState) {
+		hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeIK, Initiator: true, StaticKeypair: staticI, PeerStatic: staticR.Public})
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeIK, StaticKeypair: staticR})
+		return hsI, hsR
+	}
+
+	hsI, _ := newPair()
+	valid, variants, err := hsI.MalformedMessages([]byte("payload"))
+	c.Assert(err, IsNil)
+	var descs []string
+	for _, v := range variants {
+		descs = append(descs, v.Description)
+	}
+	c.Assert(descs, DeepEquals, []string{
+		"truncated e", "flipped e", "swapped e s",
+		"truncated s", "flipped tag s", "swapped s payload",
+		"truncated payload", "flipped tag payload",
+		"extended",
+	})
+
+	_, hsR := newPair()
+	_, _, _, err = hsR.ReadMessage(nil, valid)
+	c.Assert(err, IsNil)
+	for _, v := range variants {
+		c.Assert(v.Rejectable, Equals, true, Commentf("%s", v.Description))
+		_, hsR := newPair()
+		_, _, _, err := hsR.ReadMessage(nil, v.Message)
+		c.Assert(err, NotNil, Commentf("%s", v.Description))
+	}
+
+	// hsI is unaffected and can still complete the handshake.
+	msg, _, _, err := hsI.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	_, hsR = newPair()
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+}
+
+func (NoiseSuite) TestMalformedMessagesCompleted(c *C) {
+	// The NN initiator is due to write once it has read the last message,
+	// but has no messages left.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, cs1, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(cs1, NotNil)
+	_, _, err = hsI.MalformedMessages(nil)
+	c.Assert(err, Equals, errNoMessagesLeft)
+}
+
+func (NoiseSuite) TestMalformedMessagesUnauthenticated(c *C) {
+	// The first message of NN and XX is sent before any key is established,
+	// so only its truncated e must be rejected. Every variant of the second
+	// must be.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	for _, pattern := range []HandshakePattern{HandshakeNN, HandshakeXX} {
+		hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: pattern, Initiator: true, StaticKeypair: staticI})
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: pattern, StaticKeypair: staticR})
+		for i, writer, reader := 0, hsI, hsR; i < 2; i, writer, reader = i+1, reader, writer {
+			_, variants, err := writer.MalformedMessages([]byte("payload"))
+			c.Assert(err, IsNil)
+			for _, v := range variants {
+				comment := Commentf("%s message %d: %s", pattern.Name, i+1, v.Description)
+				c.Assert(v.Rejectable, Equals, i == 1 || v.Description == "truncated e", comment)
+				_, _, _, err := reader.Clone().ReadMessage(nil, v.Message)
+				c.Assert(err != nil, Equals, v.Rejectable, comment)
+			}
+			msg, _, _, _ := writer.WriteMessage(nil, []byte("payload"))
+			_, _, _, err = reader.ReadMessage(nil, msg)
+			c.Assert(err, IsNil)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/flynn/noise/subtle"
+)
+
+const cipherStateVersion = 1
+
+// MarshalBinary encodes the key, the next nonce and the name of the cipher
+// suite of the CipherState, so that a transport session can be restored with
+// UnmarshalBinary, for example in another process. It leaves the CipherState
+// as it is. The encoding holds the key in the clear, and once it is restored
+// the two copies must not both be used, or they reuse nonces, which breaks
+// the security of the cipher; Suspend encodes the CipherState and destroys it
+// so that this cannot happen by mistake.
+//
+// The cipher suite must be made of registered primitives, as for
+// CipherSuiteByName.
+func (s *CipherState) MarshalBinary() ([]byte, error) {
+	if s.invalid {
+		return nil, errors.New("noise: CipherState is invalid")
+	}
+	name := s.cs.Name()
+	b := make([]byte, 0, 2+8+32+len(name))
+	var flags byte
+	if s.sendOnly {
+		flags |= 1
+	}
+	if s.recvOnly {
+		flags |= 2
+	}
+	b = append(b, cipherStateVersion, flags)
+	b = binary.BigEndian.AppendUint64(b, s.n)
+	b = append(b, s.k[:]...)
+	return append(b, name...), nil
+}
+
+// Suspend returns the encoding of MarshalBinary and destroys the CipherState,
+// as Export does, so that the session can only carry on where the encoding is
+// restored. After calling it, it is an error to call any other method on the
+// CipherState. The caller must still make sure that the encoding is restored
+// at most once.
+func (s *CipherState) Suspend() ([]byte, error) {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	subtle.Zero(s.k[:])
+	s.c = nil
+	s.invalid = true
+	return b, nil
+}
+
+// UnmarshalBinary restores a CipherState encoded by MarshalBinary.
+func (s *CipherState) UnmarshalBinary(data []byte) error {
+	if len(data) < 2+8+32 || data[0] != cipherStateVersion || data[1]&^3 != 0 {
+		return errors.New("noise: malformed CipherState encoding")
+	}
+	cs, err := CipherSuiteByName(string(data[2+8+32:]))
+	if err != nil {
+		return err
+	}
+	s.cs = cs
+	s.sendOnly = data[1]&1 != 0
+	s.recvOnly = data[1]&2 != 0
+	s.n = binary.BigEndian.Uint64(data[2:])
+	copy(s.k[:], data[2+8:])
+	s.c = cs.Cipher(s.k)
+	s.invalid = false
+	return nil
+}
+
+const handshakeStateVersion = 1
+
+// MarshalBinary encodes the state of a handshake in progress, so that it can
+// be continued in another process, for example by a stateless frontend that
+// keeps the state of its handshakes with the messages it sends. The encoding
+// holds the protocol name, the position in the pattern, the symmetric state,
+// the local ephemeral keys, the remote public keys and the pre-shared keys. It
+// does not hold the local static key or any of the hooks of the Config, which
+// are supplied again to UnmarshalBinary. MarshalBinary leaves the
+// HandshakeState as it is.
+//
+// The encoding holds secrets in the clear, and must be encrypted and
+// authenticated if it is stored where others can reach it. Once it is
+// restored, the two copies must not both carry on with the handshake, or
+// they encrypt payloads with the same keys and nonces; Suspend encodes the
+// HandshakeState and destroys it so that this cannot happen by mistake.
+// Handshakes with an HFS function cannot be marshaled once the HFS key has
+// been generated.
+func (s *HandshakeState) MarshalBinary() ([]byte, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	b, err := s.marshal()
+	if _, _, _, err := s.exit(nil, nil, nil, err); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Suspend returns the encoding of MarshalBinary and destroys the
+// HandshakeState, as Destroy does, so that the handshake can only carry on
+// where the encoding is restored. The caller must still make sure that the
+// encoding is restored at most once.
+func (s *HandshakeState) Suspend() ([]byte, error) {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	s.Destroy()
+	return b, nil
+}
+
+func (s *HandshakeState) marshal() ([]byte, error) {
+	if s.msgIdx >= len(s.messagePatterns) {
+		return nil, errors.New("noise: handshake is complete")
+	}
+	if s.f != nil {
+		return nil, errors.New("noise: HandshakeState with an HFS key cannot be marshaled")
+	}
+	var flags byte
+	for i, f := range []bool{s.initiator, s.shouldWrite, s.ss.hasK, s.sSent, s.rsKnown} {
+		if f {
+			flags |= 1 << i
+		}
+	}
+	b := []byte{handshakeStateVersion, flags}
+	b = appendField16(b, []byte(s.protocolName))
+	b = binary.BigEndian.AppendUint16(b, uint16(s.msgIdx))
+	b = binary.BigEndian.AppendUint64(b, s.ss.n)
+	b = append(b, s.ss.k[:]...)
+	for _, f := range [][]byte{s.ss.ck, s.ss.h, s.e.Private, s.e.Public, s.re, s.rs, s.rf, s.e1.Private, s.e1.Public, s.re1} {
+		b = appendField16(b, f)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s.psks)))
+	for _, psk := range s.psks {
+		b = appendField16(b, psk)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores the state of a handshake encoded by MarshalBinary
+// into a HandshakeState newly created by NewHandshakeState with the same
+// Config as the marshaled one, which supplies the local static key and the
+// hooks. It fails if the protocol name or role differ. If it fails, the
+// HandshakeState must not be used.
+func (s *HandshakeState) UnmarshalBinary(data []byte) error {
+	errMalformed := errors.New("noise: malformed HandshakeState encoding")
+	if len(data) < 2 || data[0] != handshakeStateVersion || data[1]&^0x1f != 0 {
+		return errMalformed
+	}
+	flags := data[1]
+	data = data[2:]
+	name, data, ok := readField16(data)
+	if !ok {
+		return errMalformed
+	}
+	if string(name) != s.protocolName {
+		return errors.New("noise: HandshakeState encoding is for " + string(name) + ", not " + s.protocolName)
+	}
+	if flags&1 != 0 != s.initiator {
+		return errors.New("noise: HandshakeState encoding is for the other role")
+	}
+	if len(data) < 2+8+32 {
+		return errMalformed
+	}
+	msgIdx := int(binary.BigEndian.Uint16(data))
+	n := binary.BigEndian.Uint64(data[2:])
+	var k [32]byte
+	copy(k[:], data[10:])
+	data = data[42:]
+	var fields [10][]byte
+	for i := range fields {
+		if fields[i], data, ok = readField16(data); !ok {
+			return errMalformed
+		}
+	}
+	if len(data) < 2 {
+		return errMalformed
+	}
+	psks := make([][]byte, binary.BigEndian.Uint16(data))
+	data = data[2:]
+	for i := range psks {
+		if psks[i], data, ok = readField16(data); !ok {
+			return errMalformed
+		}
+	}
+	ck, h, re, rs := fields[0], fields[1], fields[4], fields[5]
+	if len(data) != 0 || msgIdx >= len(s.messagePatterns) || len(psks) != len(s.psks) ||
+		len(ck) != cap(s.ss.ck) || len(h) != cap(s.ss.h) || len(re) > cap(s.re) || len(rs) > cap(s.rs) {
+		return errMalformed
+	}
+
+	s.shouldWrite = flags&2 != 0
+	s.ss.hasK = flags&4 != 0
+	s.sSent = flags&8 != 0
+	s.rsKnown = flags&16 != 0
+	s.msgIdx = msgIdx
+	s.ss.n, s.ss.k = n, k
+	s.ss.c = nil
+	if s.ss.hasK {
+		s.ss.c = s.ss.cs.Cipher(k)
+	}
+	s.ss.ck = append(s.ss.ck[:0], ck...)
+	s.ss.h = append(s.ss.h[:0], h...)
+	s.e = DHKey{Private: fields[2], Public: fields[3]}
+	if len(s.e.Public) > 0 {
+		s.injectedE = DHKey{}
+	}
+	s.re = append(s.re[:0], re...)
+	s.rs = append(s.rs[:0], rs...)
+	s.rf = fields[6]
+	s.e1 = KEMKey{Private: fields[7], Public: fields[8]}
+	s.re1 = fields[9]
+	for i, psk := range psks {
+		if len(psk) > 0 {
+			s.psks[i] = psk
+		}
+	}
+	return nil
+}
+
+// appendField16 appends f to b, preceded by its length as a big-endian
+// uint16.
+func appendField16(b, f []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f)))
+	return append(b, f...)
+}
+
+// readField16 reads a field appended by appendField16, returning nil for an
+// empty field.
+func readField16(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	if n == 0 {
+		return nil, b[2:], true
+	}
+	return append([]byte(nil), b[2:2+n]...), b[2+n:], true
+}
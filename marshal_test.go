@@ -0,0 +1,151 @@
+package noise
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestCipherStateMarshal(c *C) {
+	send, recv := streamPair(c)
+	msg := send.Encrypt(nil, nil, []byte("one"))
+	_, err := recv.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+
+	// MarshalBinary leaves the CipherState as it is.
+	data, err := send.MarshalBinary()
+	c.Assert(err, IsNil)
+	again, err := send.MarshalBinary()
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, data)
+
+	// Suspend gives the same encoding and destroys the CipherState.
+	suspended, err := send.Suspend()
+	c.Assert(err, IsNil)
+	c.Assert(suspended, DeepEquals, data)
+	c.Assert(func() { send.Encrypt(nil, nil, nil) }, PanicMatches, ".*state is invalid")
+	_, err = send.MarshalBinary()
+	c.Assert(err, NotNil)
+	_, err = send.Suspend()
+	c.Assert(err, NotNil)
+
+	var restored CipherState
+	c.Assert(restored.UnmarshalBinary(data), IsNil)
+	c.Assert(restored.n, Equals, uint64(1))
+	msg = restored.Encrypt(nil, nil, []byte("two"))
+	res, err := recv.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "two")
+
+	c.Assert(new(CipherState).UnmarshalBinary(data[:41]), NotNil)
+	bad := append([]byte{2}, data[1:]...)
+	c.Assert(new(CipherState).UnmarshalBinary(bad), NotNil)
+	bad = append(append([]byte(nil), data[:42]...), "25519_Nope_BLAKE2s"...)
+	c.Assert(new(CipherState).UnmarshalBinary(bad), ErrorMatches, ".*unknown cipher.*")
+}
+
+func (NoiseSuite) TestCipherStateMarshalOneWay(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	staticR, _ := cs.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeN, Initiator: true, PeerStatic: staticR.Public})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeN, StaticKeypair: staticR})
+	msg, csI, _, _ := hsI.WriteMessage(nil, nil)
+	_, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	data, err := csR.MarshalBinary()
+	c.Assert(err, IsNil)
+	var restored CipherState
+	c.Assert(restored.UnmarshalBinary(data), IsNil)
+	c.Assert(restored.recvOnly, Equals, true)
+	msg = csI.Encrypt(nil, nil, []byte("hi"))
+	res, err := restored.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hi")
+}
+
+func (NoiseSuite) TestHandshakeStateMarshal(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	psk := make([]byte, 32)
+	cfgI := Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI,
+		PresharedKey: psk, PresharedKeyPlacement: 3}
+	cfgR := Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR,
+		PresharedKey: psk, PresharedKeyPlacement: 3}
+	// restore moves hs into a new HandshakeState through its encoding.
+	restore := func(hs *HandshakeState, cfg Config) *HandshakeState {
+		data, err := hs.MarshalBinary()
+		c.Assert(err, IsNil)
+		suspended, err := hs.Suspend()
+		c.Assert(err, IsNil)
+		c.Assert(suspended, DeepEquals, data)
+		_, _, _, err = hs.WriteMessage(nil, nil)
+		c.Assert(err, NotNil)
+		hs, err = NewHandshakeState(cfg)
+		c.Assert(err, IsNil)
+		c.Assert(hs.UnmarshalBinary(data), IsNil)
+		return hs
+	}
+
+	hsI, _ := NewHandshakeState(cfgI)
+	hsR, _ := NewHandshakeState(cfgR)
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("one"))
+	hsI = restore(hsI, cfgI)
+	res, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "one")
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("two"))
+	hsR = restore(hsR, cfgR)
+	res, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "two")
+	hsI = restore(hsI, cfgI)
+	msg, csI0, _, _ := hsI.WriteMessage(nil, []byte("three"))
+	res, csR0, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "three")
+	c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+	c.Assert(hsI.ChannelBinding(), DeepEquals, hsR.ChannelBinding())
+	res, err = csR0.Decrypt(nil, nil, csI0.Encrypt(nil, nil, []byte("four")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "four")
+
+	_, err = hsI.MarshalBinary()
+	c.Assert(err, ErrorMatches, ".*complete")
+}
+
+func (NoiseSuite) TestHandshakeStateUnmarshalErrors(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hs.WriteMessage(nil, nil)
+	data, err := hs.MarshalBinary()
+	c.Assert(err, IsNil)
+
+	other, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(other.UnmarshalBinary(data), ErrorMatches, ".*other role")
+	other, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: make([]byte, 32)})
+	c.Assert(other.UnmarshalBinary(data), ErrorMatches, ".*is for Noise_NN_25519_ChaChaPoly_BLAKE2s.*")
+	other, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	for _, n := range []int{0, 1, 10, len(data) - 1} {
+		c.Assert(other.UnmarshalBinary(data[:n]), NotNil)
+	}
+	c.Assert(other.UnmarshalBinary(append(data, 0)), NotNil)
+	c.Assert(other.UnmarshalBinary(data), IsNil)
+}
+
+func (NoiseSuite) TestHandshakeStateUnmarshalPeerStatic(c *C) {
+	// UnmarshalBinary must not write the remote static key into the
+	// caller's Config.PeerStatic.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	other, _ := cs.GenerateKeypair(nil)
+	hs, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: staticR.Public})
+	hs.WriteMessage(nil, nil)
+	data, err := hs.MarshalBinary()
+	c.Assert(err, IsNil)
+
+	peer := append([]byte(nil), other.Public...)
+	restored, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: peer})
+	c.Assert(restored.UnmarshalBinary(data), IsNil)
+	c.Assert(peer, DeepEquals, other.Public)
+	c.Assert(restored.PeerStatic(), DeepEquals, staticR.Public)
+}
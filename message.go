@@ -0,0 +1,169 @@
+package noise
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// A MessageTransport carries whole messages, such as the binary frames of a
+// WebSocket connection, so that Noise messages need no framing of their own.
+type MessageTransport interface {
+	// ReadMessage returns the next message, which need only be valid until
+	// the next call.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage sends msg as a single message.
+	WriteMessage(msg []byte) error
+}
+
+// A MessageConn runs a handshake and then exchanges transport messages over a
+// MessageTransport, one Noise message to each of its messages. Handshake
+// messages carry no payload. Messages longer than the Config's MaxMsgLen are
+// neither sent nor accepted.
+//
+// Send and Receive may be called concurrently with each other, but not with
+// themselves.
+type MessageConn struct {
+	t      MessageTransport
+	config Config
+
+	handshakeMu   sync.Mutex
+	handshakeDone uint32 // set atomically once the handshake has succeeded
+	handshakeErr  error
+	hs            *HandshakeState
+	maxMsgLen     int
+
+	inMu sync.Mutex
+	in   *CipherState
+
+	outMu  sync.Mutex
+	out    *CipherState
+	outBuf []byte
+}
+
+// NewMessageConn returns a MessageConn that runs a handshake over t in the
+// role given by config.Initiator.
+func NewMessageConn(t MessageTransport, config Config) *MessageConn {
+	return &MessageConn{t: t, config: config}
+}
+
+// Handshake runs the handshake if it has not yet been run. Send and Receive
+// call it as needed.
+func (c *MessageConn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is like Handshake, passing ctx to a static key that
+// implements ContextPrivateDH. The MessageTransport is not interrupted when
+// ctx is done. A failed handshake cannot be retried.
+func (c *MessageConn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshakeErr != nil || atomic.LoadUint32(&c.handshakeDone) == 1 {
+		return c.handshakeErr
+	}
+	c.handshakeErr = c.handshake(ctx)
+	if c.handshakeErr == nil {
+		atomic.StoreUint32(&c.handshakeDone, 1)
+	}
+	return c.handshakeErr
+}
+
+func (c *MessageConn) handshake(ctx context.Context) error {
+	if c.config.HalfDuplex {
+		return errors.New("noise: MessageConn does not support HalfDuplex")
+	}
+	hs, err := NewHandshakeState(c.config)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for {
+		var cs1, cs2 *CipherState
+		if hs.shouldWrite {
+			buf, cs1, cs2, err = hs.WriteMessageContext(ctx, buf[:0], nil)
+			if err != nil {
+				return err
+			}
+			if len(buf) > hs.maxMsgLen {
+				return errors.New("noise: message is too long")
+			}
+			if err := c.t.WriteMessage(buf); err != nil {
+				return err
+			}
+		} else {
+			msg, err := c.t.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if len(msg) > hs.maxMsgLen {
+				return errors.New("noise: message is too long")
+			}
+			if _, cs1, cs2, err = hs.ReadMessageContext(ctx, nil, msg); err != nil {
+				return err
+			}
+		}
+		if cs1 != nil {
+			if c.config.Initiator {
+				c.out, c.in = cs1, cs2
+			} else {
+				c.in, c.out = cs1, cs2
+			}
+			c.hs, c.maxMsgLen = hs, hs.maxMsgLen
+			return nil
+		}
+	}
+}
+
+// Send encrypts payload into a transport message and sends it, running the
+// handshake first if needed. It fails if the message would be longer than
+// MaxMsgLen.
+func (c *MessageConn) Send(payload []byte) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.out == nil {
+		return errors.New("noise: MessageConn cannot send in a one-way pattern")
+	}
+	if len(payload)+MACLen > c.maxMsgLen {
+		return errors.New("noise: message is too long")
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	c.outBuf = c.out.Encrypt(c.outBuf[:0], nil, payload)
+	return c.t.WriteMessage(c.outBuf)
+}
+
+// Receive receives a transport message and appends its payload to out,
+// running the handshake first if needed. Messages must arrive in the order in
+// which they were sent, and once one fails to decrypt the MessageConn should
+// be closed.
+func (c *MessageConn) Receive(out []byte) ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	if c.in == nil {
+		return nil, errors.New("noise: MessageConn cannot receive in a one-way pattern")
+	}
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	msg, err := c.t.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > c.maxMsgLen {
+		return nil, errors.New("noise: message is too long")
+	}
+	return c.in.Decrypt(out, nil, msg)
+}
+
+// PeerStatic returns the peer's static public key, or nil before the
+// handshake has completed or if the peer has none.
+func (c *MessageConn) PeerStatic() []byte {
+	if atomic.LoadUint32(&c.handshakeDone) == 0 {
+		return nil
+	}
+	return c.hs.PeerStatic()
+}
@@ -0,0 +1,99 @@
+package noise
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// chanTransport is a MessageTransport over channels, which keep message
+// boundaries as a WebSocket connection does.
+type chanTransport struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (t chanTransport) ReadMessage() ([]byte, error) {
+	msg, ok := <-t.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (t chanTransport) WriteMessage(msg []byte) error {
+	t.out <- append([]byte(nil), msg...)
+	return nil
+}
+
+func messagePair(cfgI, cfgR Config) (*MessageConn, *MessageConn, chan []byte, chan []byte) {
+	a, b := make(chan []byte, 4), make(chan []byte, 4)
+	cfgI.Initiator = true
+	return NewMessageConn(chanTransport{in: b, out: a}, cfgI), NewMessageConn(chanTransport{in: a, out: b}, cfgR), a, b
+}
+
+func (NoiseSuite) TestMessageConn(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	client, server, toServer, _ := messagePair(
+		Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticI, MaxMsgLen: 1000},
+		Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR, MaxMsgLen: 1000},
+	)
+	c.Assert(client.PeerStatic(), IsNil)
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	c.Assert(client.Send([]byte("hello")), IsNil)
+	c.Assert(<-done, IsNil)
+	res, err := server.Receive(nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hello")
+	c.Assert(server.Send([]byte("world")), IsNil)
+	res, err = client.Receive(nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "world")
+	c.Assert(client.PeerStatic(), DeepEquals, staticR.Public)
+	c.Assert(server.PeerStatic(), DeepEquals, staticI.Public)
+
+	// Messages are limited to MaxMsgLen in both directions.
+	c.Assert(client.Send(make([]byte, 1000-MACLen)), IsNil)
+	_, err = server.Receive(nil)
+	c.Assert(err, IsNil)
+	c.Assert(client.Send(make([]byte, 1001-MACLen)), ErrorMatches, ".*too long")
+	toServer <- make([]byte, 1001)
+	_, err = server.Receive(nil)
+	c.Assert(err, ErrorMatches, ".*too long")
+}
+
+func (NoiseSuite) TestMessageConnOneWay(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	client, server, _, _ := messagePair(
+		Config{CipherSuite: cs, Pattern: HandshakeN, PeerStatic: staticR.Public},
+		Config{CipherSuite: cs, Pattern: HandshakeN, StaticKeypair: staticR},
+	)
+	c.Assert(client.Send([]byte("one way")), IsNil)
+	res, err := server.Receive(nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "one way")
+	c.Assert(server.Send(nil), ErrorMatches, ".*one-way pattern")
+	_, err = client.Receive(nil)
+	c.Assert(err, ErrorMatches, ".*one-way pattern")
+}
+
+// errTransport fails every operation.
+type errTransport struct{}
+
+func (errTransport) ReadMessage() ([]byte, error) { return nil, errors.New("closed") }
+func (errTransport) WriteMessage([]byte) error    { return errors.New("closed") }
+
+func (NoiseSuite) TestMessageConnHandshakeError(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	conn := NewMessageConn(errTransport{}, Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	c.Assert(conn.Send(nil), ErrorMatches, "closed")
+	_, err := conn.Receive(nil)
+	c.Assert(err, ErrorMatches, "closed")
+	c.Assert(strings.Contains(NewMessageConn(errTransport{}, Config{HalfDuplex: true}).Handshake().Error(), "HalfDuplex"), Equals, true)
+}
@@ -0,0 +1,48 @@
+package noise
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"io"
+)
+
+// KEMMLKEM768 is the ML-KEM-768 key encapsulation mechanism from FIPS 203.
+// Private keys are the 64-byte seed form. Key generation reads the seed from
+// the rng passed to GenerateKEMKeypair; encapsulation always uses
+// crypto/rand, as crypto/mlkem does not accept a source of randomness.
+var KEMMLKEM768 KEM = kemMLKEM768{}
+
+type kemMLKEM768 struct{}
+
+func (kemMLKEM768) GenerateKEMKeypair(rng io.Reader) (KEMKey, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(rng, seed); err != nil {
+		return KEMKey{}, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return KEMKey{}, err
+	}
+	return KEMKey{Private: seed, Public: dk.EncapsulationKey().Bytes()}, nil
+}
+
+func (kemMLKEM768) Encapsulate(rng io.Reader, publicKey []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, errors.New("noise: invalid ML-KEM-768 public key")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	return ciphertext, sharedSecret, nil
+}
+
+func (kemMLKEM768) Decapsulate(privateKey, ciphertext []byte) ([]byte, error) {
+	dk, err := mlkem.NewDecapsulationKey768(privateKey)
+	if err != nil {
+		return nil, errors.New("noise: invalid ML-KEM-768 private key")
+	}
+	return dk.Decapsulate(ciphertext)
+}
+
+func (kemMLKEM768) KEMPublicKeyLen() int  { return KEMMLKEM768PublicKeyLen }
+func (kemMLKEM768) KEMCiphertextLen() int { return KEMMLKEM768CiphertextLen }
+func (kemMLKEM768) KEMName() string       { return "MLKEM768" }
@@ -0,0 +1,67 @@
+package noise
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestMLKEM768(c *C) {
+	rng := new(RandomInc)
+	k, err := KEMMLKEM768.GenerateKEMKeypair(rng)
+	c.Assert(err, IsNil)
+	c.Assert(k.Private, HasLen, 64)
+	c.Assert(k.Public, HasLen, KEMMLKEM768.KEMPublicKeyLen())
+
+	ct, ss, err := KEMMLKEM768.Encapsulate(rng, k.Public)
+	c.Assert(err, IsNil)
+	c.Assert(ct, HasLen, KEMMLKEM768.KEMCiphertextLen())
+	ss2, err := KEMMLKEM768.Decapsulate(k.Private, ct)
+	c.Assert(err, IsNil)
+	c.Assert(ss2, DeepEquals, ss)
+
+	_, _, err = KEMMLKEM768.Encapsulate(rng, k.Public[1:])
+	c.Assert(err, NotNil)
+	_, err = KEMMLKEM768.Decapsulate(k.Private, ct[1:])
+	c.Assert(err, NotNil)
+}
+
+func (NoiseSuite) TestMLKEM768Handshake(c *C) {
+	name := "Noise_XXhfs_25519+MLKEM768_ChaChaPoly_SHA256"
+	cfgI, err := ParseProtocolName(name)
+	c.Assert(err, IsNil)
+	cfgR, _ := ParseProtocolName(name)
+	cfgI.Initiator = true
+	cfgI.StaticKeypair, _ = cfgI.CipherSuite.GenerateKeypair(nil)
+	cfgR.StaticKeypair, _ = cfgR.CipherSuite.GenerateKeypair(nil)
+	hsI, err := NewHandshakeState(cfgI)
+	c.Assert(err, IsNil)
+	hsR, err := NewHandshakeState(cfgR)
+	c.Assert(err, IsNil)
+	c.Assert(hsI.ProtocolName(), Equals, name)
+
+	var csI, csR *CipherState
+	writer, reader := hsI, hsR
+	for csI == nil {
+		msg, cs1, _, err := writer.WriteMessage(nil, nil)
+		c.Assert(err, IsNil)
+		_, cs2, _, err := reader.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		csI, csR = cs1, cs2
+		writer, reader = reader, writer
+	}
+	c.Assert(bytes.Equal(hsI.ChannelBinding(), hsR.ChannelBinding()), Equals, true)
+	ct := csI.Encrypt(nil, nil, []byte("ping"))
+	pt, err := csR.Decrypt(nil, nil, ct)
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "ping")
+
+	for _, bad := range []string{
+		"Noise_XX_25519+MLKEM768_ChaChaPoly_SHA256",
+		"Noise_XXhfs_25519_ChaChaPoly_SHA256",
+		"Noise_XXhfs_25519+Kyber1024_ChaChaPoly_SHA256",
+	} {
+		_, err := ParseProtocolName(bad)
+		c.Assert(err, NotNil, Commentf("%s", bad))
+	}
+}
@@ -0,0 +1,456 @@
+// Package mux runs many logical byte streams over a single connection, such
+// as a noise.Conn, so that an application needs only one handshake and one
+// pair of CipherStates for all of them.
+//
+// The framing follows yamux. Each frame has a 12-byte header: a version byte,
+// a type byte, 16 bits of flags, a 32-bit stream ID and a 32-bit length, all
+// big-endian. Data frames carry length bytes of stream data, and window update
+// frames grant the peer length more bytes of credit on a stream. The SYN flag
+// opens a stream, FIN half-closes it and RST aborts it. Each stream starts
+// with InitialWindow bytes of credit in each direction, so that a slow reader
+// holds up only its own stream.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// InitialWindow is the number of bytes that may be sent on a new stream
+// before the receiver grants more credit.
+const InitialWindow = 256 * 1024
+
+// maxDataLen is the largest payload of a data frame.
+const maxDataLen = 32 * 1024
+
+// acceptBacklog is the number of streams opened by the peer that may wait
+// for AcceptStream; streams opened beyond it are reset.
+const acceptBacklog = 256
+
+// Frame types.
+const (
+	typeData byte = iota
+	typeWindowUpdate
+	typeGoAway
+)
+
+// Frame flags, with the values yamux uses. ACK is never sent.
+const (
+	flagSYN uint16 = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+const headerLen = 12
+
+var (
+	// ErrSessionClosed is returned by operations on a closed Session and its
+	// streams.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	// ErrStreamReset is returned by operations on a stream that the peer has
+	// reset.
+	ErrStreamReset = errors.New("mux: stream reset by peer")
+
+	// ErrStreamClosed is returned by Write on a stream after Close.
+	ErrStreamClosed = errors.New("mux: stream closed")
+
+	errProtocol = errors.New("mux: protocol error")
+)
+
+// A Session multiplexes streams over a connection. One peer must create it
+// with Client and the other with Server, so that they open streams with
+// different IDs.
+type Session struct {
+	conn io.ReadWriteCloser
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // why the session closed, once it has
+	closed  chan struct{}
+
+	accept chan *Stream
+}
+
+// Client returns a Session over conn for the peer that opens streams with
+// odd IDs.
+func Client(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 1)
+}
+
+// Server returns a Session over conn for the peer that opens streams with
+// even IDs.
+func Server(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		closed:  make(chan struct{}),
+		accept:  make(chan *Stream, acceptBacklog),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// OpenStream opens a new stream. The peer receives it from AcceptStream.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	if id > 1<<32-3 {
+		s.mu.Unlock()
+		return nil, errors.New("mux: stream IDs exhausted")
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// Close closes the connection and every stream.
+func (s *Session) Close() error {
+	s.writeFrame(typeGoAway, 0, 0, 0, nil)
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+// Closed returns a channel that is closed when the session closes, because
+// of Close, the peer or an error on the connection.
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// shutdown closes the session with err, if it is not already closed.
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = nil
+	close(s.closed)
+	s.mu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// writeFrame writes a frame as a single Write to the connection, so that over
+// a noise.Conn it becomes a single transport message where it fits.
+func (s *Session) writeFrame(typ byte, flags uint16, id, length uint32, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.closed:
+		return s.closeErr()
+	default:
+	}
+	b := append(s.writeBuf[:0], 0, typ)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = binary.BigEndian.AppendUint32(b, length)
+	b = append(b, data...)
+	s.writeBuf = b
+	if _, err := s.conn.Write(b); err != nil {
+		go s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var hdr [headerLen]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.shutdown(err)
+			return
+		}
+		if hdr[0] != 0 {
+			s.shutdown(errProtocol)
+			return
+		}
+		typ, flags := hdr[1], binary.BigEndian.Uint16(hdr[2:])
+		id, length := binary.BigEndian.Uint32(hdr[4:]), binary.BigEndian.Uint32(hdr[8:])
+		if typ == typeGoAway {
+			s.shutdown(ErrSessionClosed)
+			return
+		}
+		if typ > typeGoAway || id == 0 {
+			s.shutdown(errProtocol)
+			return
+		}
+		var data []byte
+		if typ == typeData {
+			if length > InitialWindow {
+				s.shutdown(errProtocol)
+				return
+			}
+			if cap(buf) < int(length) {
+				buf = make([]byte, length)
+			}
+			data = buf[:length]
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				s.shutdown(err)
+				return
+			}
+		}
+		st, err := s.stream(id, flags)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		if st == nil {
+			// A stream that has been closed, or that could not be accepted.
+			continue
+		}
+		if typ == typeWindowUpdate {
+			st.grant(length)
+		} else if err := st.receive(data); err != nil {
+			s.shutdown(err)
+			return
+		}
+		if flags&flagFIN != 0 {
+			st.receiveFIN()
+		}
+		if flags&flagRST != 0 {
+			st.fail(ErrStreamReset)
+			s.remove(id)
+		}
+	}
+}
+
+// stream returns the stream for a frame, creating it if the frame opens one.
+// It returns nil for frames of streams that are gone.
+func (s *Session) stream(id uint32, flags uint16) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	st := s.streams[id]
+	if flags&flagSYN == 0 {
+		return st, nil
+	}
+	if st != nil || id%2 == s.nextID%2 {
+		return nil, errProtocol
+	}
+	st = newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+		return st, nil
+	default:
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return nil, nil
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// A Stream is a logical byte stream within a Session. Read and Write may be
+// called concurrently with each other, but not with themselves.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte // data received and not yet read
+	consumed   uint32 // bytes read since the last window update
+	sendWindow uint32 // bytes that may be sent
+	finRecv    bool
+	finSent    bool
+	err        error // reset or session failure
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{s: s, id: id, sendWindow: InitialWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the ID of the stream.
+func (st *Stream) ID() uint32 { return st.id }
+
+// Read reads data from the stream. It returns io.EOF once the peer has closed
+// the stream and all its data has been read.
+func (st *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.finRecv && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, st.buf)
+	st.buf = st.buf[n:]
+	st.consumed += uint32(n)
+	var update uint32
+	if st.consumed >= InitialWindow/2 && !st.finRecv {
+		update, st.consumed = st.consumed, 0
+	}
+	st.mu.Unlock()
+	if update > 0 {
+		st.s.writeFrame(typeWindowUpdate, 0, st.id, update, nil)
+	}
+	return n, nil
+}
+
+// Write writes data to the stream, waiting for credit from the peer as
+// needed.
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.finSent {
+			st.cond.Wait()
+		}
+		if st.err != nil || st.finSent {
+			err := st.err
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			st.mu.Unlock()
+			return n, err
+		}
+		chunk := b
+		if uint32(len(chunk)) > st.sendWindow {
+			chunk = chunk[:st.sendWindow]
+		}
+		if len(chunk) > maxDataLen {
+			chunk = chunk[:maxDataLen]
+		}
+		st.sendWindow -= uint32(len(chunk))
+		st.mu.Unlock()
+		if err := st.s.writeFrame(typeData, 0, st.id, uint32(len(chunk)), chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close half-closes the stream: the peer reads io.EOF once it has read the
+// data already written, but may go on writing to the stream until it closes
+// it in turn.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+	return st.s.writeFrame(typeData, flagFIN, st.id, 0, nil)
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() error {
+	st.fail(ErrStreamReset)
+	st.s.remove(st.id)
+	return st.s.writeFrame(typeWindowUpdate, flagRST, st.id, 0, nil)
+}
+
+// receive adds data from the peer to the stream.
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.finRecv {
+		return errProtocol
+	}
+	if len(st.buf)+int(st.consumed)+len(data) > InitialWindow {
+		// The peer sent more than the credit it was given.
+		return errProtocol
+	}
+	if st.err == nil {
+		st.buf = append(st.buf, data...)
+		st.cond.Broadcast()
+	}
+	return nil
+}
+
+func (st *Stream) receiveFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+		st.buf = nil
+	}
+	st.cond.Broadcast()
+}
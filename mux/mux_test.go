@@ -0,0 +1,159 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MuxSuite struct{}
+
+var _ = Suite(MuxSuite{})
+
+// noisePair returns a client and server Session over a pair of noise.Conns.
+func noisePair() (*Session, *Session) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	a, b := net.Pipe()
+	client := noise.Client(a, noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN})
+	server := noise.Server(b, noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN})
+	return Client(client), Server(server)
+}
+
+func (MuxSuite) TestStreams(c *C) {
+	client, server := noisePair()
+	defer client.Close()
+	defer server.Close()
+
+	// The server echoes every stream.
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		st, err := client.OpenStream()
+		c.Assert(err, IsNil)
+		c.Assert(st.ID(), Equals, uint32(2*i+1))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 100000*(i+1))
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			got, err := io.ReadAll(st)
+			if err == nil && !bytes.Equal(got, data) {
+				err = io.ErrShortWrite
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+}
+
+func (MuxSuite) TestFlowControl(c *C) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	slow, err := client.OpenStream()
+	c.Assert(err, IsNil)
+	fast, err := client.OpenStream()
+	c.Assert(err, IsNil)
+	slowR, err := server.AcceptStream()
+	c.Assert(err, IsNil)
+	fastR, err := server.AcceptStream()
+	c.Assert(err, IsNil)
+
+	// A write beyond the window blocks until the reader catches up...
+	done := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(make([]byte, InitialWindow+1000))
+		done <- err
+	}()
+	select {
+	case <-done:
+		c.Fatal("write did not wait for credit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// ...without holding up other streams.
+	go fast.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(fastR, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "hello")
+
+	_, err = io.ReadFull(slowR, make([]byte, InitialWindow+1000))
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+}
+
+func (MuxSuite) TestResetAndClose(c *C) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	c.Assert(err, IsNil)
+	peer, err := server.AcceptStream()
+	c.Assert(err, IsNil)
+	c.Assert(peer.Reset(), IsNil)
+	_, err = st.Read(make([]byte, 1))
+	c.Assert(err, Equals, ErrStreamReset)
+
+	st, err = client.OpenStream()
+	c.Assert(err, IsNil)
+	c.Assert(st.Close(), IsNil)
+	_, err = st.Write([]byte("x"))
+	c.Assert(err, Equals, ErrStreamClosed)
+	peer, err = server.AcceptStream()
+	c.Assert(err, IsNil)
+	_, err = peer.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// Closing the session closes both ends and their streams.
+	c.Assert(client.Close(), IsNil)
+	<-server.Closed()
+	_, err = server.AcceptStream()
+	c.Assert(err, Equals, ErrSessionClosed)
+	_, err = peer.Write([]byte("x"))
+	c.Assert(err, Equals, ErrSessionClosed)
+	_, err = client.OpenStream()
+	c.Assert(err, Equals, ErrSessionClosed)
+}
+
+func (MuxSuite) TestProtocolError(c *C) {
+	a, b := net.Pipe()
+	server := Server(b)
+	// A stream opened with the server's parity is a protocol error.
+	go a.Write([]byte{0, typeWindowUpdate, 0, byte(flagSYN), 0, 0, 0, 2, 0, 0, 0, 0})
+	<-server.Closed()
+	_, err := server.AcceptStream()
+	c.Assert(err, Equals, errProtocol)
+	a.Close()
+}
@@ -0,0 +1,42 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SelectProtocol returns the first protocol name in the initiator's ordered
+// preference list that the responder also supports, so that both sides
+// arrive at the same choice from the same lists regardless of the order of
+// the responder's list.
+func SelectProtocol(initiator, responder []string) (string, error) {
+	for _, name := range initiator {
+		for _, r := range responder {
+			if name == r {
+				return name, nil
+			}
+		}
+	}
+	return "", errors.New("noise: no protocol in common")
+}
+
+// NegotiationPrologue returns a prologue that binds the initiator's offered
+// protocol names, in order, and the selected name into the handshake. Both
+// peers must use it as Config.Prologue, so that an attacker who removes
+// entries from the offer to force a weaker choice causes the handshake to
+// fail.
+func NegotiationPrologue(offered []string, selected string) []byte {
+	n := 2 + len(selected)
+	for _, name := range offered {
+		n += 2 + len(name)
+	}
+	b := make([]byte, 0, len("NoiseNegotiation")+2+n)
+	b = append(b, "NoiseNegotiation"...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(offered)))
+	for _, name := range offered {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(name)))
+		b = append(b, name...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(selected)))
+	return append(b, selected...)
+}
@@ -0,0 +1,43 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestSelectProtocol(c *C) {
+	initiator := []string{
+		"Noise_XX_25519_AESGCM_SHA256",
+		"Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		"Noise_NN_25519_ChaChaPoly_SHA256",
+	}
+	responder := []string{
+		"Noise_NN_25519_ChaChaPoly_SHA256",
+		"Noise_XX_25519_ChaChaPoly_BLAKE2s",
+	}
+	name, err := SelectProtocol(initiator, responder)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	_, err = SelectProtocol(initiator, []string{"Noise_IK_25519_AESGCM_SHA256"})
+	c.Assert(err, NotNil)
+}
+
+func (NoiseSuite) TestNegotiationPrologue(c *C) {
+	offered := []string{"Noise_NN_25519_AESGCM_SHA256", "Noise_NN_25519_ChaChaPoly_SHA256"}
+	name, _ := SelectProtocol(offered, offered)
+	cfgI, _ := ParseProtocolName(name)
+	cfgR, _ := ParseProtocolName(name)
+	cfgI.Initiator = true
+	cfgI.Prologue = NegotiationPrologue(offered, name)
+
+	// The responder saw an offer with the first entry stripped.
+	cfgR.Prologue = NegotiationPrologue(offered[1:], name)
+	hsI, _ := NewHandshakeState(cfgI)
+	hsR, _ := NewHandshakeState(cfgR)
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, NotNil)
+
+	c.Assert(NegotiationPrologue([]string{"ab", "c"}, "c"), Not(DeepEquals), NegotiationPrologue([]string{"a", "bc"}, "c"))
+}
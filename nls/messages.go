@@ -0,0 +1,219 @@
+package nls
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A Request is the negotiation data of the client's first message, the
+// NoiseLinkNegotiationDataRequest1 protobuf message.
+type Request struct {
+	// ServerName is the name of the server the client wants to reach, for a
+	// server with several identities. Field 1.
+	ServerName string
+
+	// InitialProtocol is the name of the protocol of the Noise message that
+	// follows. Field 2.
+	InitialProtocol string
+
+	// SwitchProtocols are the protocols the client will accept the server
+	// switching to. Field 3.
+	SwitchProtocols []string
+
+	// RetryProtocols are the protocols the client can retry with. Field 4.
+	RetryProtocols []string
+
+	// RejectedProtocol is set after a retry to the initial protocol of the
+	// client's previous first message. Field 5.
+	RejectedProtocol string
+
+	// PSKID identifies the pre-shared key of protocols with a psk modifier.
+	// Field 6.
+	PSKID []byte
+}
+
+// A Response is the negotiation data of the server's answer to the client's
+// first message, the NoiseLinkNegotiationDataResponse1 protobuf message. At
+// most one of its fields is set, and an acceptance is empty.
+type Response struct {
+	// SwitchProtocol is the protocol the server has switched to. Field 3.
+	SwitchProtocol string
+
+	// RetryProtocol is the protocol the client should retry with. Field 4.
+	RetryProtocol string
+
+	// Rejected is the reason the server rejected the handshake. Field 5.
+	Rejected string
+}
+
+// A HandshakePayload is the body of the payload of a handshake message, the
+// NoiseLinkHandshakePayload1 protobuf message.
+type HandshakePayload struct {
+	// EvidenceRequestTypes are the types of evidence the sender wants about
+	// the recipient's static key. Field 1.
+	EvidenceRequestTypes []string
+
+	// Evidence is evidence about the sender's static key, such as a
+	// certificate. Its types and blobs are fields 2 and 3, in the same order.
+	Evidence []Evidence
+}
+
+// Evidence is a blob of some type that supports a party's static key.
+type Evidence struct {
+	Type string
+	Blob []byte
+}
+
+var errMalformed = errors.New("nls: malformed message")
+
+// Marshal returns the protobuf encoding of r.
+func (r *Request) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.ServerName)
+	b = appendString(b, 2, r.InitialProtocol)
+	for _, p := range r.SwitchProtocols {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	for _, p := range r.RetryProtocols {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	b = appendString(b, 5, r.RejectedProtocol)
+	return appendString(b, 6, string(r.PSKID))
+}
+
+// Unmarshal decodes the protobuf encoding of a Request into r. Unknown
+// fields are ignored.
+func (r *Request) Unmarshal(b []byte) error {
+	*r = Request{}
+	return unmarshal(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			r.ServerName = string(v)
+		case 2:
+			r.InitialProtocol = string(v)
+		case 3:
+			r.SwitchProtocols = append(r.SwitchProtocols, string(v))
+		case 4:
+			r.RetryProtocols = append(r.RetryProtocols, string(v))
+		case 5:
+			r.RejectedProtocol = string(v)
+		case 6:
+			r.PSKID = append([]byte(nil), v...)
+		}
+	})
+}
+
+// Marshal returns the protobuf encoding of r.
+func (r *Response) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 3, r.SwitchProtocol)
+	b = appendString(b, 4, r.RetryProtocol)
+	return appendString(b, 5, r.Rejected)
+}
+
+// Unmarshal decodes the protobuf encoding of a Response into r. Unknown
+// fields are ignored, and if several of the fields are present the last one
+// wins, as for a protobuf oneof.
+func (r *Response) Unmarshal(b []byte) error {
+	*r = Response{}
+	return unmarshal(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 3:
+			*r = Response{SwitchProtocol: string(v)}
+		case 4:
+			*r = Response{RetryProtocol: string(v)}
+		case 5:
+			*r = Response{Rejected: string(v)}
+		}
+	})
+}
+
+// Marshal returns the protobuf encoding of p.
+func (p *HandshakePayload) Marshal() []byte {
+	var b []byte
+	for _, t := range p.EvidenceRequestTypes {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, t)
+	}
+	for _, e := range p.Evidence {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, e.Type)
+	}
+	for _, e := range p.Evidence {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.Blob)
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf encoding of a HandshakePayload into p.
+// Unknown fields are ignored. It fails if the numbers of evidence types and
+// blobs differ.
+func (p *HandshakePayload) Unmarshal(b []byte) error {
+	*p = HandshakePayload{}
+	var types []string
+	var blobs [][]byte
+	err := unmarshal(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			p.EvidenceRequestTypes = append(p.EvidenceRequestTypes, string(v))
+		case 2:
+			types = append(types, string(v))
+		case 3:
+			blobs = append(blobs, append([]byte(nil), v...))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(types) != len(blobs) {
+		return errMalformed
+	}
+	for i, t := range types {
+		p.Evidence = append(p.Evidence, Evidence{Type: t, Blob: blobs[i]})
+	}
+	return nil
+}
+
+// appendString appends a length-delimited field to b, unless v is empty,
+// which protobuf encodes by omission.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// unmarshal calls field for each length-delimited field of b. All the known
+// fields of these messages are strings or bytes, so a known field number
+// with another wire type is malformed.
+func unmarshal(b []byte, field func(num protowire.Number, v []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			if num <= 6 {
+				return errMalformed
+			}
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return errMalformed
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return errMalformed
+		}
+		field(num, v)
+		b = b[n:]
+	}
+	return nil
+}
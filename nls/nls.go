@@ -0,0 +1,320 @@
+// Package nls implements NoiseLingoSocket (NLS), a negotiated protocol on top
+// of NoiseSocket whose negotiation data and handshake payloads are protobuf
+// messages.
+//
+// The client's first message names the server it wants to reach, the
+// protocol of the Noise message it carries, the protocols it will accept the
+// server switching to or retrying with, and the ID of any pre-shared key. The
+// server accepts the initial protocol if it supports it, otherwise switches
+// to a protocol the client offered, asks the client to retry with one, or
+// rejects the handshake.
+//
+// Handshake payloads carry requests for evidence about the recipient's static
+// key, such as certificates, and the evidence sent in answer. Each party sends
+// its own requests in the first payload it writes, and its evidence in the
+// first payload it writes after reading the peer's requests.
+//
+// The message types are version 1 of those in the NLS specification. Only the
+// fields described here are supported, and unknown fields are ignored.
+// Protocols with the fallback modifier are not supported.
+package nls
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/flynn/noise"
+	"github.com/flynn/noise/noisesocket"
+)
+
+// ClientConfig is the configuration of an NLS client.
+type ClientConfig struct {
+	// Config is the template for every handshake. Its CipherSuite, Pattern
+	// and pre-shared key placements are replaced by those of the protocol in
+	// use, and Initiator and Prologue are set by the noisesocket package.
+	Config noise.Config
+
+	// ServerName is sent to the server to choose among its identities.
+	ServerName string
+
+	// InitialProtocol is the name of the protocol of the first message.
+	InitialProtocol string
+
+	// SwitchProtocols and RetryProtocols are the names of the protocols that
+	// the client will accept the server switching to, and that it will retry
+	// with if the server asks.
+	SwitchProtocols []string
+	RetryProtocols  []string
+
+	// PSKID identifies Config.PresharedKey to the server.
+	PSKID []byte
+
+	Evidence EvidenceConfig
+
+	// Padding, if positive, pads the payload of every transport message to a
+	// multiple of Padding bytes.
+	Padding int
+}
+
+// ServerConfig is the configuration of an NLS server.
+type ServerConfig struct {
+	// Config is the template for every handshake, as for ClientConfig.
+	Config noise.Config
+
+	// GetConfig, if not nil, returns the template for a client that asked
+	// for serverName, in place of Config.
+	GetConfig func(serverName string) (noise.Config, error)
+
+	// Protocols are the names of the protocols the server supports, in order
+	// of preference. The server accepts the client's initial protocol if it
+	// is one of these, and otherwise switches to or asks the client to retry
+	// with the first of them that the client offered.
+	Protocols []string
+
+	// PresharedKey returns the pre-shared key identified by pskID, for
+	// protocols with a psk modifier. If it is nil, the template's
+	// PresharedKey is used.
+	PresharedKey func(serverName string, pskID []byte) ([]byte, error)
+
+	Evidence EvidenceConfig
+
+	// Padding, if positive, pads the payload of every transport message to a
+	// multiple of Padding bytes.
+	Padding int
+}
+
+// EvidenceConfig is how a party exchanges evidence about static keys.
+type EvidenceConfig struct {
+	// RequestTypes are the types of evidence to ask the peer for.
+	RequestTypes []string
+
+	// Get, if not nil, returns the evidence to send about the local static
+	// key, given the types the peer asked for.
+	Get func(requestTypes []string) ([]Evidence, error)
+
+	// Verify, if not nil, is called once the handshake has completed with
+	// the peer's static key, which may be nil, and all the evidence the peer
+	// sent, which may be none. The handshake fails if it returns an error.
+	Verify func(peerStatic []byte, evidence []Evidence) error
+}
+
+// Client returns a new noisesocket.Conn that runs an NLS handshake as the
+// client over conn. It fails if InitialProtocol is not a supported protocol.
+func Client(conn net.Conn, config ClientConfig) (*noisesocket.Conn, error) {
+	payloads := &payloadHandler{config: config.Evidence}
+	template := config.Config
+	req := Request{
+		ServerName:      config.ServerName,
+		InitialProtocol: config.InitialProtocol,
+		SwitchProtocols: config.SwitchProtocols,
+		RetryProtocols:  config.RetryProtocols,
+		PSKID:           config.PSKID,
+	}
+	initial, err := protocolConfig(template, config.InitialProtocol)
+	if err != nil {
+		return nil, err
+	}
+	negotiate := func(negData []byte, hasMessage bool) (noisesocket.Response, error) {
+		var resp Response
+		if err := resp.Unmarshal(negData); err != nil {
+			return noisesocket.Response{}, err
+		}
+		switch {
+		case resp.SwitchProtocol != "":
+			if !hasMessage || !contains(config.SwitchProtocols, resp.SwitchProtocol) {
+				return noisesocket.Response{}, errors.New("nls: unexpected switch to " + strconv.Quote(resp.SwitchProtocol))
+			}
+			cfg, err := protocolConfig(template, resp.SwitchProtocol)
+			if err != nil {
+				return noisesocket.Response{}, err
+			}
+			cfg.Initiator = false
+			// The server did not read the first payload.
+			payloads.reset()
+			return noisesocket.Response{Action: noisesocket.Switch, Config: cfg}, nil
+		case resp.RetryProtocol != "":
+			if hasMessage || !contains(config.RetryProtocols, resp.RetryProtocol) {
+				return noisesocket.Response{}, errors.New("nls: unexpected retry with " + strconv.Quote(resp.RetryProtocol))
+			}
+			cfg, err := protocolConfig(template, resp.RetryProtocol)
+			if err != nil {
+				return noisesocket.Response{}, err
+			}
+			retry := Request{
+				ServerName:       config.ServerName,
+				InitialProtocol:  resp.RetryProtocol,
+				RejectedProtocol: config.InitialProtocol,
+				PSKID:            config.PSKID,
+			}
+			payloads.reset()
+			return noisesocket.Response{Action: noisesocket.Retry, Config: cfg, NegotiationData: retry.Marshal()}, nil
+		case resp.Rejected != "" || !hasMessage:
+			return noisesocket.Response{}, &RejectedError{Reason: resp.Rejected}
+		}
+		return noisesocket.Response{Action: noisesocket.Accept}, nil
+	}
+	return noisesocket.Client(conn, noisesocket.ClientConfig{
+		Config:          initial,
+		NegotiationData: req.Marshal(),
+		Negotiate:       negotiate,
+		Payloads:        payloads,
+		Padding:         config.Padding,
+	}), nil
+}
+
+// Server returns a new noisesocket.Conn that runs an NLS handshake as the
+// server over conn.
+func Server(conn net.Conn, config ServerConfig) *noisesocket.Conn {
+	retried := false
+	negotiate := func(negData []byte) (noisesocket.Response, error) {
+		var req Request
+		if err := req.Unmarshal(negData); err != nil {
+			return noisesocket.Response{}, err
+		}
+		template := config.Config
+		if config.GetConfig != nil {
+			var err error
+			if template, err = config.GetConfig(req.ServerName); err != nil {
+				return noisesocket.Response{}, err
+			}
+		}
+		action, name := noisesocket.Reject, ""
+		switch {
+		case contains(config.Protocols, req.InitialProtocol):
+			action, name = noisesocket.Accept, req.InitialProtocol
+		case retried:
+		case firstCommon(config.Protocols, req.SwitchProtocols) != "":
+			action, name = noisesocket.Switch, firstCommon(config.Protocols, req.SwitchProtocols)
+		case firstCommon(config.Protocols, req.RetryProtocols) != "":
+			retried = true
+			resp := Response{RetryProtocol: firstCommon(config.Protocols, req.RetryProtocols)}
+			return noisesocket.Response{Action: noisesocket.Retry, NegotiationData: resp.Marshal()}, nil
+		}
+		if action == noisesocket.Reject {
+			resp := Response{Rejected: "no supported protocol"}
+			return noisesocket.Response{Action: noisesocket.Reject, NegotiationData: resp.Marshal()}, nil
+		}
+		cfg, err := protocolConfig(template, name)
+		if err != nil {
+			return noisesocket.Response{}, err
+		}
+		if len(cfg.PresharedKeyPlacements) > 0 && config.PresharedKey != nil {
+			if cfg.PresharedKey, err = config.PresharedKey(req.ServerName, req.PSKID); err != nil {
+				return noisesocket.Response{}, err
+			}
+		}
+		if action == noisesocket.Accept {
+			return noisesocket.Response{Action: noisesocket.Accept, Config: cfg}, nil
+		}
+		cfg.Initiator = true
+		resp := Response{SwitchProtocol: name}
+		return noisesocket.Response{Action: noisesocket.Switch, Config: cfg, NegotiationData: resp.Marshal()}, nil
+	}
+	return noisesocket.Server(conn, noisesocket.ServerConfig{
+		Negotiate: negotiate,
+		Payloads:  &payloadHandler{config: config.Evidence},
+		Padding:   config.Padding,
+	})
+}
+
+// A RejectedError is returned by a client's handshake that the server
+// rejected.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	if e.Reason == "" {
+		return "nls: handshake rejected"
+	}
+	return "nls: handshake rejected: " + e.Reason
+}
+
+// protocolConfig returns template with the CipherSuite, Pattern and
+// pre-shared key placements of the protocol called name.
+func protocolConfig(template noise.Config, name string) (noise.Config, error) {
+	p, err := noise.ParseProtocolName(name)
+	if err != nil {
+		return noise.Config{}, err
+	}
+	if p.Fallback {
+		return noise.Config{}, errors.New("nls: protocol " + strconv.Quote(name) + " has the fallback modifier")
+	}
+	c := template
+	c.CipherSuite = p.CipherSuite
+	c.Pattern = p.Pattern
+	c.PresharedKeyPlacement = p.PresharedKeyPlacement
+	c.PresharedKeyPlacements = p.PresharedKeyPlacements
+	return c, nil
+}
+
+// payloadHandler exchanges evidence in handshake payloads.
+type payloadHandler struct {
+	config       EvidenceConfig
+	sentRequests bool
+	sentEvidence bool
+	peerRequests []string // nil until the peer's requests have been read
+	evidence     []Evidence
+}
+
+// reset forgets what was sent in a first message that the server discarded.
+func (p *payloadHandler) reset() {
+	p.sentRequests = false
+	p.sentEvidence = false
+}
+
+func (p *payloadHandler) WritePayload(*noise.HandshakeState) ([]byte, error) {
+	var payload HandshakePayload
+	if !p.sentRequests {
+		payload.EvidenceRequestTypes = p.config.RequestTypes
+		p.sentRequests = true
+	}
+	if p.peerRequests != nil && !p.sentEvidence && p.config.Get != nil {
+		evidence, err := p.config.Get(p.peerRequests)
+		if err != nil {
+			return nil, err
+		}
+		payload.Evidence = evidence
+		p.sentEvidence = true
+	}
+	return payload.Marshal(), nil
+}
+
+func (p *payloadHandler) ReadPayload(_ *noise.HandshakeState, body []byte) error {
+	var payload HandshakePayload
+	if err := payload.Unmarshal(body); err != nil {
+		return err
+	}
+	if p.peerRequests == nil {
+		p.peerRequests = append([]string{}, payload.EvidenceRequestTypes...)
+	}
+	p.evidence = append(p.evidence, payload.Evidence...)
+	return nil
+}
+
+func (p *payloadHandler) Complete(hs *noise.HandshakeState) error {
+	if p.config.Verify == nil {
+		return nil
+	}
+	return p.config.Verify(hs.PeerStatic(), p.evidence)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// firstCommon returns the first of preferred that is also in offered, or "".
+func firstCommon(preferred, offered []string) string {
+	for _, name := range preferred {
+		if contains(offered, name) {
+			return name
+		}
+	}
+	return ""
+}
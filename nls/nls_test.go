@@ -0,0 +1,247 @@
+package nls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/flynn/noise/noisesocket"
+	"google.golang.org/protobuf/encoding/protowire"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type NLSSuite struct{}
+
+var _ = Suite(NLSSuite{})
+
+// template returns a Config with a new static key.
+func template(c *C) noise.Config {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	key, err := cs.GenerateKeypair(nil)
+	c.Assert(err, IsNil)
+	return noise.Config{StaticKeypair: key}
+}
+
+// run runs a handshake and an exchange of data in each direction, returning
+// the errors of the client and the server.
+func run(client, server *noisesocket.Conn) (error, error) {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(server, buf)
+		if err == nil {
+			_, err = server.Write(buf)
+		}
+		server.Close()
+		done <- err
+	}()
+	_, err := client.Write([]byte("ping"))
+	if err == nil {
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(client, buf)
+	}
+	client.Close()
+	return err, <-done
+}
+
+func (NLSSuite) TestAcceptWithEvidence(c *C) {
+	a, b := net.Pipe()
+	serverConfig := template(c)
+	var serverSaw, clientSaw []Evidence
+	var requested []string
+	client, err := Client(a, ClientConfig{
+		Config:          template(c),
+		ServerName:      "example.com",
+		InitialProtocol: "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		Evidence: EvidenceConfig{
+			RequestTypes: []string{"cert"},
+			Get: func([]string) ([]Evidence, error) {
+				return []Evidence{{Type: "token", Blob: []byte("client")}}, nil
+			},
+			Verify: func(peerStatic []byte, evidence []Evidence) error {
+				if !bytes.Equal(peerStatic, serverConfig.StaticKeypair.Public) {
+					return errors.New("wrong server key")
+				}
+				clientSaw = evidence
+				return nil
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	server := Server(b, ServerConfig{
+		GetConfig: func(name string) (noise.Config, error) {
+			if name != "example.com" {
+				return noise.Config{}, errors.New("unknown server")
+			}
+			return serverConfig, nil
+		},
+		Protocols: []string{"Noise_XX_25519_ChaChaPoly_BLAKE2s"},
+		Evidence: EvidenceConfig{
+			RequestTypes: []string{"token"},
+			Get: func(types []string) ([]Evidence, error) {
+				requested = types
+				return []Evidence{{Type: "cert", Blob: []byte("server")}}, nil
+			},
+			Verify: func(_ []byte, evidence []Evidence) error {
+				serverSaw = evidence
+				return nil
+			},
+		},
+	})
+	errC, errS := run(client, server)
+	c.Assert(errC, IsNil)
+	c.Assert(errS, IsNil)
+	c.Assert(requested, DeepEquals, []string{"cert"})
+	c.Assert(clientSaw, DeepEquals, []Evidence{{Type: "cert", Blob: []byte("server")}})
+	c.Assert(serverSaw, DeepEquals, []Evidence{{Type: "token", Blob: []byte("client")}})
+}
+
+func (NLSSuite) TestVerifyFails(c *C) {
+	a, b := net.Pipe()
+	client, err := Client(a, ClientConfig{
+		Config:          template(c),
+		InitialProtocol: "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		Evidence: EvidenceConfig{Verify: func(_ []byte, evidence []Evidence) error {
+			if len(evidence) == 0 {
+				return errors.New("no evidence")
+			}
+			return nil
+		}},
+	})
+	c.Assert(err, IsNil)
+	server := Server(b, ServerConfig{
+		Config:    template(c),
+		Protocols: []string{"Noise_XX_25519_ChaChaPoly_BLAKE2s"},
+	})
+	errC, errS := run(client, server)
+	c.Assert(errC, ErrorMatches, "no evidence")
+	c.Assert(errS, NotNil)
+}
+
+func (NLSSuite) TestSwitch(c *C) {
+	a, b := net.Pipe()
+	client, err := Client(a, ClientConfig{
+		Config:          template(c),
+		InitialProtocol: "Noise_XX_25519_AESGCM_SHA256",
+		SwitchProtocols: []string{"Noise_NX_25519_ChaChaPoly_BLAKE2s", "Noise_XX_25519_ChaChaPoly_BLAKE2s"},
+	})
+	c.Assert(err, IsNil)
+	server := Server(b, ServerConfig{
+		Config:    template(c),
+		Protocols: []string{"Noise_XX_25519_ChaChaPoly_BLAKE2s", "Noise_NX_25519_ChaChaPoly_BLAKE2s"},
+	})
+	errC, errS := run(client, server)
+	c.Assert(errC, IsNil)
+	c.Assert(errS, IsNil)
+	c.Assert(client.ProtocolName(), Equals, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+}
+
+func (NLSSuite) TestRetryWithPSK(c *C) {
+	a, b := net.Pipe()
+	psk := bytes.Repeat([]byte{7}, 32)
+	clientConfig := template(c)
+	clientConfig.PresharedKey = psk
+	client, err := Client(a, ClientConfig{
+		Config:          clientConfig,
+		InitialProtocol: "Noise_XX_25519_AESGCM_SHA256",
+		RetryProtocols:  []string{"Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s"},
+		PSKID:           []byte("key 1"),
+	})
+	c.Assert(err, IsNil)
+	var pskIDs []string
+	server := Server(b, ServerConfig{
+		Config:    template(c),
+		Protocols: []string{"Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s"},
+		PresharedKey: func(_ string, id []byte) ([]byte, error) {
+			pskIDs = append(pskIDs, string(id))
+			return psk, nil
+		},
+	})
+	errC, errS := run(client, server)
+	c.Assert(errC, IsNil)
+	c.Assert(errS, IsNil)
+	c.Assert(pskIDs, DeepEquals, []string{"key 1"})
+	c.Assert(server.ProtocolName(), Equals, "Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s")
+}
+
+func (NLSSuite) TestReject(c *C) {
+	a, b := net.Pipe()
+	client, err := Client(a, ClientConfig{
+		Config:          template(c),
+		InitialProtocol: "Noise_XX_25519_AESGCM_SHA256",
+	})
+	c.Assert(err, IsNil)
+	server := Server(b, ServerConfig{
+		Config:    template(c),
+		Protocols: []string{"Noise_XX_25519_ChaChaPoly_BLAKE2s"},
+	})
+	errC, errS := run(client, server)
+	c.Assert(errC, DeepEquals, &RejectedError{Reason: "no supported protocol"})
+	c.Assert(errS, Equals, noisesocket.ErrRejected)
+}
+
+func (NLSSuite) TestClientConfigErrors(c *C) {
+	_, err := Client(nil, ClientConfig{InitialProtocol: "Noise_XX"})
+	c.Assert(err, NotNil)
+	_, err = Client(nil, ClientConfig{InitialProtocol: "Noise_XXfallback_25519_AESGCM_SHA256"})
+	c.Assert(err, ErrorMatches, ".*fallback.*")
+}
+
+func (NLSSuite) TestMessages(c *C) {
+	req := Request{
+		ServerName:       "example.com",
+		InitialProtocol:  "Noise_XX_25519_AESGCM_SHA256",
+		SwitchProtocols:  []string{"a", "b"},
+		RetryProtocols:   []string{"c"},
+		RejectedProtocol: "d",
+		PSKID:            []byte{1, 2},
+	}
+	var req2 Request
+	c.Assert(req2.Unmarshal(req.Marshal()), IsNil)
+	c.Assert(req2, DeepEquals, req)
+
+	var resp Response
+	c.Assert(resp.Unmarshal((&Response{RetryProtocol: "c"}).Marshal()), IsNil)
+	c.Assert(resp, DeepEquals, Response{RetryProtocol: "c"})
+	c.Assert(resp.Unmarshal(nil), IsNil)
+	c.Assert(resp, DeepEquals, Response{})
+
+	p := HandshakePayload{
+		EvidenceRequestTypes: []string{"cert"},
+		Evidence:             []Evidence{{Type: "x", Blob: []byte("1")}, {Type: "y", Blob: []byte("2")}},
+	}
+	var p2 HandshakePayload
+	c.Assert(p2.Unmarshal(p.Marshal()), IsNil)
+	c.Assert(p2, DeepEquals, p)
+}
+
+func (NLSSuite) TestUnmarshalUnknownAndMalformed(c *C) {
+	b := protowire.AppendTag(nil, 100, protowire.VarintType)
+	b = protowire.AppendVarint(b, 5)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "name")
+	var req Request
+	c.Assert(req.Unmarshal(b), IsNil)
+	c.Assert(req.ServerName, Equals, "name")
+
+	// A known field with the wrong wire type.
+	b = protowire.AppendTag(nil, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 5)
+	c.Assert(req.Unmarshal(b), NotNil)
+
+	// A truncated field.
+	b = protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = append(b, 10, 'a')
+	c.Assert(req.Unmarshal(b), NotNil)
+
+	// An evidence type without a blob.
+	b = protowire.AppendTag(nil, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "cert")
+	var p HandshakePayload
+	c.Assert(p.Unmarshal(b), NotNil)
+}
@@ -1,9 +1,14 @@
 package noise
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	. "gopkg.in/check.v1"
 )
 
@@ -539,3 +544,773 @@ func (NoiseSuite) TestRekey(c *C) {
 	res, err = csI1.Decrypt(nil, nil, msg)
 	c.Assert(string(serverMessage), Not(Equals), string(res))
 }
+
+func (NoiseSuite) TestHandshakeFailureReasons(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	staticI, _ := cs.GenerateKeypair(rngI)
+	staticR, _ := cs.GenerateKeypair(rngR)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rngI,
+		Pattern:       HandshakeXX,
+		Initiator:     true,
+		StaticKeypair: staticI,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rngR,
+		Pattern:       HandshakeXX,
+		StaticKeypair: staticR,
+	})
+
+	_, _, _, err := hsI.ReadMessage(nil, nil)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureWrongPhase)
+
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("abc"))
+	_, _, _, err = hsR.ReadMessage(nil, msg[:31])
+	c.Assert(err, Equals, ErrShortMessage)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("defg"))
+	msg[40] ^= 1
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureStaticMAC)
+	msg[40] ^= 1
+	msg[len(msg)-1] ^= 1
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailurePayloadMAC)
+	msg[len(msg)-1] ^= 1
+	res, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "defg")
+}
+
+func (NoiseSuite) TestSessionID(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA512)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngI,
+		Pattern:     HandshakeNN,
+		Initiator:   true,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngR,
+		Pattern:     HandshakeNN,
+	})
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	c.Assert(hsI.SessionID(), HasLen, SessionIDLen)
+	c.Assert(hsI.SessionID(), DeepEquals, hsR.SessionID())
+	c.Assert(hsI.SessionID(), Not(DeepEquals), hsI.ChannelBinding()[:SessionIDLen])
+}
+
+type ed25519PayloadKey struct {
+	priv ed25519.PrivateKey
+	peer ed25519.PublicKey
+}
+
+func (k ed25519PayloadKey) SignPayload(msg []byte) ([]byte, error) {
+	return ed25519.Sign(k.priv, msg), nil
+}
+
+func (k ed25519PayloadKey) VerifyPayload(rs, msg, sig []byte) error {
+	if !ed25519.Verify(k.peer, msg, sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func (NoiseSuite) TestPayloadSignatures(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	staticI, _ := cs.GenerateKeypair(rngI)
+	staticR, _ := cs.GenerateKeypair(rngR)
+	idPubI, idPrivI, _ := ed25519.GenerateKey(rngI)
+	idPubR, idPrivR, _ := ed25519.GenerateKey(rngR)
+	keyI := ed25519PayloadKey{idPrivI, idPubR}
+	keyR := ed25519PayloadKey{idPrivR, idPubI}
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:     cs,
+		Random:          rngI,
+		Pattern:         HandshakeXX,
+		Initiator:       true,
+		StaticKeypair:   staticI,
+		PayloadSigner:   keyI,
+		PayloadVerifier: keyI,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:     cs,
+		Random:          rngR,
+		Pattern:         HandshakeXX,
+		StaticKeypair:   staticR,
+		PayloadSigner:   keyR,
+		PayloadVerifier: ed25519PayloadKey{idPrivR, idPubR},
+	})
+
+	// -> e
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("abc"))
+	c.Assert(msg, HasLen, 35)
+	res, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "abc")
+
+	// <- e, ee, s, es
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("defg"))
+	c.Assert(msg, HasLen, 100+ed25519.SignatureSize+2)
+	res, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "defg")
+
+	// -> s, se, verified against the wrong identity key
+	msg, _, _, _ = hsI.WriteMessage(nil, []byte("xyz"))
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureSignature)
+	c.Assert(hsR.PeerStatic(), HasLen, 0)
+}
+
+func (NoiseSuite) TestDeriveCipherStates(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngI,
+		Pattern:     HandshakeNN,
+		Initiator:   true,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngR,
+		Pattern:     HandshakeNN,
+	})
+
+	_, _, err := hsI.DeriveCipherStates([]byte("control"))
+	c.Assert(err, NotNil)
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, csR0, _, _ := hsR.WriteMessage(nil, nil)
+	_, csI0, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	ctlI0, ctlI1, err := hsI.DeriveCipherStates([]byte("control"))
+	c.Assert(err, IsNil)
+	ctlR0, ctlR1, err := hsR.DeriveCipherStates([]byte("control"))
+	c.Assert(err, IsNil)
+	dataI0, _, _ := hsI.DeriveCipherStates([]byte("data"))
+
+	c.Assert(ctlI0.k, Equals, ctlR0.k)
+	c.Assert(ctlI0.k, Not(Equals), ctlI1.k)
+	c.Assert(ctlI0.k, Not(Equals), csI0.k)
+	c.Assert(ctlI0.k, Not(Equals), dataI0.k)
+
+	msg = ctlR1.Encrypt(nil, nil, []byte("ping"))
+	res, err := ctlI1.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "ping")
+
+	msg = csI0.Encrypt(nil, nil, []byte("data"))
+	res, err = csR0.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "data")
+}
+
+func (NoiseSuite) TestDeprecationHandler(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	var reported []string
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngI,
+		Pattern:     HandshakeNN,
+		Initiator:   true,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngR,
+		Pattern:     HandshakeNN,
+		Deprecated:  []string{"NN", "IK", "AESGCM", "BLAKE2s"},
+		DeprecationHandler: func(protocolName, component string) {
+			reported = append(reported, protocolName+" "+component)
+		},
+	})
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(reported, HasLen, 0)
+	hsR.WriteMessage(nil, nil)
+	c.Assert(reported, DeepEquals, []string{
+		"Noise_NN_25519_AESGCM_SHA256 NN",
+		"Noise_NN_25519_AESGCM_SHA256 AESGCM",
+	})
+}
+
+func (NoiseSuite) TestDeprecatedModifiers(c *C) {
+	// Pattern names are matched with their modifiers.
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	psk := make([]byte, 32)
+	var reported []string
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, PresharedKey: psk, PresharedKeyPlacement: 0})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:           cs,
+		Pattern:               HandshakeNN,
+		PresharedKey:          psk,
+		PresharedKeyPlacement: 0,
+		Deprecated:            []string{"NN", "NNpsk0"},
+		DeprecationHandler: func(protocolName, component string) {
+			reported = append(reported, component)
+		},
+	})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	hsR.WriteMessage(nil, nil)
+	c.Assert(reported, DeepEquals, []string{"NNpsk0"})
+}
+
+func (NoiseSuite) TestInjectedEphemeral(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	rng := new(RandomInc)
+	staticR, _ := cs.GenerateKeypair(rng)
+	ephI, _ := cs.GenerateKeypair(rng)
+
+	config := Config{
+		CipherSuite:       cs,
+		Pattern:           HandshakeN,
+		Initiator:         true,
+		PeerStatic:        staticR.Public,
+		InjectedEphemeral: ephI,
+	}
+	_, err := NewHandshakeState(config)
+	c.Assert(err, NotNil)
+
+	config.UnsafeAllowInjectedEphemeral = true
+	hs, err := NewHandshakeState(config)
+	c.Assert(err, IsNil)
+	hello, _, _, _ := hs.WriteMessage(nil, nil)
+
+	// The injected ephemeral matches the one TestN generates with RandomInc.
+	expected, _ := hex.DecodeString("358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662548331a3d1e93b490263abc7a4633867f4")
+	c.Assert(hello, DeepEquals, expected)
+}
+
+func (NoiseSuite) TestExport(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngI,
+		Pattern:     HandshakeNN,
+		Initiator:   true,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite: cs,
+		Random:      rngR,
+		Pattern:     HandshakeNN,
+	})
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, csR0, _, _ := hsR.WriteMessage(nil, nil)
+	_, csI0, _, _ := hsI.ReadMessage(nil, msg)
+
+	csI0.Encrypt(nil, nil, []byte("first"))
+	msg = csI0.Encrypt(nil, nil, []byte("second"))
+
+	k, err := csR0.Export()
+	c.Assert(err, IsNil)
+	c.Assert(k.Cipher, Equals, "ChaChaPoly")
+	c.Assert(k.Nonce, Equals, uint64(0))
+	c.Assert(csR0.k, Equals, [32]byte{})
+	c.Assert(func() { csR0.Decrypt(nil, nil, msg) }, Panics, "noise: CipherSuite has been copied, state is invalid")
+	_, err = csR0.Export()
+	c.Assert(err, NotNil)
+
+	aead, _ := chacha20poly1305.New(k.Key[:])
+	nonce, err := k.NonceBytes(1)
+	c.Assert(err, IsNil)
+	res, err := aead.Open(nil, nonce[:], msg, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "second")
+}
+
+func (NoiseSuite) TestInteractivePatternsRoundtrip(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2b)
+	for _, p := range []HandshakePattern{
+		HandshakeNN, HandshakeNK, HandshakeNX,
+		HandshakeXN, HandshakeXK, HandshakeXX,
+		HandshakeKN, HandshakeKK, HandshakeKX,
+		HandshakeIN, HandshakeIK, HandshakeIX,
+	} {
+		rngI := new(RandomInc)
+		rngR := new(RandomInc)
+		*rngR = 1
+		staticI, _ := cs.GenerateKeypair(rngI)
+		staticR, _ := cs.GenerateKeypair(rngR)
+
+		configI := Config{CipherSuite: cs, Random: rngI, Pattern: p, Initiator: true, StaticKeypair: staticI}
+		configR := Config{CipherSuite: cs, Random: rngR, Pattern: p, StaticKeypair: staticR}
+		if p.Name[0] == 'K' {
+			configR.PeerStatic = staticI.Public
+		}
+		if p.Name[1] == 'K' {
+			configI.PeerStatic = staticR.Public
+		}
+		hsI, err := NewHandshakeState(configI)
+		c.Assert(err, IsNil)
+		hsR, err := NewHandshakeState(configR)
+		c.Assert(err, IsNil)
+
+		writer, reader := hsI, hsR
+		var csW, csR *CipherState
+		for i := range p.Messages {
+			payload := []byte(fmt.Sprintf("%s message %d", p.Name, i))
+			msg, cs0, _, err := writer.WriteMessage(nil, payload)
+			c.Assert(err, IsNil)
+			res, cr0, _, err := reader.ReadMessage(nil, msg)
+			c.Assert(err, IsNil, Commentf("%s message %d", p.Name, i))
+			c.Assert(res, DeepEquals, payload)
+			csW, csR = cs0, cr0
+			writer, reader = reader, writer
+		}
+		c.Assert(csW, NotNil, Commentf(p.Name))
+		c.Assert(hsI.ChannelBinding(), DeepEquals, hsR.ChannelBinding())
+		if p.Name[0] != 'N' {
+			c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+		}
+		if p.Name[1] != 'N' {
+			c.Assert(hsI.PeerStatic(), DeepEquals, staticR.Public)
+		}
+
+		msg := csW.Encrypt(nil, nil, []byte("transport"))
+		res, err := csR.Decrypt(nil, nil, msg)
+		c.Assert(err, IsNil)
+		c.Assert(string(res), Equals, "transport")
+	}
+}
+
+func (NoiseSuite) TestOneWaySplit(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rng := new(RandomInc)
+	staticI, _ := cs.GenerateKeypair(rng)
+	staticR, _ := cs.GenerateKeypair(rng)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rng,
+		Pattern:       HandshakeX,
+		Initiator:     true,
+		StaticKeypair: staticI,
+		PeerStatic:    staticR.Public,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rng,
+		Pattern:       HandshakeX,
+		StaticKeypair: staticR,
+	})
+
+	msg, csI0, csI1, err := hsI.WriteMessage(nil, []byte("abc"))
+	c.Assert(err, IsNil)
+	c.Assert(csI0, NotNil)
+	c.Assert(csI1, IsNil)
+	res, csR0, csR1, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "abc")
+	c.Assert(csR0, NotNil)
+	c.Assert(csR1, IsNil)
+	c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+
+	msg = csI0.Encrypt(nil, nil, []byte("defg"))
+	res, err = csR0.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "defg")
+}
+
+func (NoiseSuite) TestDeferredPatternsRoundtrip(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	for _, p := range []HandshakePattern{
+		HandshakeNK1, HandshakeNX1,
+		HandshakeX1N, HandshakeX1K, HandshakeXK1, HandshakeX1K1, HandshakeX1X, HandshakeXX1, HandshakeX1X1,
+		HandshakeK1N, HandshakeK1K, HandshakeKK1, HandshakeK1K1, HandshakeK1X, HandshakeKX1, HandshakeK1X1,
+		HandshakeI1N, HandshakeI1K, HandshakeIK1, HandshakeI1K1, HandshakeI1X, HandshakeIX1, HandshakeI1X1,
+	} {
+		rngI := new(RandomInc)
+		rngR := new(RandomInc)
+		*rngR = 1
+		staticI, _ := cs.GenerateKeypair(rngI)
+		staticR, _ := cs.GenerateKeypair(rngR)
+
+		configI := Config{CipherSuite: cs, Random: rngI, Pattern: p, Initiator: true, StaticKeypair: staticI}
+		configR := Config{CipherSuite: cs, Random: rngR, Pattern: p, StaticKeypair: staticR}
+		if len(p.InitiatorPreMessages) > 0 {
+			configR.PeerStatic = staticI.Public
+		}
+		if len(p.ResponderPreMessages) > 0 {
+			configI.PeerStatic = staticR.Public
+		}
+		hsI, err := NewHandshakeState(configI)
+		c.Assert(err, IsNil)
+		hsR, err := NewHandshakeState(configR)
+		c.Assert(err, IsNil)
+
+		writer, reader := hsI, hsR
+		var csW, csR *CipherState
+		for i := range p.Messages {
+			payload := []byte(fmt.Sprintf("%s message %d", p.Name, i))
+			msg, cs0, _, err := writer.WriteMessage(nil, payload)
+			c.Assert(err, IsNil)
+			res, cr0, _, err := reader.ReadMessage(nil, msg)
+			c.Assert(err, IsNil, Commentf("%s message %d", p.Name, i))
+			c.Assert(res, DeepEquals, payload)
+			csW, csR = cs0, cr0
+			writer, reader = reader, writer
+		}
+		c.Assert(csW, NotNil, Commentf(p.Name))
+		c.Assert(hsI.ChannelBinding(), DeepEquals, hsR.ChannelBinding())
+		if p.Name[0] != 'N' {
+			c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+		}
+		if name := strings.TrimSuffix(p.Name, "1"); name[len(name)-1] != 'N' {
+			c.Assert(hsI.PeerStatic(), DeepEquals, staticR.Public)
+		}
+
+		msg := csW.Encrypt(nil, nil, []byte("transport"))
+		res, err := csR.Decrypt(nil, nil, msg)
+		c.Assert(err, IsNil)
+		c.Assert(string(res), Equals, "transport")
+	}
+}
+
+func (NoiseSuite) TestXXfallback(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	rngI := new(RandomInc)
+	rngR := new(RandomInc)
+	*rngR = 1
+
+	staticI, _ := cs.GenerateKeypair(rngI)
+	staticR, _ := cs.GenerateKeypair(rngR)
+	staleR, _ := cs.GenerateKeypair(rngR)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rngI,
+		Pattern:       HandshakeIK,
+		Initiator:     true,
+		StaticKeypair: staticI,
+		PeerStatic:    staleR.Public,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rngR,
+		Pattern:       HandshakeIK,
+		StaticKeypair: staticR,
+	})
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("abc"))
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureStaticMAC)
+
+	hsR, _ = NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Random:        rngR,
+		Pattern:       HandshakeXXfallback,
+		StaticKeypair: staticR,
+		PeerEphemeral: hsR.PeerEphemeral(),
+	})
+	hsI, _ = NewHandshakeState(Config{
+		CipherSuite:      cs,
+		Random:           rngI,
+		Pattern:          HandshakeXXfallback,
+		Initiator:        true,
+		StaticKeypair:    staticI,
+		EphemeralKeypair: hsI.LocalEphemeral(),
+	})
+
+	_, _, _, err = hsI.WriteMessage(nil, nil)
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureWrongPhase)
+
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("defg"))
+	res, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "defg")
+	c.Assert(hsI.PeerStatic(), DeepEquals, staticR.Public)
+
+	msg, csI0, csI1, _ := hsI.WriteMessage(nil, []byte("hij"))
+	res, csR0, csR1, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hij")
+	c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+
+	msg = csI0.Encrypt(nil, nil, []byte("foo"))
+	res, err = csR0.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+	msg = csR1.Encrypt(nil, nil, []byte("bar"))
+	res, err = csI1.Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "bar")
+}
+
+func (NoiseSuite) TestPresharedKeyPlacement(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	psk := []byte("supersecretsupersecretsupersecre")
+
+	for _, placement := range []int{-1, 4} {
+		_, err := NewHandshakeState(Config{
+			CipherSuite:           cs,
+			Pattern:               HandshakeXX,
+			Initiator:             true,
+			PresharedKey:          psk,
+			PresharedKeyPlacement: placement,
+		})
+		c.Assert(err, ErrorMatches, "noise: invalid preshared key placement")
+	}
+
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	for _, placement := range []int{0, 1, 2, 3} {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:           cs,
+			Pattern:               HandshakeXX,
+			Initiator:             true,
+			StaticKeypair:         staticI,
+			PresharedKey:          psk,
+			PresharedKeyPlacement: placement,
+		})
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite:           cs,
+			Pattern:               HandshakeXX,
+			StaticKeypair:         staticR,
+			PresharedKey:          psk,
+			PresharedKeyPlacement: placement,
+		})
+		c.Assert(hsI.protocolName, Equals, fmt.Sprintf("Noise_XXpsk%d_25519_ChaChaPoly_BLAKE2s", placement))
+
+		var csI, csR *CipherState
+		writer, reader := hsI, hsR
+		for csI == nil {
+			msg, cs1, _, err := writer.WriteMessage(nil, nil)
+			c.Assert(err, IsNil)
+			_, cs2, _, err := reader.ReadMessage(nil, msg)
+			c.Assert(err, IsNil)
+			csI, csR = cs1, cs2
+			writer, reader = reader, writer
+		}
+		res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+		c.Assert(err, IsNil)
+		c.Assert(string(res), Equals, "foo")
+	}
+}
+
+func (NoiseSuite) TestXXfallbackPSK(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	psk := []byte("supersecretsupersecretsupersecre")
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	e, _ := cs.GenerateKeypair(nil)
+
+	hsI, _ := NewHandshakeState(Config{
+		CipherSuite:      cs,
+		Pattern:          HandshakeXXfallback,
+		Initiator:        true,
+		StaticKeypair:    staticI,
+		EphemeralKeypair: e,
+		PresharedKey:     psk,
+	})
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeXXfallback,
+		StaticKeypair: staticR,
+		PeerEphemeral: e.Public,
+		PresharedKey:  psk,
+	})
+	c.Assert(hsI.ss.ck, DeepEquals, hsR.ss.ck)
+	c.Assert(hsI.ss.hasK, Equals, true)
+
+	msg, _, _, _ := hsR.WriteMessage(nil, nil)
+	_, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+}
+
+func (NoiseSuite) TestMultiplePresharedKeys(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	device := []byte("devicesecretdevicesecretdevicese")
+	session := []byte("sessionsecretsessionsecretsessio")
+
+	_, err := NewHandshakeState(Config{
+		CipherSuite:            cs,
+		Pattern:                HandshakeNN,
+		PresharedKeys:          [][]byte{device, session},
+		PresharedKeyPlacements: []int{2, 0},
+	})
+	c.Assert(err, ErrorMatches, "noise: invalid preshared key placement")
+	_, err = NewHandshakeState(Config{
+		CipherSuite:            cs,
+		Pattern:                HandshakeNN,
+		PresharedKey:           device,
+		PresharedKeys:          [][]byte{session},
+		PresharedKeyPlacements: []int{2},
+	})
+	c.Assert(err, NotNil)
+
+	handshake := func(psksI, psksR [][]byte) error {
+		hsI, _ := NewHandshakeState(Config{
+			CipherSuite:            cs,
+			Pattern:                HandshakeNN,
+			Initiator:              true,
+			PresharedKeys:          psksI,
+			PresharedKeyPlacements: []int{0, 2},
+		})
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite:            cs,
+			Pattern:                HandshakeNN,
+			PresharedKeys:          psksR,
+			PresharedKeyPlacements: []int{0, 2},
+		})
+		c.Assert(hsI.protocolName, Equals, "Noise_NNpsk0+psk2_25519_ChaChaPoly_BLAKE2s")
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+		if _, _, _, err := hsR.ReadMessage(nil, msg); err != nil {
+			return err
+		}
+		msg, _, _, _ = hsR.WriteMessage(nil, nil)
+		_, _, _, err := hsI.ReadMessage(nil, msg)
+		return err
+	}
+	c.Assert(handshake([][]byte{device, session}, [][]byte{device, session}), IsNil)
+	c.Assert(handshake([][]byte{device, session}, [][]byte{device, device}), NotNil)
+	c.Assert(handshake([][]byte{device, session}, [][]byte{session, session}), NotNil)
+}
+
+func (NoiseSuite) TestFallbackModifier(c *C) {
+	p, err := Fallback(HandshakeXX)
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, HandshakeXXfallback)
+	_, err = Fallback(HandshakeIK)
+	c.Assert(err, NotNil)
+	_, err = Fallback(HandshakeKX)
+	c.Assert(err, NotNil)
+	_, err = Fallback(HandshakeXXfallback)
+	c.Assert(err, NotNil)
+
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	e, _ := cs.GenerateKeypair(nil)
+	hsI, err := NewHandshakeState(Config{
+		CipherSuite:      cs,
+		Pattern:          HandshakeIX,
+		Fallback:         true,
+		Initiator:        true,
+		StaticKeypair:    staticI,
+		EphemeralKeypair: e,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(hsI.protocolName, Equals, "Noise_IXfallback_25519_ChaChaPoly_SHA256")
+	hsR, err := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeIX,
+		Fallback:      true,
+		StaticKeypair: staticR,
+		PeerEphemeral: e.Public,
+		PeerStatic:    staticI.Public,
+	})
+	c.Assert(err, IsNil)
+
+	msg, csR0, _, err := hsR.WriteMessage(nil, []byte("abc"))
+	c.Assert(err, IsNil)
+	res, csI0, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "abc")
+	c.Assert(hsI.PeerStatic(), DeepEquals, staticR.Public)
+	res, err = csR0.Decrypt(nil, nil, csI0.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+}
+
+func (NoiseSuite) TestFallbackSingleMessage(c *C) {
+	// NNfallback has a single message but is still interactive, so both
+	// peers get a CipherState for each direction.
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	e, _ := cs.GenerateKeypair(nil)
+	hsI, err := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Fallback: true, Initiator: true, EphemeralKeypair: e})
+	c.Assert(err, IsNil)
+	hsR, err := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Fallback: true, PeerEphemeral: e.Public})
+	c.Assert(err, IsNil)
+
+	msg, csR0, csR1, err := hsR.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(csR1, NotNil)
+	_, csI0, csI1, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(csI1, NotNil)
+
+	res, err := csR0.Decrypt(nil, nil, csI0.Encrypt(nil, nil, []byte("to responder")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "to responder")
+	res, err = csI1.Decrypt(nil, nil, csR1.Encrypt(nil, nil, []byte("to initiator")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "to initiator")
+}
+
+func (NoiseSuite) TestPreMessageKeys(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	static, _ := cs.GenerateKeypair(nil)
+	e, _ := cs.GenerateKeypair(nil)
+	p, _ := Fallback(HandshakeIX)
+	c.Assert(p.InitiatorPreMessages, DeepEquals, []MessagePattern{MessagePatternE, MessagePatternS})
+
+	for _, test := range []struct {
+		config Config
+		err    string
+	}{
+		{Config{Initiator: true, StaticKeypair: static}, "noise: pattern requires EphemeralKeypair as a pre-message"},
+		{Config{Initiator: true, EphemeralKeypair: e}, "noise: pattern requires StaticKeypair as a pre-message"},
+		{Config{PeerStatic: static.Public}, "noise: pattern requires PeerEphemeral as a pre-message"},
+		{Config{PeerEphemeral: e.Public, PeerStatic: static.Public[:31]}, "noise: pattern requires PeerStatic as a pre-message"},
+		{Config{Initiator: true, EphemeralKeypair: e, StaticKeypair: static}, ""},
+		{Config{PeerEphemeral: e.Public, PeerStatic: static.Public}, ""},
+	} {
+		test.config.CipherSuite = cs
+		test.config.Pattern = p
+		_, err := NewHandshakeState(test.config)
+		if test.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package noisehttp runs HTTP over connections secured with Noise, for
+// services that authenticate each other by static key rather than with
+// X.509 certificates.
+//
+// A server wraps its listener with noise.NewListener and sets ConnContext on
+// its http.Server, so that handlers can find the client's static key with
+// PeerStatic. A client uses a Transport as the RoundTripper of its
+// http.Client. Requests are made with http URLs, as Noise takes the place of
+// TLS below HTTP.
+package noisehttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/flynn/noise"
+)
+
+// A Transport is an http.RoundTripper that sends each request over a
+// connection secured with Noise as the initiator. Connections are reused, as
+// by http.Transport.
+type Transport struct {
+	// Config is the configuration of the handshake of every connection.
+	// Initiator is ignored.
+	Config noise.Config
+
+	// GetConfig, if not nil, returns the configuration for a connection to
+	// addr, a host and port, in place of Config. It is how the responder's
+	// expected static key is chosen for patterns in which the initiator knows
+	// it in advance.
+	GetConfig func(ctx context.Context, addr string) (noise.Config, error)
+
+	// DialContext, if not nil, dials the underlying connections. Otherwise a
+	// net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// MaxIdleConnsPerHost is as for http.Transport.
+	MaxIdleConnsPerHost int
+
+	once sync.Once
+	t    *http.Transport
+}
+
+func (t *Transport) transport() *http.Transport {
+	t.once.Do(func() {
+		t.t = &http.Transport{
+			DialContext:         t.dial,
+			MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		}
+	})
+	return t.t
+}
+
+// dial dials addr and runs the handshake, so that a connection that fails
+// the handshake is never used for a request.
+func (t *Transport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := t.Config
+	if t.GetConfig != nil {
+		var err error
+		if config, err = t.GetConfig(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	c, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := noise.Client(c, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// RoundTrip implements http.RoundTripper. It only accepts http URLs.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return nil, errors.New("noisehttp: unsupported scheme " + req.URL.Scheme)
+	}
+	return t.transport().RoundTrip(req)
+}
+
+// CloseIdleConnections closes any connections that are not in use.
+func (t *Transport) CloseIdleConnections() {
+	t.transport().CloseIdleConnections()
+}
+
+type connKey struct{}
+
+// ConnContext is a function for http.Server.ConnContext that records each
+// connection in the context of its requests, for PeerStatic.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// PeerStatic returns the static public key of the client whose request has
+// ctx as its context, or nil if the client has none or the connection is not
+// a *noise.Conn. The server must set ConnContext.
+func PeerStatic(ctx context.Context) []byte {
+	c, ok := ctx.Value(connKey{}).(*noise.Conn)
+	if !ok {
+		return nil
+	}
+	return c.PeerStatic()
+}
@@ -0,0 +1,91 @@
+package noisehttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/flynn/noise"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type HTTPSuite struct{}
+
+var _ = Suite(HTTPSuite{})
+
+func (HTTPSuite) TestRoundTrip(c *C) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+
+	l, err := noise.Listen("tcp", "127.0.0.1:0", noise.Config{
+		CipherSuite:   cs,
+		Pattern:       noise.HandshakeIK,
+		StaticKeypair: staticR,
+	})
+	c.Assert(err, IsNil)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(PeerStatic(r.Context()))
+		}),
+		ConnContext: ConnContext,
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	var addrs []string
+	t := &Transport{
+		Config: noise.Config{CipherSuite: cs, Pattern: noise.HandshakeIK, StaticKeypair: staticI},
+		GetConfig: func(_ context.Context, addr string) (noise.Config, error) {
+			addrs = append(addrs, addr)
+			return noise.Config{
+				CipherSuite:   cs,
+				Pattern:       noise.HandshakeIK,
+				StaticKeypair: staticI,
+				PeerStatic:    staticR.Public,
+			}, nil
+		},
+	}
+	defer t.CloseIdleConnections()
+	client := &http.Client{Transport: t}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		c.Assert(err, IsNil)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(body, staticI.Public), Equals, true)
+	}
+	// The connection was reused.
+	c.Assert(addrs, DeepEquals, []string{l.Addr().String()})
+
+	_, err = client.Get("https://" + l.Addr().String() + "/")
+	c.Assert(err, ErrorMatches, ".*unsupported scheme.*")
+}
+
+func (HTTPSuite) TestHandshakeFailure(c *C) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	staticR, _ := cs.GenerateKeypair(nil)
+	wrong, _ := cs.GenerateKeypair(nil)
+	l, err := noise.Listen("tcp", "127.0.0.1:0", noise.Config{
+		CipherSuite:   cs,
+		Pattern:       noise.HandshakeNK,
+		StaticKeypair: staticR,
+	})
+	c.Assert(err, IsNil)
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &Transport{
+		Config: noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNK, PeerStatic: wrong.Public},
+	}}
+	// NK only fails when the initiator reads the responder's message.
+	_, err = client.Get("http://" + l.Addr().String() + "/")
+	c.Assert(err, NotNil)
+	c.Assert(PeerStatic(context.Background()), IsNil)
+}
@@ -0,0 +1,638 @@
+// Package noisesocket implements NoiseSocket, an encoding for Noise
+// handshake and transport messages over stream transports that lets the
+// parties negotiate which Noise protocol to use.
+//
+// Every handshake message carries negotiation data ahead of the Noise
+// message, each preceded by its length as a big-endian uint16. The responder
+// answers the initiator's first message in one of four ways: it accepts the
+// initiator's protocol, switches to a different protocol and sends that
+// protocol's first message, asks the initiator to retry with a different
+// protocol, or rejects the connection. The negotiation data is bound into
+// the handshake through the prologue, as specified for each case.
+//
+// Every Noise payload, in handshake and transport messages alike, is a
+// uint16 body length followed by the body and any padding, so that the
+// length of application data can be hidden.
+package noisesocket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Prologue prefixes for the initial handshake, one following a switch, and
+// one following a retry.
+const (
+	prologueInit   = "NoiseSocketInit1"
+	prologueSwitch = "NoiseSocketInit2"
+	prologueRetry  = "NoiseSocketInit3"
+)
+
+// An Action is how a responder answers the initiator's first message.
+type Action int
+
+const (
+	// Accept continues the handshake with the initiator's protocol.
+	Accept Action = iota
+
+	// Switch starts a different protocol, in which the responder sends the
+	// first message, such as a fallback pattern.
+	Switch
+
+	// Retry asks the initiator to start again with a different protocol.
+	Retry
+
+	// Reject ends the handshake.
+	Reject
+)
+
+// A Response is a decision about the protocol to use, made by a responder
+// about the initiator's first message or by an initiator about the
+// responder's answer.
+type Response struct {
+	Action Action
+
+	// Config is the configuration of the handshake to continue with. For
+	// Accept, it is the protocol of the initiator's first message, and is only
+	// used by the responder. For Switch, it is the new protocol. For Retry, it
+	// is the protocol of the initiator's next first message, and is only used
+	// by the initiator. The Prologue is set by this package, and Initiator is
+	// kept as given for Switch, to allow for the fallback modifier.
+	Config noise.Config
+
+	// NegotiationData is sent by the responder with its answer, and by the
+	// initiator with its first message after a retry.
+	NegotiationData []byte
+}
+
+// A PayloadHandler supplies the bodies of the payloads of the handshake
+// messages that a Conn writes and checks those of the messages it reads. Each
+// method is called with the handshake that the message belongs to.
+type PayloadHandler interface {
+	// WritePayload returns the body of the payload of the next handshake
+	// message written.
+	WritePayload(hs *noise.HandshakeState) ([]byte, error)
+
+	// ReadPayload is called with the body of the payload of each handshake
+	// message read. The handshake fails if it returns an error.
+	ReadPayload(hs *noise.HandshakeState, body []byte) error
+
+	// Complete is called once the handshake has completed. The handshake
+	// fails if it returns an error.
+	Complete(hs *noise.HandshakeState) error
+}
+
+// ErrRejected is returned by a handshake that the responder rejected.
+var ErrRejected = errors.New("noisesocket: handshake rejected")
+
+// ClientConfig is the configuration of an initiator.
+type ClientConfig struct {
+	// Config is the configuration of the initiator's first handshake.
+	// Initiator is ignored.
+	Config noise.Config
+
+	// NegotiationData is sent with the initiator's first message.
+	NegotiationData []byte
+
+	// Negotiate interprets the responder's answer to the first message from
+	// its negotiation data, and whether it carried a Noise message. A response
+	// without one can only be a retry or a rejection. If Negotiate is nil,
+	// responses with a Noise message are accepted and others rejected.
+	Negotiate func(negotiationData []byte, hasMessage bool) (Response, error)
+
+	// Payloads, if not nil, supplies and checks the bodies of handshake
+	// payloads, which are otherwise empty. It may keep state about a single
+	// handshake, so a Config with Payloads set should only be used once.
+	Payloads PayloadHandler
+
+	// Padding, if positive, pads the payload of every transport message to a
+	// multiple of Padding bytes. It must leave room for at least one byte of
+	// data in a frame, so it can be at most noise.MaxPlaintextLen.
+	Padding int
+}
+
+// ServerConfig is the configuration of a responder.
+type ServerConfig struct {
+	// Negotiate decides how to answer the initiator's first message from its
+	// negotiation data. After a retry it is called again for the initiator's
+	// new first message, and can then only accept or reject.
+	Negotiate func(negotiationData []byte) (Response, error)
+
+	// Payloads, if not nil, supplies and checks the bodies of handshake
+	// payloads, which are otherwise empty. It may keep state about a single
+	// handshake, so a Config with Payloads set should only be used once.
+	Payloads PayloadHandler
+
+	// Padding, if positive, pads the payload of every transport message to a
+	// multiple of Padding bytes. It must leave room for at least one byte of
+	// data in a frame, so it can be at most noise.MaxPlaintextLen.
+	Padding int
+}
+
+// A Conn is a net.Conn secured with a NoiseSocket handshake. The handshake
+// is run by the first Read or Write, or explicitly by Handshake.
+//
+// Read and Write may be called concurrently with each other, but not with
+// themselves.
+type Conn struct {
+	conn   net.Conn
+	client *ClientConfig
+	server *ServerConfig
+	fr     *noise.FrameReader
+	fw     *noise.FrameWriter
+
+	handshakeMu   sync.Mutex
+	handshakeDone uint32 // set atomically once the handshake has succeeded
+	handshakeErr  error
+	hs            *noise.HandshakeState
+	initiator     bool // the role in the handshake that was run
+
+	inMu  sync.Mutex
+	in    *noise.CipherState
+	input []byte
+	inBuf []byte
+	inErr error
+
+	outMu  sync.Mutex
+	out    *noise.CipherState
+	outBuf []byte
+	outErr error
+}
+
+// Client returns a new Conn that runs a handshake as the initiator over conn.
+func Client(conn net.Conn, config ClientConfig) *Conn {
+	return &Conn{conn: conn, client: &config, fr: noise.NewFrameReader(conn), fw: noise.NewFrameWriter(conn)}
+}
+
+// Server returns a new Conn that runs a handshake as the responder over conn.
+func Server(conn net.Conn, config ServerConfig) *Conn {
+	return &Conn{conn: conn, server: &config, fr: noise.NewFrameReader(conn), fw: noise.NewFrameWriter(conn)}
+}
+
+// Handshake runs the handshake if it has not yet been run.
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is like Handshake. If ctx is done before the handshake
+// completes, the handshake is interrupted and fails with ctx.Err(). A failed
+// handshake cannot be retried, and the Conn should be closed.
+func (c *Conn) HandshakeContext(ctx context.Context) (err error) {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	if atomic.LoadUint32(&c.handshakeDone) == 1 {
+		return nil
+	}
+	if ctx.Done() != nil {
+		fired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			c.conn.SetDeadline(time.Unix(1, 0))
+			close(fired)
+		})
+		defer func() {
+			if stop() {
+				return
+			}
+			<-fired
+			if err != nil {
+				err = ctx.Err()
+				c.handshakeErr = err
+				return
+			}
+			// The handshake completed as ctx was done, so the deadline
+			// set to interrupt it must not outlive it.
+			c.conn.SetDeadline(time.Time{})
+		}()
+	}
+	var hs *noise.HandshakeState
+	if c.client != nil {
+		hs, err = c.clientHandshake(ctx)
+	} else {
+		hs, err = c.serverHandshake(ctx)
+	}
+	if err == nil {
+		err = c.finish(ctx, hs, c.client != nil)
+	}
+	c.handshakeErr = err
+	if err == nil {
+		atomic.StoreUint32(&c.handshakeDone, 1)
+	}
+	return err
+}
+
+// clientHandshake sends the initiator's first message and processes the
+// responder's answer, returning the handshake to continue with.
+func (c *Conn) clientHandshake(ctx context.Context) (*noise.HandshakeState, error) {
+	config := c.client.Config
+	negData := c.client.NegotiationData
+	prologue := appendField([]byte(prologueInit), negData)
+	for retried := false; ; retried = true {
+		config.Initiator = true
+		config.Prologue = prologue
+		hs, err := noise.NewHandshakeState(config)
+		if err != nil {
+			return nil, err
+		}
+		body, err := c.writePayload(hs)
+		if err != nil {
+			return nil, err
+		}
+		msg, cs1, _, err := hs.WriteMessageContext(ctx, nil, encodePayload(nil, body, 0))
+		if err != nil {
+			return nil, err
+		}
+		first := appendField(appendField(nil, negData), msg)
+		if _, err := c.conn.Write(first); err != nil {
+			return nil, err
+		}
+		c.initiator = true
+		if cs1 != nil {
+			// A one-way pattern, which the responder cannot answer.
+			c.setCipherStates(cs1, nil)
+			return hs, nil
+		}
+
+		respData, respMsg, err := c.readHandshakeMessage()
+		if err != nil {
+			return nil, err
+		}
+		resp := Response{Action: Reject}
+		if len(respMsg) > 0 {
+			resp.Action = Accept
+		}
+		if c.client.Negotiate != nil {
+			resp, err = c.client.Negotiate(respData, len(respMsg) > 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch resp.Action {
+		case Accept:
+		case Switch:
+			resp.Config.Prologue = appendField(append([]byte(prologueSwitch), first...), respData)
+			if hs, err = noise.NewHandshakeState(resp.Config); err != nil {
+				return nil, err
+			}
+			c.initiator = resp.Config.Initiator
+		case Retry:
+			if retried || len(respMsg) > 0 {
+				return nil, errors.New("noisesocket: unexpected retry")
+			}
+			prologue = appendField(append([]byte(prologueRetry), first...), respData)
+			config, negData = resp.Config, resp.NegotiationData
+			continue
+		default:
+			return nil, ErrRejected
+		}
+		if len(respMsg) == 0 {
+			return nil, errors.New("noisesocket: response has no Noise message")
+		}
+		if err := c.readNoiseMessage(ctx, hs, respMsg); err != nil {
+			return nil, err
+		}
+		return hs, nil
+	}
+}
+
+// serverHandshake processes the initiator's first message and sends the
+// answer, returning the handshake to continue with.
+func (c *Conn) serverHandshake(ctx context.Context) (*noise.HandshakeState, error) {
+	if c.server.Negotiate == nil {
+		return nil, errors.New("noisesocket: ServerConfig.Negotiate is nil")
+	}
+	negData, msg, err := c.readHandshakeMessage()
+	if err != nil {
+		return nil, err
+	}
+	prologue := appendField([]byte(prologueInit), negData)
+	for retried := false; ; retried = true {
+		resp, err := c.server.Negotiate(negData)
+		if err != nil {
+			return nil, err
+		}
+		first := appendField(appendField(nil, negData), msg)
+		switch resp.Action {
+		case Accept:
+			config := resp.Config
+			config.Initiator = false
+			config.Prologue = prologue
+			hs, err := noise.NewHandshakeState(config)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.readNoiseMessage(ctx, hs, msg); err != nil {
+				return nil, err
+			}
+			if c.complete() {
+				// A one-way pattern, which cannot be answered.
+				return hs, nil
+			}
+			return hs, c.writeHandshakeMessage(ctx, hs, resp.NegotiationData)
+		case Switch:
+			if retried {
+				return nil, errors.New("noisesocket: cannot switch after a retry")
+			}
+			config := resp.Config
+			config.Prologue = appendField(append([]byte(prologueSwitch), first...), resp.NegotiationData)
+			hs, err := noise.NewHandshakeState(config)
+			if err != nil {
+				return nil, err
+			}
+			c.initiator = config.Initiator
+			return hs, c.writeHandshakeMessage(ctx, hs, resp.NegotiationData)
+		case Retry:
+			if retried {
+				return nil, errors.New("noisesocket: cannot retry twice")
+			}
+			if _, err := c.conn.Write(appendField(appendField(nil, resp.NegotiationData), nil)); err != nil {
+				return nil, err
+			}
+			prologue = appendField(append([]byte(prologueRetry), first...), resp.NegotiationData)
+			if negData, msg, err = c.readHandshakeMessage(); err != nil {
+				return nil, err
+			}
+		default:
+			c.conn.Write(appendField(appendField(nil, resp.NegotiationData), nil))
+			return nil, ErrRejected
+		}
+	}
+}
+
+// finish runs the rest of the handshake, whose messages carry no negotiation
+// data. After the first exchange the client writes next, whichever protocol
+// was negotiated, and the parties then take turns.
+func (c *Conn) finish(ctx context.Context, hs *noise.HandshakeState, write bool) error {
+	for ; !c.complete(); write = !write {
+		if write {
+			if err := c.writeHandshakeMessage(ctx, hs, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		negData, msg, err := c.readHandshakeMessage()
+		if err != nil {
+			return err
+		}
+		if len(negData) > 0 {
+			return errors.New("noisesocket: unexpected negotiation data")
+		}
+		if err := c.readNoiseMessage(ctx, hs, msg); err != nil {
+			return err
+		}
+	}
+	if p := c.payloads(); p != nil {
+		if err := p.Complete(hs); err != nil {
+			return err
+		}
+	}
+	c.hs = hs
+	return nil
+}
+
+// complete reports whether the handshake has completed and set the
+// CipherStates.
+func (c *Conn) complete() bool {
+	return c.in != nil || c.out != nil
+}
+
+// setCipherStates records the CipherStates of a completed handshake.
+func (c *Conn) setCipherStates(cs1, cs2 *noise.CipherState) {
+	if c.initiator {
+		c.out, c.in = cs1, cs2
+	} else {
+		c.in, c.out = cs1, cs2
+	}
+}
+
+// payloads returns the PayloadHandler of the Conn's configuration.
+func (c *Conn) payloads() PayloadHandler {
+	if c.client != nil {
+		return c.client.Payloads
+	}
+	return c.server.Payloads
+}
+
+// writePayload returns the body of the payload of the next handshake message.
+func (c *Conn) writePayload(hs *noise.HandshakeState) ([]byte, error) {
+	if p := c.payloads(); p != nil {
+		return p.WritePayload(hs)
+	}
+	return nil, nil
+}
+
+func (c *Conn) writeHandshakeMessage(ctx context.Context, hs *noise.HandshakeState, negData []byte) error {
+	body, err := c.writePayload(hs)
+	if err != nil {
+		return err
+	}
+	msg, cs1, cs2, err := hs.WriteMessageContext(ctx, nil, encodePayload(nil, body, 0))
+	if err != nil {
+		return err
+	}
+	if cs1 != nil {
+		c.setCipherStates(cs1, cs2)
+	}
+	if len(msg) > noise.MaxFrameLen {
+		return errors.New("noisesocket: message is too long")
+	}
+	_, err = c.conn.Write(appendField(appendField(nil, negData), msg))
+	return err
+}
+
+func (c *Conn) readNoiseMessage(ctx context.Context, hs *noise.HandshakeState, msg []byte) error {
+	payload, cs1, cs2, err := hs.ReadMessageContext(ctx, nil, msg)
+	if err != nil {
+		return err
+	}
+	body, err := decodePayload(payload)
+	if err != nil {
+		return err
+	}
+	if p := c.payloads(); p != nil {
+		if err := p.ReadPayload(hs, body); err != nil {
+			return err
+		}
+	}
+	if cs1 != nil {
+		c.setCipherStates(cs1, cs2)
+	}
+	return nil
+}
+
+// readHandshakeMessage reads the negotiation data and Noise message of a
+// handshake message.
+func (c *Conn) readHandshakeMessage() ([]byte, []byte, error) {
+	negData, err := c.fr.ReadFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	negData = append([]byte(nil), negData...)
+	msg, err := c.fr.ReadFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	return negData, append([]byte(nil), msg...), nil
+}
+
+// appendField appends b to out, preceded by its length as a big-endian
+// uint16.
+func appendField(out, b []byte) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(b)))
+	return append(out, b...)
+}
+
+// encodePayload appends a payload holding body, padded to a multiple of
+// padding bytes, to out.
+func encodePayload(out, body []byte, padding int) []byte {
+	out = appendField(out, body)
+	if padding > 0 {
+		if rem := (2 + len(body)) % padding; rem != 0 {
+			out = append(out, make([]byte, padding-rem)...)
+		}
+	}
+	return out
+}
+
+// decodePayload returns the body of a payload.
+func decodePayload(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("noisesocket: malformed payload")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if n > len(payload)-2 {
+		return nil, errors.New("noisesocket: malformed payload")
+	}
+	return payload[2 : 2+n], nil
+}
+
+// Read reads application data, running the handshake first if needed. A
+// transport message that fails to decrypt breaks the Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	for len(c.input) == 0 {
+		if c.inErr != nil {
+			return 0, c.inErr
+		}
+		if c.in == nil {
+			c.inErr = errors.New("noisesocket: Conn cannot receive in a one-way pattern")
+			continue
+		}
+		msg, err := c.fr.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		payload, err := c.in.Decrypt(c.inBuf[:0], nil, msg)
+		if err == nil {
+			c.inBuf = payload
+			c.input, err = decodePayload(payload)
+		}
+		if err != nil {
+			c.inErr = err
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Write writes application data, running the handshake first if needed.
+// After an error from the underlying connection, the Conn cannot be written
+// to any more.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.outErr != nil {
+		return 0, c.outErr
+	}
+	if c.out == nil {
+		return 0, errors.New("noisesocket: Conn cannot send in a one-way pattern")
+	}
+	padding := c.padding()
+	// The payload, with its length, padding and MAC, must fit in a frame.
+	max := noise.MaxPlaintextLen - 2
+	if padding > 0 {
+		max = noise.MaxPlaintextLen/padding*padding - 2
+	}
+	if max <= 0 {
+		return 0, errors.New("noisesocket: Padding is too large for a frame")
+	}
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		payload := encodePayload(nil, chunk, padding)
+		c.outBuf = c.out.Encrypt(c.outBuf[:0], nil, payload)
+		if err := c.fw.WriteFrame(c.outBuf); err != nil {
+			c.outErr = err
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *Conn) padding() int {
+	if c.client != nil {
+		return c.client.Padding
+	}
+	return c.server.Padding
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error { return c.conn.Close() }
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// PeerStatic returns the peer's static public key, or nil before the
+// handshake has completed or if the peer has none.
+func (c *Conn) PeerStatic() []byte {
+	if atomic.LoadUint32(&c.handshakeDone) == 0 {
+		return nil
+	}
+	return c.hs.PeerStatic()
+}
+
+// ProtocolName returns the name of the Noise protocol that was negotiated,
+// or "" before the handshake has completed.
+func (c *Conn) ProtocolName() string {
+	if atomic.LoadUint32(&c.handshakeDone) == 0 {
+		return ""
+	}
+	return c.hs.ProtocolName()
+}
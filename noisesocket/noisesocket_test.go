@@ -0,0 +1,266 @@
+package noisesocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SocketSuite struct{}
+
+var _ = Suite(SocketSuite{})
+
+// mustParse returns the Config for a protocol name, with a new static key.
+func mustParse(c *C, name string) noise.Config {
+	cfg, err := noise.ParseProtocolName(name)
+	c.Assert(err, IsNil)
+	cfg.StaticKeypair, err = cfg.CipherSuite.GenerateKeypair(nil)
+	c.Assert(err, IsNil)
+	return cfg
+}
+
+// run runs a handshake and an exchange of data in each direction.
+func run(c *C, client, server *Conn) {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(server, buf)
+		if err == nil && string(buf) != "ping" {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = server.Write([]byte("pong"))
+		}
+		if err != nil {
+			server.Close()
+		}
+		done <- err
+	}()
+	_, err := client.Write([]byte("ping"))
+	c.Assert(err, IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "pong")
+	c.Assert(<-done, IsNil)
+}
+
+func (SocketSuite) TestAccept(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	var offered []byte
+	client := Client(a, ClientConfig{
+		Config:          mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s"),
+		NegotiationData: []byte("NN"),
+		Padding:         64,
+	})
+	server := Server(b, ServerConfig{
+		Negotiate: func(negData []byte) (Response, error) {
+			offered = negData
+			return Response{Action: Accept, Config: mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")}, nil
+		},
+		Padding: 64,
+	})
+	run(c, client, server)
+	c.Assert(string(offered), Equals, "NN")
+	c.Assert(client.ProtocolName(), Equals, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(server.ProtocolName(), Equals, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+}
+
+func (SocketSuite) TestPaddingLargeWrite(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	cfg := mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	client := Client(a, ClientConfig{Config: cfg, NegotiationData: []byte("NN"), Padding: 100})
+	server := Server(b, ServerConfig{
+		Negotiate: func([]byte) (Response, error) {
+			return Response{Action: Accept, Config: mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")}, nil
+		},
+		Padding: 100,
+	})
+	data := bytes.Repeat([]byte("0123456789"), 7000)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Write(data)
+		done <- err
+	}()
+	res := make([]byte, len(data))
+	_, err := io.ReadFull(server, res)
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+	c.Assert(bytes.Equal(res, data), Equals, true)
+
+	// A padding with no room for data fails without breaking the Conn.
+	client.client.Padding = noise.MaxPlaintextLen + 1
+	_, err = client.Write([]byte("x"))
+	c.Assert(err, ErrorMatches, ".*Padding is too large.*")
+	client.client.Padding = noise.MaxPlaintextLen
+	go client.Write([]byte("x"))
+	_, err = io.ReadFull(server, res[:1])
+	c.Assert(err, IsNil)
+	c.Assert(res[0], Equals, byte('x'))
+}
+
+func (SocketSuite) TestAcceptMismatchedNegotiationData(c *C) {
+	// The negotiation data is bound to the handshake, so a tampered offer
+	// fails the handshake.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := Client(a, ClientConfig{
+		Config:          mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s"),
+		NegotiationData: []byte("NN"),
+	})
+	mitm := Server(b, ServerConfig{Negotiate: func([]byte) (Response, error) {
+		return Response{Action: Accept, Config: mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")}, nil
+	}})
+	go func() {
+		// Replace the offer before the server sees it.
+		negData, msg, _ := mitm.readHandshakeMessage()
+		negData[0] = 'X'
+		cfg := mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+		cfg.Prologue = appendField([]byte(prologueInit), negData)
+		hs, _ := noise.NewHandshakeState(cfg)
+		mitm.readNoiseMessage(context.Background(), hs, msg)
+		mitm.writeHandshakeMessage(context.Background(), hs, nil)
+	}()
+	c.Assert(client.Handshake(), NotNil)
+}
+
+func (SocketSuite) TestSwitch(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := Client(a, ClientConfig{
+		Config:          mustParse(c, "Noise_NN_25519_AESGCM_SHA256"),
+		NegotiationData: []byte("AESGCM"),
+		Negotiate: func(negData []byte, hasMessage bool) (Response, error) {
+			c.Assert(string(negData), Equals, "ChaChaPoly")
+			c.Assert(hasMessage, Equals, true)
+			return Response{Action: Switch, Config: mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")}, nil
+		},
+	})
+	server := Server(b, ServerConfig{Negotiate: func(negData []byte) (Response, error) {
+		cfg := mustParse(c, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+		cfg.Initiator = true
+		return Response{Action: Switch, Config: cfg, NegotiationData: []byte("ChaChaPoly")}, nil
+	}})
+	run(c, client, server)
+	c.Assert(client.ProtocolName(), Equals, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(client.initiator, Equals, false)
+	c.Assert(server.initiator, Equals, true)
+}
+
+func (SocketSuite) TestRetry(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := Client(a, ClientConfig{
+		Config:          mustParse(c, "Noise_NN_25519_AESGCM_SHA256"),
+		NegotiationData: []byte("AESGCM"),
+		Negotiate: func(negData []byte, hasMessage bool) (Response, error) {
+			if hasMessage {
+				return Response{Action: Accept}, nil
+			}
+			return Response{
+				Action:          Retry,
+				Config:          mustParse(c, "Noise_XX_25519_ChaChaPoly_BLAKE2s"),
+				NegotiationData: []byte("XX"),
+			}, nil
+		},
+	})
+	var offers []string
+	server := Server(b, ServerConfig{Negotiate: func(negData []byte) (Response, error) {
+		offers = append(offers, string(negData))
+		if string(negData) != "XX" {
+			return Response{Action: Retry, NegotiationData: []byte("try XX")}, nil
+		}
+		return Response{Action: Accept, Config: mustParse(c, "Noise_XX_25519_ChaChaPoly_BLAKE2s")}, nil
+	}})
+	run(c, client, server)
+	c.Assert(offers, DeepEquals, []string{"AESGCM", "XX"})
+	c.Assert(server.ProtocolName(), Equals, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(server.PeerStatic(), HasLen, 32)
+}
+
+func (SocketSuite) TestReject(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := Client(a, ClientConfig{Config: mustParse(c, "Noise_NN_25519_AESGCM_SHA256")})
+	server := Server(b, ServerConfig{Negotiate: func([]byte) (Response, error) {
+		return Response{Action: Reject, NegotiationData: []byte("no")}, nil
+	}})
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	c.Assert(client.Handshake(), Equals, ErrRejected)
+	c.Assert(<-done, Equals, ErrRejected)
+}
+
+func (SocketSuite) TestPayload(c *C) {
+	p := encodePayload(nil, []byte("hello"), 16)
+	c.Assert(p, HasLen, 16)
+	c.Assert(p[:7], DeepEquals, []byte("\x00\x05hello"))
+	body, err := decodePayload(p)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(encodePayload(nil, make([]byte, 14), 16), HasLen, 16)
+	c.Assert(encodePayload(nil, nil, 0), DeepEquals, []byte{0, 0})
+
+	_, err = decodePayload([]byte{0})
+	c.Assert(err, NotNil)
+	_, err = decodePayload([]byte{0, 5, 'h'})
+	c.Assert(err, NotNil)
+}
+
+// recorder is a PayloadHandler that sends its name and records what it reads.
+type recorder struct {
+	name     string
+	read     []string
+	complete bool
+}
+
+func (r *recorder) WritePayload(*noise.HandshakeState) ([]byte, error) {
+	return []byte(r.name), nil
+}
+
+func (r *recorder) ReadPayload(_ *noise.HandshakeState, body []byte) error {
+	r.read = append(r.read, string(body))
+	return nil
+}
+
+func (r *recorder) Complete(*noise.HandshakeState) error {
+	r.complete = true
+	return nil
+}
+
+func (SocketSuite) TestPayloads(c *C) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	rc, rs := &recorder{name: "client"}, &recorder{name: "server"}
+	client := Client(a, ClientConfig{
+		Config:   mustParse(c, "Noise_XX_25519_ChaChaPoly_BLAKE2s"),
+		Payloads: rc,
+	})
+	server := Server(b, ServerConfig{
+		Negotiate: func([]byte) (Response, error) {
+			return Response{Action: Accept, Config: mustParse(c, "Noise_XX_25519_ChaChaPoly_BLAKE2s")}, nil
+		},
+		Payloads: rs,
+	})
+	run(c, client, server)
+	c.Assert(rc.read, DeepEquals, []string{"server"})
+	c.Assert(rs.read, DeepEquals, []string{"client", "client"})
+	c.Assert(rc.complete, Equals, true)
+	c.Assert(rs.complete, Equals, true)
+}
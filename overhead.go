@@ -0,0 +1,115 @@
+package noise
+
+import "crypto/mlkem"
+
+// MACLen is the size in bytes of the authentication tag that every cipher
+// appends to a ciphertext.
+const MACLen = 16
+
+// Public key and ciphertext sizes in bytes of the primitives defined in this
+// package, as returned by their DHLen, KEMPublicKeyLen and KEMCiphertextLen
+// methods. With MACLen they give the size of any handshake message as a
+// constant: "e" adds the DH length, "s" the DH length and, once a key has been
+// established, MACLen, and the payload MACLen once a key has been
+// established. HandshakeOverheads does the same sum for a Config.
+const (
+	DH25519Len        = 32
+	DHP256Len         = 65
+	DHSecp256k1Len    = 33
+	DHRistretto255Len = 32
+
+	KEMMLKEM768PublicKeyLen  = mlkem.EncapsulationKeySize768
+	KEMMLKEM768CiphertextLen = mlkem.CiphertextSize768
+)
+
+// HandshakeOverheads returns, for each message of the handshake described by
+// c, the number of bytes that the message adds to its payload: public keys,
+// their authentication tags and the payload's own tag once a key has been
+// established. A message with an n-byte payload is therefore
+// HandshakeOverheads(c)[i]+n bytes long, and the largest payload that fits is
+// MaxMsgLen minus the overhead. Payload signatures are not included.
+//
+// c is checked as by NewHandshakeState, so it needs the pre-message keys the
+// pattern requires, but no keys are generated and no DH is computed.
+func HandshakeOverheads(c Config) ([]int, error) {
+	hs, err := NewHandshakeState(c)
+	if err != nil {
+		return nil, err
+	}
+	return hs.overheads(), nil
+}
+
+// overheads returns the overhead of each message from the current one to the
+// end of the handshake.
+func (s *HandshakeState) overheads() []int {
+	layout := s.layout()
+	overheads := make([]int, 0, len(layout))
+	for _, spans := range layout {
+		n := 0
+		for _, sp := range spans {
+			n += sp.len
+		}
+		overheads = append(overheads, n)
+	}
+	return overheads
+}
+
+// A span is the part of a handshake message written for one token, or for
+// the payload, excluding the payload itself.
+type span struct {
+	token     MessagePattern
+	payload   bool
+	len       int // including the tag, if encrypted
+	encrypted bool
+}
+
+// layout returns the spans of each message from the current one to the end of
+// the handshake. Tokens that write nothing are omitted, and the last span of
+// every message is its payload.
+func (s *HandshakeState) layout() [][]span {
+	cs := s.ss.cs
+	hasK := s.ss.hasK
+	hasF := s.f != nil || len(s.rf) > 0
+	layout := make([][]span, 0, len(s.messagePatterns)-s.msgIdx)
+	for _, m := range s.messagePatterns[s.msgIdx:] {
+		var spans []span
+		add := func(t MessagePattern, n int, canEncrypt bool) {
+			sp := span{token: t, len: n, encrypted: canEncrypt && hasK}
+			if sp.encrypted {
+				sp.len += MACLen
+			}
+			spans = append(spans, sp)
+		}
+		for _, t := range m {
+			switch t {
+			case MessagePatternE:
+				add(t, cs.DHLen(), false)
+				if len(s.psks) > 0 {
+					hasK = true
+				}
+			case MessagePatternS:
+				add(t, s.staticLen(), true)
+			case MessagePatternF:
+				if hasF {
+					add(t, cs.FLen2(), true)
+				} else {
+					add(t, cs.FLen1(), true)
+				}
+				hasF = true
+			case MessagePatternSig:
+				add(t, s.sigVerifier.SignatureLen(), true)
+			case MessagePatternE1:
+				add(t, s.kem.KEMPublicKeyLen(), true)
+			case MessagePatternEKEM1:
+				add(t, s.kem.KEMCiphertextLen(), true)
+				hasK = true
+			default:
+				hasK = true
+			}
+		}
+		add(0, 0, true)
+		spans[len(spans)-1].payload = true
+		layout = append(layout, spans)
+	}
+	return layout
+}
@@ -0,0 +1,75 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestHandshakeOverheads(c *C) {
+	cs := NewCipherSuite(DH25519, CipherAESGCM, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	psk := []byte("supersecretsupersecretsupersecre")
+
+	for _, test := range []struct {
+		pattern    HandshakePattern
+		psks       [][]byte
+		placements []int
+		preS       bool
+		want       []int
+	}{
+		{HandshakeN, nil, nil, true, []int{48}},
+		{HandshakeXX, nil, nil, false, []int{32, 96, 64}},
+		{HandshakeIK, nil, nil, true, []int{96, 48}},
+		{HandshakeNN, [][]byte{psk, psk}, []int{0, 2}, false, []int{48, 48}},
+	} {
+		ci := Config{
+			CipherSuite:            cs,
+			Pattern:                test.pattern,
+			Initiator:              true,
+			StaticKeypair:          staticI,
+			PresharedKeys:          test.psks,
+			PresharedKeyPlacements: test.placements,
+		}
+		if test.preS {
+			ci.PeerStatic = staticR.Public
+		}
+		overheads, err := HandshakeOverheads(ci)
+		c.Assert(err, IsNil)
+		c.Assert(overheads, DeepEquals, test.want)
+
+		cr := ci
+		cr.Initiator = false
+		cr.StaticKeypair, cr.PeerStatic = staticR, nil
+		hsI, _ := NewHandshakeState(ci)
+		hsR, _ := NewHandshakeState(cr)
+		writer, reader := hsI, hsR
+		for _, overhead := range overheads {
+			msg, _, _, err := writer.WriteMessage(nil, []byte("payload"))
+			c.Assert(err, IsNil)
+			c.Assert(msg, HasLen, overhead+len("payload"))
+			_, _, _, err = reader.ReadMessage(nil, msg)
+			c.Assert(err, IsNil)
+			writer, reader = reader, writer
+		}
+	}
+}
+
+func (NoiseSuite) TestOverheadConstants(c *C) {
+	c.Assert(DH25519.DHLen(), Equals, DH25519Len)
+	c.Assert(DHP256.DHLen(), Equals, DHP256Len)
+	c.Assert(DHSecp256k1.DHLen(), Equals, DHSecp256k1Len)
+	c.Assert(DHRistretto255.DHLen(), Equals, DHRistretto255Len)
+	c.Assert(KEMMLKEM768.KEMPublicKeyLen(), Equals, KEMMLKEM768PublicKeyLen)
+	c.Assert(KEMMLKEM768.KEMCiphertextLen(), Equals, KEMMLKEM768CiphertextLen)
+
+	// The overheads of XX follow from the constants alone.
+	overheads, err := HandshakeOverheads(Config{
+		CipherSuite: NewCipherSuite(DHP256, CipherChaChaPoly, HashSHA256),
+		Pattern:     HandshakeXX,
+		Initiator:   true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(overheads, DeepEquals, []int{
+		DHP256Len,
+		DHP256Len + DHP256Len + MACLen + MACLen,
+		DHP256Len + MACLen + MACLen,
+	})
+}
@@ -0,0 +1,53 @@
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+)
+
+// DHP256 is the NIST P-256 ECDH function, for deployments restricted to
+// FIPS-approved curves. Public keys are uncompressed SEC 1 points, 65 bytes
+// long, and the DH output is the 32-byte x-coordinate of the shared point.
+var DHP256 DHFunc = dhP256{}
+
+type dhP256 struct{}
+
+func (dhP256) GenerateKeypair(rng io.Reader) (DHKey, error) {
+	if rng == nil {
+		rng = rand.Reader
+	}
+	// The scalar is read directly from rng, rather than through
+	// ecdh.GenerateKey, so that keys are deterministic for a given reader.
+	var scalar [32]byte
+	for {
+		if _, err := io.ReadFull(rng, scalar[:]); err != nil {
+			return DHKey{}, err
+		}
+		priv, err := ecdh.P256().NewPrivateKey(scalar[:])
+		if err != nil {
+			// The scalar was zero or not below the group order.
+			continue
+		}
+		return DHKey{Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}, nil
+	}
+}
+
+func (dhP256) DH(privkey, pubkey []byte) ([]byte, error) {
+	priv, err := ecdh.P256().NewPrivateKey(privkey)
+	if err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	pub, err := ecdh.P256().NewPublicKey(pubkey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	return shared, nil
+}
+
+func (dhP256) DHLen() int     { return DHP256Len }
+func (dhP256) DHName() string { return "P256" }
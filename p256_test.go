@@ -0,0 +1,58 @@
+package noise
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestP256(c *C) {
+	cs := NewCipherSuite(DHP256, CipherAESGCM, HashSHA256)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	c.Assert(staticI.Public, HasLen, 65)
+
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	c.Assert(hsI.ProtocolName(), Equals, "Noise_XX_P256_AESGCM_SHA256")
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, csI, _, _ := hsI.WriteMessage(nil, nil)
+	_, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(hsR.PeerStatic(), DeepEquals, staticI.Public)
+	res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+
+	// An ephemeral key that is not on the curve fails the DH.
+	hsR, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	hsI, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	msg, _, _, _ = hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	msg[len(msg)-MACLen-1] ^= 1
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	var herr *HandshakeError
+	c.Assert(errors.As(err, &herr), Equals, true)
+	c.Assert(herr.Reason, Equals, FailureDH)
+	c.Assert(errors.Is(err, ErrInvalidPublicKey), Equals, true)
+}
+
+func (NoiseSuite) TestDHErrors(c *C) {
+	for _, dh := range []DHFunc{DH25519, DHP256, DHSecp256k1, DHRistretto255} {
+		k, _ := dh.GenerateKeypair(nil)
+		_, err := dh.DH(k.Private, k.Public[1:])
+		c.Assert(err, Equals, ErrInvalidPublicKey, Commentf("%s", dh.DHName()))
+		_, err = dh.DH(k.Private[1:], k.Public)
+		c.Assert(err, Equals, ErrInvalidPrivateKey, Commentf("%s", dh.DHName()))
+		shared, err := dh.DH(k.Private, k.Public)
+		c.Assert(err, IsNil)
+		c.Assert(shared, HasLen, 32)
+	}
+}
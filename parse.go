@@ -0,0 +1,106 @@
+package noise
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var tokenNames = map[string]MessagePattern{
+	"e":     MessagePatternE,
+	"s":     MessagePatternS,
+	"ee":    MessagePatternEE,
+	"es":    MessagePatternES,
+	"se":    MessagePatternSE,
+	"ss":    MessagePatternSS,
+	"psk":   MessagePatternPSK,
+	"f":     MessagePatternF,
+	"ff":    MessagePatternFF,
+	"e1":    MessagePatternE1,
+	"ekem1": MessagePatternEKEM1,
+	"sig":   MessagePatternSig,
+}
+
+// ParseHandshakePattern parses a handshake pattern written in the notation
+// used by the specification, for example:
+//
+//	<- s
+//	...
+//	-> e, es
+//
+// Each line is a message, starting with "->" for messages from the initiator
+// or "<-" for messages from the responder, followed by a comma-separated list
+// of tokens. Lines before a "..." line are pre-messages, which may only
+// contain "e" and "s". Messages must alternate direction, starting with the
+// initiator unless name carries the fallback modifier.
+func ParseHandshakePattern(name, text string) (HandshakePattern, error) {
+	p := HandshakePattern{Name: name}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for i, line := range lines {
+		if line != "..." {
+			continue
+		}
+		for _, pre := range lines[:i] {
+			initiator, tokens, err := parseMessage(pre)
+			if err != nil {
+				return HandshakePattern{}, err
+			}
+			for _, t := range tokens {
+				if t != MessagePatternE && t != MessagePatternS {
+					return HandshakePattern{}, errors.New("noise: pre-messages may only contain e and s")
+				}
+			}
+			if initiator {
+				p.InitiatorPreMessages = append(p.InitiatorPreMessages, tokens...)
+			} else {
+				p.ResponderPreMessages = append(p.ResponderPreMessages, tokens...)
+			}
+		}
+		lines = lines[i+1:]
+		break
+	}
+	if len(lines) == 0 {
+		return HandshakePattern{}, errors.New("noise: handshake pattern has no messages")
+	}
+	fromInitiator := !p.fallback()
+	for _, line := range lines {
+		initiator, tokens, err := parseMessage(line)
+		if err != nil {
+			return HandshakePattern{}, err
+		}
+		if initiator != fromInitiator {
+			return HandshakePattern{}, errors.New("noise: handshake messages must alternate direction")
+		}
+		fromInitiator = !fromInitiator
+		p.Messages = append(p.Messages, tokens)
+	}
+	return p, nil
+}
+
+// parseMessage parses a single line of pattern notation, reporting whether it
+// is sent by the initiator.
+func parseMessage(line string) (bool, []MessagePattern, error) {
+	var initiator bool
+	switch {
+	case strings.HasPrefix(line, "->"):
+		initiator = true
+	case strings.HasPrefix(line, "<-"):
+	default:
+		return false, nil, errors.New("noise: handshake message must start with -> or <-")
+	}
+	var tokens []MessagePattern
+	for _, name := range strings.Split(line[2:], ",") {
+		name = strings.TrimSpace(name)
+		t, ok := tokenNames[name]
+		if !ok {
+			return false, nil, fmt.Errorf("noise: unknown handshake token %q", name)
+		}
+		tokens = append(tokens, t)
+	}
+	return initiator, tokens, nil
+}
@@ -0,0 +1,36 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestParseHandshakePattern(c *C) {
+	p, err := ParseHandshakePattern("XX", "-> e\n<- e, ee, s, es\n-> s, se\n")
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, HandshakeXX)
+
+	p, err = ParseHandshakePattern("KK", `
+		-> s
+		<- s
+		...
+		-> e, es, ss
+		<- e, ee, se
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, HandshakeKK)
+
+	p, err = ParseHandshakePattern("XXfallback", "-> e\n...\n<- e, ee, s, es\n-> s, se")
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, HandshakeXXfallback)
+
+	for _, text := range []string{
+		"",
+		"-> e\n-> e",
+		"<- e\n-> e",
+		"-> e, x",
+		"-> e,",
+		"=> e",
+		"-> ee\n...\n-> e",
+	} {
+		_, err = ParseHandshakePattern("bad", text)
+		c.Assert(err, NotNil, Commentf("%q", text))
+	}
+}
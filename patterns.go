@@ -1,141 +1,651 @@
 package noise
 
+import "errors"
+
+// HandshakeNN is the NN interactive pattern:
+//
+//	-> e
+//	<- e, ee
 var HandshakeNN = HandshakePattern{
 	Name: "NN",
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE},
+		{MessagePatternE, MessagePatternEE},
 	},
 }
 
+// HandshakeKN is the KN interactive pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee, se
 var HandshakeKN = HandshakePattern{
 	Name:                 "KN",
 	InitiatorPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE},
 	},
 }
 
+// HandshakeNK is the NK interactive pattern:
+//
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
 var HandshakeNK = HandshakePattern{
 	Name:                 "NK",
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES},
-		{MessagePatternE, MessagePatternDHEE},
+		{MessagePatternE, MessagePatternES},
+		{MessagePatternE, MessagePatternEE},
 	},
 }
 
+// HandshakeKK is the KK interactive pattern:
+//
+//	-> s
+//	<- s
+//	...
+//	-> e, es, ss
+//	<- e, ee, se
 var HandshakeKK = HandshakePattern{
 	Name:                 "KK",
 	InitiatorPreMessages: []MessagePattern{MessagePatternS},
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES, MessagePatternDHSS},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternES, MessagePatternSS},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE},
 	},
 }
 
+// HandshakeNX is the NX interactive pattern:
+//
+//	-> e
+//	<- e, ee, s, es
 var HandshakeNX = HandshakePattern{
 	Name: "NX",
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternS, MessagePatternDHES},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
 	},
 }
 
+// HandshakeKX is the KX interactive pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee, se, s, es
 var HandshakeKX = HandshakePattern{
 	Name:                 "KX",
 	InitiatorPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE, MessagePatternS, MessagePatternDHES},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternS, MessagePatternES},
 	},
 }
 
+// HandshakeXN is the XN interactive pattern:
+//
+//	-> e
+//	<- e, ee
+//	-> s, se
 var HandshakeXN = HandshakePattern{
 	Name: "XN",
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE},
-		{MessagePatternS, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternS, MessagePatternSE},
 	},
 }
 
+// HandshakeIN is the IN interactive pattern:
+//
+//	-> e, s
+//	<- e, ee, se
 var HandshakeIN = HandshakePattern{
 	Name: "IN",
 	Messages: [][]MessagePattern{
 		{MessagePatternE, MessagePatternS},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE},
 	},
 }
 
+// HandshakeXK is the XK interactive pattern:
+//
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
+//	-> s, se
 var HandshakeXK = HandshakePattern{
 	Name:                 "XK",
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES},
-		{MessagePatternE, MessagePatternDHEE},
-		{MessagePatternS, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternES},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternS, MessagePatternSE},
 	},
 }
 
+// HandshakeIK is the IK interactive pattern:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
 var HandshakeIK = HandshakePattern{
 	Name:                 "IK",
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES, MessagePatternS, MessagePatternDHSS},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternES, MessagePatternS, MessagePatternSS},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE},
 	},
 }
 
+// HandshakeXX is the XX interactive pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
 var HandshakeXX = HandshakePattern{
 	Name: "XX",
 	Messages: [][]MessagePattern{
 		{MessagePatternE},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternS, MessagePatternDHES},
-		{MessagePatternS, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
+		{MessagePatternS, MessagePatternSE},
 	},
 }
 
+// Fallback returns p with the fallback modifier applied: the initiator's first
+// message, which may only contain "e" and "s" tokens, becomes an initiator
+// pre-message and the responder writes the first message. The initiator and
+// responder keep their roles. It is used when a responder could not process an
+// initiator's first message but has learned the keys in it, and is typically
+// applied through Config.Fallback.
+func Fallback(p HandshakePattern) (HandshakePattern, error) {
+	if p.fallback() {
+		return HandshakePattern{}, errors.New("noise: pattern " + p.Name + " already has the fallback modifier")
+	}
+	if len(p.InitiatorPreMessages) > 0 || len(p.Messages) < 2 {
+		return HandshakePattern{}, errors.New("noise: fallback modifier cannot be applied to pattern " + p.Name)
+	}
+	for _, t := range p.Messages[0] {
+		if t != MessagePatternE && t != MessagePatternS {
+			return HandshakePattern{}, errors.New("noise: fallback modifier cannot be applied to pattern " + p.Name)
+		}
+	}
+	return HandshakePattern{
+		Name:                 appendModifier(p.Name, "fallback"),
+		InitiatorPreMessages: p.Messages[0],
+		ResponderPreMessages: p.ResponderPreMessages,
+		Messages:             p.Messages[1:],
+	}, nil
+}
+
+// HandshakeXXfallback is the XX pattern with the fallback modifier applied:
+//
+//	-> e
+//	...
+//	<- e, ee, s, es
+//	-> s, se
+//
+// It is used by a responder that could not process an initiator's first
+// message, typically an IK message encrypted to a stale static key. The
+// initiator's ephemeral from that message becomes a pre-message: the initiator
+// sets EphemeralKeypair to the key returned by LocalEphemeral and the responder
+// sets PeerEphemeral to the key returned by PeerEphemeral. Both peers keep their
+// roles, but the responder writes the first message.
+var HandshakeXXfallback = HandshakePattern{
+	Name:                 "XXfallback",
+	InitiatorPreMessages: []MessagePattern{MessagePatternE},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
+		{MessagePatternS, MessagePatternSE},
+	},
+}
+
+// HandshakeIX is the IX interactive pattern:
+//
+//	-> e, s
+//	<- e, ee, se, s, es
 var HandshakeIX = HandshakePattern{
 	Name: "IX",
 	Messages: [][]MessagePattern{
 		{MessagePatternE, MessagePatternS},
-		{MessagePatternE, MessagePatternDHEE, MessagePatternDHSE, MessagePatternS, MessagePatternDHES},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternS, MessagePatternES},
 	},
 }
 
+// HandshakeN is the N one-way pattern:
+//
+//	<- s
+//	...
+//	-> e, es
 var HandshakeN = HandshakePattern{
 	Name:                 "N",
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES},
+		{MessagePatternE, MessagePatternES},
 	},
 }
 
+// HandshakeK is the K one-way pattern:
+//
+//	-> s
+//	<- s
+//	...
+//	-> e, es, ss
 var HandshakeK = HandshakePattern{
 	Name:                 "K",
 	InitiatorPreMessages: []MessagePattern{MessagePatternS},
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES, MessagePatternDHSS},
+		{MessagePatternE, MessagePatternES, MessagePatternSS},
 	},
 }
 
+// HandshakeX is the X one-way pattern:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
 var HandshakeX = HandshakePattern{
 	Name:                 "X",
 	ResponderPreMessages: []MessagePattern{MessagePatternS},
 	Messages: [][]MessagePattern{
-		{MessagePatternE, MessagePatternDHES, MessagePatternS, MessagePatternDHSS},
+		{MessagePatternE, MessagePatternES, MessagePatternS, MessagePatternSS},
 	},
 }
 
+// HandshakeXXhfs is the XX pattern with the hybrid forward secrecy
+// modifier from draft 5 of the HFS extension:
+//
+//	-> e, f
+//	<- e, f, ee, ff, s, es
+//	-> s, se
 var HandshakeXXhfs = HandshakePattern{
 	Name: "XXhfs",
 	Messages: [][]MessagePattern{
 		{MessagePatternE, MessagePatternF},
-		{MessagePatternE, MessagePatternF, MessagePatternDHEE, MessagePatternFF, MessagePatternS, MessagePatternDHES},
-		{MessagePatternS, MessagePatternDHSE},
+		{MessagePatternE, MessagePatternF, MessagePatternEE, MessagePatternFF, MessagePatternS, MessagePatternES},
+		{MessagePatternS, MessagePatternSE},
+	},
+}
+
+// HandshakeNK1 is the deferred NK1 pattern:
+//
+//	<- s
+//	...
+//	-> e
+//	<- e, ee, es
+var HandshakeNK1 = HandshakePattern{
+	Name:                 "NK1",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternES},
+	},
+}
+
+// HandshakeNX1 is the deferred NX1 pattern:
+//
+//	-> e
+//	<- e, ee, s
+//	-> es
+var HandshakeNX1 = HandshakePattern{
+	Name: "NX1",
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS},
+		{MessagePatternES},
+	},
+}
+
+// HandshakeX1N is the deferred X1N pattern:
+//
+//	-> e
+//	<- e, ee
+//	-> s
+//	<- se
+var HandshakeX1N = HandshakePattern{
+	Name: "X1N",
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternS},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeX1K is the deferred X1K pattern:
+//
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
+//	-> s
+//	<- se
+var HandshakeX1K = HandshakePattern{
+	Name:                 "X1K",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternES},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternS},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeXK1 is the deferred XK1 pattern:
+//
+//	<- s
+//	...
+//	-> e
+//	<- e, ee, es
+//	-> s, se
+var HandshakeXK1 = HandshakePattern{
+	Name:                 "XK1",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternES},
+		{MessagePatternS, MessagePatternSE},
+	},
+}
+
+// HandshakeX1K1 is the deferred X1K1 pattern:
+//
+//	<- s
+//	...
+//	-> e
+//	<- e, ee, es
+//	-> s
+//	<- se
+var HandshakeX1K1 = HandshakePattern{
+	Name:                 "X1K1",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternES},
+		{MessagePatternS},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeX1X is the deferred X1X pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s
+//	<- se
+var HandshakeX1X = HandshakePattern{
+	Name: "X1X",
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
+		{MessagePatternS},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeXX1 is the deferred XX1 pattern:
+//
+//	-> e
+//	<- e, ee, s
+//	-> es, s, se
+var HandshakeXX1 = HandshakePattern{
+	Name: "XX1",
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS},
+		{MessagePatternES, MessagePatternS, MessagePatternSE},
+	},
+}
+
+// HandshakeX1X1 is the deferred X1X1 pattern:
+//
+//	-> e
+//	<- e, ee, s
+//	-> es, s
+//	<- se
+var HandshakeX1X1 = HandshakePattern{
+	Name: "X1X1",
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS},
+		{MessagePatternES, MessagePatternS},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeK1N is the deferred K1N pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee
+//	-> se
+var HandshakeK1N = HandshakePattern{
+	Name:                 "K1N",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeK1K is the deferred K1K pattern:
+//
+//	-> s
+//	<- s
+//	...
+//	-> e, es
+//	<- e, ee
+//	-> se
+var HandshakeK1K = HandshakePattern{
+	Name:                 "K1K",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternES},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeKK1 is the deferred KK1 pattern:
+//
+//	-> s
+//	<- s
+//	...
+//	-> e
+//	<- e, ee, se, es
+var HandshakeKK1 = HandshakePattern{
+	Name:                 "KK1",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternES},
+	},
+}
+
+// HandshakeK1K1 is the deferred K1K1 pattern:
+//
+//	-> s
+//	<- s
+//	...
+//	-> e
+//	<- e, ee, es
+//	-> se
+var HandshakeK1K1 = HandshakePattern{
+	Name:                 "K1K1",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternES},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeK1X is the deferred K1X pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee, s, es
+//	-> se
+var HandshakeK1X = HandshakePattern{
+	Name:                 "K1X",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeKX1 is the deferred KX1 pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee, se, s
+//	-> es
+var HandshakeKX1 = HandshakePattern{
+	Name:                 "KX1",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternS},
+		{MessagePatternES},
+	},
+}
+
+// HandshakeK1X1 is the deferred K1X1 pattern:
+//
+//	-> s
+//	...
+//	-> e
+//	<- e, ee, s
+//	-> se, es
+var HandshakeK1X1 = HandshakePattern{
+	Name:                 "K1X1",
+	InitiatorPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS},
+		{MessagePatternSE, MessagePatternES},
+	},
+}
+
+// HandshakeI1N is the deferred I1N pattern:
+//
+//	-> e, s
+//	<- e, ee
+//	-> se
+var HandshakeI1N = HandshakePattern{
+	Name: "I1N",
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeI1K is the deferred I1K pattern:
+//
+//	<- s
+//	...
+//	-> e, es, s
+//	<- e, ee
+//	-> se
+var HandshakeI1K = HandshakePattern{
+	Name:                 "I1K",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternES, MessagePatternS},
+		{MessagePatternE, MessagePatternEE},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeIK1 is the deferred IK1 pattern:
+//
+//	<- s
+//	...
+//	-> e, s
+//	<- e, ee, se, es
+var HandshakeIK1 = HandshakePattern{
+	Name:                 "IK1",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternES},
+	},
+}
+
+// HandshakeI1K1 is the deferred I1K1 pattern:
+//
+//	<- s
+//	...
+//	-> e, s
+//	<- e, ee, es
+//	-> se
+var HandshakeI1K1 = HandshakePattern{
+	Name:                 "I1K1",
+	ResponderPreMessages: []MessagePattern{MessagePatternS},
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE, MessagePatternES},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeI1X is the deferred I1X pattern:
+//
+//	-> e, s
+//	<- e, ee, s, es
+//	-> se
+var HandshakeI1X = HandshakePattern{
+	Name: "I1X",
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternES},
+		{MessagePatternSE},
+	},
+}
+
+// HandshakeIX1 is the deferred IX1 pattern:
+//
+//	-> e, s
+//	<- e, ee, se, s
+//	-> es
+var HandshakeIX1 = HandshakePattern{
+	Name: "IX1",
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE, MessagePatternSE, MessagePatternS},
+		{MessagePatternES},
+	},
+}
+
+// HandshakeI1X1 is the deferred I1X1 pattern:
+//
+//	-> e, s
+//	<- e, ee, s
+//	-> se, es
+var HandshakeI1X1 = HandshakePattern{
+	Name: "I1X1",
+	Messages: [][]MessagePattern{
+		{MessagePatternE, MessagePatternS},
+		{MessagePatternE, MessagePatternEE, MessagePatternS},
+		{MessagePatternSE, MessagePatternES},
 	},
 }
@@ -0,0 +1,61 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A PayloadSigner signs handshake payloads, typically with a long-term
+// identity key that is distinct from the Noise static key.
+type PayloadSigner interface {
+	// SignPayload returns a signature over msg, which is the handshake hash
+	// at the time the payload is encrypted followed by the payload.
+	SignPayload(msg []byte) ([]byte, error)
+}
+
+// A PayloadVerifier verifies handshake payload signatures produced by a
+// PayloadSigner.
+type PayloadVerifier interface {
+	// VerifyPayload checks that sig is a valid signature over msg by the peer
+	// with the static public key rs.
+	VerifyPayload(rs, msg, sig []byte) error
+}
+
+// signPayload returns payload with a signature and its big-endian uint16
+// length appended.
+func (s *HandshakeState) signPayload(payload []byte) ([]byte, error) {
+	msg := make([]byte, 0, len(s.ss.h)+len(payload))
+	msg = append(append(msg, s.ss.h...), payload...)
+	sig, err := s.signer.SignPayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > 0xffff {
+		return nil, errors.New("noise: payload signature is too long")
+	}
+	if len(payload)+len(sig)+2 > s.maxMsgLen {
+		return nil, errors.New("noise: message is too long")
+	}
+	signed := make([]byte, 0, len(payload)+len(sig)+2)
+	signed = append(append(signed, payload...), sig...)
+	return append(signed, byte(len(sig)>>8), byte(len(sig))), nil
+}
+
+// verifyPayload checks the signature trailing the payload in out[off:] against
+// the handshake hash h, and strips it.
+func (s *HandshakeState) verifyPayload(out []byte, off int, h []byte) ([]byte, error) {
+	payload := out[off:]
+	if len(payload) < 2 {
+		return nil, &HandshakeError{FailureSignature, errors.New("signature is missing")}
+	}
+	sigLen := int(binary.BigEndian.Uint16(payload[len(payload)-2:]))
+	if len(payload)-2 < sigLen {
+		return nil, &HandshakeError{FailureSignature, errors.New("signature is truncated")}
+	}
+	sig := payload[len(payload)-2-sigLen : len(payload)-2]
+	payload = payload[:len(payload)-2-sigLen]
+	if err := s.verifier.VerifyPayload(s.rs, append(h, payload...), sig); err != nil {
+		return nil, &HandshakeError{FailureSignature, err}
+	}
+	return out[:off+len(payload)], nil
+}
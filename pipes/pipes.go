@@ -0,0 +1,210 @@
+// Package pipes implements the Noise Pipes compound protocol on top of the
+// noise package.
+//
+// An initiator that has cached the responder's static public key starts with
+// the IK pattern, which allows an encrypted payload in the first message. If
+// the responder cannot decrypt that message, typically because it has rotated
+// its static key, it switches to XXfallback and reuses the initiator's
+// ephemeral. An initiator without a cached key uses the XX pattern. Either way
+// the handshake yields transport CipherStates and the responder's static key,
+// which should be cached for the next connection.
+//
+// The first message written by each peer is prefixed with a single type byte
+// identifying the pattern in use, so that neither peer has to guess how to
+// interpret the other's message.
+package pipes
+
+import (
+	"errors"
+	"io"
+
+	"github.com/flynn/noise"
+)
+
+// Handshake types sent as the first byte of each peer's first message.
+const (
+	TypeXX byte = iota
+	TypeIK
+	TypeXXfallback
+)
+
+// Config is the configuration for a Noise Pipes handshake.
+type Config struct {
+	// CipherSuite is the set of cryptographic primitives that will be used.
+	CipherSuite noise.CipherSuite
+
+	// Random is the source for cryptographically appropriate random bytes. If
+	// zero, it is automatically configured.
+	Random io.Reader
+
+	// Prologue is an optional message that has already be communicated and
+	// must be identical on both sides for the handshake to succeed.
+	Prologue []byte
+
+	// Initiator must be true if the first message in the handshake will be
+	// sent by this peer.
+	Initiator bool
+
+	// StaticKeypair is this peer's static keypair.
+	StaticKeypair noise.DHKey
+
+	// PeerStatic is the responder's static public key cached by the initiator
+	// from a previous handshake. If it is empty, the initiator uses XX.
+	PeerStatic []byte
+}
+
+// A Handshake runs a Noise Pipes handshake, falling back from IK to
+// XXfallback when the responder cannot read the initiator's first message.
+type Handshake struct {
+	c         Config
+	hs        *noise.HandshakeState
+	typ       byte
+	wroteNext bool
+	readNext  bool
+}
+
+// NewHandshake starts a new Noise Pipes handshake using the provided
+// configuration.
+func NewHandshake(c Config) (*Handshake, error) {
+	h := &Handshake{c: c}
+	if !c.Initiator {
+		return h, nil
+	}
+	h.typ = TypeXX
+	if len(c.PeerStatic) > 0 {
+		h.typ = TypeIK
+	}
+	if err := h.start(h.typ, noise.DHKey{}, nil); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Handshake) start(typ byte, e noise.DHKey, re []byte) error {
+	c := noise.Config{
+		CipherSuite:      h.c.CipherSuite,
+		Random:           h.c.Random,
+		Prologue:         h.c.Prologue,
+		Initiator:        h.c.Initiator,
+		StaticKeypair:    h.c.StaticKeypair,
+		EphemeralKeypair: e,
+		PeerEphemeral:    re,
+	}
+	switch typ {
+	case TypeXX:
+		c.Pattern = noise.HandshakeXX
+	case TypeIK:
+		c.Pattern = noise.HandshakeIK
+		if h.c.Initiator {
+			c.PeerStatic = h.c.PeerStatic
+		}
+	case TypeXXfallback:
+		c.Pattern = noise.HandshakeXXfallback
+	default:
+		return errors.New("pipes: unknown handshake type")
+	}
+	hs, err := noise.NewHandshakeState(c)
+	if err != nil {
+		return err
+	}
+	h.hs = hs
+	h.typ = typ
+	return nil
+}
+
+// WriteMessage appends a handshake message to out, with the same semantics as
+// noise.HandshakeState.WriteMessage.
+func (h *Handshake) WriteMessage(out, payload []byte) ([]byte, *noise.CipherState, *noise.CipherState, error) {
+	if h.hs == nil {
+		return nil, nil, nil, errors.New("pipes: unexpected call to WriteMessage should be ReadMessage")
+	}
+	prefixed := out
+	if !h.wroteNext {
+		prefixed = append(out, h.typ)
+	}
+	msg, cs1, cs2, err := h.hs.WriteMessage(prefixed, payload)
+	if err != nil {
+		return out, nil, nil, err
+	}
+	h.wroteNext = true
+	return msg, cs1, cs2, nil
+}
+
+// ReadMessage processes a received handshake message and appends the payload,
+// if any, to out, with the same semantics as noise.HandshakeState.ReadMessage.
+//
+// If a responder cannot read an IK message, ReadMessage switches to XXfallback
+// and returns without error; the payload of the IK message is lost and
+// Fallback reports true. The responder continues by calling WriteMessage.
+func (h *Handshake) ReadMessage(out, message []byte) ([]byte, *noise.CipherState, *noise.CipherState, error) {
+	if h.readNext || (h.c.Initiator && !h.wroteNext) {
+		return h.hs.ReadMessage(out, message)
+	}
+	if len(message) == 0 {
+		return nil, nil, nil, noise.ErrShortMessage
+	}
+	typ, message := message[0], message[1:]
+
+	if h.c.Initiator {
+		switch {
+		case typ == h.typ:
+		case typ == TypeXXfallback && h.typ == TypeIK:
+			if err := h.start(TypeXXfallback, h.hs.LocalEphemeral(), nil); err != nil {
+				return nil, nil, nil, err
+			}
+		default:
+			return nil, nil, nil, errors.New("pipes: unexpected handshake type")
+		}
+		res, cs1, cs2, err := h.hs.ReadMessage(out, message)
+		if err == nil {
+			h.readNext = true
+		}
+		return res, cs1, cs2, err
+	}
+
+	if typ != TypeXX && typ != TypeIK {
+		return nil, nil, nil, errors.New("pipes: unexpected handshake type")
+	}
+	if err := h.start(typ, noise.DHKey{}, nil); err != nil {
+		return nil, nil, nil, err
+	}
+	res, cs1, cs2, err := h.hs.ReadMessage(out, message)
+	if err != nil && typ == TypeIK && fallbackReason(err) {
+		if err := h.start(TypeXXfallback, noise.DHKey{}, h.hs.PeerEphemeral()); err != nil {
+			return nil, nil, nil, err
+		}
+		h.readNext = true
+		return out, nil, nil, nil
+	}
+	if err != nil {
+		h.hs = nil
+		return nil, nil, nil, err
+	}
+	h.readNext = true
+	return res, cs1, cs2, nil
+}
+
+// fallbackReason reports whether err indicates that an IK message could not be
+// decrypted, rather than being malformed.
+func fallbackReason(err error) bool {
+	var herr *noise.HandshakeError
+	if !errors.As(err, &herr) {
+		return false
+	}
+	return herr.Reason == noise.FailureStaticMAC || herr.Reason == noise.FailurePayloadMAC
+}
+
+// Fallback reports whether the handshake switched from IK to XXfallback.
+func (h *Handshake) Fallback() bool {
+	return h.typ == TypeXXfallback
+}
+
+// PeerStatic returns the static key of the remote peer, once it is known. An
+// initiator should cache the responder's key for use as Config.PeerStatic in
+// its next handshake.
+func (h *Handshake) PeerStatic() []byte {
+	if h.hs == nil {
+		return nil
+	}
+	return h.hs.PeerStatic()
+}
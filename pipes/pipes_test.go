@@ -0,0 +1,99 @@
+package pipes
+
+import (
+	"testing"
+
+	"github.com/flynn/noise"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PipesSuite struct{}
+
+var _ = Suite(&PipesSuite{})
+
+var cs = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// run completes a handshake between i and r, checking that the payloads and
+// the resulting CipherStates match.
+func run(c *C, i, r *Handshake) {
+	var csI, csR [2]*noise.CipherState
+	writer, reader := i, r
+	for n := 0; csI[0] == nil || csR[0] == nil; n++ {
+		c.Assert(n < 4, Equals, true)
+		payload := []byte{byte(n)}
+		msg, cs1, cs2, err := writer.WriteMessage(nil, payload)
+		c.Assert(err, IsNil)
+		res, cs3, cs4, err := reader.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		if reader == r && r.Fallback() && n == 0 {
+			c.Assert(res, HasLen, 0)
+		} else {
+			c.Assert(res, DeepEquals, payload)
+		}
+		if writer == i {
+			csI, csR = [2]*noise.CipherState{cs1, cs2}, [2]*noise.CipherState{cs3, cs4}
+		} else {
+			csR, csI = [2]*noise.CipherState{cs1, cs2}, [2]*noise.CipherState{cs3, cs4}
+		}
+		writer, reader = reader, writer
+	}
+	msg := csI[0].Encrypt(nil, nil, []byte("foo"))
+	res, err := csR[0].Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+	msg = csR[1].Encrypt(nil, nil, []byte("bar"))
+	res, err = csI[1].Decrypt(nil, nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "bar")
+}
+
+func (PipesSuite) TestPipes(c *C) {
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	stale, _ := cs.GenerateKeypair(nil)
+
+	for _, test := range []struct {
+		cached   []byte
+		typ      byte
+		fallback bool
+	}{
+		{nil, TypeXX, false},
+		{staticR.Public, TypeIK, false},
+		{stale.Public, TypeXXfallback, true},
+	} {
+		i, err := NewHandshake(Config{
+			CipherSuite:   cs,
+			Initiator:     true,
+			StaticKeypair: staticI,
+			PeerStatic:    test.cached,
+		})
+		c.Assert(err, IsNil)
+		r, err := NewHandshake(Config{
+			CipherSuite:   cs,
+			StaticKeypair: staticR,
+		})
+		c.Assert(err, IsNil)
+
+		run(c, i, r)
+		c.Assert(i.typ, Equals, test.typ)
+		c.Assert(r.typ, Equals, test.typ)
+		c.Assert(i.Fallback(), Equals, test.fallback)
+		c.Assert(r.Fallback(), Equals, test.fallback)
+		c.Assert(i.PeerStatic(), DeepEquals, staticR.Public)
+		c.Assert(r.PeerStatic(), DeepEquals, staticI.Public)
+	}
+}
+
+func (PipesSuite) TestUnexpectedType(c *C) {
+	staticR, _ := cs.GenerateKeypair(nil)
+	r, _ := NewHandshake(Config{CipherSuite: cs, StaticKeypair: staticR})
+
+	_, _, _, err := r.WriteMessage(nil, nil)
+	c.Assert(err, NotNil)
+	_, _, _, err = r.ReadMessage(nil, nil)
+	c.Assert(err, Equals, noise.ErrShortMessage)
+	_, _, _, err = r.ReadMessage(nil, append([]byte{TypeXXfallback}, make([]byte, 32)...))
+	c.Assert(err, ErrorMatches, "pipes: unexpected handshake type")
+}
@@ -0,0 +1,214 @@
+// Package pkcs11key provides static keys held in a PKCS#11 token, such as an
+// HSM, for use as a noise.PrivateDH. X25519 keys (CKK_EC_MONTGOMERY) and P-256
+// keys (CKK_EC) are supported, for use with noise.DH25519 and noise.DHP256.
+//
+// A Key keeps a pool of sessions with the token so that several handshakes
+// can use it at once; each DH takes a session from the pool for the duration
+// of the derivation.
+package pkcs11key
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/flynn/noise"
+	"github.com/miekg/pkcs11"
+)
+
+// ckkECMontgomery is CKK_EC_MONTGOMERY from PKCS#11 v3.0.
+const ckkECMontgomery = 0x00000041
+
+// Config describes where to find a key.
+type Config struct {
+	// Module is the path of the PKCS#11 module to load.
+	Module string
+
+	// Slot is the slot of the token holding the key.
+	Slot uint
+
+	// PIN is the user PIN of the token.
+	PIN string
+
+	// Label is the CKA_LABEL of the private key and its public key.
+	Label string
+
+	// Sessions is the number of sessions to open, and so the number of DH
+	// operations that can run at once. It defaults to 4.
+	Sessions int
+}
+
+// A Key is a static key held in a PKCS#11 token. It implements
+// noise.PrivateDH and is safe for concurrent use.
+type Key struct {
+	ctx      *pkcs11.Ctx
+	priv     pkcs11.ObjectHandle
+	public   []byte
+	sessions chan pkcs11.SessionHandle
+}
+
+var _ noise.PrivateDH = (*Key)(nil)
+
+// Open loads the PKCS#11 module, logs in to the token and finds the key
+// described by cfg.
+func Open(cfg Config) (*Key, error) {
+	if cfg.Sessions <= 0 {
+		cfg.Sessions = 4
+	}
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, errors.New("pkcs11key: cannot load module " + cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+	k := &Key{ctx: ctx, sessions: make(chan pkcs11.SessionHandle, cfg.Sessions)}
+	for i := 0; i < cfg.Sessions; i++ {
+		sh, err := ctx.OpenSession(cfg.Slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			k.Close()
+			return nil, err
+		}
+		k.sessions <- sh
+	}
+	if err := k.find(cfg); err != nil {
+		k.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *Key) find(cfg Config) error {
+	sh := <-k.sessions
+	defer func() { k.sessions <- sh }()
+
+	// Logging in applies to all of the application's sessions with the token.
+	err := k.ctx.Login(sh, pkcs11.CKU_USER, cfg.PIN)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return err
+	}
+	priv, err := k.findObject(sh, pkcs11.CKO_PRIVATE_KEY, cfg.Label)
+	if err != nil {
+		return err
+	}
+	attrs, err := k.ctx.GetAttributeValue(sh, priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return err
+	}
+	keyType := attrs[0].Value
+	pub, err := k.findObject(sh, pkcs11.CKO_PUBLIC_KEY, cfg.Label)
+	if err != nil {
+		return err
+	}
+	attrs, err = k.ctx.GetAttributeValue(sh, pub, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return err
+	}
+	public, err := publicKey(keyType, attrs[0].Value)
+	if err != nil {
+		return err
+	}
+	k.priv, k.public = priv, public
+	return nil
+}
+
+func (k *Key) findObject(sh pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	err := k.ctx.FindObjectsInit(sh, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return 0, err
+	}
+	objs, _, err := k.ctx.FindObjects(sh, 2)
+	if ferr := k.ctx.FindObjectsFinal(sh); err == nil {
+		err = ferr
+	}
+	switch {
+	case err != nil:
+		return 0, err
+	case len(objs) == 0:
+		return 0, errors.New("pkcs11key: no key labeled " + label)
+	case len(objs) > 1:
+		return 0, errors.New("pkcs11key: several keys labeled " + label)
+	}
+	return objs[0], nil
+}
+
+// publicKey returns the Noise encoding of a public key from the CKA_KEY_TYPE
+// of the private key and CKA_EC_POINT of the public key. CKA_EC_POINT is a DER
+// OCTET STRING, though some tokens return X25519 keys without the wrapping.
+func publicKey(keyType, point []byte) ([]byte, error) {
+	// CK_ULONG attributes are in the platform's byte order.
+	var typ uint64
+	switch len(keyType) {
+	case 4:
+		typ = uint64(binary.NativeEndian.Uint32(keyType))
+	case 8:
+		typ = binary.NativeEndian.Uint64(keyType)
+	}
+	want := 0
+	switch typ {
+	case ckkECMontgomery:
+		want = 32
+	case pkcs11.CKK_EC:
+		want = 65
+	default:
+		return nil, errors.New("pkcs11key: unsupported key type")
+	}
+	if len(point) == want+2 && point[0] == 0x04 && int(point[1]) == want {
+		point = point[2:]
+	}
+	if len(point) != want || (want == 65 && point[0] != 0x04) {
+		return nil, errors.New("pkcs11key: malformed public key")
+	}
+	return append([]byte(nil), point...), nil
+}
+
+// Public returns the public key, in the encoding used by the corresponding
+// noise.DHFunc.
+func (k *Key) Public() []byte { return k.public }
+
+// DH derives the shared secret with pubkey using CKM_ECDH1_DERIVE. The
+// derived secret is created as a session object and destroyed once read.
+func (k *Key) DH(pubkey []byte) ([]byte, error) {
+	sh := <-k.sessions
+	defer func() { k.sessions <- sh }()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE,
+		pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, pubkey))}
+	secret, err := k.ctx.DeriveKey(sh, mech, k.priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer k.ctx.DestroyObject(sh, secret)
+	attrs, err := k.ctx.GetAttributeValue(sh, secret, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
+
+// Close closes the sessions and unloads the module. It must not be called
+// while a handshake is using the Key.
+func (k *Key) Close() error {
+	for len(k.sessions) > 0 {
+		k.ctx.CloseSession(<-k.sessions)
+	}
+	err := k.ctx.Finalize()
+	k.ctx.Destroy()
+	return err
+}
@@ -0,0 +1,47 @@
+package pkcs11key
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PKCS11Suite struct{}
+
+var _ = Suite(PKCS11Suite{})
+
+func keyType(t uint64) []byte {
+	b := make([]byte, 8)
+	binary.NativeEndian.PutUint64(b, t)
+	return b
+}
+
+func (PKCS11Suite) TestPublicKey(c *C) {
+	x25519 := bytes.Repeat([]byte{7}, 32)
+	pub, err := publicKey(keyType(ckkECMontgomery), append([]byte{0x04, 32}, x25519...))
+	c.Assert(err, IsNil)
+	c.Assert(pub, DeepEquals, x25519)
+	pub, err = publicKey(keyType(ckkECMontgomery), x25519)
+	c.Assert(err, IsNil)
+	c.Assert(pub, DeepEquals, x25519)
+
+	p256 := append([]byte{0x04}, bytes.Repeat([]byte{7}, 64)...)
+	pub, err = publicKey(keyType(pkcs11.CKK_EC), append([]byte{0x04, 65}, p256...))
+	c.Assert(err, IsNil)
+	c.Assert(pub, DeepEquals, p256)
+
+	_, err = publicKey(keyType(pkcs11.CKK_EC), append([]byte{0x04, 33, 0x02}, x25519...))
+	c.Assert(err, ErrorMatches, "pkcs11key: malformed public key")
+	_, err = publicKey(keyType(pkcs11.CKK_RSA), x25519)
+	c.Assert(err, ErrorMatches, "pkcs11key: unsupported key type")
+}
+
+func (PKCS11Suite) TestOpenMissingModule(c *C) {
+	_, err := Open(Config{Module: "/nonexistent/libpkcs11.so"})
+	c.Assert(err, ErrorMatches, "pkcs11key: cannot load module .*")
+}
@@ -0,0 +1,38 @@
+package noise
+
+import "context"
+
+// A PrivateDH is a private key that performs Diffie-Hellman without exposing
+// the private scalar, such as a key held in a TPM, HSM or secure enclave. It
+// is to DH what crypto.Signer is to signatures.
+//
+// A PrivateDH can be used as the static key of a HandshakeState through
+// DHKey.PrivateDH, for example with NewDHKey. It must implement the DH
+// function of the CipherSuite it is used with.
+type PrivateDH interface {
+	// Public returns the public key.
+	Public() []byte
+
+	// DH performs a Diffie-Hellman calculation between the private key and
+	// pubkey and returns the result. An error, or a nil result for an invalid
+	// public key, fails the handshake with FailureDH. DH may be called
+	// concurrently by several handshakes.
+	DH(pubkey []byte) ([]byte, error)
+}
+
+// NewDHKey returns a DHKey for the static key held by priv.
+func NewDHKey(priv PrivateDH) DHKey {
+	return DHKey{Public: priv.Public(), PrivateDH: priv}
+}
+
+// A ContextPrivateDH is a PrivateDH whose DH can be cancelled, such as a key
+// held by a remote KMS, where DH is a network call that may take a long time.
+// HandshakeState passes it the context given to WriteMessageContext or
+// ReadMessageContext, and context.Background otherwise.
+type ContextPrivateDH interface {
+	PrivateDH
+
+	// DHContext is like DH. It should return promptly with an error, such as
+	// ctx.Err(), once ctx is done.
+	DHContext(ctx context.Context, pubkey []byte) ([]byte, error)
+}
@@ -0,0 +1,101 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+// softPrivateDH is a PrivateDH that keeps its key in memory.
+type softPrivateDH struct {
+	key   DHKey
+	calls int
+	err   error
+}
+
+func (k *softPrivateDH) Public() []byte { return k.key.Public }
+
+func (k *softPrivateDH) DH(pubkey []byte) ([]byte, error) {
+	k.calls++
+	if k.err != nil {
+		return nil, k.err
+	}
+	return DH25519.DH(k.key.Private, pubkey)
+}
+
+// remoteDH is a ContextPrivateDH that waits for release before each DH.
+type remoteDH struct {
+	softPrivateDH
+	release chan struct{}
+}
+
+func (k *remoteDH) DHContext(ctx context.Context, pubkey []byte) ([]byte, error) {
+	select {
+	case <-k.release:
+		return k.DH(pubkey)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (NoiseSuite) TestPrivateDH(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	keyR, _ := cs.GenerateKeypair(nil)
+	privR := &softPrivateDH{key: keyR}
+
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: keyR.Public})
+	hsR, err := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, StaticKeypair: NewDHKey(privR)})
+	c.Assert(err, IsNil)
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("hello"))
+	res, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hello")
+	msg, csR, _, _ := hsR.WriteMessage(nil, nil)
+	_, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	res, err = csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+	c.Assert(privR.calls, Equals, 1)
+	for _, secret := range hsR.Secrets() {
+		c.Assert(bytes.Equal(secret, keyR.Private), Equals, false)
+	}
+
+	// An error from the key fails the handshake.
+	privR.err = errors.New("device unavailable")
+	hsI, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: keyR.Public})
+	hsR, _ = NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, StaticKeypair: NewDHKey(privR)})
+	msg, _, _, _ = hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, DeepEquals, &HandshakeError{FailureDH, privR.err})
+}
+
+func (NoiseSuite) TestContextPrivateDH(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	keyR, _ := cs.GenerateKeypair(nil)
+	privR := &remoteDH{softPrivateDH: softPrivateDH{key: keyR}, release: make(chan struct{}, 1)}
+
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, Initiator: true, PeerStatic: keyR.Public})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNK, StaticKeypair: NewDHKey(privR)})
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("hello"))
+
+	// A cancelled DH rejects the message without disturbing the handshake.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err := hsR.ReadMessageContext(ctx, nil, msg)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(err, FitsTypeOf, &HandshakeError{})
+	c.Assert(privR.calls, Equals, 0)
+
+	privR.release <- struct{}{}
+	res, _, _, err := hsR.ReadMessageContext(context.Background(), nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hello")
+	c.Assert(privR.calls, Equals, 1)
+	msg, _, _, err = hsR.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,89 @@
+package noise
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var basePatterns = []HandshakePattern{
+	HandshakeNN, HandshakeKN, HandshakeNK, HandshakeKK, HandshakeNX, HandshakeKX,
+	HandshakeXN, HandshakeIN, HandshakeXK, HandshakeIK, HandshakeXX, HandshakeIX,
+	HandshakeN, HandshakeK, HandshakeX,
+	HandshakeNK1, HandshakeNX1, HandshakeX1N, HandshakeX1K, HandshakeXK1,
+	HandshakeX1K1, HandshakeX1X, HandshakeXX1, HandshakeX1X1, HandshakeK1N,
+	HandshakeK1K, HandshakeKK1, HandshakeK1K1, HandshakeK1X, HandshakeKX1,
+	HandshakeK1X1, HandshakeI1N, HandshakeI1K, HandshakeIK1, HandshakeI1K1,
+	HandshakeI1X, HandshakeIX1, HandshakeI1X1,
+}
+
+// ParseProtocolName returns a Config for the protocol name, for example
+// "Noise_XXpsk3_25519_ChaChaPoly_BLAKE2s", with the Pattern and CipherSuite
+// set from registered primitives. The psk, fallback and hfs modifiers are
+// supported; psk modifiers set PresharedKeyPlacements, and
+// PresharedKeyPlacement if there is only one, so the caller only needs to add
+// the keys and its own role. With hfs, the DH component names the DH function
+// and KEM, as in "25519+MLKEM768". Fallback may be combined with psk
+// modifiers, as in "XXfallback+psk0", but not with hfs.
+func ParseProtocolName(name string) (Config, error) {
+	var c Config
+	parts := strings.Split(name, "_")
+	if len(parts) != 5 || parts[0] != "Noise" {
+		return c, errors.New("noise: malformed protocol name " + strconv.Quote(name))
+	}
+
+	pattern := parts[1]
+	base := pattern
+	if i := strings.IndexFunc(pattern, func(r rune) bool { return r >= 'a' && r <= 'z' }); i >= 0 {
+		base = pattern[:i]
+	}
+	found := false
+	for _, p := range basePatterns {
+		if p.Name == base {
+			c.Pattern, found = p, true
+			break
+		}
+	}
+	if !found {
+		return c, errors.New("noise: unknown handshake pattern " + strconv.Quote(base))
+	}
+	hfs := false
+	for i, m := range patternModifiers(pattern) {
+		switch {
+		case m == "fallback" && i == 0:
+			c.Fallback = true
+		case m == "hfs" && !hfs:
+			c.Pattern, hfs = HFS(c.Pattern), true
+		case strings.HasPrefix(m, "psk"):
+			n, err := strconv.Atoi(m[3:])
+			if err != nil || n < 0 || m[3:] != strconv.Itoa(n) {
+				return c, errors.New("noise: malformed modifier " + strconv.Quote(m))
+			}
+			c.PresharedKeyPlacements = append(c.PresharedKeyPlacements, n)
+		default:
+			return c, errors.New("noise: unsupported modifier " + strconv.Quote(m))
+		}
+	}
+	if len(c.PresharedKeyPlacements) == 1 {
+		c.PresharedKeyPlacement = c.PresharedKeyPlacements[0]
+	}
+	// The first message of an hfs pattern sends the KEM public key, which
+	// fallback cannot turn into a pre-message.
+	if c.Fallback && hfs {
+		return c, errors.New("noise: fallback modifier cannot be combined with hfs")
+	}
+
+	hasKEM := strings.Contains(parts[2], "+")
+	switch {
+	case hfs && !hasKEM:
+		return c, errors.New("noise: hfs modifier without a KEM in " + strconv.Quote(parts[2]))
+	case !hfs && hasKEM:
+		return c, errors.New("noise: KEM in " + strconv.Quote(parts[2]) + " without the hfs modifier")
+	}
+	cs, err := lookupCipherSuite(parts[2], parts[3], parts[4])
+	if err != nil {
+		return c, err
+	}
+	c.CipherSuite = cs
+	return c, nil
+}
@@ -0,0 +1,103 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestParseProtocolName(c *C) {
+	cfg, err := ParseProtocolName("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Pattern.Name, Equals, "XX")
+	c.Assert(string(cfg.CipherSuite.Name()), Equals, "25519_ChaChaPoly_BLAKE2s")
+
+	cfg, err = ParseProtocolName("Noise_NNpsk0+psk2_25519_AESGCM_SHA256")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Pattern.Name, Equals, "NN")
+	c.Assert(cfg.PresharedKeyPlacements, DeepEquals, []int{0, 2})
+
+	cfg, err = ParseProtocolName("Noise_XXfallback_25519_AESGCM_SHA512")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Fallback, Equals, true)
+
+	for _, name := range []string{
+		"Noise_XX_25519_ChaChaPoly",
+		"Noise_ZZ_25519_ChaChaPoly_BLAKE2s",
+		"Noise_XXpskx_25519_ChaChaPoly_BLAKE2s",
+		"Noise_XXhfs_25519_ChaChaPoly_BLAKE2s",
+		"Noise_XX_448_ChaChaPoly_BLAKE2s",
+		"Noise_XX_25519_AESGCM_MD5",
+		"Noise_XXfallback+hfs_25519+MLKEM768_ChaChaPoly_BLAKE2s",
+	} {
+		_, err := ParseProtocolName(name)
+		c.Assert(err, NotNil, Commentf("%s", name))
+	}
+}
+
+func (NoiseSuite) TestParseProtocolNameHandshake(c *C) {
+	name := "Noise_NKpsk2_25519_ChaChaPoly_SHA256"
+	psk := make([]byte, 32)
+	cfgI, err := ParseProtocolName(name)
+	c.Assert(err, IsNil)
+	cfgR, _ := ParseProtocolName(name)
+	rs, _ := cfgR.CipherSuite.GenerateKeypair(nil)
+	cfgI.Initiator, cfgI.PeerStatic, cfgI.PresharedKey = true, rs.Public, psk
+	cfgR.StaticKeypair, cfgR.PresharedKey = rs, psk
+	hsI, err := NewHandshakeState(cfgI)
+	c.Assert(err, IsNil)
+	hsR, err := NewHandshakeState(cfgR)
+	c.Assert(err, IsNil)
+	c.Assert(hsI.ProtocolName(), Equals, name)
+
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+}
+
+func (NoiseSuite) TestParseProtocolNameFallbackPSK(c *C) {
+	name := "Noise_XXfallback+psk0_25519_ChaChaPoly_SHA256"
+	psk := make([]byte, 32)
+	cfgI, err := ParseProtocolName(name)
+	c.Assert(err, IsNil)
+	cfgR, _ := ParseProtocolName(name)
+	cs := cfgI.CipherSuite
+	e, _ := cs.GenerateKeypair(nil)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+	cfgI.Initiator, cfgI.EphemeralKeypair, cfgI.StaticKeypair, cfgI.PresharedKey = true, e, staticI, psk
+	cfgR.PeerEphemeral, cfgR.StaticKeypair, cfgR.PresharedKey = e.Public, staticR, psk
+	hsI, err := NewHandshakeState(cfgI)
+	c.Assert(err, IsNil)
+	hsR, err := NewHandshakeState(cfgR)
+	c.Assert(err, IsNil)
+	c.Assert(hsI.ProtocolName(), Equals, name)
+	c.Assert(hsR.ProtocolName(), Equals, name)
+
+	msg, _, _, err := hsR.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, csI, _, err := hsI.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	_, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+}
+
+func (NoiseSuite) TestProtocolName(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	hs, _ := NewHandshakeState(Config{
+		CipherSuite:            cs,
+		Pattern:                HandshakeXX,
+		Initiator:              true,
+		PresharedKeys:          [][]byte{make([]byte, 32), make([]byte, 32)},
+		PresharedKeyPlacements: []int{0, 3},
+	})
+	c.Assert(hs.ProtocolName(), Equals, "Noise_XXpsk0+psk3_25519_ChaChaPoly_BLAKE2s")
+
+	cfg, err := ParseProtocolName(hs.ProtocolName())
+	c.Assert(err, IsNil)
+	c.Assert(cfg.PresharedKeyPlacements, DeepEquals, []int{0, 3})
+}
@@ -0,0 +1,165 @@
+// Package puzzle implements stateless client puzzles that a Noise responder
+// can use to make anonymous initiators pay for handshake CPU.
+//
+// When under load, the responder answers a first handshake message with an
+// unauthenticated challenge from Issuer.Challenge instead of continuing the
+// handshake. The initiator finds a solution with Solve and retries the
+// handshake, sending the challenge and solution alongside its first message.
+// The responder checks them with Issuer.Verify, and both peers use Prologue to
+// bind them into the prologue of the retried handshake, so that the peers
+// agree on the challenge and solution or the handshake fails.
+//
+// Challenges carry their own expiry and are authenticated with a key known only
+// to the responder, so the responder does not keep any per-client state. For
+// the same reason a solution is not tied to a single handshake: the client it
+// was issued to can use it for any number of handshakes until the challenge
+// expires, so the lifetime given to NewIssuer bounds how much work a solution
+// buys.
+//
+// The difficulty is chosen by the responder and carried in the unauthenticated
+// challenge, so the initiator limits it when solving.
+package puzzle
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// ChallengeSize is the size in bytes of a challenge.
+	ChallengeSize = 8 + 1 + sha256.Size
+
+	// SolutionSize is the size in bytes of a solution.
+	SolutionSize = 8
+)
+
+var (
+	// ErrMalformed is returned for challenges or solutions of the wrong size.
+	ErrMalformed = errors.New("puzzle: malformed challenge or solution")
+
+	// ErrInvalidChallenge is returned for challenges that were not issued by
+	// the Issuer for the client.
+	ErrInvalidChallenge = errors.New("puzzle: invalid challenge")
+
+	// ErrExpired is returned for challenges that are too old.
+	ErrExpired = errors.New("puzzle: challenge has expired")
+
+	// ErrWrongSolution is returned for solutions that do not solve the
+	// challenge.
+	ErrWrongSolution = errors.New("puzzle: wrong solution")
+
+	// ErrTooDifficult is returned by Solve for challenges of a difficulty
+	// above the maximum the caller accepts.
+	ErrTooDifficult = errors.New("puzzle: challenge is too difficult")
+)
+
+// An Issuer issues and verifies challenges. It is safe for concurrent use.
+type Issuer struct {
+	key        []byte
+	difficulty uint8
+	lifetime   time.Duration
+	now        func() time.Time
+}
+
+// NewIssuer returns an Issuer that authenticates challenges with key, requires
+// solutions with difficulty leading zero bits, and accepts challenges for
+// lifetime after they were issued.
+func NewIssuer(key []byte, difficulty uint8, lifetime time.Duration) *Issuer {
+	return &Issuer{
+		key:        append([]byte(nil), key...),
+		difficulty: difficulty,
+		lifetime:   lifetime,
+		now:        time.Now,
+	}
+}
+
+// Challenge returns a new challenge for the client, which should identify the
+// initiator as seen by the responder, for example its network address.
+func (i *Issuer) Challenge(client []byte) []byte {
+	challenge := make([]byte, 9, ChallengeSize)
+	binary.BigEndian.PutUint64(challenge, uint64(i.now().Unix()))
+	challenge[8] = i.difficulty
+	return i.mac(challenge, client)
+}
+
+// Verify checks that challenge was issued to client by i, has not expired and
+// is solved by solution.
+func (i *Issuer) Verify(client, challenge, solution []byte) error {
+	if len(challenge) != ChallengeSize || len(solution) != SolutionSize {
+		return ErrMalformed
+	}
+	if !hmac.Equal(i.mac(challenge[:9:9], client), challenge) {
+		return ErrInvalidChallenge
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(challenge)), 0)
+	if i.now().Sub(issued) > i.lifetime {
+		return ErrExpired
+	}
+	if !solves(challenge, solution) {
+		return ErrWrongSolution
+	}
+	return nil
+}
+
+func (i *Issuer) mac(challenge, client []byte) []byte {
+	m := hmac.New(sha256.New, i.key)
+	m.Write(challenge)
+	m.Write(client)
+	return m.Sum(challenge)
+}
+
+// Solve returns a solution for challenge. The expected work doubles with every
+// bit of difficulty requested by the issuer, so Solve fails with
+// ErrTooDifficult for a difficulty above maxDifficulty, and with ctx.Err() if
+// ctx is done before it finds a solution.
+func Solve(ctx context.Context, challenge []byte, maxDifficulty int) ([]byte, error) {
+	if len(challenge) != ChallengeSize {
+		return nil, ErrMalformed
+	}
+	if int(challenge[8]) > maxDifficulty {
+		return nil, ErrTooDifficult
+	}
+	solution := make([]byte, SolutionSize)
+	for n := uint64(0); ; n++ {
+		if n%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		binary.BigEndian.PutUint64(solution, n)
+		if solves(challenge, solution) {
+			return solution, nil
+		}
+	}
+}
+
+func solves(challenge, solution []byte) bool {
+	h := sha256.New()
+	h.Write(challenge)
+	h.Write(solution)
+	sum := h.Sum(nil)
+	bits := int(challenge[8])
+	if bits > len(sum)*8 {
+		return false
+	}
+	for _, b := range sum[:bits/8] {
+		if b != 0 {
+			return false
+		}
+	}
+	return bits%8 == 0 || sum[bits/8]>>(8-uint(bits%8)) == 0
+}
+
+// Prologue returns the prologue for a handshake retried with challenge and
+// solution, given the prologue that would otherwise be used.
+func Prologue(prologue, challenge, solution []byte) []byte {
+	p := make([]byte, 0, len(prologue)+len("NoisePuzzle")+len(challenge)+len(solution))
+	p = append(p, prologue...)
+	p = append(p, "NoisePuzzle"...)
+	p = append(p, challenge...)
+	return append(p, solution...)
+}
@@ -0,0 +1,69 @@
+package puzzle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PuzzleSuite struct{}
+
+var _ = Suite(&PuzzleSuite{})
+
+func (PuzzleSuite) TestSolveVerify(c *C) {
+	now := time.Unix(1500000000, 0)
+	issuer := NewIssuer([]byte("secret"), 12, time.Minute)
+	issuer.now = func() time.Time { return now }
+
+	client := []byte("192.0.2.1:4242")
+	challenge := issuer.Challenge(client)
+	c.Assert(challenge, HasLen, ChallengeSize)
+
+	solution, err := Solve(context.Background(), challenge, 12)
+	c.Assert(err, IsNil)
+	c.Assert(issuer.Verify(client, challenge, solution), IsNil)
+
+	c.Assert(issuer.Verify([]byte("192.0.2.2:4242"), challenge, solution), Equals, ErrInvalidChallenge)
+	c.Assert(issuer.Verify(client, challenge, solution[1:]), Equals, ErrMalformed)
+
+	wrong := append([]byte(nil), solution...)
+	wrong[7]++
+	if solves(challenge, wrong) {
+		wrong[6]++
+	}
+	c.Assert(issuer.Verify(client, challenge, wrong), Equals, ErrWrongSolution)
+
+	easier := append([]byte(nil), challenge...)
+	easier[8] = 0
+	c.Assert(issuer.Verify(client, easier, solution), Equals, ErrInvalidChallenge)
+
+	now = now.Add(2 * time.Minute)
+	c.Assert(issuer.Verify(client, challenge, solution), Equals, ErrExpired)
+}
+
+func (PuzzleSuite) TestSolveLimits(c *C) {
+	issuer := NewIssuer([]byte("secret"), 12, time.Minute)
+	challenge := issuer.Challenge([]byte("client"))
+	_, err := Solve(context.Background(), challenge, 11)
+	c.Assert(err, Equals, ErrTooDifficult)
+
+	// The difficulty is not authenticated, so an attacker can ask for more
+	// work than any client can do.
+	hard := append([]byte(nil), challenge...)
+	hard[8] = 255
+	_, err = Solve(context.Background(), hard, 24)
+	c.Assert(err, Equals, ErrTooDifficult)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = Solve(ctx, hard, 255)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+}
+
+func (PuzzleSuite) TestPrologue(c *C) {
+	p := Prologue([]byte("base"), []byte("challenge"), []byte("solution"))
+	c.Assert(string(p), Equals, "baseNoisePuzzlechallengesolution")
+}
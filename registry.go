@@ -0,0 +1,148 @@
+package noise
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The registry maps protocol-name components to primitives. It starts out
+// with the primitives defined in this package.
+var registry = struct {
+	sync.RWMutex
+	dh     map[string]DHFunc
+	kem    map[string]KEM
+	cipher map[string]CipherFunc
+	hash   map[string]HashFunc
+}{
+	dh:     make(map[string]DHFunc),
+	kem:    make(map[string]KEM),
+	cipher: make(map[string]CipherFunc),
+	hash:   make(map[string]HashFunc),
+}
+
+func init() {
+	for _, f := range []DHFunc{DH25519, DHP256, DHSecp256k1, DHRistretto255} {
+		RegisterDH(f)
+	}
+	RegisterKEM(KEMMLKEM768)
+	for _, f := range []CipherFunc{CipherAESGCM, CipherAESGCMSIV, CipherChaChaPoly, CipherXChaChaPoly} {
+		RegisterCipher(f)
+	}
+	for _, f := range []HashFunc{HashSHA256, HashSHA512, HashBLAKE2b, HashBLAKE2s, HashSHA3_256, HashBLAKE3} {
+		RegisterHash(f)
+	}
+}
+
+// RegisterDH makes a DH function available by its DHName to
+// ParseProtocolName and CipherSuiteByName. It panics if the name is already
+// registered.
+func RegisterDH(f DHFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.dh[f.DHName()]; dup {
+		panic("noise: RegisterDH called twice for " + f.DHName())
+	}
+	registry.dh[f.DHName()] = f
+}
+
+// RegisterKEM makes a KEM available by its KEMName to ParseProtocolName and
+// CipherSuiteByName. It panics if the name is already registered.
+func RegisterKEM(f KEM) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.kem[f.KEMName()]; dup {
+		panic("noise: RegisterKEM called twice for " + f.KEMName())
+	}
+	registry.kem[f.KEMName()] = f
+}
+
+// RegisterCipher makes a cipher function available by its CipherName to
+// ParseProtocolName and CipherSuiteByName. It panics if the name is already
+// registered.
+func RegisterCipher(f CipherFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.cipher[f.CipherName()]; dup {
+		panic("noise: RegisterCipher called twice for " + f.CipherName())
+	}
+	registry.cipher[f.CipherName()] = f
+}
+
+// RegisterHash makes a hash function available by its HashName to
+// ParseProtocolName and CipherSuiteByName. It panics if the name is already
+// registered.
+func RegisterHash(f HashFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.hash[f.HashName()]; dup {
+		panic("noise: RegisterHash called twice for " + f.HashName())
+	}
+	registry.hash[f.HashName()] = f
+}
+
+// CipherSuiteByName returns the CipherSuite for the cipher suite part of a
+// protocol name, for example "25519_ChaChaPoly_BLAKE2s", built from
+// registered primitives. A DH component that also names a KEM, as in
+// "25519+MLKEM768", returns a CipherSuite for use with the hfs modifier.
+func CipherSuiteByName(name string) (CipherSuite, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return nil, errors.New("noise: malformed cipher suite name " + strconv.Quote(name))
+	}
+	return lookupCipherSuite(parts[0], parts[1], parts[2])
+}
+
+// CipherSuites returns a CipherSuite for every combination of registered DH,
+// cipher and hash functions, ordered by name. Suites with a KEM are not
+// included.
+func CipherSuites() []CipherSuite {
+	registry.RLock()
+	defer registry.RUnlock()
+	var suites []CipherSuite
+	for _, dh := range sortedKeys(registry.dh) {
+		for _, cipher := range sortedKeys(registry.cipher) {
+			for _, hash := range sortedKeys(registry.hash) {
+				suites = append(suites, NewCipherSuite(registry.dh[dh], registry.cipher[cipher], registry.hash[hash]))
+			}
+		}
+	}
+	return suites
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func lookupCipherSuite(dhName, cipherName, hashName string) (CipherSuite, error) {
+	dhName, kemName, hasKEM := strings.Cut(dhName, "+")
+	registry.RLock()
+	defer registry.RUnlock()
+	dh, ok := registry.dh[dhName]
+	if !ok {
+		return nil, errors.New("noise: unknown DH function " + strconv.Quote(dhName))
+	}
+	kem, ok := registry.kem[kemName]
+	if hasKEM && !ok {
+		return nil, errors.New("noise: unknown KEM " + strconv.Quote(kemName))
+	}
+	cipher, ok := registry.cipher[cipherName]
+	if !ok {
+		return nil, errors.New("noise: unknown cipher " + strconv.Quote(cipherName))
+	}
+	hash, ok := registry.hash[hashName]
+	if !ok {
+		return nil, errors.New("noise: unknown hash function " + strconv.Quote(hashName))
+	}
+	if hasKEM {
+		return NewCipherSuiteKEM(dh, kem, cipher, hash), nil
+	}
+	return NewCipherSuite(dh, cipher, hash), nil
+}
@@ -0,0 +1,63 @@
+package noise
+
+import (
+	"crypto/sha256"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestCipherSuiteByName(c *C) {
+	cs, err := CipherSuiteByName("25519_ChaChaPoly_BLAKE2s")
+	c.Assert(err, IsNil)
+	c.Assert(string(cs.Name()), Equals, "25519_ChaChaPoly_BLAKE2s")
+
+	cs, err = CipherSuiteByName("25519+MLKEM768_AESGCM_SHA256")
+	c.Assert(err, IsNil)
+	c.Assert(kemOf(cs).KEMName(), Equals, "MLKEM768")
+
+	for _, name := range []string{
+		"25519_ChaChaPoly",
+		"448_ChaChaPoly_BLAKE2s",
+		"25519+Kyber512_ChaChaPoly_BLAKE2s",
+		"25519_RC4_BLAKE2s",
+		"25519_ChaChaPoly_MD5",
+	} {
+		_, err := CipherSuiteByName(name)
+		c.Assert(err, NotNil, Commentf("%s", name))
+	}
+}
+
+func (NoiseSuite) TestCipherSuites(c *C) {
+	suites := CipherSuites()
+	c.Assert(suites, HasLen, 4*4*6)
+	c.Assert(string(suites[0].Name()), Equals, "25519_AESGCM_BLAKE2b")
+	names := make(map[string]bool)
+	for _, cs := range suites {
+		names[string(cs.Name())] = true
+	}
+	for _, name := range []string{
+		"P256_ChaChaPoly_SHA256",
+		"secp256k1_ChaChaPoly_SHA256",
+		"ristretto255_XChaChaPoly_BLAKE2b",
+		"25519_AESGCMSIV_SHA3-256",
+		"25519_ChaChaPoly_BLAKE3",
+	} {
+		c.Assert(names[name], Equals, true, Commentf("%s", name))
+	}
+}
+
+func (NoiseSuite) TestRegisterHash(c *C) {
+	h := hashFn{sha256.New, "TestSHA256"}
+	_, err := ParseProtocolName("Noise_NN_25519_ChaChaPoly_TestSHA256")
+	c.Assert(err, NotNil)
+	RegisterHash(h)
+	defer func() {
+		registry.Lock()
+		delete(registry.hash, h.name)
+		registry.Unlock()
+	}()
+	cfg, err := ParseProtocolName("Noise_NN_25519_ChaChaPoly_TestSHA256")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.CipherSuite.HashName(), Equals, "TestSHA256")
+	c.Assert(func() { RegisterHash(h) }, PanicMatches, "noise: RegisterHash called twice for TestSHA256")
+}
@@ -0,0 +1,56 @@
+package noise
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/gtank/ristretto255"
+)
+
+// DHRistretto255 is Diffie-Hellman over the ristretto255 prime-order group.
+// Private keys are 32-byte canonical scalars and public keys are 32-byte
+// element encodings. It is not one of the DH functions defined by the Noise
+// specification. As the group has no small subgroups, the only invalid
+// result is the identity, for which DH returns ErrInvalidPublicKey.
+var DHRistretto255 DHFunc = dhRistretto255{}
+
+type dhRistretto255 struct{}
+
+func (dhRistretto255) GenerateKeypair(rng io.Reader) (DHKey, error) {
+	if rng == nil {
+		rng = rand.Reader
+	}
+	var uniform [64]byte
+	if _, err := io.ReadFull(rng, uniform[:]); err != nil {
+		return DHKey{}, err
+	}
+	s := ristretto255.NewScalar().FromUniformBytes(uniform[:])
+	pub := ristretto255.NewElement().ScalarBaseMult(s)
+	return DHKey{Private: s.Encode(nil), Public: pub.Encode(nil)}, nil
+}
+
+func (dhRistretto255) DH(privkey, pubkey []byte) ([]byte, error) {
+	// Decode panics on input of the wrong length.
+	if len(privkey) != 32 {
+		return nil, ErrInvalidPrivateKey
+	}
+	if len(pubkey) != 32 {
+		return nil, ErrInvalidPublicKey
+	}
+	s := ristretto255.NewScalar()
+	if err := s.Decode(privkey); err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	p := ristretto255.NewElement()
+	if err := p.Decode(pubkey); err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	shared := ristretto255.NewElement().ScalarMult(s, p)
+	if shared.Equal(ristretto255.NewElement()) == 1 {
+		return nil, ErrInvalidPublicKey
+	}
+	return shared.Encode(nil), nil
+}
+
+func (dhRistretto255) DHLen() int     { return DHRistretto255Len }
+func (dhRistretto255) DHName() string { return "ristretto255" }
@@ -0,0 +1,49 @@
+package noise
+
+import (
+	"encoding/hex"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestRistretto255(c *C) {
+	// 2·B from the ristretto255 small multiples test vectors.
+	base, _ := hex.DecodeString("e2f2ae0a6abc4e71a884a961c500515f58e30b6aa582dd8db6a65945e08d2d76")
+	two := make([]byte, 32)
+	two[0] = 2
+	shared, err := DHRistretto255.DH(two, base)
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(shared), Equals,
+		"6a493210f7499cd17fecb510ae0cea23a110e8d5b901f8acadd3095c73a3b919")
+
+	// The identity and non-canonical encodings are rejected.
+	_, err = DHRistretto255.DH(two, make([]byte, 32))
+	c.Assert(err, Equals, ErrInvalidPublicKey)
+	nonCanonical := append([]byte(nil), base...)
+	nonCanonical[31] |= 0x80
+	_, err = DHRistretto255.DH(two, nonCanonical)
+	c.Assert(err, Equals, ErrInvalidPublicKey)
+
+	cfgI, err := ParseProtocolName("Noise_XX_ristretto255_ChaChaPoly_BLAKE2b")
+	c.Assert(err, IsNil)
+	cfgR, _ := ParseProtocolName("Noise_XX_ristretto255_ChaChaPoly_BLAKE2b")
+	cfgI.Initiator = true
+	cfgI.StaticKeypair, _ = cfgI.CipherSuite.GenerateKeypair(nil)
+	cfgR.StaticKeypair, _ = cfgR.CipherSuite.GenerateKeypair(nil)
+	hsI, _ := NewHandshakeState(cfgI)
+	hsR, _ := NewHandshakeState(cfgR)
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	c.Assert(msg, HasLen, 32)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, csI, _, _ := hsI.WriteMessage(nil, nil)
+	_, csR, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(hsR.PeerStatic(), DeepEquals, cfgI.StaticKeypair.Public)
+	res, err := csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("foo")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "foo")
+}
@@ -0,0 +1,167 @@
+package noise
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// DHSecp256k1 is the secp256k1 ECDH function as used by the Lightning Network
+// transport (BOLT 8). Public keys are compressed SEC 1 points, 33 bytes long,
+// and the DH output is the SHA-256 hash of the compressed shared point.
+var DHSecp256k1 DHFunc = dhSecp256k1{}
+
+type dhSecp256k1 struct{}
+
+func (dhSecp256k1) GenerateKeypair(rng io.Reader) (DHKey, error) {
+	if rng == nil {
+		rng = rand.Reader
+	}
+	var scalar [32]byte
+	for {
+		if _, err := io.ReadFull(rng, scalar[:]); err != nil {
+			return DHKey{}, err
+		}
+		var k secp256k1.ModNScalar
+		if overflow := k.SetBytes(&scalar); overflow != 0 || k.IsZero() {
+			continue
+		}
+		priv := secp256k1.NewPrivateKey(&k)
+		return DHKey{Private: priv.Serialize(), Public: priv.PubKey().SerializeCompressed()}, nil
+	}
+}
+
+func (dhSecp256k1) DH(privkey, pubkey []byte) ([]byte, error) {
+	if len(privkey) != secp256k1.PrivKeyBytesLen {
+		return nil, ErrInvalidPrivateKey
+	}
+	if len(pubkey) != secp256k1.PubKeyBytesLenCompressed {
+		return nil, ErrInvalidPublicKey
+	}
+	var scalar [32]byte
+	copy(scalar[:], privkey)
+	var k secp256k1.ModNScalar
+	if overflow := k.SetBytes(&scalar); overflow != 0 || k.IsZero() {
+		return nil, ErrInvalidPrivateKey
+	}
+	pub, err := secp256k1.ParsePubKey(pubkey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	var affine secp256k1.JacobianPoint
+	pub.AsJacobian(&affine)
+	var point, shared secp256k1Point
+	point.x, point.y, point.z = affine.X, affine.Y, affine.Z
+	shared.scalarMult(&scalar, &point)
+
+	var x, y secp256k1.FieldVal
+	zInv := new(secp256k1.FieldVal).Set(&shared.z).Inverse()
+	x.Mul2(&shared.x, zInv).Normalize()
+	y.Mul2(&shared.y, zInv).Normalize()
+	var compressed [secp256k1.PubKeyBytesLenCompressed]byte
+	compressed[0] = secp256k1.PubKeyFormatCompressedEven | byte(y.IsOddBit())
+	x.PutBytesUnchecked(compressed[1:])
+	sum := sha256.Sum256(compressed[:])
+	return sum[:], nil
+}
+
+// secp256k1Point is a point in projective coordinates, (X:Y:Z) for the
+// affine point (X/Z, Y/Z), with the identity at (0:1:0). The secp256k1
+// package only offers variable-time scalar multiplication, which would leak
+// the private key through timing, so DH uses these constant-time operations
+// instead.
+type secp256k1Point struct {
+	x, y, z secp256k1.FieldVal
+}
+
+// scalarMult sets p to k*q, for the big-endian scalar k, with a double and
+// an addition for every bit whatever its value.
+func (p *secp256k1Point) scalarMult(k *[32]byte, q *secp256k1Point) {
+	var r, t secp256k1Point
+	r.y.SetInt(1)
+	for i := 0; i < 256; i++ {
+		r.add(&r, &r)
+		t.add(&r, q)
+		bit := k[i/8] >> (7 - i%8) & 1
+		feSelect(&r.x, &t.x, bit)
+		feSelect(&r.y, &t.y, bit)
+		feSelect(&r.z, &t.z, bit)
+	}
+	*p = r
+}
+
+// add sets p to a+b using the complete addition formula for curves with
+// a = 0 from Renes, Costello and Batina, "Complete addition formulas for
+// prime order elliptic curves" (Algorithm 7). It has no exceptional cases,
+// so it also doubles and handles the identity without branching.
+func (p *secp256k1Point) add(a, b *secp256k1Point) {
+	const b3 = 3 * 7
+	var t0, t1, t2, t3, t4, x3, y3, z3 secp256k1.FieldVal
+	feMul(&t0, &a.x, &b.x)
+	feMul(&t1, &a.y, &b.y)
+	feMul(&t2, &a.z, &b.z)
+	feAdd(&t3, &a.x, &a.y)
+	feAdd(&t4, &b.x, &b.y)
+	feMul(&t3, &t3, &t4)
+	feAdd(&t4, &t0, &t1)
+	feSub(&t3, &t3, &t4)
+	feAdd(&t4, &a.y, &a.z)
+	feAdd(&x3, &b.y, &b.z)
+	feMul(&t4, &t4, &x3)
+	feAdd(&x3, &t1, &t2)
+	feSub(&t4, &t4, &x3)
+	feAdd(&x3, &a.x, &a.z)
+	feAdd(&y3, &b.x, &b.z)
+	feMul(&x3, &x3, &y3)
+	feAdd(&y3, &t0, &t2)
+	feSub(&y3, &x3, &y3)
+	feAdd(&x3, &t0, &t0)
+	feAdd(&t0, &x3, &t0)
+	t2.MulInt(b3).Normalize()
+	feAdd(&z3, &t1, &t2)
+	feSub(&t1, &t1, &t2)
+	y3.MulInt(b3).Normalize()
+	feMul(&x3, &t4, &y3)
+	feMul(&t2, &t3, &t1)
+	feSub(&x3, &t2, &x3)
+	feMul(&y3, &y3, &t0)
+	feMul(&t1, &t1, &z3)
+	feAdd(&y3, &t1, &y3)
+	feMul(&t0, &t0, &t3)
+	feMul(&z3, &z3, &t4)
+	feAdd(&z3, &z3, &t0)
+	p.x, p.y, p.z = x3, y3, z3
+}
+
+// feAdd, feSub and feMul set r to the normalized sum, difference and
+// product of normalized a and b, which r may alias.
+func feAdd(r, a, b *secp256k1.FieldVal) {
+	var t secp256k1.FieldVal
+	t.Set(a).Add(b).Normalize()
+	r.Set(&t)
+}
+
+func feSub(r, a, b *secp256k1.FieldVal) {
+	var t secp256k1.FieldVal
+	t.NegateVal(b, 1).Add(a).Normalize()
+	r.Set(&t)
+}
+
+func feMul(r, a, b *secp256k1.FieldVal) {
+	var t secp256k1.FieldVal
+	t.Mul2(a, b).Normalize()
+	r.Set(&t)
+}
+
+// feSelect sets r to b if bit is 1 and leaves it alone if bit is 0, without
+// branching on bit.
+func feSelect(r, b *secp256k1.FieldVal, bit uint8) {
+	var d secp256k1.FieldVal
+	d.NegateVal(r, 1).Add(b).MulInt(bit)
+	r.Add(&d).Normalize()
+}
+
+func (dhSecp256k1) DHLen() int     { return DHSecp256k1Len }
+func (dhSecp256k1) DHName() string { return "secp256k1" }
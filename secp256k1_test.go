@@ -0,0 +1,79 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestSecp256k1BOLT8(c *C) {
+	// The first act of the BOLT 8 transport test vectors, without the
+	// leading version byte.
+	cs := NewCipherSuite(DHSecp256k1, CipherChaChaPoly, HashSHA256)
+	ls, _ := cs.GenerateKeypair(bytes.NewReader(bytes.Repeat([]byte{0x11}, 32)))
+	e, _ := cs.GenerateKeypair(bytes.NewReader(bytes.Repeat([]byte{0x12}, 32)))
+	rs, _ := cs.GenerateKeypair(bytes.NewReader(bytes.Repeat([]byte{0x21}, 32)))
+	c.Assert(hex.EncodeToString(rs.Public), Equals, "028d7500dd4c12685d1f568b4c2b5048e8534b873319f3a8daa612b469132ec7f7")
+
+	hsI, err := NewHandshakeState(Config{
+		CipherSuite:                  cs,
+		Pattern:                      HandshakeXK,
+		Initiator:                    true,
+		Prologue:                     []byte("lightning"),
+		StaticKeypair:                ls,
+		PeerStatic:                   rs.Public,
+		InjectedEphemeral:            e,
+		UnsafeAllowInjectedEphemeral: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(hsI.ProtocolName(), Equals, "Noise_XK_secp256k1_ChaChaPoly_SHA256")
+	msg, _, _, err := hsI.WriteMessage(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(msg), Equals, "036360e856310ce5d294e8be33fc807077dc56ac80d95d9cd4ddbd21325eff73f70df6086551151f58b8afe6c195782c6a")
+
+	hsR, _ := NewHandshakeState(Config{
+		CipherSuite:   cs,
+		Pattern:       HandshakeXK,
+		Prologue:      []byte("lightning"),
+		StaticKeypair: rs,
+	})
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsI.WriteMessage(nil, nil)
+	_, _, _, err = hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(hsR.PeerStatic(), DeepEquals, ls.Public)
+}
+
+func (NoiseSuite) TestSecp256k1DH(c *C) {
+	// DH agrees with the variable-time multiplication of the secp256k1
+	// package.
+	for i := 0; i < 16; i++ {
+		a, _ := DHSecp256k1.GenerateKeypair(nil)
+		b, _ := DHSecp256k1.GenerateKeypair(nil)
+		pub, err := secp256k1.ParsePubKey(b.Public)
+		c.Assert(err, IsNil)
+		var point, shared secp256k1.JacobianPoint
+		pub.AsJacobian(&point)
+		secp256k1.ScalarMultNonConst(&secp256k1.PrivKeyFromBytes(a.Private).Key, &point, &shared)
+		shared.ToAffine()
+		want := sha256.Sum256(secp256k1.NewPublicKey(&shared.X, &shared.Y).SerializeCompressed())
+		res, err := DHSecp256k1.DH(a.Private, b.Public)
+		c.Assert(err, IsNil)
+		c.Assert(res, DeepEquals, want[:])
+	}
+
+	// Private keys that are zero or not below the group order are rejected.
+	k, _ := DHSecp256k1.GenerateKeypair(nil)
+	order, _ := hex.DecodeString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141")
+	for _, priv := range [][]byte{make([]byte, 32), order, bytes.Repeat([]byte{0xff}, 32)} {
+		_, err := DHSecp256k1.DH(priv, k.Public)
+		c.Assert(err, Equals, ErrInvalidPrivateKey)
+	}
+}
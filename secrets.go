@@ -0,0 +1,43 @@
+package noise
+
+// noCopy may be embedded in structs that must not be copied after first use,
+// so that go vet's copylocks check reports copies.
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
+// Secrets returns the secret key material held by the CipherState, for leak
+// checks in tests. The returned slices alias the CipherState's own storage.
+func (s *CipherState) Secrets() [][]byte {
+	return [][]byte{s.k[:]}
+}
+
+// Secrets returns the secret key material held by the HandshakeState: private
+// keys, preshared keys, the chaining key and the current cipher key. It is
+// intended for leak checks in tests, for example with package leakcheck. The
+// returned slices alias the HandshakeState's own storage.
+func (s *HandshakeState) Secrets() [][]byte {
+	var secrets [][]byte
+	add := func(b []byte) {
+		if len(b) > 0 {
+			secrets = append(secrets, b)
+		}
+	}
+	add(s.s.Private)
+	add(s.e.Private)
+	add(s.injectedE.Private)
+	add(s.e1.Private)
+	for _, psk := range s.psks {
+		add(psk)
+	}
+	add(s.ss.ck)
+	add(s.ss.prevCK)
+	if s.ss.hasK {
+		add(s.ss.k[:])
+	}
+	if s.ss.prevHasK {
+		add(s.ss.prevK[:])
+	}
+	return secrets
+}
@@ -0,0 +1,128 @@
+package noise
+
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+// A Signer signs handshake hashes for the sig modifier with a static signing
+// key, which may be held by hardware that can sign but cannot perform DH.
+type Signer interface {
+	// Public returns the signing public key, which is sent in place of a
+	// static DH public key.
+	Public() []byte
+
+	// Sign returns a signature over msg.
+	Sign(msg []byte) ([]byte, error)
+}
+
+// A Verifier verifies signatures for the sig modifier. Both peers must use the
+// same Verifier, as its name is part of the protocol name.
+type Verifier interface {
+	// Verify checks that sig is a valid signature over msg by publicKey.
+	Verify(publicKey, msg, sig []byte) error
+
+	// PublicKeyLen is a constant specifying the size in bytes of a public key.
+	PublicKeyLen() int
+
+	// SignatureLen is a constant specifying the size in bytes of a signature.
+	SignatureLen() int
+
+	// SigName is the name of the signature scheme.
+	SigName() string
+}
+
+// VerifierEd25519 is the Ed25519 signature scheme.
+var VerifierEd25519 Verifier = verifierEd25519{}
+
+type verifierEd25519 struct{}
+
+func (verifierEd25519) Verify(publicKey, msg, sig []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, msg, sig) {
+		return errors.New("noise: invalid Ed25519 signature")
+	}
+	return nil
+}
+
+func (verifierEd25519) PublicKeyLen() int { return ed25519.PublicKeySize }
+func (verifierEd25519) SignatureLen() int { return ed25519.SignatureSize }
+func (verifierEd25519) SigName() string   { return "Ed25519" }
+
+// SignerEd25519 returns a Signer for an Ed25519 private key.
+func SignerEd25519(priv ed25519.PrivateKey) Signer {
+	return signerEd25519(priv)
+}
+
+type signerEd25519 ed25519.PrivateKey
+
+func (k signerEd25519) Public() []byte {
+	return ed25519.PrivateKey(k).Public().(ed25519.PublicKey)
+}
+
+func (k signerEd25519) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), msg), nil
+}
+
+// Sig returns p with the sig modifier applied: static keys are signing keys
+// and are authenticated by a "sig" token, which signs the handshake hash,
+// instead of by DHs. Each "es", "se" and "ss" token is removed, and each party
+// with a static key signs in the first message it writes once its static key
+// is known to the peer and it has received the peer's ephemeral, so that the
+// signature cannot be replayed. An error is returned if a party never writes
+// such a message, as in IK or the one-way patterns.
+func Sig(p HandshakePattern) (HandshakePattern, error) {
+	sig := HandshakePattern{
+		Name:                 appendModifier(p.Name, "sig"),
+		InitiatorPreMessages: p.InitiatorPreMessages,
+		ResponderPreMessages: p.ResponderPreMessages,
+		Messages:             make([][]MessagePattern, len(p.Messages)),
+	}
+	var sent [2]map[MessagePattern]bool
+	for i, pre := range [][]MessagePattern{p.InitiatorPreMessages, p.ResponderPreMessages} {
+		sent[i] = make(map[MessagePattern]bool)
+		for _, t := range pre {
+			sent[i][t] = true
+		}
+	}
+	var signed [2]bool
+	party := 0
+	if p.fallback() {
+		party = 1
+	}
+	for i, m := range p.Messages {
+		for _, t := range m {
+			switch t {
+			case MessagePatternES, MessagePatternSE, MessagePatternSS:
+				continue
+			}
+			sent[party][t] = true
+			sig.Messages[i] = append(sig.Messages[i], t)
+		}
+		if !signed[party] && sent[party][MessagePatternS] && sent[party^1][MessagePatternE] {
+			sig.Messages[i] = append(sig.Messages[i], MessagePatternSig)
+			signed[party] = true
+		}
+		party ^= 1
+	}
+	for i := range signed {
+		if sent[i][MessagePatternS] && !signed[i] {
+			return HandshakePattern{}, errors.New("noise: static key cannot be authenticated by a signature in pattern " + p.Name)
+		}
+	}
+	return sig, nil
+}
+
+// signHash writes a signature over the current handshake hash.
+func (s *HandshakeState) signHash(out []byte) ([]byte, error) {
+	if s.sigSigner == nil {
+		return nil, errors.New("noise: sig token requires a Signer")
+	}
+	sig, err := s.sigSigner.Sign(s.ss.h)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != s.sigVerifier.SignatureLen() {
+		return nil, errors.New("noise: Signer returned a signature of the wrong length")
+	}
+	return s.ss.EncryptAndHash(out, sig), nil
+}
@@ -0,0 +1,95 @@
+package noise
+
+import (
+	"crypto/ed25519"
+
+	. "gopkg.in/check.v1"
+)
+
+// lyingSigner advertises one public key but signs with another.
+type lyingSigner struct {
+	Signer
+	public []byte
+}
+
+func (s lyingSigner) Public() []byte { return s.public }
+
+func (NoiseSuite) TestSigPattern(c *C) {
+	p, err := Sig(HandshakeXX)
+	c.Assert(err, IsNil)
+	c.Assert(p.Name, Equals, "XXsig")
+	c.Assert(p.Messages, DeepEquals, [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternS, MessagePatternSig},
+		{MessagePatternS, MessagePatternSig},
+	})
+	c.Assert(p.Validate(), IsNil)
+
+	p, err = Sig(HandshakeNK)
+	c.Assert(err, IsNil)
+	c.Assert(p.Messages, DeepEquals, [][]MessagePattern{
+		{MessagePatternE},
+		{MessagePatternE, MessagePatternEE, MessagePatternSig},
+	})
+
+	_, err = Sig(HandshakeIK)
+	c.Assert(err, NotNil)
+	_, err = Sig(HandshakeX)
+	c.Assert(err, NotNil)
+}
+
+func (NoiseSuite) TestSigHandshake(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	pubI, privI, _ := ed25519.GenerateKey(nil)
+	pubR, privR, _ := ed25519.GenerateKey(nil)
+	pattern, _ := Sig(HandshakeXX)
+
+	run := func(signerR Signer) ([]*CipherState, error) {
+		hsI, err := NewHandshakeState(Config{
+			CipherSuite: cs,
+			Pattern:     pattern,
+			Initiator:   true,
+			Signer:      SignerEd25519(privI),
+			Verifier:    VerifierEd25519,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(hsI.protocolName, Equals, "Noise_XXsig_25519+Ed25519_ChaChaPoly_SHA256")
+		hsR, _ := NewHandshakeState(Config{
+			CipherSuite: cs,
+			Pattern:     pattern,
+			Signer:      signerR,
+			Verifier:    VerifierEd25519,
+		})
+		overheads := hsI.overheads()
+		c.Assert(overheads, DeepEquals, []int{32, 32 + 48 + 80 + 16, 48 + 80 + 16})
+
+		var css []*CipherState
+		writer, reader := hsI, hsR
+		for i := 0; css == nil; i++ {
+			msg, _, _, err := writer.WriteMessage(nil, nil)
+			c.Assert(err, IsNil)
+			c.Assert(msg, HasLen, overheads[i])
+			_, cs1, cs2, err := reader.ReadMessage(nil, msg)
+			if err != nil {
+				return nil, err
+			}
+			if cs1 != nil {
+				css = []*CipherState{cs1, cs2}
+			}
+			writer, reader = reader, writer
+		}
+		c.Assert(hsI.PeerStatic(), DeepEquals, []byte(pubR))
+		c.Assert(hsR.PeerStatic(), DeepEquals, []byte(pubI))
+		return css, nil
+	}
+
+	css, err := run(SignerEd25519(privR))
+	c.Assert(err, IsNil)
+	c.Assert(css, HasLen, 2)
+
+	_, err = run(lyingSigner{SignerEd25519(privR), pubI})
+	c.Assert(err.(*HandshakeError).Reason, Equals, FailureSignature)
+
+	_, err = NewHandshakeState(Config{CipherSuite: cs, Pattern: pattern})
+	c.Assert(err, ErrorMatches, "noise: sig modifier requires a Verifier")
+}
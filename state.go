@@ -7,32 +7,49 @@
 package noise
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/flynn/noise/subtle"
 )
 
 // A CipherState provides symmetric encryption and decryption after a successful
-// handshake.
+// handshake. A CipherState must not be copied after first use. It is not safe
+// for concurrent use; callers that encrypt or decrypt from several goroutines
+// must serialize their calls.
 type CipherState struct {
+	noCopy noCopy
+
 	cs CipherSuite
 	c  Cipher
 	k  [32]byte
 	n  uint64
 
+	// sendOnly and recvOnly restrict the CipherState to one direction, for
+	// one-way patterns.
+	sendOnly, recvOnly bool
+
 	invalid bool
 }
 
 // Encrypt encrypts the plaintext and then appends the ciphertext and an
 // authentication tag across the ciphertext and optional authenticated data to
 // out. This method automatically increments the nonce after every call, so
-// messages must be decrypted in the same order.
+// messages must be decrypted in the same order. It panics if the CipherState
+// is receive-only, as the responder's is in a one-way pattern.
 func (s *CipherState) Encrypt(out, ad, plaintext []byte) []byte {
 	if s.invalid {
 		panic("noise: CipherSuite has been copied, state is invalid")
 	}
+	if s.recvOnly {
+		panic("noise: CipherState is receive-only")
+	}
 	out = s.c.Encrypt(out, s.n, ad, plaintext)
 	s.n++
 	return out
@@ -46,6 +63,9 @@ func (s *CipherState) Decrypt(out, ad, ciphertext []byte) ([]byte, error) {
 	if s.invalid {
 		panic("noise: CipherSuite has been copied, state is invalid")
 	}
+	if s.sendOnly {
+		return nil, errors.New("noise: CipherState is send-only")
+	}
 	out, err := s.c.Decrypt(out, s.n, ad, ciphertext)
 	s.n++
 	return out, err
@@ -62,11 +82,24 @@ func (s *CipherState) Cipher() Cipher {
 	return s.c
 }
 
+// Rekey replaces the key with one derived from it by the REKEY function of
+// the specification, so that a compromise of the new key does not reveal
+// earlier messages. By default the new key is the first 32 bytes of the
+// encryption of 32 zero bytes with the nonce 2^64-1, but a CipherFunc can
+// implement RekeyFunc to override it. The nonce is unchanged. The peer must
+// rekey its matching CipherState at the same point in the stream of messages.
 func (s *CipherState) Rekey() {
-	var zeros [32]byte
-	var out []byte
-	out = s.c.Encrypt(out, math.MaxUint64, []byte{}, zeros[:])
-	copy(s.k[:], out[:32])
+	if s.invalid {
+		panic("noise: CipherSuite has been copied, state is invalid")
+	}
+	if r := rekeyFunc(s.cs); r != nil {
+		s.k = r.Rekey(s.k)
+	} else {
+		var zeros [32]byte
+		out := s.c.Encrypt(nil, math.MaxUint64, []byte{}, zeros[:])
+		copy(s.k[:], out[:32])
+		subtle.Zero(out)
+	}
 	s.c = s.cs.Cipher(s.k)
 }
 
@@ -76,21 +109,23 @@ type symmetricState struct {
 	ck   []byte
 	h    []byte
 
-	prevCK []byte
-	prevH  []byte
+	prevCK   []byte
+	prevH    []byte
+	prevK    [32]byte
+	prevN    uint64
+	prevHasK bool
 }
 
 func (s *symmetricState) InitializeSymmetric(handshakeName []byte) {
 	h := s.cs.Hash()
 	if len(handshakeName) <= h.Size() {
-		s.h = make([]byte, h.Size())
+		s.h = append(s.h[:0], make([]byte, h.Size())...)
 		copy(s.h, handshakeName)
 	} else {
 		h.Write(handshakeName)
-		s.h = h.Sum(nil)
+		s.h = h.Sum(s.h[:0])
 	}
-	s.ck = make([]byte, len(s.h))
-	copy(s.ck, s.h)
+	s.ck = append(s.ck[:0], s.h...)
 }
 
 func (s *symmetricState) MixKey(dhOutput []byte) {
@@ -114,6 +149,7 @@ func (s *symmetricState) MixKeyAndHash(data []byte) {
 	var temp []byte
 	s.ck, temp, hk = hkdf(s.cs.Hash, 3, s.ck[:0], temp, s.k[:0], s.ck, data)
 	s.MixHash(temp)
+	subtle.Zero(temp)
 	copy(s.k[:], hk)
 	s.c = s.cs.Cipher(s.k)
 	s.n = 0
@@ -144,8 +180,12 @@ func (s *symmetricState) DecryptAndHash(out, data []byte) ([]byte, error) {
 }
 
 func (s *symmetricState) Split() (*CipherState, *CipherState) {
+	return s.split(nil)
+}
+
+func (s *symmetricState) split(inputKeyMaterial []byte) (*CipherState, *CipherState) {
 	s1, s2 := &CipherState{cs: s.cs}, &CipherState{cs: s.cs}
-	hk1, hk2, _ := hkdf(s.cs.Hash, 2, s1.k[:0], s2.k[:0], nil, s.ck, nil)
+	hk1, hk2, _ := hkdf(s.cs.Hash, 2, s1.k[:0], s2.k[:0], nil, s.ck, inputKeyMaterial)
 	copy(s1.k[:], hk1)
 	copy(s2.k[:], hk2)
 	s1.c = s.cs.Cipher(s1.k)
@@ -165,6 +205,8 @@ func (s *symmetricState) Checkpoint() {
 	}
 	s.prevH = s.prevH[:len(s.h)]
 	copy(s.prevH, s.h)
+
+	s.prevK, s.prevN, s.prevHasK = s.k, s.n, s.hasK
 }
 
 func (s *symmetricState) Rollback() {
@@ -172,6 +214,12 @@ func (s *symmetricState) Rollback() {
 	copy(s.ck, s.prevCK)
 	s.h = s.h[:len(s.prevH)]
 	copy(s.h, s.prevH)
+
+	if s.k != s.prevK {
+		s.k = s.prevK
+		s.c = s.cs.Cipher(s.k)
+	}
+	s.n, s.hasK = s.prevN, s.prevHasK
 }
 
 // A MessagePattern is a single message or operation used in a Noise handshake.
@@ -186,17 +234,68 @@ type HandshakePattern struct {
 	Messages             [][]MessagePattern
 }
 
+// fallback reports whether p uses the fallback modifier, in which case the
+// initiator's first message has already been consumed as a pre-message and the
+// responder writes the first handshake message.
+func (p HandshakePattern) fallback() bool {
+	for _, m := range patternModifiers(p.Name) {
+		if m == "fallback" {
+			return true
+		}
+	}
+	return false
+}
+
+// patternModifiers returns the modifiers in a pattern name, which follow the
+// upper-case base name and are separated by "+".
+func patternModifiers(name string) []string {
+	i := strings.IndexFunc(name, func(r rune) bool { return r >= 'a' && r <= 'z' })
+	if i < 0 {
+		return nil
+	}
+	return strings.Split(name[i:], "+")
+}
+
+// appendModifier appends modifier to a pattern name.
+func appendModifier(name, modifier string) string {
+	if len(patternModifiers(name)) > 0 {
+		return name + "+" + modifier
+	}
+	return name + modifier
+}
+
+// The tokens of a message pattern. The DH tokens follow the revision 34
+// semantics: the first letter names the initiator's key and the second the
+// responder's, regardless of which party writes the token, so "es" is always
+// a DH between the initiator's ephemeral and the responder's static key.
 const (
 	MessagePatternS MessagePattern = iota
 	MessagePatternE
-	MessagePatternDHEE
-	MessagePatternDHES
-	MessagePatternDHSE
-	MessagePatternDHSS
+	MessagePatternEE
+	MessagePatternES
+	MessagePatternSE
+	MessagePatternSS
 	MessagePatternPSK
 
 	MessagePatternF
 	MessagePatternFF
+
+	MessagePatternE1
+	MessagePatternEKEM1
+
+	MessagePatternSig
+)
+
+// Deprecated names for the DH tokens.
+const (
+	// Deprecated: use MessagePatternEE.
+	MessagePatternDHEE = MessagePatternEE
+	// Deprecated: use MessagePatternES.
+	MessagePatternDHES = MessagePatternES
+	// Deprecated: use MessagePatternSE.
+	MessagePatternDHSE = MessagePatternSE
+	// Deprecated: use MessagePatternSS.
+	MessagePatternDHSS = MessagePatternSS
 )
 
 // DefaultMaxMsgLen is the default maximum number of bytes that can be sent in
@@ -204,22 +303,65 @@ const (
 const DefaultMaxMsgLen = 65535
 
 // A HandshakeState tracks the state of a Noise handshake. It may be discarded
-// after the handshake is complete.
+// after the handshake is complete. A HandshakeState must not be copied; use
+// Clone instead.
+//
+// A HandshakeState is not safe for concurrent use. Overlapping calls to
+// WriteMessage and ReadMessage are detected and fail with ErrConcurrentUse,
+// after which the HandshakeState is unusable. A ReadMessage call that fails
+// leaves the state unchanged, so the handshake can continue with another
+// message; a WriteMessage call that fails while writing the message leaves it
+// unusable, and every later call returns the same error.
 type HandshakeState struct {
 	ss              symmetricState
-	s               DHKey  // local static keypair
-	e               DHKey  // local ephemeral keypair
-	f               HFSKey // local HFS keypair
-	rs              []byte // remote party's static public key
-	re              []byte // remote party's ephemeral public key
-	rf              []byte // remote party's HFS public key
-	psk             []byte // preshared key, maybe zero length
+	s               DHKey    // local static keypair
+	e               DHKey    // local ephemeral keypair
+	f               HFSKey   // local HFS keypair
+	rs              []byte   // remote party's static public key
+	prevRS          []byte   // remote party's static public key in a previous session
+	re              []byte   // remote party's ephemeral public key
+	rf              []byte   // remote party's HFS public key
+	kem             KEM      // KEM of the cipher suite, if any
+	e1              KEMKey   // local KEM keypair
+	re1             []byte   // remote party's KEM public key
+	psks            [][]byte // preshared keys in token order, maybe empty
 	messagePatterns [][]MessagePattern
 	shouldWrite     bool
 	initiator       bool
 	msgIdx          int
+	oneWay          bool
+	halfDuplex      bool
 	rng             io.Reader
 	maxMsgLen       int
+
+	signer   PayloadSigner
+	verifier PayloadVerifier
+	sSent    bool // local static public key is known to the peer
+	rsKnown  bool // remote static public key has been received
+
+	injectedE DHKey // ephemeral keypair to use at the next "e" token
+
+	ephemerals *EphemeralTracker
+	limiter    *PeerLimiter
+	rejectZero bool
+
+	sigSigner   Signer
+	sigVerifier Verifier
+
+	trace       func(TraceStep)
+	replayGuard func(id []byte) error
+
+	buf []byte // scratch space for WriteMessageTo and ReadMessageFrom
+
+	allocator Allocator
+	arena     []byte // backing storage of ck, h, re and rs, from allocate
+
+	guard int32 // guardIdle, guardBusy or guardFailed, accessed atomically
+	err   error // failure of a partly written message, set while busy
+
+	protocolName       string
+	deprecated         []string // deprecated components of protocolName
+	deprecationHandler func(protocolName, component string)
 }
 
 // A Config provides the details necessary to process a Noise handshake. It is
@@ -235,6 +377,17 @@ type Config struct {
 	// Pattern is the pattern for the handshake.
 	Pattern HandshakePattern
 
+	// Fallback applies the fallback modifier to Pattern, as with the Fallback
+	// function. The initiator keeps its role but its first message becomes a
+	// pre-message, so the responder writes first.
+	Fallback bool
+
+	// HalfDuplex indicates that the peers take turns sending transport
+	// messages, so a single CipherState is used in both directions. It is
+	// returned as the first CipherState when the handshake completes, and the
+	// second is nil.
+	HalfDuplex bool
+
 	// Initiator must be true if the first message in the handshake will be sent
 	// by this peer.
 	Initiator bool
@@ -247,9 +400,16 @@ type Config struct {
 	PresharedKey []byte
 
 	// PresharedKeyPlacement specifies the placement position of the PSK token
-	// when PresharedKey is specified
+	// when PresharedKey is specified, following the pskN modifier: 0 places it
+	// at the start of the first message, and N > 0 at the end of message N.
 	PresharedKeyPlacement int
 
+	// PresharedKeys and PresharedKeyPlacements specify several preshared keys
+	// and their placements, for patterns such as NNpsk0+psk2. Placements must
+	// be strictly increasing. They cannot be combined with PresharedKey.
+	PresharedKeys          [][]byte
+	PresharedKeyPlacements []int
+
 	// StaticKeypair is this peer's static keypair, required if part of the
 	// handshake.
 	StaticKeypair DHKey
@@ -258,6 +418,18 @@ type Config struct {
 	// a pre-message in the handshake.
 	EphemeralKeypair DHKey
 
+	// InjectedEphemeral, if set, is used as this peer's ephemeral keypair at
+	// the first "e" token it writes, instead of a freshly generated keypair.
+	// It is intended for test vectors and for fallback flows that must reuse
+	// an ephemeral; reusing ephemerals across handshakes destroys forward
+	// secrecy, so it is rejected unless UnsafeAllowInjectedEphemeral is also
+	// set.
+	InjectedEphemeral DHKey
+
+	// UnsafeAllowInjectedEphemeral must be set for InjectedEphemeral to be
+	// accepted.
+	UnsafeAllowInjectedEphemeral bool
+
 	// PeerStatic is the static public key of the remote peer that was provided
 	// as a pre-message in the handshake.
 	PeerStatic []byte
@@ -266,107 +438,373 @@ type Config struct {
 	// provided as a pre-message in the handshake.
 	PeerEphemeral []byte
 
+	// PreviousPeerStatic is the static public key the remote peer used in a
+	// previous session, when resuming or re-handshaking with the same logical
+	// peer. If the peer sends a different static key in a message that
+	// authenticates, ReadMessage fails with a HandshakeError with the reason
+	// FailureIdentityChanged.
+	PreviousPeerStatic []byte
+
 	// MaxMsgLen is the maximum number of bytes that can be sent in a single
 	// Noise message.
 	MaxMsgLen int
+
+	// PayloadSigner, if set, signs the payload of every handshake message
+	// written after the local static key has been made known to the peer.
+	PayloadSigner PayloadSigner
+
+	// PayloadVerifier, if set, verifies the signature on the payload of every
+	// handshake message read after the remote static key has been received.
+	PayloadVerifier PayloadVerifier
+
+	// Deprecated lists protocol name components, such as pattern names ("IK")
+	// or primitive names ("AESGCM"), that are still accepted but are being
+	// phased out. A pattern name matches the pattern part of the protocol
+	// name with all its modifiers, such as "XXfallback" or "NNpsk0+psk2", so
+	// "NN" does not cover "NNpsk0".
+	Deprecated []string
+
+	// Signer is this peer's static signing key, required by patterns with the
+	// sig modifier if this peer has a static key.
+	Signer Signer
+
+	// Verifier is the signature scheme used by patterns with the sig
+	// modifier. When it is set, static public keys, including PeerStatic,
+	// are signing public keys.
+	Verifier Verifier
+
+	// Allocator, if set, provides the memory for the chaining key, handshake
+	// hash and remote keys of the handshake, which is returned to it by
+	// Destroy.
+	Allocator Allocator
+
+	// ReplayGuard is called by ReadEarlyData with an identifier of the first
+	// handshake message, the handshake hash after it, which is the same for
+	// every replay of the message. It must return an error if it has seen
+	// the identifier before, for as long as the message could be accepted.
+	ReplayGuard func(id []byte) error
+
+	// Trace, if set, is called after each handshake message is written or
+	// read, to record the handshake for verification against a model.
+	Trace func(TraceStep)
+
+	// EphemeralTracker, if set, is informed of every remote ephemeral public
+	// key read during the handshake, to detect peers that reuse ephemerals.
+	EphemeralTracker *EphemeralTracker
+
+	// RejectZeroDH fails the handshake with FailureNonContributory when a DH
+	// output is all zeros, as it is for X25519 with a low-order public key.
+	// It is for protocols that require every DH to be contributory.
+	RejectZeroDH bool
+
+	// PeerLimiter, if set, rate-limits handshakes by the remote static key.
+	// A handshake fails with FailureRateLimited when the peer's static key,
+	// read from a handshake message, is over its limit. The key is only
+	// charged once the message carrying it has been authenticated.
+	PeerLimiter *PeerLimiter
+
+	// DeprecationHandler, if set, is called once for every component of the
+	// protocol listed in Deprecated when a handshake using it completes, so
+	// that remaining users can be measured before support is removed.
+	DeprecationHandler func(protocolName, component string)
 }
 
 // NewHandshakeState starts a new handshake using the provided configuration.
 func NewHandshakeState(c Config) (*HandshakeState, error) {
+	// Fallback patterns come from interactive patterns, even when they are
+	// left with a single message.
+	oneWay := len(c.Pattern.Messages) == 1 && !c.Pattern.fallback()
+	if c.Fallback {
+		p, err := Fallback(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.Pattern = p
+	}
 	hs := &HandshakeState{
 		s:               c.StaticKeypair,
 		e:               c.EphemeralKeypair,
 		rs:              c.PeerStatic,
-		psk:             c.PresharedKey,
+		prevRS:          c.PreviousPeerStatic,
 		messagePatterns: c.Pattern.Messages,
-		shouldWrite:     c.Initiator,
+		shouldWrite:     c.Initiator != c.Pattern.fallback(),
 		initiator:       c.Initiator,
+		oneWay:          oneWay,
+		halfDuplex:      c.HalfDuplex,
 		rng:             c.Random,
 		maxMsgLen:       c.MaxMsgLen,
+		signer:          c.PayloadSigner,
+		verifier:        c.PayloadVerifier,
+		ephemerals:      c.EphemeralTracker,
+		limiter:         c.PeerLimiter,
+		rejectZero:      c.RejectZeroDH,
+		sigSigner:       c.Signer,
+		sigVerifier:     c.Verifier,
+		trace:           c.Trace,
+		replayGuard:     c.ReplayGuard,
+		allocator:       c.Allocator,
+		kem:             kemOf(c.CipherSuite),
 	}
 	if hs.rng == nil {
 		hs.rng = rand.Reader
 	}
+	if len(c.InjectedEphemeral.Public) > 0 {
+		if !c.UnsafeAllowInjectedEphemeral {
+			return nil, errors.New("noise: InjectedEphemeral requires UnsafeAllowInjectedEphemeral")
+		}
+		if len(c.InjectedEphemeral.Public) != c.CipherSuite.DHLen() {
+			return nil, errors.New("noise: InjectedEphemeral has the wrong public key length")
+		}
+		hs.injectedE = c.InjectedEphemeral
+	}
+	hs.ss.cs = c.CipherSuite
+	hs.allocate()
 	if len(c.PeerEphemeral) > 0 {
-		hs.re = make([]byte, len(c.PeerEphemeral))
-		copy(hs.re, c.PeerEphemeral)
+		hs.re = append(hs.re[:0], c.PeerEphemeral...)
 	}
 	if c.MaxMsgLen <= 0 {
 		hs.maxMsgLen = DefaultMaxMsgLen
 	}
-	hs.ss.cs = c.CipherSuite
-	pskModifier := ""
-	if len(hs.psk) > 0 {
-		if len(hs.psk) != 32 {
-			return nil, errors.New("noise: specification mandates 256-bit preshared keys")
+	psks, placements := c.PresharedKeys, c.PresharedKeyPlacements
+	if len(c.PresharedKey) > 0 {
+		if len(psks) > 0 {
+			return nil, errors.New("noise: PresharedKey and PresharedKeys are mutually exclusive")
 		}
-		pskModifier = fmt.Sprintf("psk%d", c.PresharedKeyPlacement)
+		psks, placements = [][]byte{c.PresharedKey}, []int{c.PresharedKeyPlacement}
+	}
+	if len(psks) != len(placements) {
+		return nil, errors.New("noise: PresharedKeys and PresharedKeyPlacements differ in length")
+	}
+	name := c.Pattern.Name
+	if len(psks) > 0 {
 		hs.messagePatterns = append([][]MessagePattern(nil), hs.messagePatterns...)
-		if c.PresharedKeyPlacement == 0 {
+	}
+	for i, psk := range psks {
+		if len(psk) != 32 {
+			return nil, errors.New("noise: specification mandates 256-bit preshared keys")
+		}
+		placement := placements[i]
+		if placement < 0 || placement > len(hs.messagePatterns) || (i > 0 && placement <= placements[i-1]) {
+			return nil, errors.New("noise: invalid preshared key placement")
+		}
+		name = appendModifier(name, fmt.Sprintf("psk%d", placement))
+		if placement == 0 {
 			hs.messagePatterns[0] = append([]MessagePattern{MessagePatternPSK}, hs.messagePatterns[0]...)
 		} else {
-			hs.messagePatterns[c.PresharedKeyPlacement-1] = append(hs.messagePatterns[c.PresharedKeyPlacement-1], MessagePatternPSK)
+			hs.messagePatterns[placement-1] = append(hs.messagePatterns[placement-1], MessagePatternPSK)
+		}
+		hs.psks = append(hs.psks, psk)
+	}
+	if err := validatePattern(c.Pattern, hs.messagePatterns); err != nil {
+		return nil, err
+	}
+	if patternHasToken(hs.messagePatterns, MessagePatternSig) && c.Verifier == nil {
+		return nil, errors.New("noise: sig modifier requires a Verifier")
+	}
+	if hs.kem == nil && (patternHasToken(hs.messagePatterns, MessagePatternE1) || patternHasToken(hs.messagePatterns, MessagePatternEKEM1)) {
+		return nil, errors.New("noise: hfs modifier requires a CipherSuite with a KEM")
+	}
+	suite := string(hs.ss.cs.Name())
+	if c.Verifier != nil {
+		if c.Signer != nil {
+			hs.s = DHKey{Public: c.Signer.Public()}
+		}
+		i := strings.IndexByte(suite, '_')
+		suite = suite[:i] + "+" + c.Verifier.SigName() + suite[i:]
+	}
+	hs.protocolName = "Noise_" + name + "_" + suite
+	hs.ss.InitializeSymmetric([]byte(hs.protocolName))
+	if c.DeprecationHandler != nil {
+		hs.deprecationHandler = c.DeprecationHandler
+		for _, d := range c.Deprecated {
+			switch d {
+			case name, hs.ss.cs.DHName(), hs.ss.cs.CipherName(), hs.ss.cs.HashName():
+				hs.deprecated = append(hs.deprecated, d)
+			}
 		}
 	}
-	hs.ss.InitializeSymmetric([]byte("Noise_" + c.Pattern.Name + pskModifier + "_" + string(hs.ss.cs.Name())))
 	hs.ss.MixHash(c.Prologue)
 	// TODO: Technically r/rf can be part of the pre-message state, but we
 	// don't use it, so punt on supporting it.
-	for _, m := range c.Pattern.InitiatorPreMessages {
-		switch {
-		case c.Initiator && m == MessagePatternS:
-			hs.ss.MixHash(hs.s.Public)
-		case c.Initiator && m == MessagePatternE:
-			hs.ss.MixHash(hs.e.Public)
-		case !c.Initiator && m == MessagePatternS:
-			hs.ss.MixHash(hs.rs)
-		case !c.Initiator && m == MessagePatternE:
-			hs.ss.MixHash(hs.re)
+	if err := hs.mixPreMessages(c.Pattern.InitiatorPreMessages, c.Initiator); err != nil {
+		return nil, err
+	}
+	if err := hs.mixPreMessages(c.Pattern.ResponderPreMessages, !c.Initiator); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// staticLen returns the size of a static public key, which is a signing key
+// for patterns with the sig modifier.
+func (s *HandshakeState) staticLen() int {
+	if s.sigVerifier != nil {
+		return s.sigVerifier.PublicKeyLen()
+	}
+	return s.ss.cs.DHLen()
+}
+
+// patternHasToken reports whether any of messages contains t.
+func patternHasToken(messages [][]MessagePattern, t MessagePattern) bool {
+	for _, m := range messages {
+		for _, mt := range m {
+			if mt == t {
+				return true
+			}
 		}
 	}
-	for _, m := range c.Pattern.ResponderPreMessages {
+	return false
+}
+
+// dhKeys returns the initiator's and the responder's key used by a DH token,
+// as MessagePatternE or MessagePatternS.
+func dhKeys(t MessagePattern) (initiatorKey, responderKey MessagePattern) {
+	switch t {
+	case MessagePatternES:
+		return MessagePatternE, MessagePatternS
+	case MessagePatternSE:
+		return MessagePatternS, MessagePatternE
+	case MessagePatternSS:
+		return MessagePatternS, MessagePatternS
+	}
+	return MessagePatternE, MessagePatternE
+}
+
+// dh performs the DH named by a DH token. The token names the initiator's key
+// first, so each party maps it to its own private key and the peer's public
+// key according to its role.
+func (s *HandshakeState) dh(ctx context.Context, t MessagePattern) ([]byte, error) {
+	initiatorKey, responderKey := dhKeys(t)
+	local, remote := initiatorKey, responderKey
+	if !s.initiator {
+		local, remote = responderKey, initiatorKey
+	}
+	priv, pub := s.e.Private, s.re
+	if local == MessagePatternS {
+		priv = s.s.Private
+	}
+	if remote == MessagePatternS {
+		pub = s.rs
+	}
+	if local == MessagePatternS && s.s.PrivateDH != nil {
+		if k, ok := s.s.PrivateDH.(ContextPrivateDH); ok {
+			return k.DHContext(ctx, pub)
+		}
+		return s.s.PrivateDH.DH(pub)
+	}
+	return s.ss.cs.DH(priv, pub)
+}
+
+// pskIndex returns the index in psks of the preshared key used by the first psk
+// token in the current message.
+func (s *HandshakeState) pskIndex() int {
+	n := 0
+	for _, m := range s.messagePatterns[:s.msgIdx] {
+		for _, t := range m {
+			if t == MessagePatternPSK {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// mixPreMessages processes the pre-message tokens of one party, which is this
+// peer if local is set, checking that the keys they name were configured.
+func (s *HandshakeState) mixPreMessages(tokens []MessagePattern, local bool) error {
+	for _, m := range tokens {
 		switch {
-		case !c.Initiator && m == MessagePatternS:
-			hs.ss.MixHash(hs.s.Public)
-		case !c.Initiator && m == MessagePatternE:
-			hs.ss.MixHash(hs.e.Public)
-		case c.Initiator && m == MessagePatternS:
-			hs.ss.MixHash(hs.rs)
-		case c.Initiator && m == MessagePatternE:
-			hs.ss.MixHash(hs.re)
+		case local && m == MessagePatternS:
+			if len(s.s.Public) == 0 {
+				return errors.New("noise: pattern requires StaticKeypair as a pre-message")
+			}
+			s.ss.MixHash(s.s.Public)
+			s.sSent = true
+		case local && m == MessagePatternE:
+			if len(s.e.Public) != s.ss.cs.DHLen() {
+				return errors.New("noise: pattern requires EphemeralKeypair as a pre-message")
+			}
+			s.mixPreMessageE(s.e.Public)
+		case !local && m == MessagePatternS:
+			if len(s.rs) != s.staticLen() {
+				return errors.New("noise: pattern requires PeerStatic as a pre-message")
+			}
+			s.ss.MixHash(s.rs)
+			s.rsKnown = true
+		case !local && m == MessagePatternE:
+			if len(s.re) != s.ss.cs.DHLen() {
+				return errors.New("noise: pattern requires PeerEphemeral as a pre-message")
+			}
+			s.mixPreMessageE(s.re)
+		default:
+			return errors.New("noise: pre-messages may only contain e and s")
 		}
 	}
-	return hs, nil
+	return nil
+}
+
+// mixPreMessageE processes an ephemeral public key from a pre-message. As with
+// the "e" token, PSK handshakes also mix it into the chaining key.
+func (s *HandshakeState) mixPreMessageE(e []byte) {
+	s.ss.MixHash(e)
+	if len(s.psks) > 0 {
+		s.ss.MixKey(e)
+	}
 }
 
 // WriteMessage appends a handshake message to out. The message will include the
 // optional payload if provided. If the handshake is completed by the call, two
 // CipherStates will be returned, one is used for encryption of messages to the
 // remote peer, the other is used for decryption of messages from the remote
-// peer. It is an error to call this method out of sync with the handshake
-// pattern.
+// peer. For one-way patterns the second CipherState is nil. It is an error to
+// call this method out of sync with the handshake pattern.
 func (s *HandshakeState) WriteMessage(out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	return s.WriteMessageContext(context.Background(), out, payload)
+}
+
+// WriteMessageContext is like WriteMessage, and passes ctx to a static key
+// that implements ContextPrivateDH. If ctx is done before the key's DH
+// completes, the handshake fails.
+func (s *HandshakeState) WriteMessageContext(ctx context.Context, out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	if err := s.enter(); err != nil {
+		return nil, nil, nil, err
+	}
 	if !s.shouldWrite {
-		return nil, nil, nil, errors.New("noise: unexpected call to WriteMessage should be ReadMessage")
+		return s.exit(nil, nil, nil, &HandshakeError{FailureWrongPhase, errors.New("unexpected call to WriteMessage should be ReadMessage")})
 	}
 	if s.msgIdx > len(s.messagePatterns)-1 {
-		return nil, nil, nil, errors.New("noise: no handshake messages left")
+		return s.exit(nil, nil, nil, errNoMessagesLeft)
 	}
 	if len(payload) > s.maxMsgLen {
-		return nil, nil, nil, errors.New("noise: message is too long")
+		return s.exit(nil, nil, nil, errors.New("noise: message is too long"))
+	}
+	out, cs1, cs2, err := s.writeMessage(ctx, out, payload)
+	if err != nil {
+		// The message was partly written into the handshake state, which
+		// cannot be recovered.
+		s.err = err
 	}
+	return s.exit(out, cs1, cs2, err)
+}
 
+func (s *HandshakeState) writeMessage(ctx context.Context, out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	start := len(out)
+	psk := s.pskIndex()
 	for _, msg := range s.messagePatterns[s.msgIdx] {
 		switch msg {
 		case MessagePatternE:
-			e, err := s.ss.cs.GenerateKeypair(s.rng)
-			if err != nil {
-				return nil, nil, nil, err
+			if len(s.injectedE.Public) > 0 {
+				s.e, s.injectedE = s.injectedE, DHKey{}
+			} else {
+				e, err := s.ss.cs.GenerateKeypair(s.rng)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				s.e = e
 			}
-			s.e = e
 			out = append(out, s.e.Public...)
 			s.ss.MixHash(s.e.Public)
-			if len(s.psk) > 0 {
+			if len(s.psks) > 0 {
 				s.ss.MixKey(s.e.Public)
 			}
 		case MessagePatternS:
@@ -374,37 +812,58 @@ func (s *HandshakeState) WriteMessage(out, payload []byte) ([]byte, *CipherState
 				return nil, nil, nil, errors.New("noise: invalid state, s.Public is nil")
 			}
 			out = s.ss.EncryptAndHash(out, s.s.Public)
-		case MessagePatternDHEE:
-			s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.re))
-		case MessagePatternDHES:
-			if s.initiator {
-				s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.rs))
-			} else {
-				s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.re))
+			s.sSent = true
+		case MessagePatternEE, MessagePatternES, MessagePatternSE, MessagePatternSS:
+			shared, err := s.dh(ctx, msg)
+			if err != nil || len(shared) == 0 {
+				return nil, nil, nil, &HandshakeError{FailureDH, err}
 			}
-		case MessagePatternDHSE:
-			if s.initiator {
-				s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.re))
-			} else {
-				s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.rs))
+			if s.rejectZero && subtle.IsZero(shared) {
+				return nil, nil, nil, &HandshakeError{Reason: FailureNonContributory}
 			}
-		case MessagePatternDHSS:
-			s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.rs))
+			s.ss.MixKey(shared)
 		case MessagePatternPSK:
-			s.ss.MixKeyAndHash(s.psk)
+			s.ss.MixKeyAndHash(s.psks[psk])
+			psk++
 		case MessagePatternF:
 			s.f = s.ss.cs.GenerateKeypairF(s.rng, s.rf)
 			out = s.ss.EncryptAndHash(out, s.f.Public())
 		case MessagePatternFF:
 			s.ss.MixKey(s.ss.cs.FF(s.f, s.rf))
+		case MessagePatternSig:
+			var err error
+			if out, err = s.signHash(out); err != nil {
+				return nil, nil, nil, err
+			}
+		case MessagePatternE1:
+			e1, err := s.kem.GenerateKEMKeypair(s.rng)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			s.e1 = e1
+			out = s.ss.EncryptAndHash(out, s.e1.Public)
+		case MessagePatternEKEM1:
+			ct, secret, err := s.kem.Encapsulate(s.rng, s.re1)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			out = s.ss.EncryptAndHash(out, ct)
+			s.ss.MixKey(secret)
+		}
+	}
+	if s.signer != nil && s.sSent {
+		var err error
+		if payload, err = s.signPayload(payload); err != nil {
+			return nil, nil, nil, err
 		}
 	}
 	s.shouldWrite = false
 	s.msgIdx++
 	out = s.ss.EncryptAndHash(out, payload)
+	s.traceMessage(s.initiator, len(out)-start)
 
 	if s.msgIdx >= len(s.messagePatterns) {
-		cs1, cs2 := s.ss.Split()
+		cs1, cs2 := s.split()
 		return out, cs1, cs2, nil
 	}
 
@@ -412,30 +871,100 @@ func (s *HandshakeState) WriteMessage(out, payload []byte) ([]byte, *CipherState
 }
 
 // ErrShortMessage is returned by ReadMessage if a message is not as long as it should be.
-var ErrShortMessage = errors.New("noise: message is too short")
+var ErrShortMessage error = &HandshakeError{Reason: FailureShortMessage}
+
+var errNoMessagesLeft = &HandshakeError{FailureWrongPhase, errors.New("no handshake messages left")}
+
+// ErrConcurrentUse is returned by WriteMessage and ReadMessage if they are
+// called while another call on the same HandshakeState is in progress. Both
+// calls fail, and so does every later call on the HandshakeState.
+var ErrConcurrentUse = errors.New("noise: concurrent use of HandshakeState")
+
+const (
+	guardIdle int32 = iota
+	guardBusy
+	guardFailed
+)
+
+// enter marks the HandshakeState as busy for the duration of a WriteMessage
+// or ReadMessage call, which must end with exit.
+func (s *HandshakeState) enter() error {
+	if !atomic.CompareAndSwapInt32(&s.guard, guardIdle, guardBusy) {
+		atomic.CompareAndSwapInt32(&s.guard, guardBusy, guardFailed)
+		return ErrConcurrentUse
+	}
+	if s.err != nil {
+		atomic.StoreInt32(&s.guard, guardIdle)
+		return s.err
+	}
+	return nil
+}
+
+// exit ends a call started with enter, replacing its results with
+// ErrConcurrentUse if another call was made in the meantime.
+func (s *HandshakeState) exit(out []byte, cs1, cs2 *CipherState, err error) ([]byte, *CipherState, *CipherState, error) {
+	if !atomic.CompareAndSwapInt32(&s.guard, guardBusy, guardIdle) {
+		return nil, nil, nil, ErrConcurrentUse
+	}
+	return out, cs1, cs2, err
+}
 
 // ReadMessage processes a received handshake message and appends the payload,
 // if any to out. If the handshake is completed by the call, two CipherStates
 // will be returned, one is used for encryption of messages to the remote peer,
-// the other is used for decryption of messages from the remote peer. It is an
-// error to call this method out of sync with the handshake pattern.
+// the other is used for decryption of messages from the remote peer. For
+// one-way patterns the second CipherState is nil, and the first is used to
+// decrypt messages from the initiator. It is an error to call this method out
+// of sync with the handshake pattern.
 func (s *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	return s.ReadMessageContext(context.Background(), out, message)
+}
+
+// ReadMessageContext is like ReadMessage, and passes ctx to a static key that
+// implements ContextPrivateDH. If ctx is done before the key's DH completes,
+// the message is rejected and the handshake can continue with it or another
+// message.
+func (s *HandshakeState) ReadMessageContext(ctx context.Context, out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	if err := s.enter(); err != nil {
+		return nil, nil, nil, err
+	}
 	if s.shouldWrite {
-		return nil, nil, nil, errors.New("noise: unexpected call to ReadMessage should be WriteMessage")
+		return s.exit(nil, nil, nil, &HandshakeError{FailureWrongPhase, errors.New("unexpected call to ReadMessage should be WriteMessage")})
 	}
 	if s.msgIdx > len(s.messagePatterns)-1 {
-		return nil, nil, nil, errors.New("noise: no handshake messages left")
+		return s.exit(nil, nil, nil, errNoMessagesLeft)
 	}
 
+	// A message that fails to be read leaves no trace, so the handshake can
+	// continue with another message.
 	s.ss.Checkpoint()
+	hadRS, rsKnown := len(s.rs) > 0, s.rsKnown
+	out, cs1, cs2, err := s.readMessage(ctx, out, message)
+	if err != nil {
+		s.ss.Rollback()
+		if !hadRS {
+			s.rs = s.rs[:0]
+		}
+		s.rsKnown = rsKnown
+	}
+	return s.exit(out, cs1, cs2, err)
+}
+
+func (s *HandshakeState) readMessage(ctx context.Context, out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	msgLen := len(message)
 
 	var err error
+	readRS := false
+	psk := s.pskIndex()
 	for _, msg := range s.messagePatterns[s.msgIdx] {
 		switch msg {
 		case MessagePatternE, MessagePatternS:
 			expected := s.ss.cs.DHLen()
-			if msg == MessagePatternS && s.ss.hasK {
-				expected += 16
+			if msg == MessagePatternS {
+				expected = s.staticLen()
+				if s.ss.hasK {
+					expected += MACLen
+				}
 			}
 			if len(message) < expected {
 				return nil, nil, nil, ErrShortMessage
@@ -447,8 +976,11 @@ func (s *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState,
 				}
 				s.re = s.re[:s.ss.cs.DHLen()]
 				copy(s.re, message)
+				if s.ephemerals != nil {
+					s.ephemerals.Observe(s.re)
+				}
 				s.ss.MixHash(s.re)
-				if len(s.psk) > 0 {
+				if len(s.psks) > 0 {
 					s.ss.MixKey(s.re)
 				}
 			case MessagePatternS:
@@ -456,61 +988,117 @@ func (s *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState,
 					return nil, nil, nil, errors.New("noise: invalid state, rs is not nil")
 				}
 				s.rs, err = s.ss.DecryptAndHash(s.rs[:0], message[:expected])
+				s.rsKnown = err == nil
+				readRS = err == nil
 			}
 			if err != nil {
-				s.ss.Rollback()
-				return nil, nil, nil, err
+				return nil, nil, nil, &HandshakeError{FailureStaticMAC, err}
 			}
 			message = message[expected:]
-		case MessagePatternDHEE:
-			s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.re))
-		case MessagePatternDHES:
-			if s.initiator {
-				s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.rs))
-			} else {
-				s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.re))
+		case MessagePatternEE, MessagePatternES, MessagePatternSE, MessagePatternSS:
+			shared, err := s.dh(ctx, msg)
+			if err != nil || len(shared) == 0 {
+				return nil, nil, nil, &HandshakeError{FailureDH, err}
 			}
-		case MessagePatternDHSE:
-			if s.initiator {
-				s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.re))
-			} else {
-				s.ss.MixKey(s.ss.cs.DH(s.e.Private, s.rs))
+			if s.rejectZero && subtle.IsZero(shared) {
+				return nil, nil, nil, &HandshakeError{Reason: FailureNonContributory}
 			}
-		case MessagePatternDHSS:
-			s.ss.MixKey(s.ss.cs.DH(s.s.Private, s.rs))
+			s.ss.MixKey(shared)
 		case MessagePatternPSK:
-			s.ss.MixKeyAndHash(s.psk)
+			s.ss.MixKeyAndHash(s.psks[psk])
+			psk++
 		case MessagePatternF:
 			expected := s.ss.cs.FLen1()
 			if s.f != nil {
 				expected = s.ss.cs.FLen2()
 			}
 			if s.ss.hasK {
-				expected += 16
+				expected += MACLen
 			}
 			if len(message) < expected {
 				return nil, nil, nil, ErrShortMessage
 			}
 			s.rf, err = s.ss.DecryptAndHash(nil, message[:expected])
 			if err != nil {
-				s.ss.Rollback()
-				return nil, nil, nil, err
+				return nil, nil, nil, &HandshakeError{FailureStaticMAC, err}
 			}
 			message = message[expected:]
 		case MessagePatternFF:
 			s.ss.MixKey(s.ss.cs.FF(s.f, s.rf))
+		case MessagePatternSig:
+			expected := s.sigVerifier.SignatureLen()
+			if s.ss.hasK {
+				expected += MACLen
+			}
+			if len(message) < expected {
+				return nil, nil, nil, ErrShortMessage
+			}
+			h := append([]byte(nil), s.ss.h...)
+			var sig []byte
+			if sig, err = s.ss.DecryptAndHash(nil, message[:expected]); err != nil {
+				return nil, nil, nil, &HandshakeError{FailureStaticMAC, err}
+			}
+			if err = s.sigVerifier.Verify(s.rs, h, sig); err != nil {
+				return nil, nil, nil, &HandshakeError{FailureSignature, err}
+			}
+			message = message[expected:]
+		case MessagePatternE1, MessagePatternEKEM1:
+			expected := s.kem.KEMPublicKeyLen()
+			if msg == MessagePatternEKEM1 {
+				expected = s.kem.KEMCiphertextLen()
+			}
+			if s.ss.hasK {
+				expected += MACLen
+			}
+			if len(message) < expected {
+				return nil, nil, nil, ErrShortMessage
+			}
+			var data []byte
+			if data, err = s.ss.DecryptAndHash(nil, message[:expected]); err != nil {
+				return nil, nil, nil, &HandshakeError{FailureStaticMAC, err}
+			}
+			message = message[expected:]
+			if msg == MessagePatternE1 {
+				s.re1 = data
+				break
+			}
+			secret, err := s.kem.Decapsulate(s.e1.Private, data)
+			if err != nil {
+				return nil, nil, nil, &HandshakeError{FailureKEM, err}
+			}
+			s.ss.MixKey(secret)
 		}
 	}
+	var signedHash []byte
+	if s.verifier != nil && s.rsKnown {
+		signedHash = append(signedHash, s.ss.h...)
+	}
+	off := len(out)
 	out, err = s.ss.DecryptAndHash(out, message)
+	if err == nil && signedHash != nil {
+		out, err = s.verifyPayload(out, off, signedHash)
+	}
 	if err != nil {
-		s.ss.Rollback()
+		if _, ok := err.(*HandshakeError); !ok {
+			err = &HandshakeError{FailurePayloadMAC, err}
+		}
 		return nil, nil, nil, err
 	}
+	// A static key read from the message is only checked once the whole
+	// message has been authenticated, so that a forged key can neither raise
+	// an alarm nor use up the tokens of the peer it names.
+	if readRS && len(s.prevRS) > 0 && !subtle.Equal(s.rs, s.prevRS) {
+		return nil, nil, nil, &HandshakeError{Reason: FailureIdentityChanged}
+	}
+	if readRS && s.limiter != nil && !s.limiter.Allow(s.rs) {
+		return nil, nil, nil, &HandshakeError{Reason: FailureRateLimited}
+	}
 	s.shouldWrite = true
 	s.msgIdx++
+	s.traceMessage(!s.initiator, msgLen)
 
 	if s.msgIdx >= len(s.messagePatterns) {
-		cs1, cs2 := s.ss.Split()
+		cs1, cs2 := s.split()
 		return out, cs1, cs2, nil
 	}
 
@@ -519,14 +1107,220 @@ func (s *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState,
 
 // ChannelBinding provides a value that uniquely identifies the session and can
 // be used as a channel binding. It is an error to call this method before the
-// handshake is complete.
+// handshake is complete. It returns nil once the HandshakeState has been
+// destroyed or has failed.
 func (s *HandshakeState) ChannelBinding() []byte {
+	if s.err != nil {
+		return nil
+	}
 	return s.ss.h
 }
 
+// split completes the handshake. One-way patterns only have a single
+// CipherState, as the responder never sends, which the initiator can only
+// encrypt with and the responder can only decrypt with. Half-duplex
+// handshakes also have a single CipherState, used in both directions.
+func (s *HandshakeState) split() (*CipherState, *CipherState) {
+	s.reportDeprecated()
+	cs1, cs2 := s.ss.Split()
+	if s.oneWay {
+		cs1.sendOnly, cs1.recvOnly = s.initiator, !s.initiator
+		return cs1, nil
+	}
+	if s.halfDuplex {
+		return cs1, nil
+	}
+	return cs1, cs2
+}
+
+func (s *HandshakeState) reportDeprecated() {
+	for _, d := range s.deprecated {
+		s.deprecationHandler(s.protocolName, d)
+	}
+}
+
+// DeriveCipherStates returns a pair of CipherStates for a separate logical
+// channel identified by label, for example to keep control and data traffic
+// in different nonce spaces with their own rekey cadence. The keys are derived
+// from the final chaining key and are independent of those returned when the
+// handshake completed and of those derived for any other label. As with the
+// handshake, the first CipherState encrypts messages from the initiator to the
+// responder. It is an error to call this method before the handshake is
+// complete, or after the HandshakeState has been destroyed.
+func (s *HandshakeState) DeriveCipherStates(label []byte) (*CipherState, *CipherState, error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	if s.msgIdx < len(s.messagePatterns) {
+		return nil, nil, errors.New("noise: handshake is not complete")
+	}
+	cs1, cs2 := s.ss.split(append([]byte("NoiseChannel"), label...))
+	return cs1, cs2, nil
+}
+
+// SessionIDLen is the length in bytes of the value returned by SessionID.
+const SessionIDLen = 16
+
+// SessionID returns a non-secret identifier for the session, derived from the
+// handshake hash under a distinct label. Both peers compute the same value, so
+// it can be logged to correlate a session across hosts without exchanging
+// extra data. It is an error to call this method before the handshake is
+// complete. It returns nil once the HandshakeState has been destroyed or has
+// failed.
+func (s *HandshakeState) SessionID() []byte {
+	if s.err != nil {
+		return nil
+	}
+	h := s.ss.cs.Hash()
+	h.Write([]byte("NoiseSessionID"))
+	h.Write(s.ss.h)
+	return h.Sum(nil)[:SessionIDLen]
+}
+
+// LocalEphemeral returns the ephemeral keypair generated by this peer during
+// the handshake. It is intended for fallback flows, where an initiator whose
+// first message was rejected passes it as EphemeralKeypair to a new
+// HandshakeState using the fallback pattern.
+func (s *HandshakeState) LocalEphemeral() DHKey {
+	return s.e
+}
+
+// PeerEphemeral returns the ephemeral key provided by the remote peer during a
+// handshake. It is set as soon as the "e" token has been read, even if the
+// rest of the message fails to decrypt, so that a responder can pass it as
+// PeerEphemeral to a new HandshakeState using the fallback pattern.
+func (s *HandshakeState) PeerEphemeral() []byte {
+	return s.re
+}
+
 // PeerStatic returns the static key provided by the remote peer during
 // a handshake. It is an error to call this method if a handshake message
 // containing a static key has not been read.
 func (s *HandshakeState) PeerStatic() []byte {
 	return s.rs
 }
+
+// allocate carves the buffers for the chaining key, handshake hash, their
+// checkpoints, the remote keys and any ephemeral private keys already set out
+// of a single allocation sized from the cipher suite, so that a handshake does
+// not allocate them as it progresses. The allocation comes from the
+// Allocator, if there is one.
+func (s *HandshakeState) allocate() {
+	hashLen, dhLen := s.ss.cs.Hash().Size(), s.ss.cs.DHLen()
+	staticLen := dhLen
+	if s.sigVerifier != nil {
+		staticLen = s.sigVerifier.PublicKeyLen()
+	}
+	n := 4*hashLen + dhLen + staticLen + len(s.e.Private) + len(s.injectedE.Private) + len(s.e1.Private)
+	var arena []byte
+	if s.allocator != nil {
+		arena = s.allocator.Alloc(n)[:n]
+	} else {
+		arena = make([]byte, n)
+	}
+	s.arena = arena
+	next := func(n int) []byte {
+		b := arena[:0:n]
+		arena = arena[n:]
+		return b
+	}
+	s.ss.h, s.ss.ck = next(hashLen), next(hashLen)
+	s.ss.prevH, s.ss.prevCK = next(hashLen), next(hashLen)
+	s.re = next(dhLen)
+	// Config.PeerStatic belongs to the caller, so it is copied rather than
+	// written to in place.
+	s.rs = append(next(staticLen), s.rs...)
+	// So do Config.EphemeralKeypair and Config.InjectedEphemeral, and a clone
+	// must not share its ephemerals with the original, as Destroy wipes them.
+	if len(s.e.Private) > 0 {
+		s.e.Private = append(next(len(s.e.Private)), s.e.Private...)
+	}
+	if len(s.injectedE.Private) > 0 {
+		s.injectedE.Private = append(next(len(s.injectedE.Private)), s.injectedE.Private...)
+	}
+	if len(s.e1.Private) > 0 {
+		s.e1.Private = append(next(len(s.e1.Private)), s.e1.Private...)
+	}
+}
+
+// ProtocolName returns the full protocol name of the handshake, including the
+// pattern modifiers and cipher suite, for example
+// "Noise_XXpsk3_25519_ChaChaPoly_BLAKE2s". It is the name that was mixed into
+// the handshake hash and is accepted by ParseProtocolName.
+func (s *HandshakeState) ProtocolName() string {
+	return s.protocolName
+}
+
+// Clone returns a deep copy of the handshake state, so that the same message
+// can be processed speculatively, for example under several candidate
+// preshared keys, without affecting the original. The clone shares the
+// callbacks, Random reader and EphemeralTracker of the original's Config.
+func (s *HandshakeState) Clone() *HandshakeState {
+	c := &HandshakeState{
+		s:                  s.s,
+		e:                  s.e,
+		f:                  s.f,
+		prevRS:             s.prevRS,
+		rf:                 s.rf,
+		kem:                s.kem,
+		e1:                 s.e1,
+		re1:                s.re1,
+		psks:               append([][]byte(nil), s.psks...),
+		messagePatterns:    s.messagePatterns,
+		shouldWrite:        s.shouldWrite,
+		initiator:          s.initiator,
+		msgIdx:             s.msgIdx,
+		oneWay:             s.oneWay,
+		halfDuplex:         s.halfDuplex,
+		rng:                s.rng,
+		maxMsgLen:          s.maxMsgLen,
+		signer:             s.signer,
+		verifier:           s.verifier,
+		sSent:              s.sSent,
+		rsKnown:            s.rsKnown,
+		injectedE:          s.injectedE,
+		ephemerals:         s.ephemerals,
+		limiter:            s.limiter,
+		rejectZero:         s.rejectZero,
+		sigSigner:          s.sigSigner,
+		sigVerifier:        s.sigVerifier,
+		trace:              s.trace,
+		replayGuard:        s.replayGuard,
+		protocolName:       s.protocolName,
+		deprecated:         s.deprecated,
+		deprecationHandler: s.deprecationHandler,
+	}
+	c.ss.cs, c.ss.k, c.ss.n = s.ss.cs, s.ss.k, s.ss.n
+	if s.ss.c != nil {
+		c.ss.c = s.ss.cs.Cipher(s.ss.k)
+	}
+	c.ss.hasK = s.ss.hasK
+	c.allocator = s.allocator
+	c.allocate()
+	c.rs = append(c.rs[:0], s.rs...)
+	c.re = append(c.re[:0], s.re...)
+	c.ss.h = append(c.ss.h[:0], s.ss.h...)
+	c.ss.ck = append(c.ss.ck[:0], s.ss.ck...)
+	c.ss.prevH = append(c.ss.prevH[:0], s.ss.prevH...)
+	c.ss.prevCK = append(c.ss.prevCK[:0], s.ss.prevCK...)
+	c.ss.prevK, c.ss.prevN, c.ss.prevHasK = s.ss.prevK, s.ss.prevN, s.ss.prevHasK
+	c.err = s.err
+	return c
+}
+
+// SetPresharedKey replaces the preshared key at index i, in the order of the
+// psk modifiers, before it is used. Together with Clone it allows a responder
+// to try several candidate keys against the same message.
+func (s *HandshakeState) SetPresharedKey(i int, psk []byte) error {
+	if i < 0 || i >= len(s.psks) {
+		return errors.New("noise: no preshared key at that index")
+	}
+	if len(psk) != 32 {
+		return errors.New("noise: specification mandates 256-bit preshared keys")
+	}
+	if i < s.pskIndex() {
+		return errors.New("noise: preshared key has already been used")
+	}
+	s.psks[i] = psk
+	return nil
+}
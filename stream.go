@@ -0,0 +1,220 @@
+package noise
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// MaxPlaintextLen is the largest payload of a transport message that fits in
+// a frame of MaxFrameLen bytes.
+const MaxPlaintextLen = MaxFrameLen - MACLen
+
+// closeAD is the associated data of the empty transport message that ends a
+// stream, which sets it apart from a rekey signal.
+var closeAD = []byte("NoiseStreamClose")
+
+var errWriterClosed = errors.New("noise: Writer is closed")
+
+// A RekeyPolicy says when a Writer rekeys. A limit that is zero is not used,
+// so the zero RekeyPolicy never rekeys. The limits are checked before each
+// transport message is written, so an Interval is only acted on once there is
+// data to send.
+//
+// A Writer signals a rekey in band with a transport message that has an empty
+// payload, encrypted with the old key, and then rekeys with
+// CipherState.Rekey. A Reader rekeys when it receives such a message,
+// whatever its own policy, so the two stay in step.
+type RekeyPolicy struct {
+	// Messages is the number of transport messages after which to rekey.
+	Messages uint64
+
+	// Bytes is the number of bytes of data after which to rekey.
+	Bytes uint64
+
+	// Interval is the time after which to rekey.
+	Interval time.Duration
+
+	// OnRekey, if not nil, is called after each rekey of a Writer, with send
+	// true, and of a Reader, with send false.
+	OnRekey func(send bool)
+}
+
+// due reports whether a rekey is due after messages and bytes since the last
+// one, which was at last.
+func (p *RekeyPolicy) due(messages, bytes uint64, last, now time.Time) bool {
+	return p.Messages > 0 && messages >= p.Messages ||
+		p.Bytes > 0 && bytes >= p.Bytes ||
+		p.Interval > 0 && now.Sub(last) >= p.Interval
+}
+
+// A Writer encrypts a stream of application data into transport messages of
+// at most MaxFrameLen bytes, each framed as by FrameWriter. Every call to
+// Write sends at least one message, so small writes should be buffered by the
+// caller, for example with a bufio.Writer.
+type Writer struct {
+	fw  *FrameWriter
+	cs  *CipherState
+	buf []byte
+	err error
+
+	policy   RekeyPolicy
+	messages uint64 // since the last rekey
+	bytes    uint64
+	last     time.Time
+	now      func() time.Time
+}
+
+// NewWriter returns a Writer that encrypts with cs and writes to w.
+func NewWriter(w io.Writer, cs *CipherState) *Writer {
+	return newWriter(NewFrameWriter(w), cs)
+}
+
+func newWriter(fw *FrameWriter, cs *CipherState) *Writer {
+	return &Writer{fw: fw, cs: cs, now: time.Now, last: time.Now()}
+}
+
+// SetRekeyPolicy sets the policy for rekeying. The counts and time towards
+// its limits start from the last rekey, or from the creation of the Writer.
+func (w *Writer) SetRekeyPolicy(p RekeyPolicy) {
+	w.policy = p
+}
+
+// Write encrypts p into as many transport messages as needed, of at most
+// MaxPlaintextLen bytes of data each, and writes them. After an error from the
+// underlying writer, the Writer cannot be written to any more, as part of a
+// message may have been written.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxPlaintextLen {
+			chunk = chunk[:MaxPlaintextLen]
+		}
+		if w.policy.due(w.messages, w.bytes, w.last, w.now()) {
+			if err := w.rekey(); err != nil {
+				return n, err
+			}
+		}
+		w.buf = w.cs.Encrypt(w.buf[:0], nil, chunk)
+		if err := w.fw.WriteFrame(w.buf); err != nil {
+			w.err = err
+			return n, err
+		}
+		w.messages++
+		w.bytes += uint64(len(chunk))
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// rekey sends the signal for a rekey and rekeys.
+func (w *Writer) rekey() error {
+	w.buf = w.cs.Encrypt(w.buf[:0], nil, nil)
+	if err := w.fw.WriteFrame(w.buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.cs.Rekey()
+	w.messages, w.bytes, w.last = 0, 0, w.now()
+	if w.policy.OnRekey != nil {
+		w.policy.OnRekey(true)
+	}
+	return nil
+}
+
+// close sends the authenticated message that ends the stream, after which
+// the Writer cannot be written to. A Reader returns io.EOF when it reads it.
+func (w *Writer) close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buf = w.cs.Encrypt(w.buf[:0], closeAD, nil)
+	if err := w.fw.WriteFrame(w.buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errWriterClosed
+	return nil
+}
+
+// A Reader decrypts a stream of application data from transport messages
+// written by a Writer.
+type Reader struct {
+	fr    *FrameReader
+	cs    *CipherState
+	buf   []byte
+	input []byte // decrypted bytes not yet returned by Read, in buf
+	err   error
+
+	// requireClose makes the end of r without the message that ends the
+	// stream an io.ErrUnexpectedEOF, so that truncation is detected.
+	requireClose bool
+
+	onRekey func(send bool)
+}
+
+// NewReader returns a Reader that reads from r and decrypts with cs.
+func NewReader(r io.Reader, cs *CipherState) *Reader {
+	return &Reader{fr: NewFrameReader(r), cs: cs}
+}
+
+// SetRekeyPolicy sets the policy whose OnRekey is called when the Reader
+// rekeys. The Reader rekeys when signalled by the Writer, so the limits of the
+// policy are not used.
+func (r *Reader) SetRekeyPolicy(p RekeyPolicy) {
+	r.onRekey = p.OnRekey
+}
+
+// Read reads and decrypts transport messages until it has data to return,
+// rekeying on any message with an empty payload. It returns io.EOF after the
+// message that ends the stream, which Tunnel sends, or if r ends between
+// messages. A read error from r part way through a message, such as a
+// timeout, can be retried. A message that fails to decrypt, or the end of r
+// within a message, breaks the Reader, and Read returns the error from then
+// on.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.input) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		msg, err := r.fr.ReadFrame()
+		if err == io.EOF && r.requireClose {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.err = err
+		}
+		if err != nil {
+			return 0, err
+		}
+		n := r.cs.n
+		plaintext, err := r.cs.Decrypt(r.buf[:0], nil, msg)
+		if err != nil {
+			if len(msg) == MACLen {
+				if _, cerr := r.cs.c.Decrypt(nil, n, closeAD, msg); cerr == nil {
+					err = io.EOF
+				}
+			}
+			r.err = err
+			return 0, err
+		}
+		r.buf, r.input = plaintext, plaintext
+		if len(plaintext) == 0 {
+			r.cs.Rekey()
+			if r.onRekey != nil {
+				r.onRekey(false)
+			}
+		}
+	}
+	n := copy(p, r.input)
+	r.input = r.input[n:]
+	return n, nil
+}
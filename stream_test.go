@@ -0,0 +1,167 @@
+package noise
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func streamPair(c *C) (*CipherState, *CipherState) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, _, csR, _ := hsR.WriteMessage(nil, nil)
+	_, _, csI, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	return csR, csI
+}
+
+func (NoiseSuite) TestStream(c *C) {
+	send, recv := streamPair(c)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, send)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	n, err := w.Write(big)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(big))
+	_, err = w.Write([]byte("tail"))
+	c.Assert(err, IsNil)
+	// The data is split into three messages of at most MaxFrameLen bytes,
+	// then the tail.
+	c.Assert(buf.Len(), Equals, len(big)+len("tail")+4*(2+MACLen))
+	c.Assert(buf.Bytes()[:2], DeepEquals, []byte{0xff, 0xff})
+
+	r := NewReader(&buf, recv)
+	got, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, append(big, "tail"...))
+	_, err = r.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (NoiseSuite) TestStreamErrors(c *C) {
+	send, recv := streamPair(c)
+	var buf bytes.Buffer
+	NewWriter(&buf, send).Write([]byte("hello"))
+	msg := buf.Bytes()
+	msg[len(msg)-1] ^= 1
+	r := NewReader(bytes.NewReader(msg), recv)
+	_, err := r.Read(make([]byte, 5))
+	c.Assert(err, NotNil)
+	_, err2 := r.Read(make([]byte, 5))
+	c.Assert(err2, Equals, err)
+
+	send, recv = streamPair(c)
+	buf.Reset()
+	NewWriter(&buf, send).Write([]byte("hello"))
+	r = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), recv)
+	_, err = r.Read(make([]byte, 5))
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+
+	w := NewWriter(errWriter{}, send)
+	_, err = w.Write([]byte("x"))
+	c.Assert(err, NotNil)
+	_, err2 = w.Write([]byte("x"))
+	c.Assert(err2, Equals, err)
+}
+
+func (NoiseSuite) TestStreamClose(c *C) {
+	send, recv := streamPair(c)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, send)
+	w.Write([]byte("hello"))
+	c.Assert(w.close(), IsNil)
+	_, err := w.Write([]byte("x"))
+	c.Assert(err, Equals, errWriterClosed)
+
+	// The message that ends the stream is an io.EOF, even if more follows.
+	r := NewReader(io.MultiReader(&buf, bytes.NewReader([]byte("junk"))), recv)
+	r.requireClose = true
+	got, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(got), Equals, "hello")
+
+	// Without it, a Reader that requires it reports truncation.
+	send, recv = streamPair(c)
+	buf.Reset()
+	NewWriter(&buf, send).Write([]byte("hello"))
+	r = NewReader(&buf, recv)
+	r.requireClose = true
+	got, err = io.ReadAll(r)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	c.Assert(string(got), Equals, "hello")
+
+	// A forged one is not accepted.
+	send, recv = streamPair(c)
+	buf.Reset()
+	w = NewWriter(&buf, send)
+	w.Write([]byte("hello"))
+	w.close()
+	msg := buf.Bytes()
+	msg[len(msg)-1] ^= 1
+	_, err = io.ReadAll(NewReader(&buf, recv))
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(Equals), io.ErrUnexpectedEOF)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func (NoiseSuite) TestStreamRekey(c *C) {
+	send, recv := streamPair(c)
+	var buf bytes.Buffer
+	var events []bool
+	onRekey := func(send bool) { events = append(events, send) }
+	w := NewWriter(&buf, send)
+	now := time.Unix(1500000000, 0)
+	w.now = func() time.Time { return now }
+	w.last = now
+	w.SetRekeyPolicy(RekeyPolicy{Messages: 2, Bytes: 10, Interval: time.Minute, OnRekey: onRekey})
+
+	w.Write([]byte("a"))
+	w.Write([]byte("b")) // 2 messages
+	w.Write([]byte("0123456789"))
+	w.Write([]byte("c")) // 10 bytes
+	now = now.Add(time.Minute)
+	w.Write([]byte("d")) // a minute
+	w.Write([]byte("e"))
+	c.Assert(events, DeepEquals, []bool{true, true, true})
+	key := send.k
+
+	r := NewReader(&buf, recv)
+	r.SetRekeyPolicy(RekeyPolicy{OnRekey: onRekey})
+	got, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(got), Equals, "ab0123456789cde")
+	c.Assert(events, DeepEquals, []bool{true, true, true, false, false, false})
+	c.Assert(recv.k, Equals, key)
+}
+
+func (NoiseSuite) TestConnRekey(c *C) {
+	client, server := connPair(HandshakeNN, nil)
+	defer client.Close()
+	defer server.Close()
+	var rekeys int32
+	client.SetRekeyPolicy(RekeyPolicy{Messages: 1})
+	server.SetRekeyPolicy(RekeyPolicy{OnRekey: func(send bool) {
+		if !send {
+			atomic.AddInt32(&rekeys, 1)
+		}
+	}})
+	go func() {
+		for _, m := range []string{"one", "two", "three"} {
+			client.Write([]byte(m))
+		}
+	}()
+	buf := make([]byte, len("onetwothree"))
+	_, err := io.ReadFull(server, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "onetwothree")
+	c.Assert(atomic.LoadInt32(&rekeys), Equals, int32(2))
+}
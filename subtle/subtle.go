@@ -0,0 +1,30 @@
+// Package subtle implements the constant-time comparison and zeroization
+// helpers used by package noise on key material, so that code handling the
+// same keys outside of the package can follow the same hygiene.
+package subtle
+
+import "crypto/subtle"
+
+// Equal reports whether a and b are equal. The time taken depends on the
+// lengths of the slices but not on their contents.
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// IsZero reports whether every byte of b is zero. The time taken depends on
+// the length of b but not on its contents.
+func IsZero(b []byte) bool {
+	var acc byte
+	for _, v := range b {
+		acc |= v
+	}
+	return subtle.ConstantTimeByteEq(acc, 0) == 1
+}
+
+// Zero overwrites b with zeros. It should be called on buffers that held
+// secret material once they are no longer needed.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
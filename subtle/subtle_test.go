@@ -0,0 +1,31 @@
+package subtle
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SubtleSuite struct{}
+
+var _ = Suite(&SubtleSuite{})
+
+func (SubtleSuite) TestEqual(c *C) {
+	c.Assert(Equal([]byte("abc"), []byte("abc")), Equals, true)
+	c.Assert(Equal([]byte("abc"), []byte("abd")), Equals, false)
+	c.Assert(Equal([]byte("abc"), []byte("ab")), Equals, false)
+	c.Assert(Equal(nil, []byte{}), Equals, true)
+}
+
+func (SubtleSuite) TestZero(c *C) {
+	b := []byte{1, 2, 3, 4}
+	c.Assert(IsZero(b), Equals, false)
+	Zero(b[2:])
+	c.Assert(b, DeepEquals, []byte{1, 2, 0, 0})
+	c.Assert(IsZero(b), Equals, false)
+	Zero(b)
+	c.Assert(IsZero(b), Equals, true)
+	c.Assert(IsZero(nil), Equals, true)
+}
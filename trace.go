@@ -0,0 +1,124 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// String returns the name of the token as used in the specification's
+// pattern notation.
+func (m MessagePattern) String() string {
+	for name, t := range tokenNames {
+		if t == m {
+			return name
+		}
+	}
+	return fmt.Sprintf("MessagePattern(%d)", int(m))
+}
+
+// A TraceStep records the processing of one handshake message, as reported
+// through Config.Trace.
+type TraceStep struct {
+	// FromInitiator is true for messages sent by the initiator.
+	FromInitiator bool
+
+	// Tokens are the tokens of the message, including psk tokens.
+	Tokens []MessagePattern
+
+	// Len is the length of the message in bytes.
+	Len int
+
+	// Encrypted is true if the payload was encrypted, that is if a key had
+	// been established by the end of the message.
+	Encrypted bool
+
+	// HandshakeHash is the handshake hash after the message.
+	HandshakeHash []byte
+}
+
+// String formats the step as a line of a symbolic trace, for example
+// "-> e, ee len=48 enc h=4ad1...".
+func (t TraceStep) String() string {
+	dir := "<-"
+	if t.FromInitiator {
+		dir = "->"
+	}
+	tokens := make([]string, len(t.Tokens))
+	for i, tok := range t.Tokens {
+		tokens[i] = tok.String()
+	}
+	enc := "clear"
+	if t.Encrypted {
+		enc = "enc"
+	}
+	return fmt.Sprintf("%s %s len=%d %s h=%s", dir, strings.Join(tokens, ", "), t.Len, enc, hex.EncodeToString(t.HandshakeHash))
+}
+
+func (s *HandshakeState) traceMessage(fromInitiator bool, n int) {
+	if s.trace == nil {
+		return
+	}
+	s.trace(TraceStep{
+		FromInitiator: fromInitiator,
+		Tokens:        append([]MessagePattern(nil), s.messagePatterns[s.msgIdx-1]...),
+		Len:           n,
+		Encrypted:     s.ss.hasK,
+		HandshakeHash: append([]byte(nil), s.ss.h...),
+	})
+}
+
+// A TranscriptMessage is a recorded handshake message and its payload.
+type TranscriptMessage struct {
+	Message []byte
+	Payload []byte
+}
+
+// ReplayTranscript replays a recorded handshake against the state machine as
+// the peer described by c, and returns its symbolic trace, one TraceStep.String
+// line per message. Messages this peer wrote are regenerated from their
+// payloads and must match the recording byte for byte, which requires c to
+// reproduce the recorded ephemeral, for example through a deterministic
+// Random. Messages from the peer are read and their payloads must match.
+//
+// Comparing the trace with one derived from the specification's model checks
+// the token order, message lengths and handshake hash at every step.
+func ReplayTranscript(c Config, transcript []TranscriptMessage) (string, error) {
+	var trace []string
+	userTrace := c.Trace
+	c.Trace = func(t TraceStep) {
+		trace = append(trace, t.String())
+		if userTrace != nil {
+			userTrace(t)
+		}
+	}
+	hs, err := NewHandshakeState(c)
+	if err != nil {
+		return "", err
+	}
+	for i, m := range transcript {
+		if hs.shouldWrite {
+			msg, _, _, err := hs.WriteMessage(nil, m.Payload)
+			if err != nil {
+				return "", err
+			}
+			if !bytes.Equal(msg, m.Message) {
+				return "", fmt.Errorf("noise: transcript message %d differs from the regenerated message", i)
+			}
+			continue
+		}
+		payload, _, _, err := hs.ReadMessage(nil, m.Message)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(payload, m.Payload) {
+			return "", fmt.Errorf("noise: transcript message %d has a different payload", i)
+		}
+	}
+	if hs.msgIdx < len(hs.messagePatterns) {
+		return "", errors.New("noise: transcript ends before the handshake is complete")
+	}
+	return strings.Join(trace, "\n"), nil
+}
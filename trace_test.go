@@ -0,0 +1,53 @@
+package noise
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestReplayTranscript(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256)
+	newConfig := func(initiator bool) Config {
+		rng := new(RandomInc)
+		if !initiator {
+			*rng = 1
+		}
+		return Config{CipherSuite: cs, Random: rng, Pattern: HandshakeNN, Initiator: initiator}
+	}
+
+	var steps []TraceStep
+	ci := newConfig(true)
+	ci.Trace = func(t TraceStep) { steps = append(steps, t) }
+	hsI, _ := NewHandshakeState(ci)
+	hsR, _ := NewHandshakeState(newConfig(false))
+	var transcript []TranscriptMessage
+	msg, _, _, _ := hsI.WriteMessage(nil, []byte("hello"))
+	transcript = append(transcript, TranscriptMessage{msg, []byte("hello")})
+	hsR.ReadMessage(nil, msg)
+	msg, _, _, _ = hsR.WriteMessage(nil, []byte("world"))
+	transcript = append(transcript, TranscriptMessage{msg, []byte("world")})
+	_, _, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+
+	c.Assert(steps, HasLen, 2)
+	c.Assert(steps[1].HandshakeHash, DeepEquals, hsI.ChannelBinding())
+	lines := []string{steps[0].String(), steps[1].String()}
+	c.Assert(strings.HasPrefix(lines[0], "-> e len=37 clear h="), Equals, true)
+	c.Assert(strings.HasPrefix(lines[1], "<- e, ee len=53 enc h="), Equals, true)
+	want := strings.Join(lines, "\n")
+
+	for _, initiator := range []bool{true, false} {
+		trace, err := ReplayTranscript(newConfig(initiator), transcript)
+		c.Assert(err, IsNil)
+		c.Assert(trace, Equals, want)
+	}
+
+	transcript[1].Payload = []byte("there")
+	_, err = ReplayTranscript(newConfig(true), transcript)
+	c.Assert(err, ErrorMatches, "noise: transcript message 1 has a different payload")
+	_, err = ReplayTranscript(newConfig(false), transcript)
+	c.Assert(err, ErrorMatches, "noise: transcript message 1 differs from the regenerated message")
+	_, err = ReplayTranscript(newConfig(true), transcript[:1])
+	c.Assert(err, ErrorMatches, "noise: transcript ends before the handshake is complete")
+}
@@ -0,0 +1,110 @@
+package noise
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Tunnel runs a handshake with config over secure, and then copies between
+// plain and secure until both directions are done: data read from plain is
+// encrypted and written to secure, and data read from secure is decrypted and
+// written to plain, as a pair of io.Copy calls would. It is the usual core of
+// a tunnel or proxy, with plain the local connection and secure the one to
+// the peer, which runs Tunnel or a Conn in the other role and ends its data
+// with Conn.CloseWrite. Handshake messages carry no payload, and the pattern
+// must be a two-way one.
+//
+// When reads from plain end with io.EOF, Tunnel sends an authenticated
+// message that ends the stream and then closes the write half of secure if it
+// has a CloseWrite method, as *net.TCPConn does; the other direction carries
+// on. The peer passes the end on to its plain side in the same way once it has
+// read that message. If secure ends without it, the data may have been
+// truncated by an attacker, so the direction fails with an error that wraps
+// io.ErrUnexpectedEOF instead. When either direction fails, or ctx is done,
+// Tunnel closes both sides if they implement io.Closer, so that the other
+// direction stops too, and returns the first error. It returns nil once both
+// directions have ended with io.EOF.
+func Tunnel(ctx context.Context, plain, secure io.ReadWriter, config Config) (err error) {
+	if config.HalfDuplex {
+		return errors.New("noise: Tunnel does not support HalfDuplex")
+	}
+	hs, err := NewHandshakeState(config)
+	if err != nil {
+		return err
+	}
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			for _, rw := range []io.ReadWriter{plain, secure} {
+				if c, ok := rw.(io.Closer); ok {
+					c.Close()
+				}
+			}
+		})
+	}
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer func() {
+		if !stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	var cs1, cs2 *CipherState
+	for cs1 == nil {
+		if hs.shouldWrite {
+			cs1, cs2, err = hs.WriteMessageTo(secure, nil)
+		} else {
+			_, cs1, cs2, err = hs.ReadMessageFrom(secure)
+		}
+		if err != nil {
+			closeBoth()
+			return err
+		}
+	}
+	if cs2 == nil {
+		closeBoth()
+		return errors.New("noise: Tunnel needs a two-way pattern")
+	}
+	send, recv := cs1, cs2
+	if !config.Initiator {
+		send, recv = cs2, cs1
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		w := NewWriter(secure, send)
+		errc <- tunnelCopy(w, plain, secure, w.close)
+	}()
+	go func() {
+		r := NewReader(secure, recv)
+		r.requireClose = true
+		errc <- tunnelCopy(plain, r, plain, nil)
+	}()
+	for i := 0; i < 2; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+			closeBoth()
+		}
+	}
+	return err
+}
+
+// tunnelCopy copies from src to dst, calls end if it is not nil, and then
+// closes the write half of dstSide if it can.
+func tunnelCopy(dst io.Writer, src io.Reader, dstSide io.ReadWriter, end func() error) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if end != nil {
+		if err := end(); err != nil {
+			return err
+		}
+	}
+	if cw, ok := dstSide.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	. "gopkg.in/check.v1"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(c *C) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	b, err := l.Accept()
+	c.Assert(err, IsNil)
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func (NoiseSuite) TestTunnel(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	staticI, _ := cs.GenerateKeypair(nil)
+	staticR, _ := cs.GenerateKeypair(nil)
+
+	// app <-> tunnel I <-> tunnel R <-> backend, with each hop over TCP.
+	app, plainI := tcpPair(c)
+	secureI, secureR := tcpPair(c)
+	plainR, backend := tcpPair(c)
+	done := make(chan error, 2)
+	go func() {
+		done <- Tunnel(context.Background(), plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeXX, Initiator: true, StaticKeypair: staticI})
+	}()
+	go func() {
+		done <- Tunnel(context.Background(), plainR, secureR, Config{CipherSuite: cs, Pattern: HandshakeXX, StaticKeypair: staticR})
+	}()
+
+	// The backend echoes everything it reads until the end of its input,
+	// which only reaches it through the half-closes along the way.
+	go func() {
+		io.Copy(backend, backend)
+		backend.CloseWrite()
+	}()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	go func() {
+		app.Write(data)
+		app.CloseWrite()
+	}()
+	res, err := io.ReadAll(app)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(res, data), Equals, true)
+	c.Assert(<-done, IsNil)
+	c.Assert(<-done, IsNil)
+}
+
+func (NoiseSuite) TestTunnelErrors(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+
+	// A failed handshake is returned, and closes both sides.
+	app, plainI := tcpPair(c)
+	secureI, secureR := tcpPair(c)
+	go func() {
+		secureR.Write([]byte{0, 3, 'b', 'a', 'd'})
+	}()
+	err := Tunnel(context.Background(), plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	c.Assert(err, NotNil)
+	_, err = app.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+	secureR.Close()
+
+	// So is a one-way pattern.
+	staticR, _ := cs.GenerateKeypair(nil)
+	_, plainI = tcpPair(c)
+	secureI, secureR = tcpPair(c)
+	defer secureR.Close()
+	err = Tunnel(context.Background(), plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeN, Initiator: true, PeerStatic: staticR.Public})
+	c.Assert(err, ErrorMatches, ".*two-way pattern")
+
+	// Cancelling the context stops a tunnel that is waiting.
+	app, plainI = tcpPair(c)
+	defer app.Close()
+	secureI, secureR = tcpPair(c)
+	defer secureR.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(ctx, plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	}()
+	plainR, backend := tcpPair(c)
+	defer backend.Close()
+	go Tunnel(context.Background(), plainR, secureR, Config{CipherSuite: cs, Pattern: HandshakeNN})
+	cancel()
+	c.Assert(<-done, Equals, context.Canceled)
+}
+
+func (NoiseSuite) TestTunnelTruncation(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	config := Config{CipherSuite: cs, Pattern: HandshakeNN}
+
+	// A peer that ends its data with Conn.CloseWrite ends the stream.
+	app, plainI := tcpPair(c)
+	secureI, secureR := tcpPair(c)
+	done := make(chan error, 1)
+	go func() {
+		done <- Tunnel(context.Background(), plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	}()
+	peer := Server(secureR, config)
+	_, err := peer.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	c.Assert(peer.CloseWrite(), IsNil)
+	res, err := io.ReadAll(app)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "data")
+	app.CloseWrite()
+	res, err = io.ReadAll(peer)
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 0)
+	c.Assert(<-done, IsNil)
+	app.Close()
+	peer.Close()
+
+	// One whose connection just ends has been cut off.
+	app, plainI = tcpPair(c)
+	defer app.Close()
+	secureI, secureR = tcpPair(c)
+	go func() {
+		done <- Tunnel(context.Background(), plainI, secureI, Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	}()
+	peer = Server(secureR, config)
+	defer peer.Close()
+	_, err = peer.Write([]byte("data"))
+	c.Assert(err, IsNil)
+	secureR.CloseWrite()
+	c.Assert(errors.Is(<-done, io.ErrUnexpectedEOF), Equals, true)
+}
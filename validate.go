@@ -0,0 +1,119 @@
+package noise
+
+import "errors"
+
+// Validate checks that p follows the validity rules of the specification:
+// public keys are sent at most once and before they are used, no DH is
+// performed twice, and a party does not encrypt with a key derived from its
+// static key until it has also mixed in a DH with its ephemeral key.
+// NewHandshakeState rejects patterns that fail these checks.
+func (p HandshakePattern) Validate() error {
+	return validatePattern(p, p.Messages)
+}
+
+// validatePattern checks the pre-messages of p together with messages, which
+// are p.Messages with any psk tokens inserted.
+func validatePattern(p HandshakePattern, messages [][]MessagePattern) error {
+	if len(messages) == 0 {
+		return errors.New("noise: handshake pattern has no messages")
+	}
+
+	// sent records, for the initiator (0) and responder (1), which of their
+	// public keys have been sent.
+	var sent [2]map[MessagePattern]bool
+	for i := range sent {
+		sent[i] = make(map[MessagePattern]bool)
+	}
+	send := func(party int, t MessagePattern) error {
+		if sent[party][t] {
+			return errors.New("noise: handshake pattern sends a public key twice")
+		}
+		sent[party][t] = true
+		return nil
+	}
+	for party, pre := range [][]MessagePattern{p.InitiatorPreMessages, p.ResponderPreMessages} {
+		for _, t := range pre {
+			if t != MessagePatternE && t != MessagePatternS {
+				return errors.New("noise: pre-messages may only contain e and s")
+			}
+			if err := send(party, t); err != nil {
+				return err
+			}
+		}
+	}
+
+	done := make(map[MessagePattern]bool)
+	psk := false
+	canEncrypt := func(party int) error {
+		local, remote := MessagePatternSE, MessagePatternES
+		if party == 1 {
+			local, remote = MessagePatternES, MessagePatternSE
+		}
+		if done[local] && !done[MessagePatternEE] || done[MessagePatternSS] && !done[remote] {
+			return errors.New("noise: handshake pattern encrypts with a static key before the ephemeral DH")
+		}
+		if psk && !sent[party][MessagePatternE] {
+			return errors.New("noise: handshake pattern encrypts after a psk without sending an ephemeral")
+		}
+		return nil
+	}
+
+	party := 0
+	if p.fallback() {
+		party = 1
+	}
+	for _, m := range messages {
+		for _, t := range m {
+			switch t {
+			case MessagePatternE, MessagePatternS, MessagePatternF, MessagePatternE1:
+				if t != MessagePatternE {
+					if err := canEncrypt(party); err != nil {
+						return err
+					}
+				}
+				if err := send(party, t); err != nil {
+					return err
+				}
+			case MessagePatternEE, MessagePatternES, MessagePatternSE, MessagePatternSS, MessagePatternFF:
+				keyI, keyR := dhKeys(t)
+				if t == MessagePatternFF {
+					keyI, keyR = MessagePatternF, MessagePatternF
+				}
+				if !sent[0][keyI] || !sent[1][keyR] {
+					return errors.New("noise: handshake pattern uses a key before it is sent")
+				}
+				if done[t] {
+					return errors.New("noise: handshake pattern performs a DH twice")
+				}
+				done[t] = true
+			case MessagePatternEKEM1:
+				if err := canEncrypt(party); err != nil {
+					return err
+				}
+				if !sent[party^1][MessagePatternE1] {
+					return errors.New("noise: handshake pattern uses a key before it is sent")
+				}
+				if done[t] {
+					return errors.New("noise: handshake pattern performs a DH twice")
+				}
+				done[t] = true
+			case MessagePatternSig:
+				if err := canEncrypt(party); err != nil {
+					return err
+				}
+				if !sent[party][MessagePatternS] || !sent[party^1][MessagePatternE] {
+					return errors.New("noise: handshake pattern signs before keys are sent")
+				}
+			case MessagePatternPSK:
+				psk = true
+			default:
+				return errors.New("noise: unknown handshake token")
+			}
+		}
+		if err := canEncrypt(party); err != nil {
+			return err
+		}
+		party ^= 1
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestValidatePatterns(c *C) {
+	for _, p := range []HandshakePattern{
+		HandshakeNN, HandshakeKN, HandshakeNK, HandshakeKK, HandshakeNX, HandshakeKX, HandshakeXN, HandshakeIN, HandshakeXK, HandshakeIK, HandshakeXX, HandshakeXXfallback, HandshakeIX, HandshakeN, HandshakeK, HandshakeX, HandshakeXXhfs, HandshakeNK1, HandshakeNX1, HandshakeX1N, HandshakeX1K, HandshakeXK1, HandshakeX1K1, HandshakeX1X, HandshakeXX1, HandshakeX1X1, HandshakeK1N, HandshakeK1K, HandshakeKK1, HandshakeK1K1, HandshakeK1X, HandshakeKX1, HandshakeK1X1, HandshakeI1N, HandshakeI1K, HandshakeIK1, HandshakeI1K1, HandshakeI1X, HandshakeIX1, HandshakeI1X1,
+	} {
+		c.Assert(p.Validate(), IsNil, Commentf(p.Name))
+	}
+
+	for _, test := range []struct {
+		text string
+		err  string
+	}{
+		{"-> e\n<- e, ee\n-> e", "noise: handshake pattern sends a public key twice"},
+		{"-> s\n...\n-> s", "noise: handshake pattern sends a public key twice"},
+		{"-> e, es\n<- s", "noise: handshake pattern uses a key before it is sent"},
+		{"-> e\n<- e, ee, ee", "noise: handshake pattern performs a DH twice"},
+		{"<- s\n...\n-> s, ss", "noise: handshake pattern encrypts with a static key before the ephemeral DH"},
+		{"-> e\n<- s, es", "noise: handshake pattern encrypts with a static key before the ephemeral DH"},
+		{"-> psk\n<- e", "noise: handshake pattern encrypts after a psk without sending an ephemeral"},
+		{"-> e\n<- f, ff", "noise: handshake pattern uses a key before it is sent"},
+	} {
+		p, err := ParseHandshakePattern("test", test.text)
+		c.Assert(err, IsNil)
+		c.Assert(p.Validate(), ErrorMatches, test.err, Commentf("%q", test.text))
+	}
+
+	_, err := NewHandshakeState(Config{
+		CipherSuite: NewCipherSuite(DH25519, CipherChaChaPoly, HashSHA256),
+		Pattern:     HandshakePattern{Name: "bad", Messages: [][]MessagePattern{{MessagePatternEE}}},
+	})
+	c.Assert(err, NotNil)
+}
@@ -101,6 +101,13 @@ func init() {
 func (NoiseSuite) TestVectors(c *C) {
 	f, err := os.Open("vectors.txt")
 	c.Assert(err, IsNil)
+	defer f.Close()
+	checkVectors(c, f)
+}
+
+// checkVectors runs the handshakes in a file of test vectors and checks that
+// every message matches.
+func checkVectors(c *C, f io.Reader) {
 	r := bufio.NewReader(f)
 
 	var hsI, hsR *HandshakeState
@@ -199,6 +206,13 @@ func (NoiseSuite) TestVectors(c *C) {
 			if (i-len(configI.Pattern.Messages))%2 != 0 {
 				enc, dec = csW1, csR1
 			}
+			if enc == nil {
+				// Older transcripts include responder messages for
+				// one-way patterns, which no longer have a CipherState
+				// for them.
+				payload = nil
+				continue
+			}
 			encrypted := enc.Encrypt(nil, nil, payload)
 			c.Assert(fmt.Sprintf("%x", encrypted), Equals, string(splitLine[1]))
 			decrypted, err := dec.Decrypt(nil, nil, encrypted)
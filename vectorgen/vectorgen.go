@@ -179,6 +179,10 @@ func writeHandshake(out io.Writer, cs CipherSuite, h HandshakePattern, pskPlacem
 	payload1 := []byte("submarineyellow")
 	fmt.Fprintf(out, "msg_%d_payload=%x\n", len(h.Messages), payload0)
 	fmt.Fprintf(out, "msg_%d_ciphertext=%x\n", len(h.Messages), cs0.Encrypt(nil, nil, payload0))
+	if cs1 == nil {
+		// One-way patterns have no responder to initiator CipherState.
+		return
+	}
 	fmt.Fprintf(out, "msg_%d_payload=%x\n", len(h.Messages)+1, payload1)
 	fmt.Fprintf(out, "msg_%d_ciphertext=%x\n", len(h.Messages)+1, cs1.Encrypt(nil, nil, payload1))
 }
@@ -0,0 +1,78 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherXChaChaPoly is the XChaCha20-Poly1305 AEAD cipher. With Encrypt and
+// Decrypt its 192-bit nonce holds the counter in little-endian order in the
+// final eight bytes, after sixteen zero bytes. Its nonce is long enough to be
+// chosen at random, for transports that reorder or drop messages, with
+// EncryptWithNonce and DecryptWithNonce.
+var CipherXChaChaPoly CipherFunc = cipherFn{cipherXChaChaPoly, "XChaChaPoly"}
+
+func cipherXChaChaPoly(k [32]byte) Cipher {
+	c, err := chacha20poly1305.NewX(k[:])
+	if err != nil {
+		panic(err)
+	}
+	return NewAEADCipher(c, binary.LittleEndian)
+}
+
+var errNoExplicitNonce = errors.New("noise: cipher does not support explicit nonces")
+
+// NonceSize returns the size in bytes of the nonces accepted by
+// EncryptWithNonce and DecryptWithNonce, or zero if the cipher does not
+// support explicit nonces. Only ciphers built with NewAEADCipher do.
+func (s *CipherState) NonceSize() int {
+	if c, ok := s.c.(aeadCipher); ok {
+		return c.NonceSize()
+	}
+	return 0
+}
+
+// EncryptWithNonce encrypts plaintext with an explicit nonce instead of the
+// CipherState's counter, which is left unchanged, and appends the ciphertext
+// and tag to out. The caller must never use a nonce twice with the same key;
+// only ciphers with a long nonce, such as CipherXChaChaPoly, are suitable for
+// random nonces.
+func (s *CipherState) EncryptWithNonce(out, nonce, ad, plaintext []byte) ([]byte, error) {
+	if s.invalid {
+		panic("noise: CipherSuite has been copied, state is invalid")
+	}
+	if s.recvOnly {
+		return nil, errors.New("noise: CipherState is receive-only")
+	}
+	c, ok := s.c.(aeadCipher)
+	if !ok {
+		return nil, errNoExplicitNonce
+	}
+	if len(nonce) != c.NonceSize() {
+		return nil, errors.New("noise: wrong nonce size")
+	}
+	return c.Seal(out, nonce, plaintext, ad), nil
+}
+
+// DecryptWithNonce authenticates and decrypts a ciphertext produced by
+// EncryptWithNonce with the same nonce, and appends the plaintext to out. The
+// CipherState's counter is left unchanged, and it is up to the caller to
+// reject replayed nonces.
+func (s *CipherState) DecryptWithNonce(out, nonce, ad, ciphertext []byte) ([]byte, error) {
+	if s.invalid {
+		panic("noise: CipherSuite has been copied, state is invalid")
+	}
+	if s.sendOnly {
+		return nil, errors.New("noise: CipherState is send-only")
+	}
+	c, ok := s.c.(aeadCipher)
+	if !ok {
+		return nil, errNoExplicitNonce
+	}
+	if len(nonce) != c.NonceSize() {
+		return nil, errors.New("noise: wrong nonce size")
+	}
+	return c.Open(out, nonce, ciphertext, ad)
+}
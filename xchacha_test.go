@@ -0,0 +1,46 @@
+package noise
+
+import (
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+)
+
+func (NoiseSuite) TestXChaChaPoly(c *C) {
+	cs := NewCipherSuite(DH25519, CipherXChaChaPoly, HashBLAKE2b)
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	c.Assert(hsI.ProtocolName(), Equals, "Noise_NN_25519_XChaChaPoly_BLAKE2b")
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	hsR.ReadMessage(nil, msg)
+	msg, csR, _, _ := hsR.WriteMessage(nil, []byte("hi"))
+	res, csI, _, err := hsI.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "hi")
+
+	// Random nonces allow messages to be decrypted out of order.
+	c.Assert(csI.NonceSize(), Equals, 24)
+	var cts, nonces [][]byte
+	for _, m := range []string{"one", "two"} {
+		nonce := make([]byte, csI.NonceSize())
+		rand.Read(nonce)
+		ct, err := csI.EncryptWithNonce(nil, nonce, nil, []byte(m))
+		c.Assert(err, IsNil)
+		cts, nonces = append(cts, ct), append(nonces, nonce)
+	}
+	res, err = csR.DecryptWithNonce(nil, nonces[1], nil, cts[1])
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "two")
+	res, err = csR.DecryptWithNonce(nil, nonces[0], nil, cts[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "one")
+	_, err = csR.DecryptWithNonce(nil, nonces[0], nil, cts[1])
+	c.Assert(err, NotNil)
+	_, err = csR.DecryptWithNonce(nil, nonces[0][:12], nil, cts[0])
+	c.Assert(err, ErrorMatches, ".*wrong nonce size")
+
+	// The counter is untouched by explicit nonces.
+	res, err = csR.Decrypt(nil, nil, csI.Encrypt(nil, nil, []byte("three")))
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "three")
+}
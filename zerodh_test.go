@@ -0,0 +1,38 @@
+package noise
+
+import . "gopkg.in/check.v1"
+
+func (NoiseSuite) TestRejectZeroDH(c *C) {
+	cs := NewCipherSuite(DH25519, CipherChaChaPoly, HashBLAKE2s)
+	for _, reject := range []bool{false, true} {
+		hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true})
+		hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, RejectZeroDH: reject})
+		msg, _, _, _ := hsI.WriteMessage(nil, nil)
+
+		// The zero point has low order, so ee is all zeros.
+		for i := range msg {
+			msg[i] = 0
+		}
+		_, _, _, err := hsR.ReadMessage(nil, msg)
+		c.Assert(err, IsNil)
+		_, _, _, err = hsR.WriteMessage(nil, nil)
+		if reject {
+			c.Assert(err, DeepEquals, &HandshakeError{Reason: FailureNonContributory})
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+
+	// The initiator rejects it on read.
+	hsI, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN, Initiator: true, RejectZeroDH: true})
+	hsR, _ := NewHandshakeState(Config{CipherSuite: cs, Pattern: HandshakeNN})
+	msg, _, _, _ := hsI.WriteMessage(nil, nil)
+	_, _, _, err := hsR.ReadMessage(nil, msg)
+	c.Assert(err, IsNil)
+	msg, _, _, _ = hsR.WriteMessage(nil, nil)
+	for i := 0; i < 32; i++ {
+		msg[i] = 0
+	}
+	_, _, _, err = hsI.ReadMessage(nil, msg)
+	c.Assert(err, DeepEquals, &HandshakeError{Reason: FailureNonContributory})
+}